@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/storage"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/pkg/client/bundle"
+	"github.com/unbasical/doras/pkg/client/edgeapi"
+	"github.com/unbasical/doras/pkg/client/updater"
+	"github.com/unbasical/doras/pkg/client/updater/fetcher"
+	"github.com/unbasical/doras/pkg/delta"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// createBundle requests the delta from the server (or creates it locally) and writes it to an offline update bundle.
+func (args *cliArgs) createBundle(ctx context.Context) error {
+	opts := args.Bundle.Create
+	creds, err := args.getCredentialFunc()
+	if err != nil {
+		return err
+	}
+	source := fetcher.NewRepoStorageSource(args.InsecureAllowHTTP, creds)
+	var deltaSrc oras.ReadOnlyGraphTarget
+	var deltaDescriptor v1.Descriptor
+	if opts.Local {
+		workDir, err := os.MkdirTemp("", "doras-delta-*")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = os.RemoveAll(workDir)
+		}()
+		deltaSrc, deltaDescriptor, err = args.createDeltaLocally(ctx, creds, workDir)
+		if err != nil {
+			return err
+		}
+	} else {
+		dorasClient, err := edgeapi.NewEdgeClient(args.Remote, args.InsecureAllowHTTP, creds)
+		if err != nil {
+			return err
+		}
+		res, err := dorasClient.ReadDelta(opts.From, opts.To, opts.AcceptedAlgorithm)
+		if err != nil {
+			return err
+		}
+		deltaSrc, deltaDescriptor, err = resolveGraphTarget(ctx, source, res.DeltaImage)
+		if err != nil {
+			return err
+		}
+	}
+	targetRepo, _, _, err := ociutils.ParseOciImageString(opts.To)
+	if err != nil {
+		return err
+	}
+	target, err := source.GetTarget(targetRepo)
+	if err != nil {
+		return err
+	}
+	targetSrc, ok := target.(oras.ReadOnlyGraphTarget)
+	if !ok {
+		return errors.New("repository does not support listing referrers")
+	}
+	err = bundle.Create(ctx, deltaSrc, deltaDescriptor, targetSrc, opts.Output)
+	if err != nil {
+		return err
+	}
+	log.Infof("created bundle at %s", opts.Output)
+	return nil
+}
+
+// createDeltaLocally creates the delta the same way the Doras server would, but stores it in an OCI layout in the workDir.
+// The delta is not signed.
+func (args *cliArgs) createDeltaLocally(ctx context.Context, creds auth.CredentialFunc, workDir string) (oras.ReadOnlyGraphTarget, v1.Descriptor, error) {
+	opts := args.Bundle.Create
+	creator := delta.NewCreator(
+		delta.WithCredentials(creds),
+		delta.WithInsecureAllowHTTP(args.InsecureAllowHTTP),
+		delta.WithAcceptedAlgorithms(opts.AcceptedAlgorithm),
+		delta.WithOCILayout(workDir),
+	)
+	res, err := creator.Create(ctx, opts.From, opts.To)
+	if err != nil {
+		return nil, v1.Descriptor{}, err
+	}
+	repoName, _, _, err := ociutils.ParseOciImageString(res.Image)
+	if err != nil {
+		return nil, v1.Descriptor{}, err
+	}
+	graphSrc, err := storage.NewLayoutProvider(workDir).ExistingRepository(repoName)
+	if err != nil {
+		return nil, v1.Descriptor{}, err
+	}
+	return graphSrc, res.Descriptor, nil
+}
+
+// applyBundle applies an offline update bundle to the output directory.
+func (args *cliArgs) applyBundle(ctx context.Context) error {
+	opts := []func(*updater.Client){
+		updater.WithInternalDirectory(args.Bundle.Apply.InternalDir),
+		updater.WithOutputDirectory(args.Bundle.Apply.Output),
+		updater.WithDockerConfigPath(args.DockerConfigFilePath),
+		updater.WithContext(ctx),
+	}
+	verificationOpts, err := args.Bundle.Apply.Verify.clientOptions()
+	if err != nil {
+		return err
+	}
+	opts = append(opts, verificationOpts...)
+	client, err := updater.NewClient(opts...)
+	if err != nil {
+		return err
+	}
+	err = client.ApplyBundle(args.Bundle.Apply.Bundle)
+	if err != nil {
+		return err
+	}
+	log.Info("update successful")
+	return nil
+}
+
+// resolveGraphTarget resolves the image (with digest) in its repository.
+func resolveGraphTarget(ctx context.Context, source fetcher.StorageSource, image string) (oras.ReadOnlyGraphTarget, v1.Descriptor, error) {
+	repoName, dgst, isDigest, err := ociutils.ParseOciImageString(image)
+	if err != nil {
+		return nil, v1.Descriptor{}, err
+	}
+	if !isDigest {
+		return nil, v1.Descriptor{}, fmt.Errorf("expected image with digest, got %q", image)
+	}
+	target, err := source.GetTarget(repoName)
+	if err != nil {
+		return nil, v1.Descriptor{}, err
+	}
+	graphSrc, ok := target.(oras.ReadOnlyGraphTarget)
+	if !ok {
+		return nil, v1.Descriptor{}, errors.New("repository does not support listing referrers")
+	}
+	d, err := graphSrc.Resolve(ctx, strings.TrimPrefix(dgst, "@"))
+	if err != nil {
+		return nil, v1.Descriptor{}, err
+	}
+	return graphSrc, d, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/algorithmchoice"
+	"github.com/unbasical/doras/internal/pkg/compression/gzip"
+	"github.com/unbasical/doras/internal/pkg/patchfile"
+	"github.com/unbasical/doras/internal/pkg/utils/compressionutils"
+	"github.com/unbasical/doras/internal/pkg/utils/fileutils"
+	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
+	"github.com/unbasical/doras/internal/pkg/utils/readerutils"
+	"github.com/unbasical/doras/internal/pkg/utils/tarutils"
+	"github.com/unbasical/doras/pkg/algorithm/delta"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
+)
+
+// errInputKindMismatch is returned if a file is diffed against (or patched with) a directory.
+var errInputKindMismatch = errors.New("old and new have to be both files or both directories")
+
+// diff creates a self-describing patch file from two local files or directories.
+func (args *cliArgs) diff(ctx context.Context) error {
+	opts := args.Diff
+	choice, err := algorithmchoice.NewDifferChoice(opts.Algo, opts.Compress)
+	if err != nil {
+		return err
+	}
+	oldInput, oldIsDir, err := openInput(ctx, opts.Old)
+	if err != nil {
+		return err
+	}
+	defer funcutils.PanicOrLogOnErr(oldInput.Close, false, "failed to close input")
+	newInput, newIsDir, err := openInput(ctx, opts.New)
+	if err != nil {
+		return err
+	}
+	defer funcutils.PanicOrLogOnErr(newInput.Close, false, "failed to close input")
+	if oldIsDir != newIsDir {
+		return errInputKindMismatch
+	}
+
+	// The digest has to match the output of the patcher, patches of archive algorithms (tardiff) produce uncompressed tar archives.
+	var newReader io.Reader
+	var getDigest func() (digest.Digest, error)
+	if algorithmchoice.IsArchiveAlgorithm(choice.Differ) {
+		rc, f := readerutils.NewDecompressedDigestReader(newInput)
+		defer funcutils.PanicOrLogOnErr(rc.Close, false, "failed to close digest reader")
+		newReader, getDigest = rc, f
+	} else {
+		digester := digest.Canonical.Digester()
+		newReader = io.TeeReader(newInput, digester.Hash())
+		getDigest = func() (digest.Digest, error) { return digester.Digest(), nil }
+	}
+	patch, err := choice.Diff(oldInput, newReader)
+	if err != nil {
+		return err
+	}
+	defer funcutils.PanicOrLogOnErr(patch.Close, false, "failed to close patch")
+	compressedPatch, err := choice.Compress(patch)
+	if err != nil {
+		return err
+	}
+
+	// The header precedes the patch, so the patch is buffered until the digest of the output is known.
+	tmp, err := os.CreateTemp(filepath.Dir(opts.Out), ".doras-diff-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := io.Copy(tmp, compressedPatch); err != nil {
+		return err
+	}
+	outputDigest, err := getDigest()
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := patchfile.Header{
+		MediaType:    choice.GetMediaType(),
+		OutputDigest: outputDigest,
+		Directory:    newIsDir,
+	}
+	out, err := os.Create(opts.Out)
+	if err != nil {
+		return err
+	}
+	err = patchfile.Write(out, header, tmp)
+	if err := errors.Join(err, out.Close()); err != nil {
+		return err
+	}
+	log.Infof("created %s patch at %s", header.MediaType, opts.Out)
+	return nil
+}
+
+// patch applies a patch file that was created with diff, the output is verified before it is written.
+func (args *cliArgs) patch(ctx context.Context) error {
+	opts := args.Patch
+	fp, err := os.Open(opts.Patch)
+	if err != nil {
+		return err
+	}
+	defer funcutils.PanicOrLogOnErr(fp.Close, false, "failed to close patch file")
+	header, patch, err := patchfile.Read(fp)
+	if err != nil {
+		return err
+	}
+	choice, err := algorithmchoice.NewPatcherChoice(header.MediaType, registry.PatcherOptions{
+		TempDir:              os.TempDir(),
+		OutputDirPermissions: 0755,
+	})
+	if err != nil {
+		return err
+	}
+	oldInput, oldIsDir, err := openInput(ctx, opts.Old)
+	if err != nil {
+		return err
+	}
+	defer funcutils.PanicOrLogOnErr(oldInput.Close, false, "failed to close input")
+	if oldIsDir != header.Directory {
+		return errInputKindMismatch
+	}
+	var old io.Reader = oldInput
+	if algorithmchoice.IsArchiveAlgorithm(choice.Patcher) {
+		// Archive patchers (tardiff) expect a gzip compressed tar archive.
+		old, err = ensureGzip(oldInput)
+		if err != nil {
+			return err
+		}
+	}
+	decompressedPatch, err := choice.Decompress(patch)
+	if err != nil {
+		return err
+	}
+	output, err := choice.Patch(old, decompressedPatch)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(opts.New), ".doras-patch-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	verifier := header.OutputDigest.Verifier()
+	_, err = io.Copy(io.MultiWriter(tmp, verifier), output)
+	if err := errors.Join(err, tmp.Close()); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("%w: expected %s", delta.ErrDigestMismatch, header.OutputDigest)
+	}
+	if !header.Directory {
+		if stat, err := os.Stat(opts.Old); err == nil {
+			if err := os.Chmod(tmp.Name(), stat.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+		err = fileutils.ReplaceFile(tmp.Name(), opts.New)
+	} else {
+		err = extractDirectory(tmp.Name(), opts.New)
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("patched %s to %s", opts.Old, opts.New)
+	return nil
+}
+
+// extractDirectory extracts the tar archive and replaces the directory at dir with its contents.
+func extractDirectory(archive, dir string) error {
+	extractDir, err := os.MkdirTemp(filepath.Dir(dir), ".doras-patch-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// this only removes the directory if the replacement failed
+		_ = os.RemoveAll(extractDir)
+	}()
+	err = tarutils.ExtractCompressedTar(extractDir, "", archive, nil, compressionutils.NewNopDecompressor())
+	if err != nil {
+		return err
+	}
+	return fileutils.ReplaceDirectory(extractDir, dir)
+}
+
+// openInput opens the file or directory at path, directories are turned into tar archives.
+// Timestamps are removed from the archive so it only depends on the contents of the directory.
+func openInput(ctx context.Context, path string) (rc io.ReadCloser, isDir bool, err error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if !stat.IsDir() {
+		fp, err := os.Open(path)
+		return fp, false, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		// closing with a nil error results in io.EOF for the reader
+		_ = pw.CloseWithError(tarutils.TarDirectory(ctx, path, "", pw, true))
+	}()
+	return pr, true, nil
+}
+
+// ensureGzip compresses r with gzip unless it already is gzip compressed.
+func ensureGzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return br, nil
+	}
+	return gzip.NewCompressor().Compress(io.NopCloser(br))
+}
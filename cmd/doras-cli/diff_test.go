@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/unbasical/doras/internal/pkg/compression/gzip"
+	"github.com/unbasical/doras/internal/pkg/patchfile"
+	"github.com/unbasical/doras/internal/pkg/utils/fileutils"
+	"github.com/unbasical/doras/internal/pkg/utils/tarutils"
+	"github.com/unbasical/doras/pkg/algorithm/delta"
+)
+
+func writeDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func writeTarGz(t *testing.T, dir string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := tarutils.TarDirectory(context.Background(), dir, "", &buf, true); err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := gzip.NewCompressor().Compress(io.NopCloser(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "archive.tar.gz")
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func Test_diffAndPatch(t *testing.T) {
+	oldFiles := map[string]string{"a": "hello world", "b/c": "foo bar baz"}
+	newFiles := map[string]string{"a": "hello world!", "b/c": "foo bar baz", "d": "new file"}
+	oldFile := filepath.Join(writeDir(t, map[string]string{"f": "some old content"}), "f")
+	newFile := filepath.Join(writeDir(t, map[string]string{"f": "some new content"}), "f")
+	oldTarGz := writeTarGz(t, writeDir(t, oldFiles))
+	newTarGz := writeTarGz(t, writeDir(t, newFiles))
+	tests := []struct {
+		name      string
+		algo      string
+		compress  string
+		old       string
+		new       string
+		mediaType string
+		isDir     bool
+	}{
+		{name: "file (bsdiff+zstd)", algo: "bsdiff", compress: "zstd", old: oldFile, new: newFile, mediaType: "application/bsdiff+zstd"},
+		{name: "directory (bsdiff)", algo: "bsdiff", compress: "none", old: writeDir(t, oldFiles), new: writeDir(t, newFiles), mediaType: "application/bsdiff", isDir: true},
+		{name: "directory (tardiff+gzip)", algo: "tardiff", compress: "gzip", old: writeDir(t, oldFiles), new: writeDir(t, newFiles), mediaType: "application/tardiff+gzip", isDir: true},
+		{name: "tar archive (tardiff)", algo: "tardiff", compress: "none", old: oldTarGz, new: newTarGz, mediaType: "application/tardiff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			args := &cliArgs{}
+			args.Diff.Algo = tt.algo
+			args.Diff.Compress = tt.compress
+			args.Diff.Old = tt.old
+			args.Diff.New = tt.new
+			args.Diff.Out = filepath.Join(t.TempDir(), "out.patch")
+			if err := args.diff(ctx); err != nil {
+				t.Fatal(err)
+			}
+			fp, err := os.Open(args.Diff.Out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, _, err := patchfile.Read(fp)
+			_ = fp.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.MediaType != tt.mediaType || header.Directory != tt.isDir {
+				t.Errorf("unexpected header %+v", header)
+			}
+
+			args.Patch.Old = tt.old
+			args.Patch.Patch = args.Diff.Out
+			args.Patch.New = filepath.Join(t.TempDir(), "new")
+			if err := args.patch(ctx); err != nil {
+				t.Fatal(err)
+			}
+			var equal bool
+			switch {
+			case tt.isDir:
+				equal, err = fileutils.CompareDirectories(tt.new, args.Patch.New)
+			case tt.algo == "tardiff":
+				// tardiff produces the uncompressed tar archive
+				var rc io.Reader
+				rc, err = os.Open(tt.new)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rc, err = gzip.NewDecompressor().Decompress(rc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				equal = bytes.Equal(readAll(t, rc), fileutils.ReadOrPanic(args.Patch.New))
+			default:
+				equal = bytes.Equal(fileutils.ReadOrPanic(tt.new), fileutils.ReadOrPanic(args.Patch.New))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equal {
+				t.Error("patched output does not match the new input")
+			}
+		})
+	}
+}
+
+func Test_patch_Errors(t *testing.T) {
+	ctx := context.Background()
+	oldFile := filepath.Join(writeDir(t, map[string]string{"f": "some old content"}), "f")
+	newFile := filepath.Join(writeDir(t, map[string]string{"f": "some new content"}), "f")
+	args := &cliArgs{}
+	args.Diff.Algo = "bsdiff"
+	args.Diff.Compress = "none"
+	args.Diff.Old = oldFile
+	args.Diff.New = newFile
+	args.Diff.Out = filepath.Join(t.TempDir(), "out.patch")
+	if err := args.diff(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		old     string
+		patch   string
+		wantErr error
+	}{
+		{name: "wrong input", old: newFile, patch: args.Diff.Out, wantErr: delta.ErrDigestMismatch},
+		{name: "directory input", old: filepath.Dir(oldFile), patch: args.Diff.Out, wantErr: errInputKindMismatch},
+		{name: "not a patch file", old: oldFile, patch: newFile, wantErr: patchfile.ErrInvalidPatchFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args.Patch.Old = tt.old
+			args.Patch.Patch = tt.patch
+			args.Patch.New = filepath.Join(t.TempDir(), "new")
+			err := args.patch(ctx)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+			if _, err := os.Stat(args.Patch.New); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected no output to be written, got %v", err)
+			}
+		})
+	}
+}
+
+func readAll(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"strings"
+
 	"github.com/alecthomas/kong"
 	log "github.com/sirupsen/logrus"
 	"github.com/unbasical/doras/internal/pkg/utils/logutils"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
 	"oras.land/oras-go/v2/registry/remote/auth"
 	"oras.land/oras-go/v2/registry/remote/credentials"
 )
@@ -16,17 +19,25 @@ type cliArgs struct {
 	InsecureAllowHTTP    bool   `help:"Allow INSECURE HTTP connections." default:"false" env:"DORAS_INSECURE_ALLOW_HTTP"`
 	Remote               string `help:"The URL of the Doras server." default:"http://localhost:8080" env:"DORAS_SERVER_URL"`
 	Push                 struct {
-		Compress     string `help:"Compress artifact before uploading." default:"gzip" enum:"zstd,gzip,none"`
+		Compress     string `help:"Compress artifact before uploading (${compressors})." default:"gzip" enum:"${compressors}"`
 		ArchiveFiles bool   `help:"Archive artifact before uploading." default:"false"`
 		Image        string `arg:"" name:"image" help:"Target image/repository where the artifact will be published."`
 		Path         string `arg:"" name:"path" help:"Path of the artifact that should be uploaded (single file or directory)"`
 	} `cmd:"" help:"Upload artifact to a registry."`
 	Pull struct {
-		Image             string   `arg:"" name:"image" help:"Target image/repository which is pulled."`
-		Output            string   `help:"Output directory." type:"path" default:"."`
-		Async             bool     `help:"Do not block until the delta is created." default:"false"`
-		InternalDir       string   `help:"Doras internal directory." type:"path" default:"~/.local/share/doras"`
-		AcceptedAlgorithm []string `help:"Select algorithms which are accepted for deltas."`
+		Image              string         `arg:"" name:"image" help:"Target image/repository which is pulled."`
+		Output             string         `help:"Output directory." type:"path" default:"."`
+		Async              bool           `help:"Do not block until the delta is created." default:"false"`
+		InternalDir        string         `help:"Doras internal directory." type:"path" default:"~/.local/share/doras"`
+		AcceptedAlgorithm  []string       `help:"Select algorithms which are accepted for deltas."`
+		Verify             signatureFlags `embed:""`
+		ReferrersFallback  bool           `help:"Look up deltas among the referrers of the target image if the Doras server is unreachable." default:"false"`
+		ServerlessFallback bool           `help:"Look up already created deltas in the registry before requesting them from the Doras server." default:"false"`
+		ClientCert         string         `help:"PEM encoded client certificate which is used to authenticate to the Doras server (mTLS)." type:"path" env:"DORAS_CLIENT_CERT"`
+		ClientKey          string         `help:"PEM encoded private key of the client certificate." type:"path" env:"DORAS_CLIENT_KEY"`
+		DeviceID           string         `help:"ID of the device, requests tokens from the token service of the Doras server with the device key." env:"DORAS_DEVICE_ID"`
+		DeviceKey          string         `help:"Key of the device." env:"DORAS_DEVICE_KEY"`
+		DeviceJWTPath      string         `help:"Path to a JWT which is used to request tokens from the token service of the Doras server, it is read for each token request." type:"path" env:"DORAS_DEVICE_JWT_PATH"`
 	} `cmd:"" name:"pull" help:"Pull an artifact from a registry, uses readDelta updates if possible."`
 	ReadDelta struct {
 		From              string   `help:"From which image the delta will be built."`
@@ -34,13 +45,50 @@ type cliArgs struct {
 		Async             bool     `help:"Do not block until the delta is created." default:"false"`
 		AcceptedAlgorithm []string `help:"Select algorithms which are accepted for deltas."`
 	} `cmd:"" help:"Request a delta image from the Doras server."`
+	Bundle struct {
+		Create struct {
+			From              string   `help:"Image (with digest) from which the delta is created." required:""`
+			To                string   `help:"Image to which the delta leads." required:""`
+			Output            string   `help:"Path of the created bundle." type:"path" default:"bundle.tar"`
+			Local             bool     `help:"Create the delta locally instead of requesting it from the Doras server (the delta is not signed)." default:"false"`
+			AcceptedAlgorithm []string `help:"Select algorithms which are accepted for deltas."`
+		} `cmd:"" help:"Create an offline update bundle that contains the delta between two images."`
+		Apply struct {
+			Bundle      string         `arg:"" name:"bundle" help:"Path of the bundle." type:"existingfile"`
+			Output      string         `help:"Output directory." type:"path" default:"."`
+			InternalDir string         `help:"Doras internal directory." type:"path" default:"~/.local/share/doras"`
+			Verify      signatureFlags `embed:""`
+		} `cmd:"" help:"Apply an offline update bundle to the output directory."`
+	} `cmd:"" help:"Create and apply offline update bundles, e.g. for devices without network access."`
+	Diff struct {
+		Algo     string `help:"Diffing algorithm (${differs}), tardiff requires tar archives or directories." default:"bsdiff" enum:"${differs}"`
+		Compress string `help:"Compress the patch (${compressors})." default:"none" enum:"${compressors}"`
+		Old      string `arg:"" name:"old" help:"Old file, tar archive or directory." type:"path"`
+		New      string `arg:"" name:"new" help:"New file, tar archive or directory." type:"path"`
+		Out      string `arg:"" name:"out" help:"Path of the created patch file." type:"path"`
+	} `cmd:"" help:"Create a patch file from two local files, tar archives or directories."`
+	Patch struct {
+		Old   string `arg:"" name:"old" help:"Old file, tar archive or directory." type:"path"`
+		Patch string `arg:"" name:"patch" help:"Patch file created with the diff command." type:"existingfile"`
+		New   string `arg:"" name:"new" help:"Path of the patched file or directory." type:"path"`
+	} `cmd:"" help:"Apply a patch file, the result is verified before it is written."`
+}
+
+// signatureFlags configure the verification of signatures.
+type signatureFlags struct {
+	VerifyKey      []string `help:"Only accept artifacts signed by one of these cosign public keys (PEM)." type:"path"`
+	VerifyCert     []string `help:"Only accept artifacts with a notation signature that chains to one of these certificates (PEM)." type:"path"`
+	DeltaVerifyKey []string `help:"Public keys (PEM) of the Doras server which are used to verify delta manifests." type:"path"`
 }
 
 func main() {
 	ctx := context.Background()
 	// parse args
 	args := cliArgs{}
-	cliCtx := kong.Parse(&args)
+	cliCtx := kong.Parse(&args, kong.Vars{
+		"differs":     strings.Join(registry.Differs(), ","),
+		"compressors": strings.Join(append(registry.Compressors(), "none"), ","),
+	})
 
 	// Setup logging.
 	logutils.SetLogLevel(args.LogLevel)
@@ -54,6 +102,14 @@ func main() {
 		err = args.pull(ctx)
 	case "read-delta":
 		err = args.readDelta(ctx)
+	case "bundle create":
+		err = args.createBundle(ctx)
+	case "bundle apply <bundle>":
+		err = args.applyBundle(ctx)
+	case "diff <old> <new> <out>":
+		err = args.diff(ctx)
+	case "patch <old> <patch> <new>":
+		err = args.patch(ctx)
 	default:
 		log.Fatalf("Unknown command: %v", cliCtx.Command())
 	}
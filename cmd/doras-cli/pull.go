@@ -2,21 +2,44 @@ package main
 
 import (
 	"context"
+	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/unbasical/doras/pkg/client/updater"
+	"github.com/unbasical/doras/pkg/signature"
 )
 
 // pull image from the registry and use delta updates if possible.
 func (args *cliArgs) pull(ctx context.Context) error {
-	client, err := updater.NewClient(
+	opts := []func(*updater.Client){
 		updater.WithRemoteURL(args.Remote),
 		updater.WithInternalDirectory(args.Pull.InternalDir),
 		updater.WithOutputDirectory(args.Pull.Output),
 		updater.WithDockerConfigPath(args.DockerConfigFilePath),
 		updater.WithAcceptedAlgorithms(args.Pull.AcceptedAlgorithm),
 		updater.WithContext(ctx),
-	)
+		updater.WithReferrersFallback(args.Pull.ReferrersFallback),
+		updater.WithServerlessFallback(args.Pull.ServerlessFallback),
+	}
+	verificationOpts, err := args.Pull.Verify.clientOptions()
+	if err != nil {
+		return err
+	}
+	opts = append(opts, verificationOpts...)
+	if args.Pull.ClientCert != "" {
+		opts = append(opts, updater.WithClientCertificate(args.Pull.ClientCert, args.Pull.ClientKey))
+	}
+	switch {
+	case args.Pull.DeviceJWTPath != "":
+		opts = append(opts, updater.WithDeviceJWT(func() (string, error) {
+			jwt, err := os.ReadFile(args.Pull.DeviceJWTPath)
+			return strings.TrimSpace(string(jwt)), err
+		}))
+	case args.Pull.DeviceID != "":
+		opts = append(opts, updater.WithDeviceKey(args.Pull.DeviceID, args.Pull.DeviceKey))
+	}
+	client, err := updater.NewClient(opts...)
 	if err != nil {
 		return err
 	}
@@ -44,3 +67,53 @@ func (args *cliArgs) pull(ctx context.Context) error {
 	log.Info("update successful")
 	return nil
 }
+
+// clientOptions returns the options that enable signature verification if keys or certificates are configured.
+func (f *signatureFlags) clientOptions() ([]func(*updater.Client), error) {
+	if len(f.VerifyKey) == 0 && len(f.VerifyCert) == 0 {
+		return nil, nil
+	}
+	artifactVerifiers, deltaVerifiers, err := f.getSignatureVerifiers()
+	if err != nil {
+		return nil, err
+	}
+	return []func(*updater.Client){updater.WithSignatureVerification(artifactVerifiers, deltaVerifiers)}, nil
+}
+
+// getSignatureVerifiers loads the configured keys and certificates.
+func (f *signatureFlags) getSignatureVerifiers() (artifactVerifiers, deltaVerifiers []signature.Verifier, err error) {
+	for _, p := range f.VerifyKey {
+		keys, err := signature.LoadPublicKeys(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, err := signature.NewCosignVerifier(keys...)
+		if err != nil {
+			return nil, nil, err
+		}
+		artifactVerifiers = append(artifactVerifiers, v)
+	}
+	for _, p := range f.VerifyCert {
+		certs, err := signature.LoadCertificates(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, err := signature.NewNotationVerifier(certs...)
+		if err != nil {
+			return nil, nil, err
+		}
+		artifactVerifiers = append(artifactVerifiers, v)
+	}
+	for _, p := range f.DeltaVerifyKey {
+		keys, err := signature.LoadPublicKeys(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, err := signature.NewCosignVerifier(keys...)
+		if err != nil {
+			return nil, nil, err
+		}
+		deltaVerifiers = append(deltaVerifiers, v)
+	}
+	return artifactVerifiers, deltaVerifiers, nil
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"archive/tar"
 	"context"
 	"crypto/sha256"
 	"errors"
@@ -9,13 +8,12 @@ import (
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	log "github.com/sirupsen/logrus"
-	"github.com/unbasical/doras/internal/pkg/compression/gzip"
-	"github.com/unbasical/doras/internal/pkg/compression/zstd"
-	"github.com/unbasical/doras/internal/pkg/utils/compressionutils"
 	"github.com/unbasical/doras/internal/pkg/utils/fileutils"
 	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
 	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/internal/pkg/utils/tarutils"
 	"github.com/unbasical/doras/pkg/algorithm/compression"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
 	"github.com/unbasical/doras/pkg/constants"
 	"io"
 	"oras.land/oras-go/v2"
@@ -23,8 +21,6 @@ import (
 	"oras.land/oras-go/v2/registry/remote/auth"
 	"oras.land/oras-go/v2/registry/remote/retry"
 	"os"
-	"path/filepath"
-	"time"
 )
 
 // push image to the registry
@@ -159,7 +155,7 @@ func pushDirectory(ctx context.Context, args *cliArgs, target oras.Target, tag s
 	// turn writer into reader
 	pr, pw := io.Pipe()
 	go func() {
-		err := tarDirectory(ctx, dirName, dirName, pw, true)
+		err := tarutils.TarDirectory(ctx, dirName, dirName, pw, true)
 		if err != nil {
 			log.WithError(err).Error("failed to add FS to tar")
 			_ = pw.CloseWithError(err)
@@ -238,16 +234,20 @@ func pushAndTag(ctx context.Context, target oras.Target, d v1.Descriptor, conten
 
 // getCompressor loads the correct compression.Compressor from the set algorithm.
 func (args *cliArgs) getCompressor() (compression.Compressor, error) {
-	switch args.Push.Compress {
-	case "zstd":
-		return zstd.NewCompressor(), nil
-	case "gzip":
-		return gzip.NewCompressor(), nil
-	case "none":
-		return compressionutils.NewNopCompressor(), nil
-	default:
-		return nil, fmt.Errorf("unknown compression algorithm: %q", args.Push.Compress)
+	return getCompressor(args.Push.Compress)
+}
+
+// getCompressor loads the compression.Compressor with the given name from the registry, `none` disables compression.
+func getCompressor(name string) (compression.Compressor, error) {
+	// The flag has to disable compression explicitly.
+	if name == "" {
+		return nil, errors.New("missing compression algorithm")
+	}
+	c, err := registry.Compression(name)
+	if err != nil {
+		return nil, err
 	}
+	return c.NewCompressor(), nil
 }
 
 // setupRepo with path, HTTP client, credentials etc.
@@ -273,85 +273,3 @@ func (args *cliArgs) setupRepo(repoName string) (oras.Target, error) {
 	}
 	return repo, nil
 }
-
-// tarDirectory walks the directory specified by path, and tar those files with a new
-// path prefix.
-//
-//nolint:revive // This rule is disabled to get around complexity linter errors. It is a slightly modified copy from the oras-go lib https://github.com/oras-project/oras-go/blob/dff56286a744d805bf953ada296e6076c335258b/content/file/utils.go#L36C92-L112.
-func tarDirectory(ctx context.Context, root, prefix string, w io.Writer, removeTimes bool) (err error) {
-	tw := tar.NewWriter(w)
-	defer func() {
-		closeErr := tw.Close()
-		if err == nil {
-			err = closeErr
-		}
-	}()
-
-	return filepath.Walk(root, func(path string, info os.FileInfo, err error) (returnErr error) {
-		if err != nil {
-			return err
-		}
-
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-
-		// Rename path
-		name, err := filepath.Rel(root, path)
-		if err != nil {
-			return err
-		}
-		name = filepath.Join(prefix, name)
-		name = filepath.ToSlash(name)
-
-		// Generate header
-		// NOTE: We don't support hard links and treat it as regular files
-		var link string
-		mode := info.Mode()
-		if mode&os.ModeSymlink != 0 {
-			if link, err = os.Readlink(path); err != nil {
-				return err
-			}
-		}
-		header, err := tar.FileInfoHeader(info, link)
-		if err != nil {
-			return fmt.Errorf("%s: %w", path, err)
-		}
-		header.Name = name
-		header.Uid = 0
-		header.Gid = 0
-		header.Uname = ""
-		header.Gname = ""
-
-		if removeTimes {
-			header.ModTime = time.Time{}
-			header.AccessTime = time.Time{}
-			header.ChangeTime = time.Time{}
-		}
-
-		// Write file
-		if err := tw.WriteHeader(header); err != nil {
-			return fmt.Errorf("tar: %w", err)
-		}
-		if mode.IsRegular() {
-			fp, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer func() {
-				closeErr := fp.Close()
-				if returnErr == nil {
-					returnErr = closeErr
-				}
-			}()
-
-			if _, err := io.Copy(tw, fp); err != nil {
-				return fmt.Errorf("failed to copy to %s: %w", path, err)
-			}
-		}
-
-		return nil
-	})
-}
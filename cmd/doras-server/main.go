@@ -57,7 +57,15 @@ func main() {
 	}
 	log.Debugf("Config: %+v", configFile)
 
+	if strings.HasPrefix(kongCtx.Command(), "gc") {
+		if err := collectGarbage(serverConfig); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.Infof("Doras version: %v", version)
+	serverConfig.Version = version
 	// Start up server.
 	doras := core.New(serverConfig)
 	doras.Start()
@@ -77,6 +85,29 @@ func main() {
 	log.Println("Server exited gracefully")
 }
 
+// collectGarbage runs the garbage collection once and prints a report of the deleted deltas.
+func collectGarbage(serverConfig configs.ServerConfig) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	opts := serverConfig.CliOpts.GC
+	reports, err := core.CollectGarbage(ctx, serverConfig, opts.Repositories, opts.DryRun)
+	for _, report := range reports {
+		action := "deleted"
+		if report.DryRun {
+			action = "would delete"
+		}
+		for _, e := range report.Deleted {
+			image := e.Image
+			if e.Tag != "" {
+				image = fmt.Sprintf("%s (%s)", image, e.Tag)
+			}
+			_, _ = fmt.Printf("%s %s: %s\n", action, image, e.Reason)
+		}
+		_, _ = fmt.Printf("%s: %s %d, kept %d\n", report.Repository, action, len(report.Deleted), report.Kept)
+	}
+	return err
+}
+
 // StringToLogLevel parse a logrus.Level from the string.
 // Converts input to a lowercase string.
 func StringToLogLevel(level string) log.Level {
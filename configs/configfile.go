@@ -1,29 +1,76 @@
 package configs
 
+import "time"
+
 // ServerConfig is the data structure to configure a Doras s
 type ServerConfig struct {
 	ConfigFile ServerConfigFile
 	CliOpts    CLI
+	// Version of the server, it is advertised to clients.
+	Version string
 }
 
 // CLI is the struct to parse the command line parameters or environment variables.
 type CLI struct {
-	HTTPPort                    uint16 `help:"HTTP port to listen on." default:"8080" env:"DORAS_HTTP_PORT"`
-	Host                        string `help:"Hostname to listen on." default:"127.0.0.1" env:"DORAS_HOST"`
-	ConfigFilePath              string `help:"Path to the Doras server config file." env:"DORAS_CONFIG_FILE_PATH"`
-	DockerConfigFilePath        string `help:"Path to the docker config file which is used to access registry credentials." default:"~/.docker/config.json" env:"DOCKER_CONFIG_FILE_PATH"`
-	LogLevel                    string `help:"Server log level." default:"info" enum:"debug,info,warn,error" env:"DORAS_LOG_LEVEL"`
-	ShutdownTimout              uint   `help:"Graceful shutdown timeout (in seconds)." default:"20" env:"DORAS_SHUTDOWN_TIMEOUT"`
-	InsecureAllowHTTP           bool   `help:"Allow INSECURE HTTP connections." default:"false" env:"DORAS_INSECURE_ALLOW_HTTP"`
-	RequireClientAuth           bool   `help:"Always require clients to provide an authentication token, regardless of repo access rights." default:"true" env:"DORAS_REQUIRE_CLIENT_AUTH"`
-	ExposeMetrics               bool   `help:"Expose prometheus metrics at '/metrics'." default:"false" env:"DORAS_EXPOSE_METRICS"`
-	EnableProfiling             bool   `help:"Enable and expose profiling at '/debug/pprof/'." default:"false" env:"DORAS_ENABLE_PROFILING"`
-	DummyExpirationDurationMins int    `help:"Duration until a dummy is considered to be expired." default:"30" env:"DORAS_DUMMY_EXPIRATION_DURATION_MINS"`
-	ExampleConfig               struct {
+	HTTPPort                             uint16   `help:"HTTP port to listen on." default:"8080" env:"DORAS_HTTP_PORT"`
+	GRPCPort                             uint16   `help:"gRPC port to listen on, the gRPC API shares the TLS and authentication settings of the HTTP API (0 disables)." default:"0" env:"DORAS_GRPC_PORT"`
+	Host                                 string   `help:"Hostname to listen on." default:"127.0.0.1" env:"DORAS_HOST"`
+	ConfigFilePath                       string   `help:"Path to the Doras server config file." env:"DORAS_CONFIG_FILE_PATH"`
+	DockerConfigFilePath                 string   `help:"Path to the docker config file which is used to access registry credentials." default:"~/.docker/config.json" env:"DOCKER_CONFIG_FILE_PATH"`
+	LogLevel                             string   `help:"Server log level." default:"info" enum:"debug,info,warn,error" env:"DORAS_LOG_LEVEL"`
+	ShutdownTimout                       uint     `help:"Graceful shutdown timeout (in seconds)." default:"20" env:"DORAS_SHUTDOWN_TIMEOUT"`
+	InsecureAllowHTTP                    bool     `help:"Allow INSECURE HTTP connections." default:"false" env:"DORAS_INSECURE_ALLOW_HTTP"`
+	TLSCertPath                          string   `help:"Path to the PEM encoded certificate (chain) of the server, enables TLS. The certificate is reloaded if the file changes." type:"path" env:"DORAS_TLS_CERT_PATH"`
+	TLSKeyPath                           string   `help:"Path to the PEM encoded private key of the server certificate." type:"path" env:"DORAS_TLS_KEY_PATH"`
+	TLSClientCAPath                      string   `help:"Path to the PEM encoded CA certificates which are used to verify client certificates (mTLS)." type:"path" env:"DORAS_TLS_CLIENT_CA_PATH"`
+	TLSRequireClientCert                 bool     `help:"Reject connections without a verified client certificate (requires a client CA)." default:"false" env:"DORAS_TLS_REQUIRE_CLIENT_CERT"`
+	TokenSecretPath                      string   `help:"Path to the secret (at least 32 bytes) which signs device tokens, it has to be shared by replicas. Defaults to a random secret." type:"path" env:"DORAS_TOKEN_SECRET_PATH"`
+	TokenTTLMins                         uint     `help:"Lifetime of device tokens in minutes." default:"15" env:"DORAS_TOKEN_TTL_MINS"`
+	RequireClientAuth                    bool     `help:"Always require clients to provide an authentication token, regardless of repo access rights." default:"true" env:"DORAS_REQUIRE_CLIENT_AUTH"`
+	ExposeMetrics                        bool     `help:"Expose prometheus metrics at '/metrics'." default:"false" env:"DORAS_EXPOSE_METRICS"`
+	EnableProfiling                      bool     `help:"Enable and expose profiling at '/debug/pprof/'." default:"false" env:"DORAS_ENABLE_PROFILING"`
+	DummyExpirationDurationMins          int      `help:"Duration since the last heartbeat until a dummy is considered to be expired." default:"30" env:"DORAS_DUMMY_EXPIRATION_DURATION_MINS"`
+	InstanceID                           string   `help:"ID of the server which is recorded as owner of the dummies it creates, defaults to the hostname with a random suffix." env:"DORAS_INSTANCE_ID"`
+	DeltaSigningKeyPath                  string   `help:"Path to a PEM encoded private key which is used to sign delta manifests (cosign compatible)." type:"path" env:"DORAS_DELTA_SIGNING_KEY_PATH"`
+	DeltaStorageMode                     string   `help:"Store deltas at derived tags or as referrers of the target image (requires OCI 1.1 referrers support)." default:"tag" enum:"tag,referrers" env:"DORAS_DELTA_STORAGE_MODE"`
+	StorageBackend                       string   `help:"Storage backend for source images and deltas, either remote registries or a local OCI image layout." default:"registry" enum:"registry,oci-layout" env:"DORAS_STORAGE_BACKEND"`
+	OCILayoutPath                        string   `help:"Root directory of the OCI image layouts (one layout per repository) used by the oci-layout storage backend." type:"path" env:"DORAS_OCI_LAYOUT_PATH"`
+	ServeDistributionAPI                 bool     `help:"Serve the content of the OCI layouts via a read-only distribution API at '/v2/' (requires the oci-layout storage backend)." default:"false" env:"DORAS_SERVE_DISTRIBUTION_API"`
+	DeltaUsageFilePath                   string   `help:"Path to a file in which served deltas are recorded, required to collect unused deltas across restarts. Replicas have to share it (on a file system with flock) for --gc-unused-days." type:"path" env:"DORAS_DELTA_USAGE_FILE_PATH"`
+	RolloutStateFilePath                 string   `help:"Path to a file in which the state of rollouts is kept, required to keep the targets of devices across restarts." type:"path" env:"DORAS_ROLLOUT_STATE_FILE_PATH"`
+	GCMaxAgeDays                         uint     `help:"Garbage collect deltas that are older than this many days (0 disables)." default:"0" env:"DORAS_GC_MAX_AGE_DAYS"`
+	GCUnusedDays                         uint     `help:"Garbage collect deltas that have not been served for this many days (0 disables). Only safe with a single replica or a --delta-usage-file-path shared by all replicas." default:"0" env:"DORAS_GC_UNUSED_DAYS"`
+	GCIntervalMins                       uint     `help:"Run the garbage collection in the background at this interval (0 disables)." default:"0" env:"DORAS_GC_INTERVAL_MINS"`
+	MaxArtifactSizeMiB                   uint     `help:"Do not create deltas for artifacts that are larger than this many MiB (0 disables)." default:"0" env:"DORAS_MAX_ARTIFACT_SIZE_MIB"`
+	DeltaCreationTimeoutMins             uint     `help:"Abort delta creations that take longer than this many minutes (0 disables)." default:"0" env:"DORAS_DELTA_CREATION_TIMEOUT_MINS"`
+	DeltaCreationMaxEstimatedMemoryMiB   uint     `help:"Reject delta requests whose creation the algorithm estimates to require more than this many MiB of memory (0 disables), actual usage is not enforced." default:"0" env:"DORAS_DELTA_CREATION_MAX_ESTIMATED_MEMORY_MIB"`
+	DeltaCreationMaxEstimatedTempDiskMiB uint     `help:"Reject delta requests whose creation the algorithm estimates to require more than this many MiB of temporary disk space (0 disables), actual usage is not enforced." default:"0" env:"DORAS_DELTA_CREATION_MAX_ESTIMATED_TEMP_DISK_MIB"`
+	RateLimitPerMin                      uint     `help:"Maximum sustained delta requests per minute of each client (identity or IP), rejected requests are answered with 429 (0 disables)." default:"0" env:"DORAS_RATE_LIMIT_PER_MIN"`
+	RateLimitBurst                       uint     `help:"Number of delta requests a client can send in a burst before the rate limit applies." default:"10" env:"DORAS_RATE_LIMIT_BURST"`
+	LockBackend                          string   `help:"Locks that prevent replicas from creating the same delta, 'local' only coordinates within the server." default:"local" enum:"local,file,redis,registry,raft" env:"DORAS_LOCK_BACKEND"`
+	LockFileDir                          string   `help:"Directory shared by the replicas in which the file lock backend stores locks." type:"path" env:"DORAS_LOCK_FILE_DIR"`
+	LockRedisAddress                     string   `help:"Address (host:port) or URL (redis://host:6379/0, rediss:// for TLS) of the Redis compatible server of the redis lock backend." env:"DORAS_LOCK_REDIS_ADDRESS"`
+	LockRedisPassword                    string   `help:"Password of the Redis compatible server of the redis lock backend, overrides the password of the URL." env:"DORAS_LOCK_REDIS_PASSWORD"`
+	LockRaftNodeID                       string   `help:"ID of the replica in the Raft cluster of the raft lock backend, it must not change." env:"DORAS_LOCK_RAFT_NODE_ID"`
+	LockRaftAddress                      string   `help:"Address (host:port) at which the replica listens for and is reachable by the other replicas of the raft lock backend." env:"DORAS_LOCK_RAFT_ADDRESS"`
+	LockRaftDir                          string   `help:"Directory in which the raft lock backend stores the Raft log (bolt) and snapshots of the replica." type:"path" env:"DORAS_LOCK_RAFT_DIR"`
+	LockRaftPeers                        []string `help:"All replicas of the Raft cluster of the raft lock backend as id=host:port, including this replica." env:"DORAS_LOCK_RAFT_PEERS"`
+	LockRaftTLSCertPath                  string   `help:"Certificate of the replica for the mutual TLS between the replicas of the raft lock backend (required), it has to be valid for the host of its address." type:"path" env:"DORAS_LOCK_RAFT_TLS_CERT_PATH"`
+	LockRaftTLSKeyPath                   string   `help:"Key of the certificate of the replica for the raft lock backend (required)." type:"path" env:"DORAS_LOCK_RAFT_TLS_KEY_PATH"`
+	LockRaftTLSCAPath                    string   `help:"CA that issues the certificates of the replicas of the raft lock backend (required), replicas reject peers without one, so use a CA dedicated to the cluster." type:"path" env:"DORAS_LOCK_RAFT_TLS_CA_PATH"`
+	MQTTBroker                           string   `help:"URL of the MQTT broker on which created deltas are announced, e.g. tcp://broker:1883 or mqtts://broker:8883 (empty disables)." env:"DORAS_MQTT_BROKER"`
+	MQTTTopic                            string   `help:"MQTT topic on which created deltas are announced." default:"doras/deltas" env:"DORAS_MQTT_TOPIC"`
+	MQTTUsername                         string   `help:"User name with which the server connects to the MQTT broker." env:"DORAS_MQTT_USERNAME"`
+	MQTTPassword                         string   `help:"Password with which the server connects to the MQTT broker." env:"DORAS_MQTT_PASSWORD"`
+	ExampleConfig                        struct {
 		Output string `help:"Write example config to this location instead of printing to stdout." type:"path"`
 	} `cmd:"" help:"Print or store example config."`
 	Run struct {
 	} `cmd:"" help:"Run the server." default:"1"`
+	GC struct {
+		Repositories []string `arg:"" optional:"" help:"Repositories in which garbage is collected, defaults to the repositories in the config file."`
+		DryRun       bool     `help:"Only report what would be deleted." default:"false"`
+	} `cmd:"" name:"gc" help:"Delete stale deltas and expired dummies."`
 	Version bool `help:"Print version number version and exit." default:"false"`
 }
 
@@ -31,6 +78,91 @@ type CLI struct {
 type ServerConfigFile struct {
 	TrustedProxies []string             `yaml:"trusted-proxies"`
 	Registries     map[string]RegConfig `yaml:"registries"`
+	GC             GCConfig             `yaml:"gc"`
+	DeltaTargets   []DeltaTarget        `yaml:"delta-targets"`
+	// ClientCertificates map the identities of client certificates to registry credentials.
+	ClientCertificates []ClientCertificate `yaml:"client-certificates"`
+	// TokenService issues device tokens, it is enabled if devices are configured.
+	TokenService TokenServiceConfig `yaml:"token-service"`
+	// Policy restricts the delta requests that are accepted.
+	Policy PolicyConfig `yaml:"policy"`
+	// DeviceGroups map the names of device groups to patterns of device IDs, e.g. "lab-*".
+	DeviceGroups map[string][]string `yaml:"device-groups"`
+	// Rollouts decide which image each device runs, devices ask for it at /api/v1/target.
+	Rollouts []RolloutConfig `yaml:"rollouts"`
+}
+
+// RolloutConfig rolls out the target to a percentage of the devices of the groups (all devices if no groups are configured).
+// Devices run the target of the latest started rollout that selected them.
+type RolloutConfig struct {
+	Name string `yaml:"name"`
+	// Target is the image that is rolled out, tags are resolved to a digest once the rollout has started.
+	Target     string   `yaml:"target"`
+	Percentage uint     `yaml:"percentage"`
+	Groups     []string `yaml:"groups"`
+	// Start is the time at which the rollout starts (RFC 3339), it starts right away if it is not set.
+	Start time.Time `yaml:"start"`
+}
+
+// PolicyConfig restricts the delta requests that are accepted, requests that violate it are rejected with 403.
+// Empty fields do not restrict requests.
+type PolicyConfig struct {
+	// Repositories which are allowed, wildcards (e.g. "registry.example.org/apps/*") are supported.
+	Repositories []string `yaml:"repositories"`
+	// Algorithms (differs and compressors) which are allowed.
+	Algorithms         []string `yaml:"algorithms"`
+	MaxArtifactSizeMiB uint     `yaml:"max-artifact-size-mib"`
+	// QuotaWindowMins is the duration in which delta creations are counted, defaults to 60 minutes.
+	QuotaWindowMins uint          `yaml:"quota-window-mins"`
+	Quotas          []QuotaConfig `yaml:"quotas"`
+}
+
+// QuotaConfig limits the delta creations of each client whose identity matches the pattern.
+// The identity is the device ID of device tokens, the name of client certificates or the username of basic auth.
+// The first matching entry is used.
+type QuotaConfig struct {
+	Identity          string `yaml:"identity"`
+	MaxDeltaCreations uint   `yaml:"max-delta-creations"`
+}
+
+// TokenServiceConfig configures how devices authenticate to request tokens and which repositories they can access.
+type TokenServiceConfig struct {
+	// JWKSURL is the endpoint of the keys which sign device JWTs, devices can only use device keys if it is not set.
+	JWKSURL     string         `yaml:"jwks-url"`
+	JWTIssuer   string         `yaml:"jwt-issuer"`
+	JWTAudience string         `yaml:"jwt-audience"`
+	Devices     []DeviceConfig `yaml:"devices"`
+}
+
+// DeviceConfig configures a device of the token service.
+// Devices authenticate with their ID and key or with a JWT whose subject is the ID.
+type DeviceConfig struct {
+	ID string `yaml:"id"`
+	// KeySHA256 is the hex encoded SHA-256 hash of the device key.
+	KeySHA256 string `yaml:"key-sha256"`
+	// Repositories is the allow-list of the device, wildcards (e.g. "registry.example.org/apps/*") are supported.
+	Repositories []string `yaml:"repositories"`
+}
+
+// ClientCertificate configures the registry credentials of clients which authenticate with a certificate (mTLS).
+// The identity is matched against the common name and the SANs of the certificate, wildcards (e.g. "device-*") are supported.
+// The first matching entry is used.
+type ClientCertificate struct {
+	Identity   string               `yaml:"identity"`
+	Registries map[string]RegConfig `yaml:"registries"`
+}
+
+// DeltaTarget configures a repository in which the deltas of a source repository (or namespace) are stored.
+// Credentials for the target registry are configured in the registries section.
+type DeltaTarget struct {
+	Source string `yaml:"source"`
+	Target string `yaml:"target"`
+}
+
+// GCConfig configures the garbage collection of deltas.
+type GCConfig struct {
+	// Repositories in which garbage is collected.
+	Repositories []string `yaml:"repositories"`
 }
 
 // RegConfig stores the configuration for an OCI registry.
@@ -2,22 +2,16 @@ package algorithmchoice
 
 import (
 	"fmt"
+
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	log "github.com/sirupsen/logrus"
 	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/pkg/algorithm"
+	"github.com/unbasical/doras/pkg/algorithm/compression"
 	"github.com/unbasical/doras/pkg/algorithm/delta"
-	"slices"
-
-	"github.com/unbasical/doras/internal/pkg/compression/zstd"
-
+	"github.com/unbasical/doras/pkg/algorithm/registry"
 	"github.com/unbasical/doras/pkg/constants"
-
-	"github.com/unbasical/doras/internal/pkg/compression/gzip"
-	"github.com/unbasical/doras/internal/pkg/delta/bsdiff"
-	"github.com/unbasical/doras/internal/pkg/delta/tardiff"
-	"github.com/unbasical/doras/internal/pkg/utils/compressionutils"
-
-	"github.com/unbasical/doras/pkg/algorithm/compression"
+	"github.com/unbasical/doras/pkg/deltalocation"
 )
 
 // PatcherChoice aggregates the two algorithms that are used to apply a delta patch.
@@ -38,8 +32,14 @@ type DifferChoice struct {
 
 // GetTagSuffix returns the suffix that is added to the tag of the delta image to identify the used algorithms.
 func (c *DifferChoice) GetTagSuffix() string {
+	return deltalocation.TagSuffix(c.Differ.Name(), c.Compressor.Name())
+}
+
+// GetAlgorithm returns the string that identifies the algorithms of a delta patch.
+// For instance, a zstd-compressed bsdiff patch has the value `bsdiff+zstd`.
+func (c *DifferChoice) GetAlgorithm() string {
 	if compressorName := c.Compressor.Name(); compressorName != "" {
-		return c.Differ.Name() + "_" + compressorName
+		return c.Differ.Name() + "+" + compressorName
 	}
 	return c.Differ.Name()
 }
@@ -47,10 +47,13 @@ func (c *DifferChoice) GetTagSuffix() string {
 // GetMediaType returns the media type that is used to identify the algorithms of a delta patch.
 // For instance, a zstd-compressed bsdiff patch has the value `application/bsdiff+zstd`.
 func (c *DifferChoice) GetMediaType() string {
-	if compressorName := c.Compressor.Name(); compressorName != "" {
-		return "application/" + c.Differ.Name() + "+" + compressorName
+	d, errDelta := registry.Delta(c.Differ.Name())
+	comp, errCompression := registry.Compression(c.Compressor.Name())
+	if errDelta != nil || errCompression != nil {
+		// Algorithms that are not registered cannot be applied by clients, but their name is the best guess.
+		return "application/" + c.GetAlgorithm()
 	}
-	return "application/" + c.Differ.Name()
+	return registry.MediaType(d, comp)
 }
 
 // GetFileExt returns the file extension that is appended to the file name of a delta patch.
@@ -63,14 +66,10 @@ func (c *DifferChoice) GetFileExt() string {
 }
 
 // ChooseAlgorithms returns a DifferChoice that is the most suitable to create a delta patch for the given artifacts,
-// under the constraint of only using the acceptedAlgorithms.
+// under the constraint of only using the acceptedAlgorithms (see registry.Choose).
 func ChooseAlgorithms(acceptedAlgorithms []string, mfFrom, mfTo *ociutils.Manifest) DifferChoice {
 	_ = mfTo
 
-	algorithm := DifferChoice{
-		Differ:     bsdiff.NewDiffer(),
-		Compressor: compressionutils.NewNopCompressor(),
-	}
 	var artifacts []v1.Descriptor
 	if len(mfFrom.Layers) > 0 {
 		artifacts = mfFrom.Layers
@@ -78,18 +77,43 @@ func ChooseAlgorithms(acceptedAlgorithms []string, mfFrom, mfTo *ociutils.Manife
 	if len(mfFrom.Blobs) > 0 {
 		artifacts = mfFrom.Blobs
 	}
-	if artifacts[0].Annotations[constants.OrasContentUnpack] == "true" && slices.Contains(acceptedAlgorithms, "tardiff") {
-		algorithm.Differ = tardiff.NewCreator()
-		algorithm.Compressor = compressionutils.NewNopCompressor()
-		return algorithm
-	}
-	// The order is inverse to the priority.
-	if slices.Contains(acceptedAlgorithms, "gzip") {
-		algorithm.Compressor = gzip.NewCompressor()
-	}
-	if slices.Contains(acceptedAlgorithms, "zstd") {
-		algorithm.Compressor = zstd.NewCompressor()
+	isArchive := len(artifacts) > 0 && artifacts[0].Annotations[constants.OrasContentUnpack] == "true"
+	d, c := registry.Choose(acceptedAlgorithms, isArchive)
+	algorithm := DifferChoice{
+		Differ:     d.NewDiffer(),
+		Compressor: c.NewCompressor(),
 	}
 	log.Debugf("chosen algorithms: differ=%s compression=%s", algorithm.Differ.Name(), algorithm.Compressor.Name())
 	return algorithm
 }
+
+// NewDifferChoice loads the algorithms with the given names from the registry.
+// An empty compressor name (or `none`) disables compression.
+func NewDifferChoice(differ, compressor string) (DifferChoice, error) {
+	d, err := registry.Delta(differ)
+	if err != nil {
+		return DifferChoice{}, err
+	}
+	c, err := registry.Compression(compressor)
+	if err != nil {
+		return DifferChoice{}, err
+	}
+	return DifferChoice{Differ: d.NewDiffer(), Compressor: c.NewCompressor()}, nil
+}
+
+// NewPatcherChoice loads the algorithms that are required to apply a delta patch with the given media type,
+// e.g. `application/bsdiff+zstd`.
+func NewPatcherChoice(mediaType string, opts registry.PatcherOptions) (PatcherChoice, error) {
+	d, c, err := registry.ParseMediaType(mediaType)
+	if err != nil {
+		return PatcherChoice{}, err
+	}
+	return PatcherChoice{Patcher: d.NewPatcher(opts), Decompressor: c.NewDecompressor()}, nil
+}
+
+// IsArchiveAlgorithm checks whether the diffing algorithm only supports archives,
+// patches of these algorithms produce the uncompressed archive instead of the target artifact.
+func IsArchiveAlgorithm(a algorithm.Algorithm) bool {
+	d, err := registry.Delta(a.Name())
+	return err == nil && d.Archives
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+)
+
+func Test_algorithms(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/algorithms", algorithms)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/algorithms", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var res apicommon.AlgorithmsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{name: "differs", got: res.Differs, want: []string{"bsdiff", "tardiff"}},
+		{name: "compressors", got: res.Compressors, want: []string{"gzip", "zstd"}},
+		{name: "default algorithms", got: res.DefaultAlgorithms, want: []string{"bsdiff", "tardiff", "zstd"}},
+	} {
+		if !slices.Equal(tt.got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, tt.got)
+		}
+	}
+}
+
+func Test_capabilities(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/capabilities", capabilities(ServerInfo{Version: "v1.2.3", MaxArtifactSize: 1 << 20, RequireClientAuth: true, ClientCertificates: true, TokenService: true}))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/capabilities", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var res apicommon.CapabilitiesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Version != "v1.2.3" || res.MaxArtifactSize != 1<<20 || !res.Auth.Required || !res.Auth.ClientCertificates || !res.Auth.TokenService {
+		t.Errorf("unexpected capabilities %+v", res)
+	}
+	if !slices.Equal(res.Differs, []string{"bsdiff", "tardiff"}) || !slices.Equal(res.Compressors, []string{"gzip", "zstd"}) {
+		t.Errorf("unexpected algorithms %v, %v", res.Differs, res.Compressors)
+	}
+}
+
+func Test_capabilities_Algorithms(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/capabilities", capabilities(ServerInfo{Algorithms: []string{"bsdiff", "zstd"}}))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/capabilities", nil))
+	var res apicommon.CapabilitiesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(res.Differs, []string{"bsdiff"}) || !slices.Equal(res.Compressors, []string{"zstd"}) || slices.Contains(res.DefaultAlgorithms, "tardiff") {
+		t.Errorf("expected only the allowed algorithms, got %v, %v, %v", res.Differs, res.Compressors, res.DefaultAlgorithms)
+	}
+}
@@ -1,11 +1,25 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"github.com/gin-contrib/pprof"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/unbasical/doras/internal/pkg/api/clientauth"
+	"github.com/unbasical/doras/internal/pkg/auth"
 	"github.com/unbasical/doras/internal/pkg/core/metrics"
+	error2 "github.com/unbasical/doras/internal/pkg/error"
+	"github.com/unbasical/doras/internal/pkg/ratelimit"
+	"github.com/unbasical/doras/internal/pkg/rollout"
+	"github.com/unbasical/doras/internal/pkg/storage"
+	"github.com/unbasical/doras/internal/pkg/tokenservice"
+	"io"
+	"math"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/unbasical/doras/internal/pkg/api/gindelegate"
@@ -14,6 +28,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/unbasical/doras/internal/pkg/api/apicommon"
 	"github.com/unbasical/doras/internal/pkg/core/dorasengine"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
 )
 
 func init() {
@@ -42,9 +57,34 @@ func logger() gin.HandlerFunc {
 	}
 }
 
+// ServerInfo is the configuration of the server that is advertised to clients via the capabilities endpoint.
+type ServerInfo struct {
+	Version string
+	// MaxArtifactSize is the maximum size of artifacts in bytes (0 if there is no limit).
+	MaxArtifactSize   int64
+	RequireClientAuth bool
+	// ClientCertificates is set if client certificates are verified and mapped to registry credentials.
+	ClientCertificates bool
+	// TokenService is set if the server issues device tokens.
+	TokenService bool
+	// Algorithms that are allowed by the policy of the server, all supported algorithms are allowed if it is empty.
+	Algorithms []string
+}
+
+// AuthConfig configures how clients can authenticate delta requests besides registry credentials.
+type AuthConfig struct {
+	// ClientCertificates map the identities of verified client certificates to registry credentials.
+	ClientCertificates []auth.ClientCertificateIdentity
+	// Tokens issues device tokens, they are accepted as Bearer tokens if it is set.
+	Tokens tokenservice.Service
+}
+
 // BuildApp return an engine that when ran servers the Doras API.
 // Uses the provided configuration to set up logging, storage and other things.
-func BuildApp(engine dorasengine.Engine, exposeMetrics bool, enableProfiling bool) *gin.Engine {
+// If a storage.LayoutProvider is provided, its content is served via a read-only distribution API.
+// If a ratelimit.Limiter is provided, it limits the delta requests of each client.
+// If a rollout.Manager is provided, devices can ask for the image they should run.
+func BuildApp(engine dorasengine.Engine, info ServerInfo, exposeMetrics bool, enableProfiling bool, distribution storage.LayoutProvider, authConfig AuthConfig, limiter ratelimit.Limiter, rollouts rollout.Manager) *gin.Engine {
 	log.Debug("Building app")
 	gin.DisableConsoleColor()
 	r := gin.New()
@@ -60,8 +100,31 @@ func BuildApp(engine dorasengine.Engine, exposeMetrics bool, enableProfiling boo
 		log.Info("Enabling pprof at /debug/pprof")
 		pprof.Register(r)
 	}
-	r = buildEdgeAPI(r, engine)
+	r = buildEdgeAPI(r, engine, authConfig, limiter)
+	if authConfig.Tokens != nil {
+		log.Info("Issuing device tokens at /api/v1/token")
+		r.POST("/"+apicommon.ApiBasePathV1+"/"+apicommon.TokenApiPath, token(authConfig.Tokens))
+	}
+	if rollouts != nil {
+		log.Info("Serving the targets of devices at /api/v1/target")
+		var targetHandlers []gin.HandlerFunc
+		if limiter != nil {
+			targetHandlers = append(targetHandlers, rateLimit(limiter, []gindelegate.Option{
+				gindelegate.WithClientCertificateIdentities(authConfig.ClientCertificates),
+				gindelegate.WithTokenService(authConfig.Tokens),
+			}, nil))
+		}
+		authn := clientauth.Authenticator{Identities: authConfig.ClientCertificates, Tokens: authConfig.Tokens}
+		targetHandlers = append(targetHandlers, target(rollouts, authn, info.RequireClientAuth))
+		r.GET("/"+apicommon.ApiBasePathV1+"/"+apicommon.TargetApiPath, targetHandlers...)
+	}
+	if distribution != nil {
+		log.Info("Serving the distribution API at /v2/")
+		r = buildDistributionAPI(r, distribution)
+	}
 	r.GET("/api/v1/ping", ping)
+	r.GET("/"+apicommon.ApiBasePathV1+"/"+apicommon.AlgorithmsApiPath, algorithms)
+	r.GET("/"+apicommon.ApiBasePathV1+"/"+apicommon.CapabilitiesApiPath, capabilities(info))
 
 	return r
 }
@@ -73,19 +136,179 @@ func ping(c *gin.Context) {
 	})
 }
 
+// algorithms is an endpoint that lists the algorithms which are supported by the server.
+func algorithms(c *gin.Context) {
+	c.JSON(http.StatusOK, apicommon.AlgorithmsResponse{
+		Differs:           registry.Differs(),
+		Compressors:       registry.Compressors(),
+		DefaultAlgorithms: registry.DefaultAlgorithms(),
+	})
+}
+
+// capabilities returns an endpoint that describes the server, clients use it to negotiate the algorithms of delta requests.
+func capabilities(info ServerInfo) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, capabilitiesResponse(info))
+	}
+}
+
+// capabilitiesResponse describes the server, it is served by the HTTP and the gRPC API.
+func capabilitiesResponse(info ServerInfo) apicommon.CapabilitiesResponse {
+	return apicommon.CapabilitiesResponse{
+		Version:           info.Version,
+		Differs:           allowed(registry.Differs(), info.Algorithms),
+		Compressors:       allowed(registry.Compressors(), info.Algorithms),
+		DefaultAlgorithms: allowed(registry.DefaultAlgorithms(), info.Algorithms),
+		MaxArtifactSize:   info.MaxArtifactSize,
+		MaxWait:           int64(apicommon.MaxWait.Seconds()),
+		Auth: apicommon.AuthRequirements{
+			Required:           info.RequireClientAuth,
+			Schemes:            []string{"Bearer", "Basic"},
+			ClientCertificates: info.ClientCertificates,
+			TokenService:       info.TokenService,
+		},
+	}
+}
+
+// allowed returns the algorithms that are allowed, all algorithms are allowed if the allow-list is empty.
+func allowed(algorithms, allowList []string) []string {
+	if len(allowList) == 0 {
+		return algorithms
+	}
+	return slices.DeleteFunc(algorithms, func(name string) bool { return !slices.Contains(allowList, name) })
+}
+
+// token returns an endpoint that issues device tokens for the requested repositories.
+func token(tokens tokenservice.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req apicommon.TokenRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			gindelegate.RespondWithError(c, http.StatusBadRequest, error2.ErrUnmarshal, "")
+			return
+		}
+		t, err := tokens.Issue(c.Request.Context(), c.GetHeader("Authorization"), req.Repositories)
+		switch {
+		case errors.Is(err, tokenservice.ErrUnauthenticated):
+			log.WithError(err).Debug("failed to authenticate device")
+			gindelegate.RespondWithError(c, http.StatusUnauthorized, error2.ErrUnauthorized, "")
+			return
+		case errors.Is(err, tokenservice.ErrForbidden):
+			gindelegate.RespondWithError(c, http.StatusForbidden, error2.ErrForbidden, err.Error())
+			return
+		case errors.Is(err, tokenservice.ErrNoRepositories):
+			gindelegate.RespondWithError(c, http.StatusBadRequest, error2.ErrBadRequest, err.Error())
+			return
+		case err != nil:
+			log.WithError(err).Error("failed to issue token")
+			gindelegate.RespondWithError(c, http.StatusInternalServerError, error2.ErrInternal, "")
+			return
+		}
+		c.JSON(http.StatusOK, apicommon.TokenResponse{
+			Token:     t.Token,
+			ExpiresIn: int64(t.ExpiresAt.Sub(t.IssuedAt).Seconds()),
+			IssuedAt:  t.IssuedAt.UTC().Format(time.RFC3339),
+		})
+	}
+}
+
 // buildEdgeAPI sets up the API which handles delta requests.
-func buildEdgeAPI(r *gin.Engine, engine dorasengine.Engine) *gin.Engine {
+// If a ratelimit.Limiter is provided, clients that exceed their rate limit are rejected.
+func buildEdgeAPI(r *gin.Engine, engine dorasengine.Engine, authConfig AuthConfig, limiter ratelimit.Limiter) *gin.Engine {
 	log.Debug("Building edge API")
 	edgeApiPath, err := url.JoinPath("/", apicommon.ApiBasePathV1, apicommon.DeltaApiPath)
 	if err != nil {
 		log.Error(err)
 		panic(err)
 	}
+	delegateOpts := []gindelegate.Option{
+		gindelegate.WithClientCertificateIdentities(authConfig.ClientCertificates),
+		gindelegate.WithTokenService(authConfig.Tokens),
+	}
 	edgeAPI := r.Group(edgeApiPath)
-	edgeAPI.GET("/", func(c *gin.Context) {
-		apiDelegate := gindelegate.NewDelegate(c)
+	if limiter != nil {
+		edgeAPI.Use(rateLimit(limiter, delegateOpts, nil))
+	}
+	readDelta := func(c *gin.Context) {
+		apiDelegate := gindelegate.NewDelegate(c, delegateOpts...)
 		metrics.DeltaRequestCounter.Inc()
 		engine.HandleReadDelta(apiDelegate)
+	}
+	// Requests are not redirected to the path with a trailing slash, clients would have to send the body of POST requests again.
+	for _, path := range []string{"", "/"} {
+		edgeAPI.GET(path, readDelta)
+		edgeAPI.POST(path, readDelta)
+	}
+	batchPath, err := url.JoinPath("/", apicommon.ApiBasePathV1, apicommon.BatchDeltaApiPath)
+	if err != nil {
+		log.Error(err)
+		panic(err)
+	}
+	batchHandlers := []gin.HandlerFunc{func(c *gin.Context) {
+		// Gin parses the colon of the path as a parameter, other paths that match the route do not exist.
+		if c.Request.URL.Path != batchPath {
+			c.AbortWithStatus(http.StatusNotFound)
+		}
+	}}
+	if limiter != nil {
+		batchHandlers = append(batchHandlers, rateLimit(limiter, delegateOpts, batchCost))
+	}
+	batchHandlers = append(batchHandlers, func(c *gin.Context) {
+		apiDelegate := gindelegate.NewDelegate(c, delegateOpts...)
+		metrics.DeltaRequestCounter.Inc()
+		engine.HandleReadDeltas(apiDelegate)
 	})
+	r.POST(batchPath, batchHandlers...)
 	return r
 }
+
+// rateLimit returns a middleware that rejects requests of clients which exceed their rate limit with 429.
+// Clients are identified by rateLimitKey, requests take the number of tokens returned by cost (one if cost is nil).
+func rateLimit(limiter ratelimit.Limiter, delegateOpts []gindelegate.Option, cost func(c *gin.Context) int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientAuth, err := gindelegate.NewDelegate(c, delegateOpts...).ExtractClientAuth()
+		if err != nil {
+			clientAuth = nil
+		}
+		key := rateLimitKey(c.ClientIP(), clientAuth)
+		n := 1
+		if cost != nil {
+			n = cost(c)
+		}
+		ok, retryAfter := limiter.AllowN(key, n)
+		if ok {
+			c.Next()
+			return
+		}
+		log.Debugf("client %s exceeded its rate limit", key)
+		metrics.ThrottledRequestsCounter.WithLabelValues(c.FullPath()).Inc()
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		gindelegate.RespondWithError(c, http.StatusTooManyRequests, error2.ErrTooManyRequests, apicommon.ErrTooManyRequests.InnerError.ErrorContext)
+		c.Abort()
+	}
+}
+
+// batchCost returns the number of requests of a batch, so each request of the batch counts against the rate limit.
+// The body is restored for the handler, batches that cannot be decoded count as one request and are rejected by the handler.
+func batchCost(c *gin.Context) int {
+	body, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return 1
+	}
+	var batch apicommon.BatchReadDeltaRequest
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return 1
+	}
+	return min(max(len(batch.Requests), 1), apicommon.MaxBatchSize)
+}
+
+// rateLimitKey identifies clients by their verified identity (see auth.VerifiedIdentity), other clients by their IP.
+// Identities that are chosen by the client are not used, otherwise clients could evade their rate limit by changing them.
+func rateLimitKey(ip string, clientAuth auth.RegistryAuth) string {
+	if clientAuth != nil {
+		if identity, ok := auth.VerifiedIdentity(clientAuth); ok {
+			return "identity:" + identity
+		}
+	}
+	return "ip:" + ip
+}
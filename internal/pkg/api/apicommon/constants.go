@@ -1,7 +1,30 @@
 package apicommon
 
+import "time"
+
 // ApiBasePathV1 is the base path for version 1 of the API.
 const ApiBasePathV1 = "api/v1"
 
 // DeltaApiPath is the sub path for the delta creation API.
 const DeltaApiPath = "delta"
+
+// CapabilitiesApiPath is the sub path for the API which describes the capabilities of the server.
+const CapabilitiesApiPath = "capabilities"
+
+// AlgorithmsApiPath is the sub path for the API which lists the supported algorithms.
+const AlgorithmsApiPath = "algorithms"
+
+// TokenApiPath is the sub path for the API which issues device tokens.
+const TokenApiPath = "token"
+
+// TargetApiPath is the sub path for the API which tells devices the image they should run.
+const TargetApiPath = "target"
+
+// BatchDeltaApiPath is the sub path for the API which handles batches of delta requests.
+const BatchDeltaApiPath = "deltas:batch"
+
+// MaxBatchSize is the maximum number of requests in a batch.
+const MaxBatchSize = 100
+
+// MaxWait is the longest duration the server holds delta requests that wait for the delta to be created.
+const MaxWait = 2 * time.Minute
@@ -9,17 +9,110 @@ type SuccessResponse[T any] struct {
 	Success T `json:"success"`
 }
 
+// ReadDeltaRequest is the body of POST requests for deltas, the fields correspond to the query parameters of GET requests.
+// To is either a tagged image or an image identified by a digest.
 type ReadDeltaRequest struct {
 	From               string   `json:"from"`
 	To                 string   `json:"to"`
 	AcceptedAlgorithms []string `json:"accepted_algorithms"`
 }
 
+// BatchReadDeltaRequest requests deltas for many pairs of images at once, e.g. by gateways that update many devices.
+type BatchReadDeltaRequest struct {
+	Requests []ReadDeltaRequest `json:"requests"`
+}
+
+// BatchReadDeltaResponse contains the responses to the requests of a batch in the same order.
+type BatchReadDeltaResponse struct {
+	Responses []BatchItemResponse `json:"responses"`
+}
+
+// BatchItemResponse is the response to a single request of a batch.
+// Status is the HTTP status code with which the request would have been answered on its own.
+type BatchItemResponse struct {
+	Status int `json:"status"`
+	// Delta is set if the delta has been created (200).
+	Delta *ReadDeltaResponse `json:"delta,omitempty"`
+	// EstimatedCompletion is set if the delta is being created (202) and the server can estimate when it will be created.
+	EstimatedCompletion string `json:"estimated_completion,omitempty"`
+	// Error is set if the request failed.
+	Error *APIErrorInner `json:"error,omitempty"`
+}
+
 type ReadDeltaResponse struct {
 	TargetImage string `json:"target_image"`
 	DeltaImage  string `json:"delta_image"`
 }
 
+// DeltaReadyNotification is published once a delta has been created, clients that wait for it can request it right away.
+// From and To are the images as they have been requested, e.g. To is tagged if the request was for a tag.
+type DeltaReadyNotification struct {
+	From        string `json:"from"`
+	To          string `json:"to"`
+	TargetImage string `json:"target_image"`
+	DeltaImage  string `json:"delta_image"`
+}
+
+// AcceptedResponse is the body of responses to delta requests which have been accepted but the delta has not been created yet.
+// It is only sent if the server can estimate when the delta will be created, the response has a Retry-After header as well.
+type AcceptedResponse struct {
+	// EstimatedCompletion is the time at which the delta is expected to be created (RFC 3339).
+	EstimatedCompletion string `json:"estimated_completion"`
+}
+
+// AlgorithmsResponse lists the algorithms that are supported by the server.
+type AlgorithmsResponse struct {
+	Differs           []string `json:"differs"`
+	Compressors       []string `json:"compressors"`
+	DefaultAlgorithms []string `json:"default_algorithms"`
+}
+
+// CapabilitiesResponse describes the server, clients use it to negotiate the algorithms of delta requests.
+type CapabilitiesResponse struct {
+	Version           string   `json:"version"`
+	Differs           []string `json:"differs"`
+	Compressors       []string `json:"compressors"`
+	DefaultAlgorithms []string `json:"default_algorithms"`
+	MaxArtifactSize   int64    `json:"max_artifact_size"`
+	// MaxWait is the longest duration in seconds the server holds requests that wait for deltas (0 if waiting is not supported).
+	MaxWait int64            `json:"max_wait"`
+	Auth    AuthRequirements `json:"auth"`
+}
+
+// TokenRequest requests a device token for the repositories.
+type TokenRequest struct {
+	Repositories []string `json:"repositories"`
+}
+
+// TokenResponse contains a device token, it is sent as Bearer token with delta requests.
+type TokenResponse struct {
+	Token string `json:"token"`
+	// ExpiresIn is the lifetime of the token in seconds.
+	ExpiresIn int64  `json:"expires_in"`
+	IssuedAt  string `json:"issued_at"`
+}
+
+// TargetResponse tells a device which image it should run, the image is identified by its digest.
+type TargetResponse struct {
+	// Image is the target, e.g. registry.example.org/app@sha256:...
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+	// Rollout is the name of the rollout that selected the device.
+	Rollout string `json:"rollout"`
+}
+
+// AuthRequirements describe how clients authenticate delta requests.
+type AuthRequirements struct {
+	// Required is set if requests without credentials are rejected.
+	Required bool `json:"required"`
+	// Schemes are the supported schemes of the Authorization header.
+	Schemes []string `json:"schemes"`
+	// ClientCertificates is set if clients can authenticate with client certificates instead of the Authorization header.
+	ClientCertificates bool `json:"client_certificates"`
+	// TokenService is set if devices can request tokens from the server (see TokenRequest).
+	TokenService bool `json:"token_service"`
+}
+
 // APIError wraps around the actual error for easier JSON parsing.
 type APIError struct {
 	InnerError APIErrorInner `json:"error"`
@@ -62,3 +155,27 @@ var ErrImagesIncompatible = APIError{InnerError: APIErrorInner{
 	Message:      "artifacts are not compatible",
 	ErrorContext: "cannot build a delta from images",
 }}
+
+// ErrTooManyRequests is returned by the API when a client exceeds its rate limit, the response has a Retry-After header.
+var ErrTooManyRequests = APIError{InnerError: APIErrorInner{
+	Message:      "too many requests",
+	ErrorContext: "rate limit exceeded",
+}}
+
+// ErrNoTarget is returned by the API when no rollout targets the device, the device keeps running its image.
+var ErrNoTarget = APIError{InnerError: APIErrorInner{
+	Message:      "no target",
+	ErrorContext: "no rollout targets the device",
+}}
+
+// ErrArtifactTooLarge is returned by the API when an artifact exceeds the maximum size of the server.
+var ErrArtifactTooLarge = APIError{InnerError: APIErrorInner{
+	Message:      "artifact is too large",
+	ErrorContext: "artifacts exceed the limits of the server",
+}}
+
+// ErrQuotaExceeded is returned by the API when the estimated resource usage of the delta creation exceeds the quotas of the server.
+var ErrQuotaExceeded = APIError{InnerError: APIErrorInner{
+	Message:      "quota exceeded",
+	ErrorContext: "the estimated resource usage exceeds the quotas of the server",
+}}
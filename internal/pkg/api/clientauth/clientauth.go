@@ -0,0 +1,74 @@
+// Package clientauth authenticates the clients of the APIs, it is shared by the HTTP and the gRPC API.
+package clientauth
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/unbasical/doras/internal/pkg/auth"
+	error2 "github.com/unbasical/doras/internal/pkg/error"
+	"github.com/unbasical/doras/internal/pkg/tokenservice"
+	"github.com/unbasical/doras/internal/pkg/utils/tlsutils"
+)
+
+// Authenticator authenticates clients with the credentials of the Authorization header or with client certificates.
+type Authenticator struct {
+	// Identities map the identities of verified client certificates to registry credentials.
+	// Requests without Authorization header are authenticated with the client certificate if it is set.
+	Identities []auth.ClientCertificateIdentity
+	// Tokens makes the authenticator accept the tokens of the token service as Bearer tokens.
+	// Other Bearer tokens are passed on to the registries.
+	Tokens tokenservice.Service
+}
+
+// Authenticate returns the client auth of the Authorization header (Bearer or Basic) or of the verified client certificate of the connection.
+func (a Authenticator) Authenticate(authHeader string, state *tls.ConnectionState) (auth.RegistryAuth, error) {
+	isBasicAuth := strings.HasPrefix(authHeader, "Basic ")
+	isBearerToken := strings.HasPrefix(authHeader, "Bearer ")
+	// Credentials in the header take precedence over client certificates.
+	if cert := tlsutils.VerifiedClientCertificate(state); authHeader == "" && cert != nil && len(a.Identities) > 0 {
+		return auth.NewClientAuthFromCertificate(cert, a.Identities)
+	}
+	if authHeader == "" {
+		return nil, fmt.Errorf("missing Authorization header")
+	}
+	if isBearerToken {
+		return a.bearerAuth(strings.TrimPrefix(authHeader, "Bearer "))
+	}
+	if isBasicAuth {
+		// Trim the "Basic " prefix
+		encodedCredentials := strings.TrimPrefix(authHeader, "Basic ")
+		// Decode the base64-encoded credentials
+		decodedBytes, err := base64.StdEncoding.DecodeString(encodedCredentials)
+		if err != nil {
+			return nil, errors.New("invalid base64 encoding in authorization header")
+		}
+		decodedCredentials := string(decodedBytes)
+
+		// Split into username and password
+		parts := strings.SplitN(decodedCredentials, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid authorization header: missing username or password")
+		}
+		return auth.NewClientAuthFromUsernamePassword(parts[0], parts[1]), nil
+	}
+	return nil, fmt.Errorf("invalid Authorization header")
+}
+
+// bearerAuth returns the client auth of tokens of the token service, other tokens are registry tokens.
+func (a Authenticator) bearerAuth(token string) (auth.RegistryAuth, error) {
+	if a.Tokens == nil {
+		return auth.NewClientAuthFromToken(token), nil
+	}
+	clientAuth, err := a.Tokens.Authenticate(token)
+	if errors.Is(err, tokenservice.ErrNotIssued) {
+		return auth.NewClientAuthFromToken(token), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", error2.ErrUnauthorized, err)
+	}
+	return clientAuth, nil
+}
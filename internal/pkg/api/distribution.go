@@ -0,0 +1,170 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/storage"
+	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry"
+)
+
+// distributionError is an error as specified by the OCI distribution spec.
+type distributionError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// buildDistributionAPI sets up a read-only subset of the OCI distribution API at `/v2/`.
+// It serves manifests, blobs and referrers of the repositories of the storage.LayoutProvider.
+func buildDistributionAPI(r *gin.Engine, repositories storage.LayoutProvider) *gin.Engine {
+	log.Debug("Building distribution API")
+	handler := func(c *gin.Context) {
+		c.Header("Docker-Distribution-API-Version", "registry/2.0")
+		path := strings.Trim(c.Param("path"), "/")
+		if path == "" {
+			c.JSON(http.StatusOK, gin.H{})
+			return
+		}
+		for _, kind := range []string{"manifests", "blobs", "referrers"} {
+			name, reference, found := strings.Cut(path, "/"+kind+"/")
+			if !found || name == "" || reference == "" {
+				continue
+			}
+			// The registry part of the repository name is ignored by the storage.
+			src, err := repositories.ExistingRepository(c.Request.Host + "/" + name)
+			if err != nil {
+				handleDistributionError(c, http.StatusNotFound, "NAME_UNKNOWN", err)
+				return
+			}
+			switch kind {
+			case "manifests":
+				serveManifest(c, src, reference)
+			case "blobs":
+				serveBlob(c, src, reference)
+			case "referrers":
+				serveReferrers(c, src, reference)
+			}
+			return
+		}
+		handleDistributionError(c, http.StatusNotFound, "UNSUPPORTED", fmt.Errorf("unsupported endpoint %q: %w", path, errdef.ErrNotFound))
+	}
+	r.GET("/v2/*path", handler)
+	r.HEAD("/v2/*path", handler)
+	return r
+}
+
+func serveManifest(c *gin.Context, src oras.ReadOnlyGraphTarget, reference string) {
+	d, err := src.Resolve(c, reference)
+	if err != nil {
+		handleDistributionError(c, http.StatusNotFound, "MANIFEST_UNKNOWN", err)
+		return
+	}
+	serveContent(c, src, d)
+}
+
+func serveBlob(c *gin.Context, src oras.ReadOnlyGraphTarget, reference string) {
+	dgst, err := digest.Parse(reference)
+	if err != nil {
+		handleDistributionError(c, http.StatusBadRequest, "DIGEST_INVALID", err)
+		return
+	}
+	d, err := src.Resolve(c, dgst.String())
+	if err != nil {
+		handleDistributionError(c, http.StatusNotFound, "BLOB_UNKNOWN", err)
+		return
+	}
+	d.MediaType = "application/octet-stream"
+	serveContent(c, src, d)
+}
+
+func serveReferrers(c *gin.Context, src oras.ReadOnlyGraphTarget, reference string) {
+	dgst, err := digest.Parse(reference)
+	if err != nil {
+		handleDistributionError(c, http.StatusBadRequest, "DIGEST_INVALID", err)
+		return
+	}
+	artifactType := c.Query("artifactType")
+	var referrers []v1.Descriptor
+	// The subject does not have to exist, in which case there are no referrers.
+	subject, err := src.Resolve(c, dgst.String())
+	if err != nil && !errors.Is(err, errdef.ErrNotFound) {
+		handleDistributionError(c, http.StatusInternalServerError, "UNKNOWN", err)
+		return
+	}
+	if err == nil {
+		referrers, err = registry.Referrers(c, src, subject, artifactType)
+		// Blobs cannot have referrers.
+		if err != nil && !errors.Is(err, errdef.ErrUnsupported) {
+			handleDistributionError(c, http.StatusInternalServerError, "UNKNOWN", err)
+			return
+		}
+	}
+	if referrers == nil {
+		referrers = []v1.Descriptor{}
+	}
+	index := v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: referrers,
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		handleDistributionError(c, http.StatusInternalServerError, "UNKNOWN", err)
+		return
+	}
+	if artifactType != "" {
+		c.Header("OCI-Filters-Applied", "artifactType")
+	}
+	c.Data(http.StatusOK, v1.MediaTypeImageIndex, data)
+}
+
+// serveContent writes the content of the descriptor to the response.
+// Only the headers are written for HEAD requests.
+func serveContent(c *gin.Context, src oras.ReadOnlyTarget, d v1.Descriptor) {
+	setHeaders := func() {
+		c.Header("Content-Type", d.MediaType)
+		c.Header("Content-Length", strconv.FormatInt(d.Size, 10))
+		c.Header("Docker-Content-Digest", d.Digest.String())
+	}
+	if c.Request.Method == http.MethodHead {
+		setHeaders()
+		c.Status(http.StatusOK)
+		return
+	}
+	rc, err := src.Fetch(c, d)
+	if err != nil {
+		handleDistributionError(c, http.StatusNotFound, "BLOB_UNKNOWN", err)
+		return
+	}
+	defer funcutils.PanicOrLogOnErr(rc.Close, false, "failed to close reader")
+	setHeaders()
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, rc); err != nil {
+		log.WithError(err).Errorf("failed to serve %s", d.Digest)
+	}
+}
+
+func handleDistributionError(c *gin.Context, status int, code string, err error) {
+	if !errors.Is(err, errdef.ErrNotFound) && status == http.StatusNotFound {
+		status = http.StatusInternalServerError
+		code = "UNKNOWN"
+	}
+	log.WithError(err).Debugf("distribution API error %s", code)
+	c.Header("Content-Type", "application/json")
+	c.AbortWithStatusJSON(status, gin.H{
+		"errors": []distributionError{{Code: code, Message: fmt.Sprint(err)}},
+	})
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/unbasical/doras/internal/pkg/storage"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func TestDistributionAPI(t *testing.T) {
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	layouts := storage.NewLayoutProvider(t.TempDir())
+	server := httptest.NewServer(buildDistributionAPI(gin.New(), layouts))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// Populate the layout the same way the registry delegate does.
+	store, err := layouts.Repository("localhost/foo/bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("layer")
+	layer := v1.Descriptor{MediaType: "application/vnd.test.file", Digest: digest.FromBytes(data), Size: int64(len(data))}
+	if err := store.Push(ctx, layer, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	subject, err := oras.PackManifest(ctx, store, oras.PackManifestVersion1_1, "application/vnd.test.artifact", oras.PackManifestOptions{
+		Layers: []v1.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Tag(ctx, subject, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	referrer, err := oras.PackManifest(ctx, store, oras.PackManifestVersion1_1, "application/vnd.test.referrer", oras.PackManifestOptions{
+		Subject: &subject,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := remote.NewRepository(host + "/foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.PlainHTTP = true
+
+	d, err := repo.Resolve(ctx, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Digest != subject.Digest {
+		t.Errorf("expected digest %s, got %s", subject.Digest, d.Digest)
+	}
+	rc, err := repo.Blobs().Fetch(ctx, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := content.ReadAll(rc, layer)
+	_ = rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("expected blob %q, got %q", data, got)
+	}
+	referrers, err := registry.Referrers(ctx, repo, subject, "application/vnd.test.referrer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != referrer.Digest {
+		t.Errorf("expected referrer %s, got %v", referrer.Digest, referrers)
+	}
+	if _, err := repo.Resolve(ctx, "missing"); !errors.Is(err, errdef.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for missing tag, got %v", err)
+	}
+	missingRepo, err := remote.NewRepository(host + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	missingRepo.PlainHTTP = true
+	if _, err := missingRepo.Resolve(ctx, "v1"); !errors.Is(err, errdef.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for missing repository, got %v", err)
+	}
+}
+
+func TestDistributionAPI_Head(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	layouts := storage.NewLayoutProvider(t.TempDir())
+	store, err := layouts.Repository("localhost/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("blob")
+	d := v1.Descriptor{MediaType: "application/octet-stream", Digest: digest.FromBytes(data), Size: int64(len(data))}
+	if err := store.Push(context.Background(), d, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	r := buildDistributionAPI(gin.New(), layouts)
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "version check", method: http.MethodGet, path: "/v2/", wantStatus: http.StatusOK, wantBody: "{}"},
+		{name: "head blob", method: http.MethodHead, path: "/v2/foo/blobs/" + d.Digest.String(), wantStatus: http.StatusOK},
+		{name: "get blob", method: http.MethodGet, path: "/v2/foo/blobs/" + d.Digest.String(), wantStatus: http.StatusOK, wantBody: "blob"},
+		{name: "invalid digest", method: http.MethodGet, path: "/v2/foo/blobs/invalid", wantStatus: http.StatusBadRequest},
+		{name: "unsupported endpoint", method: http.MethodGet, path: "/v2/foo/tags/list", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			body, _ := io.ReadAll(w.Body)
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("expected body %q, got %q", tt.wantBody, body)
+			}
+			if tt.method == http.MethodHead && len(body) != 0 {
+				t.Errorf("expected empty body for HEAD, got %q", body)
+			}
+		})
+	}
+}
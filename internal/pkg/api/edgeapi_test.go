@@ -0,0 +1,54 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	apidelegate "github.com/unbasical/doras/internal/pkg/delegates/api"
+)
+
+// recordingEngine records which handler has been called.
+type recordingEngine struct {
+	handled string
+}
+
+func (e *recordingEngine) HandleReadDelta(apidelegate.APIDelegate) {
+	e.handled = "delta"
+}
+
+func (e *recordingEngine) HandleReadDeltas(apidelegate.APIDelegate) {
+	e.handled = "batch"
+}
+
+func (e *recordingEngine) StopWaiting() {}
+
+func (e *recordingEngine) Stop(context.Context) {}
+
+func Test_buildEdgeAPI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		wantHandled string
+	}{
+		{name: "GET", method: http.MethodGet, path: "/api/v1/delta", wantHandled: "delta"},
+		{name: "POST", method: http.MethodPost, path: "/api/v1/delta", wantHandled: "delta"},
+		{name: "batch", method: http.MethodPost, path: "/api/v1/deltas:batch", wantHandled: "batch"},
+		{name: "unknown custom method", method: http.MethodPost, path: "/api/v1/deltas:foo", wantHandled: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &recordingEngine{}
+			r := buildEdgeAPI(gin.New(), engine, AuthConfig{}, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if engine.handled != tt.wantHandled {
+				t.Errorf("expected %q to be handled, got %q (status %d)", tt.wantHandled, engine.handled, w.Code)
+			}
+		})
+	}
+}
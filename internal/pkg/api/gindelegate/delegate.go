@@ -1,68 +1,88 @@
 package gindelegate
 
 import (
-	"encoding/base64"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/unbasical/doras/internal/pkg/api/clientauth"
 	"github.com/unbasical/doras/internal/pkg/auth"
 	apidelegate "github.com/unbasical/doras/internal/pkg/delegates/api"
+	"github.com/unbasical/doras/internal/pkg/tokenservice"
 
 	"github.com/gin-gonic/gin"
 	"github.com/unbasical/doras/internal/pkg/api/apicommon"
 	error2 "github.com/unbasical/doras/internal/pkg/error"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
 	"github.com/unbasical/doras/pkg/constants"
 )
 
 // ginDorasContext implements the apidelegate.APIDelegate interface for gin HTTP servers.
 type ginDorasContext struct {
-	c *gin.Context
+	c     *gin.Context
+	authn clientauth.Authenticator
+	// body is the decoded body of POST requests.
+	body *apicommon.ReadDeltaRequest
+}
+
+// Option configures the delegate.
+type Option func(*ginDorasContext)
+
+// WithClientCertificateIdentities makes the delegate authenticate requests without Authorization header
+// with the registry credentials of the identity of the verified client certificate.
+func WithClientCertificateIdentities(identities []auth.ClientCertificateIdentity) Option {
+	return func(g *ginDorasContext) {
+		g.authn.Identities = identities
+	}
+}
+
+// WithTokenService makes the delegate accept the tokens of the token service as Bearer tokens.
+// Other Bearer tokens are passed on to the registries.
+func WithTokenService(tokens tokenservice.Service) Option {
+	return func(g *ginDorasContext) {
+		g.authn.Tokens = tokens
+	}
 }
 
 func (g *ginDorasContext) HandleNoNewVersion() {
+	if g.streamStarted() {
+		g.event("error", apicommon.ErrImagesIdentical)
+		return
+	}
 	g.c.Status(http.StatusNoContent)
 }
 
 func (g *ginDorasContext) ExtractClientAuth() (auth.RegistryAuth, error) {
-	// Extract the Bearer token from the Auth Header.
-	authHeader := g.c.GetHeader("Authorization")
-	isBasicAuth := strings.HasPrefix(authHeader, "Basic ")
-	isBearerToken := strings.HasPrefix(authHeader, "Bearer ")
-	if authHeader == "" {
-		return nil, fmt.Errorf("missing Authorization header")
-	}
-	if isBearerToken {
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		return auth.NewClientAuthFromToken(token), nil
-	}
-	if isBasicAuth {
-		// Trim the "Basic " prefix
-		encodedCredentials := strings.TrimPrefix(authHeader, "Basic ")
-		// Decode the base64-encoded credentials
-		decodedBytes, err := base64.StdEncoding.DecodeString(encodedCredentials)
-		if err != nil {
-			return nil, errors.New("invalid base64 encoding in authorization header")
-		}
-		decodedCredentials := string(decodedBytes)
-
-		// Split into username and password
-		parts := strings.SplitN(decodedCredentials, ":", 2)
-		if len(parts) != 2 {
-			return nil, errors.New("invalid authorization header: missing username or password")
-		}
-		return auth.NewClientAuthFromUsernamePassword(parts[0], parts[1]), nil
-	}
-	return nil, fmt.Errorf("invalid Authorization header")
+	return g.authn.Authenticate(g.c.GetHeader("Authorization"), g.c.Request.TLS)
 }
 
 // NewDelegate constructs an apidelegate.APIDelegate for a given gin.Context.
-func NewDelegate(c *gin.Context) apidelegate.APIDelegate {
-	return &ginDorasContext{c: c}
+func NewDelegate(c *gin.Context, opts ...Option) apidelegate.APIDelegate {
+	g := &ginDorasContext{c: c}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
 }
 
 func (g *ginDorasContext) HandleError(err error, msg string) {
+	statusCode := statusCode(err)
+	// The status has been sent with the first event of the stream.
+	if g.streamStarted() {
+		g.event("error", newAPIError(statusCode, err, msg))
+		return
+	}
+	RespondWithError(g.c, statusCode, err, msg)
+}
+
+// statusCode returns the HTTP status code of errors of the error package.
+func statusCode(err error) int {
 	var statusCode int
 	if errors.Is(err, error2.ErrAliasNotFound) {
 		statusCode = http.StatusNotFound
@@ -103,16 +123,26 @@ func (g *ginDorasContext) HandleError(err error, msg string) {
 	if errors.Is(err, error2.ErrUnauthorized) {
 		statusCode = http.StatusUnauthorized
 	}
+	if errors.Is(err, error2.ErrForbidden) {
+		statusCode = http.StatusForbidden
+	}
 	if errors.Is(err, error2.ErrFailedToResolve) {
 		statusCode = http.StatusNotFound
 	}
 	if errors.Is(err, error2.ErrIncompatibleArtifacts) {
 		statusCode = http.StatusBadRequest
 	}
-	RespondWithError(g.c, statusCode, err, msg)
+	if errors.Is(err, error2.ErrArtifactTooLarge) || errors.Is(err, error2.ErrQuotaExceeded) {
+		statusCode = http.StatusRequestEntityTooLarge
+	}
+	return statusCode
 }
 
+// ExtractParams extracts the parameters from the query of GET requests and from the JSON body of POST requests.
 func (g *ginDorasContext) ExtractParams() (fromImage, toImage string, acceptedAlgorithms []string, err error) {
+	if g.c.Request.Method == http.MethodPost {
+		return g.extractBody()
+	}
 	// The from image is mandatory, if it does not exist we cannot continue.
 	fromImage = g.c.Query(constants.QueryKeyFromDigest)
 	if fromImage == "" {
@@ -137,26 +167,166 @@ func (g *ginDorasContext) ExtractParams() (fromImage, toImage string, acceptedAl
 	}
 	acceptedAlgorithms = g.c.QueryArray(constants.QueryKeyAcceptedAlgorithm)
 	if len(acceptedAlgorithms) == 0 {
-		acceptedAlgorithms = constants.DefaultAlgorithms()
+		acceptedAlgorithms = registry.DefaultAlgorithms()
 	}
 	return fromImage, toImage, acceptedAlgorithms, nil
 }
 
+// ExtractWait returns the wait parameter, requests that stream events wait for apicommon.MaxWait by default.
+// The duration is capped at apicommon.MaxWait.
+func (g *ginDorasContext) ExtractWait() (time.Duration, error) {
+	value := g.c.Query(constants.QueryKeyWait)
+	if value == "" {
+		if g.streaming() {
+			return apicommon.MaxWait, nil
+		}
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait < 0 {
+		return 0, fmt.Errorf("%w: invalid wait duration %q", error2.ErrBadRequest, value)
+	}
+	return min(wait, apicommon.MaxWait), nil
+}
+
+func (g *ginDorasContext) ClientIP() string {
+	return g.c.ClientIP()
+}
+
+func (g *ginDorasContext) RequestContext() (context.Context, error) {
+	return g.c.Request.Context(), nil
+}
+
+// extractBody extracts the parameters from the body of POST requests (apicommon.ReadDeltaRequest).
+// The body is decoded once, requests that wait for deltas extract the parameters repeatedly.
+func (g *ginDorasContext) extractBody() (fromImage, toImage string, acceptedAlgorithms []string, err error) {
+	if g.body == nil {
+		var body apicommon.ReadDeltaRequest
+		if err := json.NewDecoder(g.c.Request.Body).Decode(&body); err != nil {
+			return "", "", []string{}, fmt.Errorf("%w: %w", error2.ErrUnmarshal, err)
+		}
+		g.body = &body
+	}
+	if g.body.From == "" || g.body.To == "" {
+		return "", "", []string{}, error2.ErrMissingRequestBody
+	}
+	acceptedAlgorithms = g.body.AcceptedAlgorithms
+	if len(acceptedAlgorithms) == 0 {
+		acceptedAlgorithms = registry.DefaultAlgorithms()
+	}
+	return g.body.From, g.body.To, acceptedAlgorithms, nil
+}
+
+// ExtractBatch extracts the requests of a batch from the JSON body (apicommon.BatchReadDeltaRequest).
+// Batches have to contain between one and apicommon.MaxBatchSize requests.
+func (g *ginDorasContext) ExtractBatch() ([]apicommon.ReadDeltaRequest, error) {
+	var batch apicommon.BatchReadDeltaRequest
+	if err := json.NewDecoder(g.c.Request.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("%w: %w", error2.ErrUnmarshal, err)
+	}
+	if len(batch.Requests) == 0 || len(batch.Requests) > apicommon.MaxBatchSize {
+		return nil, fmt.Errorf("batches have to contain between 1 and %d requests, got %d", apicommon.MaxBatchSize, len(batch.Requests))
+	}
+	for i := range batch.Requests {
+		if len(batch.Requests[i].AcceptedAlgorithms) == 0 {
+			batch.Requests[i].AcceptedAlgorithms = registry.DefaultAlgorithms()
+		}
+	}
+	return batch.Requests, nil
+}
+
+// HandleBatch responds with the status of each request of the batch.
+func (g *ginDorasContext) HandleBatch(results []apidelegate.BatchResult) {
+	responses := make([]apicommon.BatchItemResponse, len(results))
+	for i, result := range results {
+		switch {
+		case result.Err != nil:
+			status := statusCode(result.Err)
+			apiErr := newAPIError(status, result.Err, result.ErrMsg)
+			responses[i] = apicommon.BatchItemResponse{Status: status, Error: &apiErr.InnerError}
+		case result.Delta != nil:
+			responses[i] = apicommon.BatchItemResponse{Status: http.StatusOK, Delta: result.Delta}
+		case result.NoNewVersion:
+			responses[i] = apicommon.BatchItemResponse{Status: http.StatusNoContent}
+		default:
+			responses[i] = apicommon.BatchItemResponse{
+				Status:              http.StatusAccepted,
+				EstimatedCompletion: acceptedResponse(result.RetryAfter).EstimatedCompletion,
+			}
+		}
+	}
+	g.c.JSON(http.StatusOK, apicommon.BatchReadDeltaResponse{Responses: responses})
+}
+
 func (g *ginDorasContext) HandleSuccess(response any) {
+	if g.streaming() {
+		g.event("delta", response)
+		return
+	}
 	g.c.JSON(http.StatusOK, response)
 }
 
-func (g *ginDorasContext) HandleAccepted() {
-	g.c.Status(http.StatusAccepted)
+// HandlePending sends a pending event to clients that stream events, other clients are not notified.
+func (g *ginDorasContext) HandlePending(retryAfter time.Duration) {
+	if g.streaming() {
+		g.event("pending", acceptedResponse(retryAfter))
+	}
+}
+
+func (g *ginDorasContext) HandleAccepted(retryAfter time.Duration) {
+	if g.streaming() {
+		g.event("accepted", acceptedResponse(retryAfter))
+		return
+	}
+	if retryAfter <= 0 {
+		g.c.Status(http.StatusAccepted)
+		return
+	}
+	g.c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	g.c.JSON(http.StatusAccepted, acceptedResponse(retryAfter))
+}
+
+// acceptedResponse returns the estimated completion of a delta that is created within retryAfter.
+// The estimated completion is empty if there is no estimate.
+func acceptedResponse(retryAfter time.Duration) apicommon.AcceptedResponse {
+	if retryAfter <= 0 {
+		return apicommon.AcceptedResponse{}
+	}
+	return apicommon.AcceptedResponse{
+		EstimatedCompletion: time.Now().Add(retryAfter).UTC().Format(time.RFC3339),
+	}
+}
+
+// streaming checks whether the client requested a stream of server-sent events.
+func (g *ginDorasContext) streaming() bool {
+	return strings.Contains(g.c.GetHeader("Accept"), "text/event-stream")
+}
+
+// streamStarted checks whether events have been sent to the client.
+func (g *ginDorasContext) streamStarted() bool {
+	return g.streaming() && g.c.Writer.Written()
+}
+
+// event sends a server-sent event and flushes it to the client.
+func (g *ginDorasContext) event(name string, data any) {
+	if !g.c.Writer.Written() {
+		g.c.Header("Cache-Control", "no-cache")
+	}
+	g.c.SSEvent(name, data)
+	g.c.Writer.Flush()
 }
 
 // RespondWithError sends an error reply to the client.
 func RespondWithError(c *gin.Context, statusCode int, err error, errorContext string) {
-	c.JSON(statusCode, apicommon.APIError{
+	c.JSON(statusCode, newAPIError(statusCode, err, errorContext))
+}
+
+func newAPIError(statusCode int, err error, errorContext string) apicommon.APIError {
+	return apicommon.APIError{
 		InnerError: apicommon.APIErrorInner{
 			Code:         statusCode,
 			Message:      err.Error(),
 			ErrorContext: errorContext,
 		},
-	})
+	}
 }
@@ -0,0 +1,374 @@
+package gindelegate
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/auth"
+	apidelegate "github.com/unbasical/doras/internal/pkg/delegates/api"
+	error2 "github.com/unbasical/doras/internal/pkg/error"
+	"github.com/unbasical/doras/internal/pkg/tokenservice"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
+	auth2 "oras.land/oras-go/v2/registry/remote/auth"
+)
+
+func Test_ginDorasContext_ExtractClientAuth(t *testing.T) {
+	const registry = "registry.example.org"
+	identities := []auth.ClientCertificateIdentity{
+		{Pattern: "device-*.fleet.example.org", Credentials: map[string]auth2.Credential{registry: {AccessToken: "fleet"}}},
+		{Pattern: "spiffe://example.org/*", Credentials: map[string]auth2.Credential{registry: {Username: "spiffe", Password: "secret"}}},
+		{Pattern: "*", Credentials: map[string]auth2.Credential{registry: {AccessToken: "fallback"}}},
+	}
+	spiffeID, _ := url.Parse("spiffe://example.org/device")
+	tests := []struct {
+		name       string
+		header     string
+		cert       *x509.Certificate
+		identities []auth.ClientCertificateIdentity
+		want       auth2.Credential
+		wantErr    error
+	}{
+		{
+			name:       "common name",
+			cert:       &x509.Certificate{Subject: pkix.Name{CommonName: "device-1.fleet.example.org"}},
+			identities: identities,
+			want:       auth2.Credential{AccessToken: "fleet"},
+		},
+		{
+			name:       "uri san",
+			cert:       &x509.Certificate{Subject: pkix.Name{CommonName: "device"}, URIs: []*url.URL{spiffeID}},
+			identities: identities[1:2],
+			want:       auth2.Credential{Username: "spiffe", Password: "secret"},
+		},
+		{
+			name:       "first match wins",
+			cert:       &x509.Certificate{DNSNames: []string{"device-2.fleet.example.org"}},
+			identities: identities,
+			want:       auth2.Credential{AccessToken: "fleet"},
+		},
+		{
+			name:       "header takes precedence",
+			header:     "Bearer token",
+			cert:       &x509.Certificate{Subject: pkix.Name{CommonName: "device-1.fleet.example.org"}},
+			identities: identities,
+			want:       auth2.Credential{AccessToken: "token"},
+		},
+		{
+			name:       "unknown identity",
+			cert:       &x509.Certificate{Subject: pkix.Name{CommonName: "laptop.example.org"}},
+			identities: identities[:2],
+			wantErr:    auth.ErrUnknownClientCertificate,
+		},
+		{
+			name:    "certificates are not mapped",
+			cert:    &x509.Certificate{Subject: pkix.Name{CommonName: "device-1.fleet.example.org"}},
+			wantErr: errors.New("missing Authorization header"),
+		},
+		{
+			name:       "unverified connection",
+			identities: identities,
+			wantErr:    errors.New("missing Authorization header"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/api/v1/delta", nil)
+			if tt.header != "" {
+				c.Request.Header.Set("Authorization", tt.header)
+			}
+			if tt.cert != nil {
+				c.Request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert}}}
+			}
+			clientAuth, err := NewDelegate(c, WithClientCertificateIdentities(tt.identities)).ExtractClientAuth()
+			if tt.wantErr != nil {
+				if err == nil || (!errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error()) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			credFunc, err := clientAuth.CredentialFunc(registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := credFunc(context.Background(), registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_ginDorasContext_ExtractClientAuth_TokenService(t *testing.T) {
+	const registry = "registry.example.org"
+	hash := sha256.Sum256([]byte("device-key"))
+	serverCredentials := auth2.StaticCredential(registry, auth2.Credential{AccessToken: "server"})
+	tokens, err := tokenservice.New(tokenservice.Config{
+		Secret:  []byte(strings.Repeat("s", 32)),
+		TTL:     time.Minute,
+		Devices: []tokenservice.Device{{ID: "device-1", KeySHA256: hex.EncodeToString(hash[:]), Repositories: []string{registry + "/apps/*"}}},
+	}, serverCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := tokens.Issue(context.Background(), auth.GenerateBasicAuth("device-1", "device-key"), []string{registry + "/apps/foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		token     string
+		want      auth2.Credential
+		wantScope string
+		wantErr   error
+	}{
+		{name: "issued token", token: issued.Token, want: auth2.Credential{AccessToken: "server"}, wantScope: registry + "/apps/foo"},
+		{name: "registry token", token: "registry-token", want: auth2.Credential{AccessToken: "registry-token"}},
+		{name: "tampered token", token: issued.Token + "x", wantErr: error2.ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/api/v1/delta", nil)
+			c.Request.Header.Set("Authorization", "Bearer "+tt.token)
+			clientAuth, err := NewDelegate(c, WithTokenService(tokens)).ExtractClientAuth()
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			scoped, ok := clientAuth.(auth.ScopedRegistryAuth)
+			if ok != (tt.wantScope != "") {
+				t.Fatalf("expected scoped client auth: %v, got %v", tt.wantScope != "", ok)
+			}
+			if ok && !scoped.Allows(tt.wantScope) {
+				t.Errorf("expected %q to be allowed", tt.wantScope)
+			}
+			credFunc, err := clientAuth.CredentialFunc(registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := credFunc(context.Background(), registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_ginDorasContext_HandleAccepted(t *testing.T) {
+	tests := []struct {
+		name           string
+		retryAfter     time.Duration
+		wantRetryAfter string
+	}{
+		{name: "no estimate", retryAfter: 0, wantRetryAfter: ""},
+		{name: "rounds up", retryAfter: 1500 * time.Millisecond, wantRetryAfter: "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", "/api/v1/delta", nil)
+			NewDelegate(c).HandleAccepted(tt.retryAfter)
+			if got := c.Writer.Status(); got != http.StatusAccepted {
+				t.Fatalf("expected status %d, got %d", http.StatusAccepted, got)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("expected Retry-After %q, got %q", tt.wantRetryAfter, got)
+			}
+			if tt.retryAfter <= 0 {
+				return
+			}
+			var res apicommon.AcceptedResponse
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			completion, err := time.Parse(time.RFC3339, res.EstimatedCompletion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if until := time.Until(completion); until > tt.retryAfter+time.Second {
+				t.Errorf("expected completion within %v, got %v", tt.retryAfter, until)
+			}
+		})
+	}
+}
+
+func Test_ginDorasContext_ExtractWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		accept  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "no wait", want: 0},
+		{name: "wait", query: "?wait=60s", want: time.Minute},
+		{name: "capped", query: "?wait=1h", want: apicommon.MaxWait},
+		{name: "stream waits by default", accept: "text/event-stream", want: apicommon.MaxWait},
+		{name: "invalid", query: "?wait=soon", wantErr: true},
+		{name: "negative", query: "?wait=-1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/api/v1/delta"+tt.query, nil)
+			c.Request.Header.Set("Accept", tt.accept)
+			got, err := NewDelegate(c).ExtractWait()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExtractWait() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_ginDorasContext_stream(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/api/v1/delta", nil)
+	c.Request.Header.Set("Accept", "text/event-stream")
+	delegate := NewDelegate(c)
+	delegate.HandlePending(time.Minute)
+	delegate.HandleSuccess(apicommon.ReadDeltaResponse{TargetImage: "registry.example.org/foo:v2", DeltaImage: "registry.example.org/foo:delta"})
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/event-stream") {
+		t.Errorf("expected an event stream, got %q", got)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"event:pending\n", "event:delta\n", `"delta_image":"registry.example.org/foo:delta"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the stream %q", want, body)
+		}
+	}
+	// Errors are sent as events once the stream has started.
+	delegate.HandleError(error2.ErrInternal, "")
+	if !strings.Contains(w.Body.String(), "event:error\n") {
+		t.Errorf("expected an error event in the stream %q", w.Body.String())
+	}
+}
+
+func Test_ginDorasContext_ExtractParams_Body(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantTo   string
+		wantAlgs []string
+		wantErr  bool
+	}{
+		{name: "body", body: `{"from":"registry.example.org/foo@sha256:abc","to":"registry.example.org/foo:v2","accepted_algorithms":["bsdiff"]}`, wantTo: "registry.example.org/foo:v2", wantAlgs: []string{"bsdiff"}},
+		{name: "default algorithms", body: `{"from":"registry.example.org/foo@sha256:abc","to":"registry.example.org/foo:v2"}`, wantTo: "registry.example.org/foo:v2", wantAlgs: registry.DefaultAlgorithms()},
+		{name: "missing image", body: `{"from":"registry.example.org/foo@sha256:abc"}`, wantErr: true},
+		{name: "invalid json", body: `{`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/delta", strings.NewReader(tt.body))
+			delegate := NewDelegate(c)
+			// The body is read once, the parameters are extracted again by requests that wait for deltas.
+			for range 2 {
+				_, to, algs, err := delegate.ExtractParams()
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("ExtractParams() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if to != tt.wantTo || !slices.Equal(algs, tt.wantAlgs) {
+					t.Errorf("expected %q %v, got %q %v", tt.wantTo, tt.wantAlgs, to, algs)
+				}
+			}
+		})
+	}
+}
+
+func Test_ginDorasContext_ExtractBatch(t *testing.T) {
+	tooLarge := apicommon.BatchReadDeltaRequest{Requests: make([]apicommon.ReadDeltaRequest, apicommon.MaxBatchSize+1)}
+	tooLargeBody, _ := json.Marshal(tooLarge)
+	tests := []struct {
+		name    string
+		body    string
+		want    int
+		wantErr bool
+	}{
+		{name: "batch", body: `{"requests":[{"from":"a","to":"b"},{"from":"c","to":"d","accepted_algorithms":["bsdiff"]}]}`, want: 2},
+		{name: "empty", body: `{"requests":[]}`, wantErr: true},
+		{name: "too large", body: string(tooLargeBody), wantErr: true},
+		{name: "invalid json", body: `[`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/deltas:batch", strings.NewReader(tt.body))
+			requests, err := NewDelegate(c).ExtractBatch()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExtractBatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(requests) != tt.want {
+				t.Fatalf("expected %d requests, got %d", tt.want, len(requests))
+			}
+			for _, r := range requests {
+				if len(r.AcceptedAlgorithms) == 0 {
+					t.Errorf("expected accepted algorithms for %+v", r)
+				}
+			}
+		})
+	}
+}
+
+func Test_ginDorasContext_HandleBatch(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/deltas:batch", nil)
+	NewDelegate(c).HandleBatch([]apidelegate.BatchResult{
+		{Delta: &apicommon.ReadDeltaResponse{DeltaImage: "registry.example.org/foo:delta"}},
+		{Accepted: true, RetryAfter: time.Minute},
+		{NoNewVersion: true},
+		{Err: error2.ErrForbidden, ErrMsg: "repository is not allowed"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var res apicommon.BatchReadDeltaResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	var statuses []int
+	for _, r := range res.Responses {
+		statuses = append(statuses, r.Status)
+	}
+	if want := []int{http.StatusOK, http.StatusAccepted, http.StatusNoContent, http.StatusForbidden}; !slices.Equal(statuses, want) {
+		t.Fatalf("expected statuses %v, got %v", want, statuses)
+	}
+	if res.Responses[0].Delta == nil || res.Responses[1].EstimatedCompletion == "" || res.Responses[3].Error == nil {
+		t.Errorf("unexpected responses %+v", res.Responses)
+	}
+}
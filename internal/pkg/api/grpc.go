@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/api/clientauth"
+	"github.com/unbasical/doras/internal/pkg/api/grpcdelegate"
+	"github.com/unbasical/doras/internal/pkg/core/dorasengine"
+	"github.com/unbasical/doras/internal/pkg/core/metrics"
+	error2 "github.com/unbasical/doras/internal/pkg/error"
+	"github.com/unbasical/doras/internal/pkg/ratelimit"
+	dorasv1 "github.com/unbasical/doras/pkg/api/doras/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// deltaServer serves the delta service of the gRPC API, the calls are handled by the engine like the requests of the HTTP API.
+type deltaServer struct {
+	dorasv1.UnimplementedDeltaServiceServer
+	engine       dorasengine.Engine
+	info         ServerInfo
+	delegateOpts []grpcdelegate.Option
+}
+
+// BuildGRPCServer returns a gRPC server that serves the delta service (api/doras/v1/doras.proto).
+// The server options configure the server, e.g. its transport credentials.
+// If a ratelimit.Limiter is provided, it limits the delta requests of each client.
+func BuildGRPCServer(engine dorasengine.Engine, info ServerInfo, authConfig AuthConfig, limiter ratelimit.Limiter, opts ...grpc.ServerOption) *grpc.Server {
+	log.Debug("Building gRPC API")
+	authn := clientauth.Authenticator{Identities: authConfig.ClientCertificates, Tokens: authConfig.Tokens}
+	if limiter != nil {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, call *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+				if err := allow(ctx, call.FullMethod, limiter, authn); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, call *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := allow(ss.Context(), call.FullMethod, limiter, authn); err != nil {
+					return err
+				}
+				return handler(srv, ss)
+			}),
+		)
+	}
+	s := grpc.NewServer(opts...)
+	dorasv1.RegisterDeltaServiceServer(s, &deltaServer{
+		engine: engine,
+		info:   info,
+		delegateOpts: []grpcdelegate.Option{
+			grpcdelegate.WithClientCertificateIdentities(authConfig.ClientCertificates),
+			grpcdelegate.WithTokenService(authConfig.Tokens),
+		},
+	})
+	return s
+}
+
+// ReadDelta handles the request without waiting for the delta.
+func (s *deltaServer) ReadDelta(ctx context.Context, req *dorasv1.ReadDeltaRequest) (*dorasv1.ReadDeltaResponse, error) {
+	var res *dorasv1.ReadDeltaResponse
+	apiDelegate := grpcdelegate.NewDelegate(ctx, req, 0, func(r *dorasv1.ReadDeltaResponse) error {
+		res = r
+		return nil
+	}, s.delegateOpts...)
+	metrics.DeltaRequestCounter.Inc()
+	s.engine.HandleReadDelta(apiDelegate)
+	if err := apiDelegate.Err(); err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, status.Error(codes.Internal, error2.ErrInternal.Error())
+	}
+	return res, nil
+}
+
+// WatchDelta handles the request and streams pending responses while it waits for the delta for up to apicommon.MaxWait.
+func (s *deltaServer) WatchDelta(req *dorasv1.ReadDeltaRequest, stream grpc.ServerStreamingServer[dorasv1.ReadDeltaResponse]) error {
+	apiDelegate := grpcdelegate.NewDelegate(stream.Context(), req, apicommon.MaxWait, stream.Send, s.delegateOpts...)
+	metrics.DeltaRequestCounter.Inc()
+	s.engine.HandleReadDelta(apiDelegate)
+	return apiDelegate.Err()
+}
+
+func (s *deltaServer) Capabilities(context.Context, *dorasv1.CapabilitiesRequest) (*dorasv1.CapabilitiesResponse, error) {
+	c := capabilitiesResponse(s.info)
+	return &dorasv1.CapabilitiesResponse{
+		Version:            c.Version,
+		Differs:            c.Differs,
+		Compressors:        c.Compressors,
+		DefaultAlgorithms:  c.DefaultAlgorithms,
+		MaxArtifactSize:    c.MaxArtifactSize,
+		MaxWait:            c.MaxWait,
+		AuthRequired:       c.Auth.Required,
+		AuthSchemes:        c.Auth.Schemes,
+		ClientCertificates: c.Auth.ClientCertificates,
+		TokenService:       c.Auth.TokenService,
+	}, nil
+}
+
+// allow rejects delta requests of clients which exceed their rate limit with codes.ResourceExhausted.
+// The status has errdetails.RetryInfo which tells the client when to retry.
+// Clients are identified by rateLimitKey like clients of the HTTP API.
+func allow(ctx context.Context, fullMethod string, limiter ratelimit.Limiter, authn clientauth.Authenticator) error {
+	if fullMethod == dorasv1.DeltaService_Capabilities_FullMethodName {
+		return nil
+	}
+	clientAuth, err := authn.Authenticate(grpcdelegate.AuthorizationHeader(ctx), grpcdelegate.TLSState(ctx))
+	if err != nil {
+		clientAuth = nil
+	}
+	key := rateLimitKey(grpcdelegate.PeerHost(ctx), clientAuth)
+	ok, retryAfter := limiter.Allow(key)
+	if ok {
+		return nil
+	}
+	log.Debugf("client %s exceeded its rate limit", key)
+	metrics.ThrottledRequestsCounter.WithLabelValues(fullMethod).Inc()
+	st := status.New(codes.ResourceExhausted, error2.ErrTooManyRequests.Error())
+	if withDetails, err := st.WithDetails(
+		&errdetails.ErrorInfo{
+			Reason: st.Code().String(),
+			Domain: grpcdelegate.ErrorDomain,
+			Metadata: map[string]string{
+				"message": apicommon.ErrTooManyRequests.InnerError.Message,
+				"context": apicommon.ErrTooManyRequests.InnerError.ErrorContext,
+			},
+		},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)},
+	); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	apidelegate "github.com/unbasical/doras/internal/pkg/delegates/api"
+	error2 "github.com/unbasical/doras/internal/pkg/error"
+	"github.com/unbasical/doras/internal/pkg/ratelimit"
+	dorasv1 "github.com/unbasical/doras/pkg/api/doras/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// scriptedEngine responds to delta requests depending on the requested image.
+type scriptedEngine struct {
+	recordingEngine
+}
+
+func (e *scriptedEngine) HandleReadDelta(apiDelegate apidelegate.APIDelegate) {
+	_, to, _, err := apiDelegate.ExtractParams()
+	if err != nil {
+		apiDelegate.HandleError(err, "")
+		return
+	}
+	if _, err := apiDelegate.ExtractClientAuth(); err != nil {
+		apiDelegate.HandleError(error2.ErrUnauthorized, err.Error())
+		return
+	}
+	wait, _ := apiDelegate.ExtractWait()
+	switch to {
+	case "registry.example/app:ready":
+		apiDelegate.HandleSuccess(apicommon.ReadDeltaResponse{TargetImage: to, DeltaImage: "registry.example/app:delta"})
+	case "registry.example/app:pending":
+		if wait == 0 {
+			apiDelegate.HandleAccepted(time.Minute)
+			return
+		}
+		apiDelegate.HandlePending(time.Minute)
+		apiDelegate.HandlePending(time.Minute)
+		apiDelegate.HandleSuccess(apicommon.ReadDeltaResponse{TargetImage: to, DeltaImage: "registry.example/app:delta"})
+	case "registry.example/app:identical":
+		apiDelegate.HandleNoNewVersion()
+	default:
+		apiDelegate.HandleError(error2.ErrForbidden, "not allowed")
+	}
+}
+
+// newTestGRPCClient serves the gRPC API via an in-memory connection.
+func newTestGRPCClient(t *testing.T, limiter ratelimit.Limiter) dorasv1.DeltaServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := BuildGRPCServer(&scriptedEngine{}, ServerInfo{Version: "test", RequireClientAuth: true, TokenService: true}, AuthConfig{}, limiter)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return dorasv1.NewDeltaServiceClient(conn)
+}
+
+func authorized() context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer token")
+}
+
+func Test_deltaServer_ReadDelta(t *testing.T) {
+	client := newTestGRPCClient(t, nil)
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		to         string
+		wantStatus dorasv1.DeltaStatus
+		wantCode   codes.Code
+	}{
+		{name: "ready", ctx: authorized(), to: "registry.example/app:ready", wantStatus: dorasv1.DeltaStatus_DELTA_STATUS_READY},
+		{name: "pending", ctx: authorized(), to: "registry.example/app:pending", wantStatus: dorasv1.DeltaStatus_DELTA_STATUS_PENDING},
+		{name: "identical", ctx: authorized(), to: "registry.example/app:identical", wantStatus: dorasv1.DeltaStatus_DELTA_STATUS_IDENTICAL},
+		{name: "forbidden", ctx: authorized(), to: "registry.example/app:other", wantCode: codes.PermissionDenied},
+		{name: "missing credentials", ctx: context.Background(), to: "registry.example/app:ready", wantCode: codes.Unauthenticated},
+		{name: "missing image", ctx: authorized(), to: "", wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := client.ReadDelta(tt.ctx, &dorasv1.ReadDeltaRequest{From: "registry.example/app@sha256:0000000000000000000000000000000000000000000000000000000000000000", To: tt.to})
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("expected code %v, got %v (%v)", tt.wantCode, got, err)
+			}
+			if err != nil {
+				return
+			}
+			if res.GetStatus() != tt.wantStatus {
+				t.Errorf("expected status %v, got %v", tt.wantStatus, res.GetStatus())
+			}
+			if tt.wantStatus == dorasv1.DeltaStatus_DELTA_STATUS_READY && res.GetDeltaImage() != "registry.example/app:delta" {
+				t.Errorf("unexpected delta image %q", res.GetDeltaImage())
+			}
+			if tt.wantStatus == dorasv1.DeltaStatus_DELTA_STATUS_PENDING && res.GetEstimatedCompletion() == "" {
+				t.Error("expected an estimated completion")
+			}
+		})
+	}
+}
+
+func Test_deltaServer_ReadDelta_errorDetails(t *testing.T) {
+	client := newTestGRPCClient(t, nil)
+	_, err := client.ReadDelta(authorized(), &dorasv1.ReadDeltaRequest{From: "registry.example/app@sha256:0000000000000000000000000000000000000000000000000000000000000000", To: "registry.example/app:other"})
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			if info.GetMetadata()["message"] != error2.ErrForbidden.Error() || info.GetMetadata()["context"] != "not allowed" {
+				t.Errorf("unexpected error info %v", info)
+			}
+			return
+		}
+	}
+	t.Errorf("expected error info in %v", err)
+}
+
+func Test_deltaServer_WatchDelta(t *testing.T) {
+	client := newTestGRPCClient(t, nil)
+	stream, err := client.WatchDelta(authorized(), &dorasv1.ReadDeltaRequest{From: "registry.example/app@sha256:0000000000000000000000000000000000000000000000000000000000000000", To: "registry.example/app:pending"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []dorasv1.DeltaStatus
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, res.GetStatus())
+	}
+	want := []dorasv1.DeltaStatus{dorasv1.DeltaStatus_DELTA_STATUS_PENDING, dorasv1.DeltaStatus_DELTA_STATUS_PENDING, dorasv1.DeltaStatus_DELTA_STATUS_READY}
+	if len(statuses) != len(want) {
+		t.Fatalf("expected %v, got %v", want, statuses)
+	}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Errorf("expected %v, got %v", want, statuses)
+		}
+	}
+}
+
+func Test_deltaServer_Capabilities(t *testing.T) {
+	client := newTestGRPCClient(t, nil)
+	res, err := client.Capabilities(context.Background(), &dorasv1.CapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.GetVersion() != "test" || !res.GetAuthRequired() || res.GetMaxWait() != int64(apicommon.MaxWait.Seconds()) || len(res.GetDefaultAlgorithms()) == 0 {
+		t.Errorf("unexpected capabilities %v", res)
+	}
+	// Clients discover how to authenticate like clients of the HTTP API.
+	if !slices.Equal(res.GetAuthSchemes(), []string{"Bearer", "Basic"}) || res.GetClientCertificates() || !res.GetTokenService() {
+		t.Errorf("unexpected auth capabilities %v", res)
+	}
+}
+
+func Test_deltaServer_rateLimit(t *testing.T) {
+	client := newTestGRPCClient(t, ratelimit.New(1.0/60, 1))
+	req := &dorasv1.ReadDeltaRequest{From: "registry.example/app@sha256:0000000000000000000000000000000000000000000000000000000000000000", To: "registry.example/app:ready"}
+	if _, err := client.ReadDelta(authorized(), req); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.ReadDelta(authorized(), req)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected the request to be rate limited, got %v", err)
+	}
+	var retryInfo *errdetails.RetryInfo
+	for _, detail := range status.Convert(err).Details() {
+		if d, ok := detail.(*errdetails.RetryInfo); ok {
+			retryInfo = d
+		}
+	}
+	if retryInfo == nil || retryInfo.GetRetryDelay().AsDuration() <= 0 {
+		t.Errorf("expected a retry delay, got %v", retryInfo)
+	}
+	// Registry tokens are chosen by the client, rotating them does not evade the rate limit.
+	rotated := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer rotated-token")
+	if _, err := client.ReadDelta(rotated, req); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected the request with a rotated token to be rate limited, got %v", err)
+	}
+	if _, err := client.Capabilities(authorized(), &dorasv1.CapabilitiesRequest{}); err != nil {
+		t.Errorf("capabilities should not be rate limited: %v", err)
+	}
+}
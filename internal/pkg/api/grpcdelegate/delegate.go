@@ -0,0 +1,237 @@
+package grpcdelegate
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/api/clientauth"
+	"github.com/unbasical/doras/internal/pkg/auth"
+	apidelegate "github.com/unbasical/doras/internal/pkg/delegates/api"
+	error2 "github.com/unbasical/doras/internal/pkg/error"
+	"github.com/unbasical/doras/internal/pkg/tokenservice"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
+	dorasv1 "github.com/unbasical/doras/pkg/api/doras/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorDomain is the domain of the errdetails.ErrorInfo of errors, its metadata contains the message and the context of the error.
+const ErrorDomain = "doras"
+
+// grpcDelegate implements the apidelegate.APIDelegate interface for a single gRPC call.
+// Responses are passed to the send function, errors are recorded and returned by Err.
+type grpcDelegate struct {
+	ctx     context.Context
+	request *dorasv1.ReadDeltaRequest
+	// wait is the duration for which the call waits for the delta, pending responses are only sent if it is set.
+	wait  time.Duration
+	send  func(*dorasv1.ReadDeltaResponse) error
+	authn clientauth.Authenticator
+	err   error
+}
+
+// Option configures the delegate.
+type Option func(*grpcDelegate)
+
+// WithClientCertificateIdentities makes the delegate authenticate calls without authorization metadata
+// with the registry credentials of the identity of the verified client certificate.
+func WithClientCertificateIdentities(identities []auth.ClientCertificateIdentity) Option {
+	return func(g *grpcDelegate) {
+		g.authn.Identities = identities
+	}
+}
+
+// WithTokenService makes the delegate accept the tokens of the token service as Bearer tokens.
+// Other Bearer tokens are passed on to the registries.
+func WithTokenService(tokens tokenservice.Service) Option {
+	return func(g *grpcDelegate) {
+		g.authn.Tokens = tokens
+	}
+}
+
+// Delegate is the apidelegate.APIDelegate of a gRPC call.
+type Delegate interface {
+	apidelegate.APIDelegate
+	// Err returns the status error of the call once it has been handled, nil if the call succeeded.
+	Err() error
+}
+
+// NewDelegate constructs a Delegate for a call with the given context and request.
+// The call waits for the delta for the given duration, responses are passed to send.
+func NewDelegate(ctx context.Context, request *dorasv1.ReadDeltaRequest, wait time.Duration, send func(*dorasv1.ReadDeltaResponse) error, opts ...Option) Delegate {
+	g := &grpcDelegate{ctx: ctx, request: request, wait: wait, send: send}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+func (g *grpcDelegate) Err() error {
+	return g.err
+}
+
+func (g *grpcDelegate) ExtractParams() (fromImage, toImage string, acceptedAlgorithms []string, err error) {
+	if g.request.GetFrom() == "" || g.request.GetTo() == "" {
+		return "", "", []string{}, error2.ErrMissingQueryParam
+	}
+	acceptedAlgorithms = g.request.GetAcceptedAlgorithms()
+	if len(acceptedAlgorithms) == 0 {
+		acceptedAlgorithms = registry.DefaultAlgorithms()
+	}
+	return g.request.GetFrom(), g.request.GetTo(), acceptedAlgorithms, nil
+}
+
+// ExtractClientAuth authenticates the call with the authorization metadata or the client certificate of the connection.
+func (g *grpcDelegate) ExtractClientAuth() (auth.RegistryAuth, error) {
+	return g.authn.Authenticate(AuthorizationHeader(g.ctx), TLSState(g.ctx))
+}
+
+// ExtractBatch is not supported, batches are only served by the HTTP API.
+func (g *grpcDelegate) ExtractBatch() ([]apicommon.ReadDeltaRequest, error) {
+	return nil, error2.ErrNotYetImplemented
+}
+
+func (g *grpcDelegate) ExtractWait() (time.Duration, error) {
+	return g.wait, nil
+}
+
+func (g *grpcDelegate) ClientIP() string {
+	return PeerHost(g.ctx)
+}
+
+func (g *grpcDelegate) RequestContext() (context.Context, error) {
+	return g.ctx, nil
+}
+
+func (g *grpcDelegate) HandleError(err error, msg string) {
+	st := status.New(Code(err), err.Error())
+	if withDetails, detailsErr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   st.Code().String(),
+		Domain:   ErrorDomain,
+		Metadata: map[string]string{"message": err.Error(), "context": msg},
+	}); detailsErr == nil {
+		st = withDetails
+	}
+	g.err = st.Err()
+}
+
+func (g *grpcDelegate) HandleSuccess(response any) {
+	res, ok := response.(apicommon.ReadDeltaResponse)
+	if !ok {
+		g.HandleError(error2.ErrInternal, "")
+		return
+	}
+	g.respond(&dorasv1.ReadDeltaResponse{
+		Status:      dorasv1.DeltaStatus_DELTA_STATUS_READY,
+		TargetImage: res.TargetImage,
+		DeltaImage:  res.DeltaImage,
+	})
+}
+
+func (g *grpcDelegate) HandleAccepted(retryAfter time.Duration) {
+	g.respond(pendingResponse(retryAfter))
+}
+
+// HandlePending streams the status to calls that wait for the delta.
+func (g *grpcDelegate) HandlePending(retryAfter time.Duration) {
+	if g.wait > 0 {
+		g.respond(pendingResponse(retryAfter))
+	}
+}
+
+func (g *grpcDelegate) HandleNoNewVersion() {
+	g.respond(&dorasv1.ReadDeltaResponse{Status: dorasv1.DeltaStatus_DELTA_STATUS_IDENTICAL})
+}
+
+// HandleBatch is not supported, batches are only served by the HTTP API.
+func (g *grpcDelegate) HandleBatch([]apidelegate.BatchResult) {
+	g.HandleError(error2.ErrNotYetImplemented, "batches are not supported by the gRPC API")
+}
+
+// respond sends the response, the call fails if the client cannot receive it.
+func (g *grpcDelegate) respond(res *dorasv1.ReadDeltaResponse) {
+	if err := g.send(res); err != nil {
+		log.WithError(err).Debug("failed to send response")
+		g.err = err
+	}
+}
+
+// pendingResponse returns the response for a delta that is created within retryAfter.
+// The estimated completion is empty if there is no estimate.
+func pendingResponse(retryAfter time.Duration) *dorasv1.ReadDeltaResponse {
+	res := &dorasv1.ReadDeltaResponse{Status: dorasv1.DeltaStatus_DELTA_STATUS_PENDING}
+	if retryAfter > 0 {
+		res.EstimatedCompletion = time.Now().Add(retryAfter).UTC().Format(time.RFC3339)
+	}
+	return res
+}
+
+// AuthorizationHeader returns the authorization metadata of the call, it carries the same credentials as the Authorization header of the HTTP API.
+func AuthorizationHeader(ctx context.Context) string {
+	values := metadata.ValueFromIncomingContext(ctx, "authorization")
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// PeerHost returns the host of the peer of the call without port, empty if the call has no peer.
+func PeerHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// TLSState returns the TLS state of the connection of the call, nil if the connection does not use TLS.
+func TLSState(ctx context.Context) *tls.ConnectionState {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	return &tlsInfo.State
+}
+
+// Code returns the gRPC status code of errors of the error package.
+func Code(err error) codes.Code {
+	switch {
+	case errors.Is(err, error2.ErrAliasNotFound), errors.Is(err, error2.ErrDeltaNotFound),
+		errors.Is(err, error2.ErrArtifactNotFound), errors.Is(err, error2.ErrFailedToResolve):
+		return codes.NotFound
+	case errors.Is(err, error2.ErrUnauthorized):
+		return codes.Unauthenticated
+	case errors.Is(err, error2.ErrForbidden):
+		return codes.PermissionDenied
+	case errors.Is(err, error2.ErrArtifactTooLarge), errors.Is(err, error2.ErrQuotaExceeded), errors.Is(err, error2.ErrTooManyRequests):
+		return codes.ResourceExhausted
+	case errors.Is(err, error2.ErrIncompatibleArtifacts):
+		return codes.FailedPrecondition
+	case errors.Is(err, error2.ErrNotYetImplemented):
+		return codes.Unimplemented
+	case errors.Is(err, error2.ErrArtifactNotProvided), errors.Is(err, error2.ErrMissingRequestBody),
+		errors.Is(err, error2.ErrUnsupportedDiffingAlgorithm), errors.Is(err, error2.ErrUnmarshal),
+		errors.Is(err, error2.ErrBadRequest), errors.Is(err, error2.ErrInvalidOciImage),
+		errors.Is(err, error2.ErrMissingQueryParam):
+		return codes.InvalidArgument
+	default:
+		return codes.Internal
+	}
+}
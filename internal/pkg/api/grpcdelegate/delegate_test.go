@@ -0,0 +1,104 @@
+package grpcdelegate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	error2 "github.com/unbasical/doras/internal/pkg/error"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
+	dorasv1 "github.com/unbasical/doras/pkg/api/doras/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want codes.Code
+	}{
+		{err: error2.ErrDeltaNotFound, want: codes.NotFound},
+		{err: fmt.Errorf("%w: expired token", error2.ErrUnauthorized), want: codes.Unauthenticated},
+		{err: error2.ErrForbidden, want: codes.PermissionDenied},
+		{err: error2.ErrArtifactTooLarge, want: codes.ResourceExhausted},
+		{err: error2.ErrQuotaExceeded, want: codes.ResourceExhausted},
+		{err: error2.ErrIncompatibleArtifacts, want: codes.FailedPrecondition},
+		{err: error2.ErrMissingQueryParam, want: codes.InvalidArgument},
+		{err: error2.ErrNotYetImplemented, want: codes.Unimplemented},
+		{err: error2.ErrInternal, want: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := Code(tt.err); got != tt.want {
+				t.Errorf("Code() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_grpcDelegate_ExtractParams(t *testing.T) {
+	d := NewDelegate(context.Background(), &dorasv1.ReadDeltaRequest{From: "a", To: "b"}, 0, nil)
+	from, to, algorithms, err := d.ExtractParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != "a" || to != "b" || !slices.Equal(algorithms, registry.DefaultAlgorithms()) {
+		t.Errorf("unexpected params %q %q %v", from, to, algorithms)
+	}
+	if _, _, _, err := NewDelegate(context.Background(), &dorasv1.ReadDeltaRequest{From: "a"}, 0, nil).ExtractParams(); err == nil {
+		t.Error("expected an error for a missing image")
+	}
+}
+
+func Test_grpcDelegate_ExtractClientAuth(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer token"))
+	clientAuth, err := NewDelegate(ctx, &dorasv1.ReadDeltaRequest{}, 0, nil).ExtractClientAuth()
+	if err != nil || clientAuth == nil {
+		t.Fatalf("expected client auth, got %v", err)
+	}
+	if _, err := NewDelegate(context.Background(), &dorasv1.ReadDeltaRequest{}, 0, nil).ExtractClientAuth(); err == nil {
+		t.Error("expected an error without authorization metadata")
+	}
+}
+
+func Test_grpcDelegate_HandlePending(t *testing.T) {
+	tests := []struct {
+		name string
+		wait time.Duration
+		want int
+	}{
+		{name: "waiting", wait: time.Minute, want: 1},
+		{name: "not waiting", wait: 0, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []*dorasv1.ReadDeltaResponse
+			d := NewDelegate(context.Background(), &dorasv1.ReadDeltaRequest{}, tt.wait, func(res *dorasv1.ReadDeltaResponse) error {
+				sent = append(sent, res)
+				return nil
+			})
+			d.HandlePending(time.Minute)
+			if len(sent) != tt.want {
+				t.Fatalf("expected %d responses, got %d", tt.want, len(sent))
+			}
+			if tt.want > 0 && (sent[0].GetStatus() != dorasv1.DeltaStatus_DELTA_STATUS_PENDING || sent[0].GetEstimatedCompletion() == "") {
+				t.Errorf("unexpected response %v", sent[0])
+			}
+		})
+	}
+}
+
+func Test_grpcDelegate_HandleError(t *testing.T) {
+	d := NewDelegate(context.Background(), &dorasv1.ReadDeltaRequest{}, 0, nil)
+	if d.Err() != nil {
+		t.Fatal("expected no error before the call has been handled")
+	}
+	d.HandleError(error2.ErrForbidden, "not allowed")
+	st := status.Convert(d.Err())
+	if st.Code() != codes.PermissionDenied || len(st.Details()) != 1 {
+		t.Errorf("unexpected status %v", st)
+	}
+}
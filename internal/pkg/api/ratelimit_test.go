@@ -0,0 +1,118 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/api/gindelegate"
+	"github.com/unbasical/doras/internal/pkg/auth"
+	"github.com/unbasical/doras/internal/pkg/ratelimit"
+	"github.com/unbasical/doras/internal/pkg/tokenservice"
+)
+
+func Test_rateLimit(t *testing.T) {
+	hash := sha256.Sum256([]byte("device-key"))
+	tokens, err := tokenservice.New(tokenservice.Config{
+		Secret:  []byte(strings.Repeat("s", 32)),
+		TTL:     5 * time.Minute,
+		Devices: []tokenservice.Device{{ID: "device-1", KeySHA256: hex.EncodeToString(hash[:]), Repositories: []string{"registry.example.org/apps/*"}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceToken, err := tokens.Issue(context.Background(), auth.GenerateBasicAuth("device-1", "device-key"), []string{"registry.example.org/apps/foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(rateLimit(ratelimit.New(0.5, 1), []gindelegate.Option{gindelegate.WithTokenService(tokens)}, nil))
+	r.GET("/api/v1/delta", func(c *gin.Context) { c.Status(http.StatusAccepted) })
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		authorization  string
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{name: "first request", remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusAccepted},
+		{name: "throttled", remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusTooManyRequests, wantRetryAfter: "2"},
+		{name: "other ip", remoteAddr: "192.0.2.2:1234", wantStatus: http.StatusAccepted},
+		{name: "verified identity instead of ip", remoteAddr: "192.0.2.1:1234", authorization: "Bearer " + deviceToken.Token, wantStatus: http.StatusAccepted},
+		{name: "verified identity throttled from other ip", remoteAddr: "192.0.2.3:1234", authorization: "Bearer " + deviceToken.Token, wantStatus: http.StatusTooManyRequests, wantRetryAfter: "2"},
+		// Identities that are chosen by the client do not evade the rate limit of the ip.
+		{name: "bearer token", remoteAddr: "192.0.2.4:1234", authorization: "Bearer registry-token-1", wantStatus: http.StatusAccepted},
+		{name: "rotated bearer token", remoteAddr: "192.0.2.4:1234", authorization: "Bearer registry-token-2", wantStatus: http.StatusTooManyRequests, wantRetryAfter: "2"},
+		{name: "basic auth", remoteAddr: "192.0.2.4:1234", authorization: auth.GenerateBasicAuth("device-2", "secret"), wantStatus: http.StatusTooManyRequests, wantRetryAfter: "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/delta", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("expected Retry-After %q, got %q", tt.wantRetryAfter, got)
+			}
+		})
+	}
+}
+
+func Test_rateLimit_batch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/v1/delta:batch", rateLimit(ratelimit.New(0.5, 5), nil, batchCost), func(c *gin.Context) {
+		// The handler decodes the body that the rate limit read.
+		var batch apicommon.BatchReadDeltaRequest
+		if err := json.NewDecoder(c.Request.Body).Decode(&batch); err != nil {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		c.JSON(http.StatusOK, len(batch.Requests))
+	})
+	tests := []struct {
+		name       string
+		requests   int
+		wantStatus int
+	}{
+		{name: "batch", requests: 3, wantStatus: http.StatusOK},
+		// Each request of the batch takes a token, two are left.
+		{name: "throttled batch", requests: 3, wantStatus: http.StatusTooManyRequests},
+		{name: "smaller batch", requests: 2, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(apicommon.BatchReadDeltaRequest{Requests: make([]apicommon.ReadDeltaRequest, tt.requests)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/delta:batch", bytes.NewReader(body))
+			req.RemoteAddr = "192.0.2.1:1234"
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if w.Code == http.StatusOK && w.Body.String() != strconv.Itoa(tt.requests) {
+				t.Errorf("expected the handler to decode %d requests, got %s", tt.requests, w.Body.String())
+			}
+		})
+	}
+}
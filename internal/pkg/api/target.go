@@ -0,0 +1,107 @@
+package api
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/api/clientauth"
+	"github.com/unbasical/doras/internal/pkg/api/gindelegate"
+	"github.com/unbasical/doras/internal/pkg/auth"
+	error2 "github.com/unbasical/doras/internal/pkg/error"
+	"github.com/unbasical/doras/internal/pkg/rollout"
+	"github.com/unbasical/doras/internal/pkg/utils/tlsutils"
+	"github.com/unbasical/doras/pkg/constants"
+)
+
+// target returns an endpoint that tells devices which image they should run according to the rollouts.
+// Devices are identified by their device token or by their client certificate (see deviceOf).
+// Requests without credentials are only accepted if the server does not require client auth.
+func target(rollouts rollout.Manager, authn clientauth.Authenticator, requireClientAuth bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		clientAuth, err := authn.Authenticate(authHeader, c.Request.TLS)
+		if err != nil {
+			if requireClientAuth || authHeader != "" {
+				log.WithError(err).Debug("failed to authenticate device")
+				gindelegate.RespondWithError(c, http.StatusUnauthorized, error2.ErrUnauthorized, "")
+				return
+			}
+			clientAuth = nil
+		}
+		device, err := deviceOf(c.Query(constants.QueryKeyDevice), clientAuth, c.Request.TLS, requireClientAuth)
+		if err != nil {
+			log.WithError(err).Debug("failed to identify device")
+			if errors.Is(err, error2.ErrMissingQueryParam) {
+				gindelegate.RespondWithError(c, http.StatusBadRequest, error2.ErrMissingQueryParam, constants.QueryKeyDevice)
+				return
+			}
+			gindelegate.RespondWithError(c, http.StatusForbidden, error2.ErrForbidden, err.Error())
+			return
+		}
+		scoped, isDevice := clientAuth.(auth.ScopedRegistryAuth)
+		t, err := rollouts.Target(c.Request.Context(), device, c.Query(constants.QueryKeyRepository))
+		switch {
+		case errors.Is(err, rollout.ErrNoTarget):
+			gindelegate.RespondWithError(c, http.StatusNotFound, error2.ErrNoTarget, apicommon.ErrNoTarget.InnerError.ErrorContext)
+			return
+		case errors.Is(err, rollout.ErrAmbiguous):
+			gindelegate.RespondWithError(c, http.StatusBadRequest, error2.ErrBadRequest, "rollouts of several repositories target the device, the repository is required")
+			return
+		case err != nil:
+			log.WithError(err).Error("failed to determine target")
+			gindelegate.RespondWithError(c, http.StatusInternalServerError, error2.ErrInternal, "")
+			return
+		}
+		if isDevice && !scoped.Allows(t.Repository) {
+			gindelegate.RespondWithError(c, http.StatusForbidden, error2.ErrForbidden, t.Repository)
+			return
+		}
+		c.JSON(http.StatusOK, apicommon.TargetResponse{
+			Image:   t.Image,
+			Digest:  t.Digest.String(),
+			Rollout: t.Rollout,
+		})
+	}
+}
+
+// deviceOf returns the device of a target request.
+// Devices with a device token are identified by the token, devices with a verified client certificate by the identities of the certificate,
+// the device parameter has to match them. It is only trusted without them if the server does not require client auth,
+// other credentials (e.g. registry tokens) do not identify devices.
+func deviceOf(device string, clientAuth auth.RegistryAuth, state *tls.ConnectionState, requireClientAuth bool) (rollout.Device, error) {
+	if scoped, ok := clientAuth.(auth.ScopedRegistryAuth); ok {
+		if device != "" && device != scoped.Identity() {
+			return rollout.Device{}, errors.New("the token belongs to another device")
+		}
+		return rollout.Device{ID: scoped.Identity(), Verified: true}, nil
+	}
+	if cert := tlsutils.VerifiedClientCertificate(state); cert != nil {
+		identities := tlsutils.Identities(cert)
+		if device == "" {
+			// The identity that matched the configured identities of certificates is preferred.
+			if identity, ok := auth.VerifiedIdentity(clientAuth); ok {
+				return rollout.Device{ID: identity, Verified: true}, nil
+			}
+			if len(identities) == 0 {
+				return rollout.Device{}, errors.New("the client certificate has no identity")
+			}
+			return rollout.Device{ID: identities[0], Verified: true}, nil
+		}
+		if !slices.Contains(identities, device) {
+			return rollout.Device{}, errors.New("the client certificate belongs to another device")
+		}
+		return rollout.Device{ID: device, Verified: true}, nil
+	}
+	if requireClientAuth {
+		return rollout.Device{}, errors.New("devices have to authenticate with a device token or a client certificate")
+	}
+	if device == "" {
+		return rollout.Device{}, error2.ErrMissingQueryParam
+	}
+	return rollout.Device{ID: device}, nil
+}
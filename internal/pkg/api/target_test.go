@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/api/clientauth"
+	"github.com/unbasical/doras/internal/pkg/auth"
+	"github.com/unbasical/doras/internal/pkg/rollout"
+	"github.com/unbasical/doras/internal/pkg/tokenservice"
+)
+
+func Test_target(t *testing.T) {
+	dgst := digest.FromString("v2")
+	rollouts, err := rollout.New(rollout.Config{
+		Groups: map[string][]string{"canary": {"device-*"}},
+		Rollouts: []rollout.Rollout{
+			{Name: "apps", Target: "registry.example.org/apps/foo:v2", Percentage: 100, Groups: []string{"canary"}},
+			{Name: "tools", Target: "registry.example.org/tools/bar:v2", Percentage: 100, Groups: []string{"canary"}},
+		},
+	}, "", func(context.Context, string) (digest.Digest, error) { return dgst, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte("device-key"))
+	tokens, err := tokenservice.New(tokenservice.Config{
+		Secret:  []byte(strings.Repeat("s", 32)),
+		TTL:     5 * time.Minute,
+		Devices: []tokenservice.Device{{ID: "device-1", KeySHA256: hex.EncodeToString(hash[:]), Repositories: []string{"registry.example.org/apps/*"}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceToken, err := tokens.Issue(context.Background(), auth.GenerateBasicAuth("device-1", "device-key"), []string{"registry.example.org/apps/foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceCert := &x509.Certificate{Subject: pkix.Name{CommonName: "device-3"}, DNSNames: []string{"device-3.fleet.example.org"}}
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name              string
+		query             string
+		authorization     string
+		cert              *x509.Certificate
+		requireClientAuth bool
+		wantStatus        int
+		wantRollout       string
+	}{
+		{name: "device", query: "?device=device-2&repository=registry.example.org/apps/foo", wantStatus: http.StatusOK, wantRollout: "apps"},
+		{name: "device token", query: "?repository=registry.example.org/apps/foo", authorization: "Bearer " + deviceToken.Token, wantStatus: http.StatusOK, wantRollout: "apps"},
+		{name: "token of another device", query: "?device=device-2&repository=registry.example.org/apps/foo", authorization: "Bearer " + deviceToken.Token, wantStatus: http.StatusForbidden},
+		{name: "repository not allowed by the token", query: "?repository=registry.example.org/tools/bar", authorization: "Bearer " + deviceToken.Token, wantStatus: http.StatusForbidden},
+		{name: "missing device", query: "?repository=registry.example.org/apps/foo", wantStatus: http.StatusBadRequest},
+		{name: "several repositories", query: "?device=device-2", wantStatus: http.StatusBadRequest},
+		{name: "no target", query: "?device=other", wantStatus: http.StatusNotFound},
+		{name: "client certificate", query: "?repository=registry.example.org/apps/foo", cert: deviceCert, wantStatus: http.StatusOK, wantRollout: "apps"},
+		{name: "client certificate of the device", query: "?device=device-3&repository=registry.example.org/apps/foo", cert: deviceCert, wantStatus: http.StatusOK, wantRollout: "apps"},
+		{name: "client certificate of another device", query: "?device=device-2&repository=registry.example.org/apps/foo", cert: deviceCert, wantStatus: http.StatusForbidden},
+		{name: "registry credentials do not identify devices", query: "?device=device-2&repository=registry.example.org/apps/foo", authorization: auth.GenerateBasicAuth("user", "secret"), requireClientAuth: true, wantStatus: http.StatusForbidden},
+		{name: "registry credentials with client certificate", query: "?device=device-2&repository=registry.example.org/apps/foo", authorization: auth.GenerateBasicAuth("user", "secret"), cert: deviceCert, requireClientAuth: true, wantStatus: http.StatusForbidden},
+		{name: "missing credentials", query: "?device=device-2&repository=registry.example.org/apps/foo", requireClientAuth: true, wantStatus: http.StatusUnauthorized},
+		{name: "invalid credentials", query: "?device=device-2&repository=registry.example.org/apps/foo", authorization: "Basic invalid", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/api/v1/target", target(rollouts, clientauth.Authenticator{Tokens: tokens}, tt.requireClientAuth))
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/target"+tt.query, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.cert != nil {
+				req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert}}}
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var res apicommon.TargetResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Rollout != tt.wantRollout || res.Digest != dgst.String() || res.Image != "registry.example.org/apps/foo@"+dgst.String() {
+				t.Errorf("unexpected target %+v", res)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/auth"
+	"github.com/unbasical/doras/internal/pkg/tokenservice"
+)
+
+func Test_token(t *testing.T) {
+	hash := sha256.Sum256([]byte("device-key"))
+	tokens, err := tokenservice.New(tokenservice.Config{
+		Secret:  []byte(strings.Repeat("s", 32)),
+		TTL:     5 * time.Minute,
+		Devices: []tokenservice.Device{{ID: "device-1", KeySHA256: hex.EncodeToString(hash[:]), Repositories: []string{"registry.example.org/apps/*"}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/v1/token", token(tokens))
+	tests := []struct {
+		name          string
+		authorization string
+		body          string
+		wantStatus    int
+	}{
+		{name: "token", authorization: auth.GenerateBasicAuth("device-1", "device-key"), body: `{"repositories": ["registry.example.org/apps/foo"]}`, wantStatus: http.StatusOK},
+		{name: "invalid key", authorization: auth.GenerateBasicAuth("device-1", "other"), body: `{"repositories": ["registry.example.org/apps/foo"]}`, wantStatus: http.StatusUnauthorized},
+		{name: "missing credentials", body: `{"repositories": ["registry.example.org/apps/foo"]}`, wantStatus: http.StatusUnauthorized},
+		{name: "repository not on allow-list", authorization: auth.GenerateBasicAuth("device-1", "device-key"), body: `{"repositories": ["registry.example.org/tools/foo"]}`, wantStatus: http.StatusForbidden},
+		{name: "no repositories", authorization: auth.GenerateBasicAuth("device-1", "device-key"), body: `{}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid body", authorization: auth.GenerateBasicAuth("device-1", "device-key"), body: `repositories`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/token", strings.NewReader(tt.body))
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var res apicommon.TokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.ExpiresIn != 300 {
+				t.Errorf("expected token to expire in 300 seconds, got %d", res.ExpiresIn)
+			}
+			clientAuth, err := tokens.Authenticate(res.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !clientAuth.Allows("registry.example.org/apps/foo") {
+				t.Error("expected token to allow the requested repository")
+			}
+		})
+	}
+}
@@ -1,11 +1,27 @@
 package auth
 
-import auth2 "oras.land/oras-go/v2/registry/remote/auth"
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/unbasical/doras/internal/pkg/utils/tlsutils"
+	auth2 "oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// ErrUnknownClientCertificate is returned if a client certificate is not mapped to registry credentials.
+var ErrUnknownClientCertificate = errors.New("client certificate is not mapped to registry credentials")
 
 // RegistryAuth abstracts over credentials that can be used to access registries.
 type RegistryAuth interface {
 	// CredentialFunc returns an authentication mechanism that can be used to access the registry at the provided URL.
 	CredentialFunc(scope string) (auth2.CredentialFunc, error)
+	// Identity identifies the client, e.g. to apply quotas.
+	Identity() string
 }
 
 type registryAuthToken struct {
@@ -16,6 +32,15 @@ func (c *registryAuthToken) CredentialFunc(scope string) (auth2.CredentialFunc,
 	return auth2.StaticCredential(scope, c.credential), nil
 }
 
+// Identity returns the username or, as tokens are opaque, a prefix of the hash of the token (e.g. "token:0123456789abcdef").
+func (c *registryAuthToken) Identity() string {
+	if c.credential.AccessToken == "" {
+		return c.credential.Username
+	}
+	h := sha256.Sum256([]byte(c.credential.AccessToken))
+	return "token:" + hex.EncodeToString(h[:8])
+}
+
 func NewClientAuthFromToken(token string) RegistryAuth {
 	return &registryAuthToken{credential: auth2.Credential{AccessToken: token}}
 }
@@ -23,3 +48,85 @@ func NewClientAuthFromToken(token string) RegistryAuth {
 func NewClientAuthFromUsernamePassword(username, password string) RegistryAuth {
 	return &registryAuthToken{credential: auth2.Credential{Username: username, Password: password}}
 }
+
+// ClientCertificateIdentity maps the identity of client certificates to registry credentials,
+// this allows clients that authenticate with certificates (mTLS) to request deltas without registry tokens.
+type ClientCertificateIdentity struct {
+	// Pattern is matched (see path.Match) against the common name and the DNS, email and URI SANs of the certificate.
+	Pattern string
+	// Credentials of the registries (hostname as key) the clients with the identity can access.
+	Credentials map[string]auth2.Credential
+}
+
+type registryAuthCertificate struct {
+	identity    string
+	credentials map[string]auth2.Credential
+}
+
+// CredentialFunc returns the credentials of the registry, registries without credentials are accessed anonymously.
+func (c *registryAuthCertificate) CredentialFunc(scope string) (auth2.CredentialFunc, error) {
+	return auth2.StaticCredential(scope, c.credentials[scope]), nil
+}
+
+// Identity returns the name of the certificate that matched the identity.
+func (c *registryAuthCertificate) Identity() string {
+	return c.identity
+}
+
+// NewClientAuthFromCertificate returns the credentials of the first identity that matches the verified client certificate.
+func NewClientAuthFromCertificate(cert *x509.Certificate, identities []ClientCertificateIdentity) (RegistryAuth, error) {
+	names := tlsutils.Identities(cert)
+	for _, identity := range identities {
+		for _, name := range names {
+			if ok, err := path.Match(identity.Pattern, name); err == nil && ok {
+				return &registryAuthCertificate{identity: name, credentials: identity.Credentials}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %v", ErrUnknownClientCertificate, names)
+}
+
+// ScopedRegistryAuth is RegistryAuth which may only be used to access some repositories.
+type ScopedRegistryAuth interface {
+	RegistryAuth
+	// Allows reports whether the repository (e.g. registry.example.org/foo) may be accessed.
+	Allows(repository string) bool
+}
+
+type registryAuthScoped struct {
+	identity     string
+	repositories []string
+	credentials  auth2.CredentialFunc
+}
+
+func (c *registryAuthScoped) CredentialFunc(string) (auth2.CredentialFunc, error) {
+	return c.credentials, nil
+}
+
+func (c *registryAuthScoped) Identity() string {
+	return c.identity
+}
+
+func (c *registryAuthScoped) Allows(repository string) bool {
+	return slices.Contains(c.repositories, repository)
+}
+
+// NewScopedClientAuth returns ScopedRegistryAuth of the client with the identity which accesses registries with the credentials but only allows the repositories.
+// This is used for tokens that the server issues to clients, the server accesses the registries on their behalf.
+func NewScopedClientAuth(identity string, repositories []string, credentials auth2.CredentialFunc) ScopedRegistryAuth {
+	return &registryAuthScoped{identity: identity, repositories: repositories, credentials: credentials}
+}
+
+// VerifiedIdentity returns the identity of clients whose identity has been verified by the server,
+// i.e. clients with tokens issued by the server or with client certificates.
+// Other identities (e.g. the username of basic auth or registry tokens) are chosen by the client and only verified by registries.
+func VerifiedIdentity(clientAuth RegistryAuth) (string, bool) {
+	switch a := clientAuth.(type) {
+	case *registryAuthScoped:
+		return a.identity, a.identity != ""
+	case *registryAuthCertificate:
+		return a.identity, a.identity != ""
+	default:
+		return "", false
+	}
+}
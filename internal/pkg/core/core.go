@@ -1,30 +1,66 @@
 package core
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
 	log "github.com/sirupsen/logrus"
 	"github.com/unbasical/doras/configs"
 	"github.com/unbasical/doras/internal/pkg/api"
+	dorasauth "github.com/unbasical/doras/internal/pkg/auth"
 	"github.com/unbasical/doras/internal/pkg/core/dorasengine"
 	deltadelegate "github.com/unbasical/doras/internal/pkg/delegates/delta"
 	registrydelegate "github.com/unbasical/doras/internal/pkg/delegates/registry"
+	"github.com/unbasical/doras/internal/pkg/gc"
+	"github.com/unbasical/doras/internal/pkg/lock"
+	"github.com/unbasical/doras/internal/pkg/mqtt"
+	"github.com/unbasical/doras/internal/pkg/notify"
+	"github.com/unbasical/doras/internal/pkg/policy"
+	"github.com/unbasical/doras/internal/pkg/ratelimit"
+	"github.com/unbasical/doras/internal/pkg/rollout"
+	"github.com/unbasical/doras/internal/pkg/storage"
+	"github.com/unbasical/doras/internal/pkg/tokenservice"
+	"github.com/unbasical/doras/internal/pkg/utils/fileutils"
 	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/internal/pkg/utils/tlsutils"
+	"github.com/unbasical/doras/pkg/deltalocation"
+	"github.com/unbasical/doras/pkg/signature"
+	"google.golang.org/grpc"
+	grpccredentials "google.golang.org/grpc/credentials"
+	"io"
+	"net"
 	"net/http"
 	"oras.land/oras-go/v2/registry/remote/auth"
 	"oras.land/oras-go/v2/registry/remote/credentials"
 	"os"
+	"path"
 	"time"
 )
 
 type Doras struct {
-	srv      *http.Server
+	srv *http.Server
+	// grpcSrv serves the gRPC API, it is nil if the gRPC API is disabled.
+	grpcSrv  *grpc.Server
+	grpcPort uint16
 	engine   dorasengine.Engine
+	// notifier announces created deltas, it is nil if notifications are disabled.
+	notifier notify.Notifier
+	// locker coordinates delta creations with other replicas.
+	locker lock.Locker
+	// usage records the served deltas for the garbage collection.
+	usage    gc.UsageStore
 	hostname string
 	port     uint16
 	config   configs.ServerConfig
+	// collector and stopGC are used for the background garbage collection.
+	collector gc.Collector
+	stopGC    context.CancelFunc
 }
 
 // New returns an instance of a Doras server.
@@ -40,10 +76,377 @@ func New(config configs.ServerConfig) *Doras {
 func (d *Doras) init(config configs.ServerConfig) *Doras {
 	d.hostname = config.CliOpts.Host
 	d.port = config.CliOpts.HTTPPort
+	d.grpcPort = config.CliOpts.GRPCPort
 
 	if config.CliOpts.LogLevel != "debug" {
 		gin.SetMode(gin.ReleaseMode)
 	}
+	creds := loadCredentials(config)
+
+	var signer signature.Signer
+	if config.CliOpts.DeltaSigningKeyPath != "" {
+		key, err := signature.LoadPrivateKey(config.CliOpts.DeltaSigningKeyPath)
+		if err != nil {
+			log.WithError(err).Fatal("failed to load delta signing key")
+		}
+		signer, err = signature.NewCosignSigner(key)
+		if err != nil {
+			log.WithError(err).Fatal("failed to create delta signer")
+		}
+		log.Info("signing delta manifests")
+	}
+
+	repositories, err := newStorageProvider(config)
+	if err != nil {
+		log.WithError(err).Fatal("failed to set up storage")
+	}
+	instanceID := config.CliOpts.InstanceID
+	if instanceID == "" {
+		instanceID = newInstanceID()
+	}
+	log.Infof("instance ID: %s", instanceID)
+	registryDelegate := registrydelegate.NewRegistryDelegateWithStorage(
+		repositories,
+		creds,
+		signer,
+		registrydelegate.DeltaStorageMode(config.CliOpts.DeltaStorageMode),
+		registrydelegate.WithInstanceID(instanceID),
+	)
+	targets := make(deltalocation.Targets, 0, len(config.ConfigFile.DeltaTargets))
+	for _, t := range config.ConfigFile.DeltaTargets {
+		targets = append(targets, deltalocation.Target{Source: t.Source, Repository: t.Target})
+	}
+	// Referrers have to be stored in the repository of their subject.
+	if len(targets) > 0 && registrydelegate.DeltaStorageMode(config.CliOpts.DeltaStorageMode) == registrydelegate.DeltaStorageReferrers {
+		log.Fatal("delta storage targets are not supported if deltas are stored as referrers")
+	}
+	deltaDelegate := deltadelegate.NewDeltaDelegate(time.Duration(config.CliOpts.DummyExpirationDurationMins)*time.Minute, targets)
+
+	usage, err := gc.NewUsageStore(config.CliOpts.DeltaUsageFilePath)
+	if err != nil {
+		log.WithError(err).Fatal("failed to load delta usage")
+	}
+	d.usage = usage
+	d.collector = newCollector(config, repositories, creds, usage, false)
+	limits := dorasengine.Limits{
+		MaxArtifactSize:         int64(config.CliOpts.MaxArtifactSizeMiB) << 20,
+		JobTimeout:              time.Duration(config.CliOpts.DeltaCreationTimeoutMins) * time.Minute,
+		MaxEstimatedJobMemory:   int64(config.CliOpts.DeltaCreationMaxEstimatedMemoryMiB) << 20,
+		MaxEstimatedJobTempDisk: int64(config.CliOpts.DeltaCreationMaxEstimatedTempDiskMiB) << 20,
+	}
+	// Locks and temporary files of delta creations are stale once the dummy has expired or the creation has timed out.
+	// The heartbeat of a delta creation renews its lock, so locks only expire if their holder stopped.
+	staleAfter := max(limits.JobTimeout, time.Duration(config.CliOpts.DummyExpirationDurationMins)*time.Minute)
+	locker, err := newLocker(config, creds, staleAfter)
+	if err != nil {
+		log.WithError(err).Fatal("failed to set up locks")
+	}
+	pol, err := newPolicy(config)
+	if err != nil {
+		log.WithError(err).Fatal("failed to set up the policy")
+	}
+	d.locker = locker
+	d.notifier = newNotifier(config)
+	engineOpts := []dorasengine.Option{
+		dorasengine.WithUsageStore(usage),
+		dorasengine.WithLimits(limits),
+		dorasengine.WithLocker(locker),
+		dorasengine.WithPolicy(pol),
+		dorasengine.WithNotifier(d.notifier),
+	}
+	if config.CliOpts.RequireClientAuth {
+		engineOpts = append(engineOpts, dorasengine.WithRequiredClientAuth())
+	}
+	dorasEngine := dorasengine.NewEngine(registryDelegate, deltaDelegate, engineOpts...)
+	var distributionRepositories storage.LayoutProvider
+	if config.CliOpts.ServeDistributionAPI {
+		layout, ok := repositories.(storage.LayoutProvider)
+		if !ok {
+			log.Fatal("the distribution API can only be served for the oci-layout storage backend")
+		}
+		distributionRepositories = layout
+	}
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		log.WithError(err).Fatal("failed to set up TLS")
+	}
+	identities := loadClientCertificateIdentities(config)
+	if len(identities) > 0 && config.CliOpts.TLSClientCAPath == "" {
+		log.Warn("client certificates are configured but not verified, a client CA is required")
+	}
+	tokens, err := newTokenService(config, creds)
+	if err != nil {
+		log.WithError(err).Fatal("failed to set up the token service")
+	}
+	serverInfo := api.ServerInfo{
+		Version:            config.Version,
+		MaxArtifactSize:    maxArtifactSize(limits.MaxArtifactSize, int64(config.ConfigFile.Policy.MaxArtifactSizeMiB)<<20),
+		Algorithms:         config.ConfigFile.Policy.Algorithms,
+		RequireClientAuth:  config.CliOpts.RequireClientAuth,
+		ClientCertificates: len(identities) > 0 && config.CliOpts.TLSClientCAPath != "",
+		TokenService:       tokens != nil,
+	}
+	authConfig := api.AuthConfig{ClientCertificates: identities, Tokens: tokens}
+	var limiter ratelimit.Limiter
+	if config.CliOpts.RateLimitPerMin > 0 {
+		limiter = ratelimit.New(float64(config.CliOpts.RateLimitPerMin)/60, int(config.CliOpts.RateLimitBurst))
+	}
+	rollouts, err := newRollouts(config, registryDelegate, creds)
+	if err != nil {
+		log.WithError(err).Fatal("failed to set up rollouts")
+	}
+	r := api.BuildApp(dorasEngine, serverInfo, config.CliOpts.ExposeMetrics, config.CliOpts.EnableProfiling, distributionRepositories, authConfig, limiter, rollouts)
+	err = r.SetTrustedProxies(config.ConfigFile.TrustedProxies)
+	if err != nil {
+		log.WithError(err).Fatal("failed to set trusted proxies")
+	}
+	d.srv = &http.Server{
+		Addr:      fmt.Sprintf("%s:%d", d.hostname, d.port),
+		Handler:   r,
+		TLSConfig: tlsConfig,
+	}
+	// Requests that wait for deltas would delay the shutdown until they time out.
+	d.srv.RegisterOnShutdown(dorasEngine.StopWaiting)
+	if d.grpcPort > 0 {
+		var opts []grpc.ServerOption
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(grpccredentials.NewTLS(tlsConfig)))
+		}
+		d.grpcSrv = api.BuildGRPCServer(dorasEngine, serverInfo, authConfig, limiter, opts...)
+	}
+	d.engine = dorasEngine
+	d.config = config
+	removeStaleTempFiles(staleAfter)
+	return d
+}
+
+// newInstanceID returns an ID that identifies the server, it is unique across restarts.
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "doras"
+	}
+	b := make([]byte, 4)
+	// rand.Read never returns an error.
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%s", hostname, hex.EncodeToString(b))
+}
+
+// staleTempFilePatterns match the temporary files that are created during delta creations.
+var staleTempFilePatterns = []string{"delta_*", "*.tardiff", "tar-diff-*"}
+
+// removeStaleTempFiles removes temporary files of delta creations that are older than maxAge.
+// These files are left behind if the server is killed while it creates deltas.
+func removeStaleTempFiles(maxAge time.Duration) {
+	removed, err := fileutils.RemoveStaleFiles(os.TempDir(), staleTempFilePatterns, maxAge)
+	if err != nil {
+		log.WithError(err).Warn("failed to remove stale temporary files")
+	}
+	if removed > 0 {
+		log.Infof("removed %d stale temporary files", removed)
+	}
+}
+
+const (
+	storageBackendRegistry  = "registry"
+	storageBackendOCILayout = "oci-layout"
+)
+
+// newStorageProvider returns the storage.Provider of the configured storage backend.
+func newStorageProvider(config configs.ServerConfig) (storage.Provider, error) {
+	switch config.CliOpts.StorageBackend {
+	case storageBackendRegistry, "":
+		return storage.NewRemoteProvider(config.CliOpts.InsecureAllowHTTP), nil
+	case storageBackendOCILayout:
+		if config.CliOpts.OCILayoutPath == "" {
+			return nil, errors.New("the OCI layout storage backend requires a path")
+		}
+		return storage.NewLayoutProvider(config.CliOpts.OCILayoutPath), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.CliOpts.StorageBackend)
+	}
+}
+
+const (
+	lockBackendLocal    = "local"
+	lockBackendFile     = "file"
+	lockBackendRedis    = "redis"
+	lockBackendRegistry = "registry"
+	lockBackendRaft     = "raft"
+)
+
+// newLocker returns the lock.Locker of the configured lock backend, locks expire after the ttl.
+func newLocker(config configs.ServerConfig, creds auth.CredentialFunc, ttl time.Duration) (lock.Locker, error) {
+	switch config.CliOpts.LockBackend {
+	case lockBackendLocal, "":
+		return lock.NewLocalLocker(ttl), nil
+	case lockBackendFile:
+		if config.CliOpts.LockFileDir == "" {
+			return nil, errors.New("the file lock backend requires a directory")
+		}
+		return lock.NewFileLocker(config.CliOpts.LockFileDir, ttl)
+	case lockBackendRedis:
+		if config.CliOpts.LockRedisAddress == "" {
+			return nil, errors.New("the redis lock backend requires an address")
+		}
+		return lock.NewRedisLocker(config.CliOpts.LockRedisAddress, config.CliOpts.LockRedisPassword, ttl)
+	case lockBackendRegistry:
+		if config.CliOpts.StorageBackend == storageBackendOCILayout {
+			return nil, errors.New("the registry lock backend requires the registry storage backend")
+		}
+		return lock.NewRegistryLocker(creds, config.CliOpts.InsecureAllowHTTP, ttl), nil
+	case lockBackendRaft:
+		peers, err := lock.ParseRaftPeers(config.CliOpts.LockRaftPeers)
+		if err != nil {
+			return nil, err
+		}
+		return lock.NewRaftLocker(lock.RaftConfig{
+			NodeID:   config.CliOpts.LockRaftNodeID,
+			Address:  config.CliOpts.LockRaftAddress,
+			Dir:      config.CliOpts.LockRaftDir,
+			Peers:    peers,
+			CertPath: config.CliOpts.LockRaftTLSCertPath,
+			KeyPath:  config.CliOpts.LockRaftTLSKeyPath,
+			CAPath:   config.CliOpts.LockRaftTLSCAPath,
+		}, ttl)
+	default:
+		return nil, fmt.Errorf("unknown lock backend %q", config.CliOpts.LockBackend)
+	}
+}
+
+// newRollouts returns the manager of the rollouts or nil if no rollouts are configured.
+// The targets of rollouts are resolved with the credentials of the server.
+func newRollouts(config configs.ServerConfig, registry registrydelegate.RegistryDelegate, creds auth.CredentialFunc) (rollout.Manager, error) {
+	if len(config.ConfigFile.Rollouts) == 0 {
+		return nil, nil
+	}
+	if config.CliOpts.RolloutStateFilePath == "" {
+		log.Warn("no rollout state file is configured, devices might get other targets after restarts")
+	}
+	rollouts := make([]rollout.Rollout, 0, len(config.ConfigFile.Rollouts))
+	for _, r := range config.ConfigFile.Rollouts {
+		rollouts = append(rollouts, rollout.Rollout{Name: r.Name, Target: r.Target, Percentage: r.Percentage, Groups: r.Groups, Start: r.Start})
+	}
+	resolve := func(_ context.Context, image string) (digest.Digest, error) {
+		_, _, d, err := registry.Resolve(image, false, creds)
+		return d.Digest, err
+	}
+	return rollout.New(rollout.Config{Rollouts: rollouts, Groups: config.ConfigFile.DeviceGroups}, config.CliOpts.RolloutStateFilePath, resolve)
+}
+
+// newNotifier returns the notifier that announces created deltas on the MQTT broker or nil if no broker is configured.
+func newNotifier(config configs.ServerConfig) notify.Notifier {
+	if config.CliOpts.MQTTBroker == "" {
+		return nil
+	}
+	log.Infof("announcing created deltas on %s (topic %q)", config.CliOpts.MQTTBroker, config.CliOpts.MQTTTopic)
+	return notify.NewMQTTNotifier(config.CliOpts.MQTTBroker, config.CliOpts.MQTTTopic,
+		mqtt.WithCredentials(config.CliOpts.MQTTUsername, config.CliOpts.MQTTPassword),
+	)
+}
+
+// newTLSConfig returns the TLS configuration of the server or nil if TLS is not configured.
+func newTLSConfig(config configs.ServerConfig) (*tls.Config, error) {
+	opts := config.CliOpts
+	if opts.TLSCertPath == "" && opts.TLSKeyPath == "" {
+		if opts.TLSClientCAPath != "" || opts.TLSRequireClientCert {
+			return nil, errors.New("client certificates require TLS")
+		}
+		return nil, nil
+	}
+	if opts.TLSCertPath == "" || opts.TLSKeyPath == "" {
+		return nil, errors.New("TLS requires a certificate and a key")
+	}
+	reloader, err := tlsutils.NewCertificateReloader(opts.TLSCertPath, opts.TLSKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return tlsutils.NewServerConfig(reloader, opts.TLSClientCAPath, opts.TLSRequireClientCert)
+}
+
+// loadClientCertificateIdentities returns the registry credentials of client certificates that are configured in the config file.
+func loadClientCertificateIdentities(config configs.ServerConfig) []dorasauth.ClientCertificateIdentity {
+	identities := make([]dorasauth.ClientCertificateIdentity, 0, len(config.ConfigFile.ClientCertificates))
+	for _, c := range config.ConfigFile.ClientCertificates {
+		if _, err := path.Match(c.Identity, ""); err != nil {
+			log.WithError(err).Fatalf("invalid client certificate identity %q", c.Identity)
+		}
+		identity := dorasauth.ClientCertificateIdentity{Pattern: c.Identity, Credentials: make(map[string]auth.Credential)}
+		for regName, regConf := range c.Registries {
+			identity.Credentials[regName] = auth.Credential{
+				Username:    os.ExpandEnv(regConf.Auth.Username),
+				Password:    os.ExpandEnv(regConf.Auth.Password),
+				AccessToken: os.ExpandEnv(regConf.Auth.AccessToken),
+			}
+		}
+		identities = append(identities, identity)
+	}
+	return identities
+}
+
+// newPolicy returns the policy of the config file or nil if it does not restrict requests.
+func newPolicy(config configs.ServerConfig) (policy.Policy, error) {
+	policyConfig := config.ConfigFile.Policy
+	if len(policyConfig.Repositories) == 0 && len(policyConfig.Algorithms) == 0 && policyConfig.MaxArtifactSizeMiB == 0 && len(policyConfig.Quotas) == 0 {
+		return nil, nil
+	}
+	quotas := make([]policy.Quota, 0, len(policyConfig.Quotas))
+	for _, q := range policyConfig.Quotas {
+		quotas = append(quotas, policy.Quota{Identity: q.Identity, MaxDeltaCreations: int(q.MaxDeltaCreations)})
+	}
+	return policy.New(policy.Config{
+		Repositories:    policyConfig.Repositories,
+		Algorithms:      policyConfig.Algorithms,
+		MaxArtifactSize: int64(policyConfig.MaxArtifactSizeMiB) << 20,
+		Quotas:          quotas,
+		QuotaWindow:     time.Duration(policyConfig.QuotaWindowMins) * time.Minute,
+	})
+}
+
+// maxArtifactSize returns the smaller of the limits, zero disables a limit.
+func maxArtifactSize(a, b int64) int64 {
+	if a == 0 || b == 0 {
+		return max(a, b)
+	}
+	return min(a, b)
+}
+
+// newTokenService returns the service that issues device tokens or nil if no devices are configured.
+// Registries are accessed with the server credentials on behalf of the devices.
+func newTokenService(config configs.ServerConfig, creds auth.CredentialFunc) (tokenservice.Service, error) {
+	tokenConfig := config.ConfigFile.TokenService
+	if len(tokenConfig.Devices) == 0 {
+		return nil, nil
+	}
+	var secret []byte
+	if config.CliOpts.TokenSecretPath != "" {
+		data, err := os.ReadFile(config.CliOpts.TokenSecretPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token secret: %w", err)
+		}
+		secret = bytes.TrimSpace(data)
+	} else {
+		log.Warn("no token secret is configured, device tokens are only accepted by this server")
+		secret = make([]byte, 32)
+		// rand.Read never returns an error.
+		_, _ = rand.Read(secret)
+	}
+	devices := make([]tokenservice.Device, 0, len(tokenConfig.Devices))
+	for _, d := range tokenConfig.Devices {
+		devices = append(devices, tokenservice.Device{ID: d.ID, KeySHA256: d.KeySHA256, Repositories: d.Repositories})
+	}
+	return tokenservice.New(tokenservice.Config{
+		Secret:      secret,
+		TTL:         time.Duration(config.CliOpts.TokenTTLMins) * time.Minute,
+		Devices:     devices,
+		JWKSURL:     tokenConfig.JWKSURL,
+		JWTIssuer:   tokenConfig.JWTIssuer,
+		JWTAudience: tokenConfig.JWTAudience,
+	}, creds)
+}
+
+// loadCredentials returns the registry credentials that are configured in the config file and the docker config file.
+func loadCredentials(config configs.ServerConfig) auth.CredentialFunc {
 	var opts []func(aggregate *ociutils.CredFuncAggregate)
 
 	// Load credentials configured in the config file.
@@ -74,24 +477,7 @@ func (d *Doras) init(config configs.ServerConfig) *Doras {
 		}
 		opts = append(opts, ociutils.WithCredFunc(credentials.Credential(credentialStore)))
 	}
-	creds := ociutils.NewCredentialsAggregate(opts...)
-
-	registryDelegate := registrydelegate.NewRegistryDelegate(creds, config.CliOpts.InsecureAllowHTTP)
-	deltaDelegate := deltadelegate.NewDeltaDelegate(time.Duration(config.CliOpts.DummyExpirationDurationMins) * time.Minute)
-
-	dorasEngine := dorasengine.NewEngine(registryDelegate, deltaDelegate, config.CliOpts.RequireClientAuth)
-	r := api.BuildApp(dorasEngine, config.CliOpts.ExposeMetrics, config.CliOpts.EnableProfiling)
-	err := r.SetTrustedProxies(config.ConfigFile.TrustedProxies)
-	if err != nil {
-		log.WithError(err).Fatal("failed to set trusted proxies")
-	}
-	d.srv = &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", d.hostname, d.port),
-		Handler: r,
-	}
-	d.engine = dorasEngine
-	d.config = config
-	return d
+	return ociutils.NewCredentialsAggregate(opts...)
 }
 
 // Start the Doras server.
@@ -99,16 +485,93 @@ func (d *Doras) Start() {
 	log.Info("Starting Doras server")
 
 	go func() {
-		if err := d.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if d.srv.TLSConfig != nil {
+			// The certificates are provided by the TLS config.
+			err = d.srv.ListenAndServeTLS("", "")
+		} else {
+			err = d.srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.WithError(err).Fatal("failed to start server")
 			panic(err)
 		}
 	}()
-	log.Infof("Listening on %s", d.srv.Addr)
+	if d.srv.TLSConfig != nil {
+		log.Infof("Listening on %s (TLS)", d.srv.Addr)
+	} else {
+		log.Infof("Listening on %s", d.srv.Addr)
+	}
+	if d.grpcSrv != nil {
+		d.startGRPC()
+	}
+	if interval := time.Duration(d.config.CliOpts.GCIntervalMins) * time.Minute; interval > 0 {
+		repositories := d.config.ConfigFile.GC.Repositories
+		if len(repositories) == 0 {
+			log.Warn("background garbage collection is enabled but no repositories are configured")
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		d.stopGC = cancel
+		go gc.RunPeriodically(ctx, d.collector, repositories, interval)
+		log.Infof("running garbage collection every %s", interval)
+	}
+}
+
+// startGRPC serves the gRPC API on the gRPC port of the host.
+func (d *Doras) startGRPC() {
+	addr := fmt.Sprintf("%s:%d", d.hostname, d.grpcPort)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.WithError(err).Fatal("failed to start gRPC server")
+	}
+	go func() {
+		if err := d.grpcSrv.Serve(lis); err != nil {
+			log.WithError(err).Fatal("failed to serve gRPC API")
+		}
+	}()
+	log.Infof("Serving the gRPC API on %s", addr)
 }
 
 // Stop the Doras server.
 func (d *Doras) Stop(ctx context.Context) error {
-	go d.engine.Stop(ctx)
-	return d.srv.Shutdown(ctx)
+	if d.stopGC != nil {
+		d.stopGC()
+	}
+	err := d.srv.Shutdown(ctx)
+	if d.grpcSrv != nil {
+		stopGRPC(ctx, d.grpcSrv)
+	}
+	d.engine.Stop(ctx)
+	if d.usage != nil {
+		if err := d.usage.Close(); err != nil {
+			log.WithError(err).Warn("failed to persist delta usage")
+		}
+	}
+	// Embedded lock backends (raft) stop their replica.
+	if closer, ok := d.locker.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.WithError(err).Warn("failed to stop the lock backend")
+		}
+	}
+	if d.notifier != nil {
+		if err := d.notifier.Close(); err != nil {
+			log.WithError(err).Warn("failed to disconnect from the MQTT broker")
+		}
+	}
+	return err
+}
+
+// stopGRPC stops the gRPC server gracefully, calls that have not finished once the context is done are cancelled.
+// Calls that wait for deltas have been told to stop waiting by the shutdown of the HTTP server.
+func stopGRPC(ctx context.Context, srv *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		srv.Stop()
+	}
 }
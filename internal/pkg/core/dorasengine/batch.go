@@ -0,0 +1,81 @@
+package dorasengine
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	apidelegate "github.com/unbasical/doras/internal/pkg/delegates/api"
+	error2 "github.com/unbasical/doras/internal/pkg/error"
+)
+
+// batchConcurrency limits the number of requests of a batch that are handled at the same time.
+const batchConcurrency = 8
+
+// batchItemDelegate handles a single request of a batch, the response is recorded instead of being sent.
+// Clients are authenticated by the delegate of the batch.
+type batchItemDelegate struct {
+	apidelegate.APIDelegate
+	request apicommon.ReadDeltaRequest
+	result  apidelegate.BatchResult
+}
+
+func (b *batchItemDelegate) ExtractParams() (fromImage, toImage string, acceptedAlgorithms []string, err error) {
+	if b.request.From == "" || b.request.To == "" {
+		return "", "", []string{}, errors.New("missing images")
+	}
+	return b.request.From, b.request.To, b.request.AcceptedAlgorithms, nil
+}
+
+func (b *batchItemDelegate) HandleError(err error, msg string) {
+	b.result.Err = err
+	b.result.ErrMsg = msg
+}
+
+func (b *batchItemDelegate) HandleSuccess(response any) {
+	res, ok := response.(apicommon.ReadDeltaResponse)
+	if !ok {
+		b.HandleError(error2.ErrInternal, "")
+		return
+	}
+	b.result.Delta = &res
+}
+
+func (b *batchItemDelegate) HandleAccepted(retryAfter time.Duration) {
+	b.result.Accepted = true
+	b.result.RetryAfter = retryAfter
+}
+
+func (b *batchItemDelegate) HandlePending(time.Duration) {}
+
+func (b *batchItemDelegate) HandleNoNewVersion() {
+	b.result.NoNewVersion = true
+}
+
+func (d *engine) HandleReadDeltas(apiDelegate apidelegate.APIDelegate) {
+	requests, err := apiDelegate.ExtractBatch()
+	if err != nil {
+		log.WithError(err).Debug("Error extracting batch")
+		apiDelegate.HandleError(error2.ErrBadRequest, err.Error())
+		return
+	}
+	ctx := d.requestContext()
+	results := make([]apidelegate.BatchResult, len(requests))
+	sem := make(chan struct{}, batchConcurrency)
+	wg := sync.WaitGroup{}
+	for i, request := range requests {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			item := &batchItemDelegate{APIDelegate: apiDelegate, request: request}
+			readDelta(ctx, d.registry, d.delegate, item, d.requireClientAuth)
+			results[i] = item.result
+		}()
+	}
+	wg.Wait()
+	apiDelegate.HandleBatch(results)
+}
@@ -6,12 +6,19 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	auth2 "github.com/unbasical/doras/internal/pkg/auth"
+	"github.com/unbasical/doras/internal/pkg/core/estimator"
 	"github.com/unbasical/doras/internal/pkg/core/metrics"
 	apidelegate "github.com/unbasical/doras/internal/pkg/delegates/api"
 	deltadelegate "github.com/unbasical/doras/internal/pkg/delegates/delta"
 	registrydelegate "github.com/unbasical/doras/internal/pkg/delegates/registry"
+	"github.com/unbasical/doras/internal/pkg/gc"
+	"github.com/unbasical/doras/internal/pkg/lock"
+	"github.com/unbasical/doras/internal/pkg/notify"
+	"github.com/unbasical/doras/internal/pkg/policy"
 	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
 	"oras.land/oras-go/v2/registry/remote/auth"
 
@@ -20,6 +27,7 @@ import (
 	"github.com/unbasical/doras/internal/pkg/api/apicommon"
 	error2 "github.com/unbasical/doras/internal/pkg/error"
 	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
+	algorithmregistry "github.com/unbasical/doras/pkg/algorithm/registry"
 	"github.com/unbasical/doras/pkg/constants"
 )
 
@@ -27,27 +35,126 @@ import (
 // Errors and responses are handled by apidelegate.APIDelegate implementations.
 type Engine interface {
 	HandleReadDelta(apiDeletgate apidelegate.APIDelegate)
+	// HandleReadDeltas handles a batch of delta requests, each request is handled like a request of HandleReadDelta without waiting.
+	HandleReadDeltas(apiDelegate apidelegate.APIDelegate)
+	// StopWaiting responds to the requests that wait for deltas, it is called when the server starts to shut down.
+	StopWaiting()
 	Stop(ctx context.Context)
 }
 
 type contextKey string
 
+// errShutdown is the cause of cancelled delta creations if the server shuts down.
+var errShutdown = errors.New("server is shutting down")
+
+// cleanupTimeout limits the time it takes to delete the dummies of cancelled delta creations and to release their locks.
+const cleanupTimeout = 10 * time.Second
+
+// minRetryAfter is the minimum duration clients are asked to wait before they retry requests for deltas that are being created.
+const minRetryAfter = time.Second
+
+// Limits restrict delta requests and the delta creations they start, zero values disable a limit.
+type Limits struct {
+	// MaxArtifactSize is the maximum size of artifacts in bytes.
+	MaxArtifactSize int64
+	// JobTimeout is the maximum duration of a delta creation.
+	JobTimeout time.Duration
+	// MaxEstimatedJobMemory is the maximum memory usage in bytes that the algorithm may estimate for a delta creation.
+	// It only decides the admission of requests, the memory usage of running delta creations is not limited.
+	MaxEstimatedJobMemory int64
+	// MaxEstimatedJobTempDisk is the maximum usage of temporary disk space in bytes that the algorithm may estimate for a delta creation.
+	// It only decides the admission of requests, the disk usage of running delta creations is not limited.
+	MaxEstimatedJobTempDisk int64
+}
+
 type engine struct {
 	registry          registrydelegate.RegistryDelegate
 	delegate          deltadelegate.DeltaDelegate
 	requireClientAuth bool
 	wg                *sync.WaitGroup
+	usage             gc.UsageStore
+	limits            Limits
+	locker            lock.Locker
+	policy            policy.Policy
+	notifier          notify.Notifier
+	// estimates are used to tell clients when the deltas they requested will be created.
+	estimates estimator.Estimator
+	// jobs notifies requests that wait for deltas which are created by this engine.
+	jobs *jobs
+	// stopWaiting is closed if waiting requests have to be answered.
+	stopWaiting     chan struct{}
+	stopWaitingOnce sync.Once
+	// ctx is cancelled if the server shuts down, delta creations are derived from it.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// Option configures the Engine.
+type Option func(*engine)
+
+// WithRequiredClientAuth rejects requests without client credentials.
+func WithRequiredClientAuth() Option {
+	return func(e *engine) {
+		e.requireClientAuth = true
+	}
+}
+
+// WithUsageStore records served deltas in the gc.UsageStore.
+func WithUsageStore(usage gc.UsageStore) Option {
+	return func(e *engine) {
+		e.usage = usage
+	}
+}
+
+// WithLimits restricts delta requests and the delta creations they start, requests are not limited by default.
+func WithLimits(limits Limits) Option {
+	return func(e *engine) {
+		e.limits = limits
+	}
+}
+
+// WithLocker coordinates delta creations with other engines, deltas are only created by the engine that holds the lock of the delta's location.
+func WithLocker(locker lock.Locker) Option {
+	return func(e *engine) {
+		e.locker = locker
+	}
+}
+
+// WithPolicy rejects requests that the policy.Policy does not allow.
+func WithPolicy(pol policy.Policy) Option {
+	return func(e *engine) {
+		e.policy = pol
+	}
+}
+
+// WithNotifier notifies clients about created deltas with the notify.Notifier.
+func WithNotifier(notifier notify.Notifier) Option {
+	return func(e *engine) {
+		e.notifier = notifier
+	}
 }
 
-// NewEngine construct a new dorasengine.Engine with the given delegates.
-func NewEngine(registry registrydelegate.RegistryDelegate, delegate deltadelegate.DeltaDelegate, requireClientAuth bool) Engine {
-	return &engine{
-		registry:          registry,
-		delegate:          delegate,
-		wg:                &sync.WaitGroup{},
-		requireClientAuth: requireClientAuth,
+// NewEngine construct a new dorasengine.Engine with the given delegates, it is configured by the options.
+func NewEngine(registry registrydelegate.RegistryDelegate, delegate deltadelegate.DeltaDelegate, opts ...Option) Engine {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	e := &engine{
+		registry:    registry,
+		delegate:    delegate,
+		wg:          &sync.WaitGroup{},
+		estimates:   estimator.New(),
+		jobs:        newJobs(),
+		stopWaiting: make(chan struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
 	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
 }
+
+// Stop waits for delta requests and creations until the context is done.
+// Delta creations that are still running are cancelled afterward and their dummies are deleted.
 func (d *engine) Stop(ctx context.Context) {
 	doneChan := make(chan struct{})
 	go func() {
@@ -56,17 +163,58 @@ func (d *engine) Stop(ctx context.Context) {
 	}()
 	select {
 	case <-ctx.Done():
-		log.Debug(ctx.Err())
+		log.Warn("cancelling delta creations that did not finish in time")
+		d.cancel(errShutdown)
+		select {
+		case <-doneChan:
+		case <-time.After(cleanupTimeout):
+			log.Warn("delta creations did not stop in time")
+		}
 	case <-doneChan:
 		log.Debug("all delta requests have been served")
 	}
+	d.cancel(errShutdown)
+}
+
+func (d *engine) StopWaiting() {
+	d.stopWaitingOnce.Do(func() { close(d.stopWaiting) })
 }
 
 func (d *engine) HandleReadDelta(apiDeletgate apidelegate.APIDelegate) {
-	ctx := context.WithValue(context.Background(), contextKey("wg"), d.wg)
+	ctx := d.requestContext()
+	wait, err := apiDeletgate.ExtractWait()
+	if err != nil {
+		log.WithError(err).Debug("Error extracting wait duration")
+		apiDeletgate.HandleError(error2.ErrBadRequest, "invalid wait duration")
+		return
+	}
+	if wait > 0 {
+		d.waitForDelta(ctx, apiDeletgate, wait)
+		return
+	}
 	readDelta(ctx, d.registry, d.delegate, apiDeletgate, d.requireClientAuth)
 }
 
+// requestContext returns the context of requests, it contains the state of the engine that is used by readDelta.
+func (d *engine) requestContext() context.Context {
+	ctx := context.WithValue(d.ctx, contextKey("wg"), d.wg)
+	if d.usage != nil {
+		ctx = context.WithValue(ctx, contextKey("usage"), d.usage)
+	}
+	ctx = context.WithValue(ctx, contextKey("limits"), d.limits)
+	if d.locker != nil {
+		ctx = context.WithValue(ctx, contextKey("locker"), d.locker)
+	}
+	if d.policy != nil {
+		ctx = context.WithValue(ctx, contextKey("policy"), d.policy)
+	}
+	if d.notifier != nil {
+		ctx = context.WithValue(ctx, contextKey("notifier"), d.notifier)
+	}
+	ctx = context.WithValue(ctx, contextKey("estimator"), d.estimates)
+	return context.WithValue(ctx, contextKey("jobs"), d.jobs)
+}
+
 // checkRepoCompatability ensures that the two provided images are from the same repository.
 func checkRepoCompatability(a, b string) error {
 	nameA, _, _, err := ociutils.ParseOciImageString(a)
@@ -83,6 +231,53 @@ func checkRepoCompatability(a, b string) error {
 	return nil
 }
 
+// forbiddenRepository returns the repository of the image if the client auth is scoped to other repositories.
+func forbiddenRepository(clientAuth auth2.RegistryAuth, image string) (string, bool) {
+	scoped, ok := clientAuth.(auth2.ScopedRegistryAuth)
+	if !ok {
+		return "", false
+	}
+	repoName, _, _, err := ociutils.ParseOciImageString(image)
+	if err != nil || !scoped.Allows(repoName) {
+		return repoName, true
+	}
+	return "", false
+}
+
+// quotaIdentity returns the verified identity of the client (see auth.VerifiedIdentity), other clients are identified by "ip:" followed by their IP.
+// Identities that are chosen by the client are not used, otherwise clients could evade their quota by changing them.
+func quotaIdentity(ip string, clientAuth auth2.RegistryAuth) string {
+	if clientAuth != nil {
+		if identity, ok := auth2.VerifiedIdentity(clientAuth); ok {
+			return identity
+		}
+	}
+	return "ip:" + ip
+}
+
+// authorizeRequest checks the request against the policy before the images are resolved.
+// Returns the accepted algorithms that are allowed.
+func authorizeRequest(pol policy.Policy, fromImage string, acceptedAlgorithms []string) ([]string, error) {
+	repoName, _, _, err := ociutils.ParseOciImageString(fromImage)
+	if err != nil {
+		return nil, err
+	}
+	return pol.Authorize(repoName, acceptedAlgorithms)
+}
+
+// authorizeDelta checks the chosen algorithms and the artifacts against the policy.
+func authorizeDelta(pol policy.Policy, from, to *ociutils.Manifest, choice algorithmchoice.DifferChoice) error {
+	artifactsFrom, err := extractArtifacts(from)
+	if err != nil {
+		return err
+	}
+	artifactsTo, err := extractArtifacts(to)
+	if err != nil {
+		return err
+	}
+	return pol.AuthorizeDelta(choice.Differ.Name(), choice.Compressor.Name(), artifactsFrom[0].Size, artifactsTo[0].Size)
+}
+
 //nolint:revive // This rule is disabled to get around complexity linter errors. Reducing the complexity of this function is difficult. Refer to the Doras specs in the file docs/delta-creation-spec.md for more information on the semantics of this god function.
 func readDelta(ctx context.Context, registry registrydelegate.RegistryDelegate, delegate deltadelegate.DeltaDelegate, apiDelegate apidelegate.APIDelegate, requireClientAuth bool) {
 	wg, ok := ctx.Value(contextKey("wg")).(*sync.WaitGroup)
@@ -105,7 +300,8 @@ func readDelta(ctx context.Context, registry registrydelegate.RegistryDelegate,
 	clientAuth, err := apiDelegate.ExtractClientAuth()
 	if err != nil {
 		log.WithError(err).Debug("Error extracting client token")
-		if requireClientAuth {
+		// Invalid credentials are rejected even if they are optional, e.g. expired tokens of the token service.
+		if requireClientAuth || errors.Is(err, error2.ErrUnauthorized) {
 			apiDelegate.HandleError(error2.ErrUnauthorized, "")
 			return
 		}
@@ -130,6 +326,20 @@ func readDelta(ctx context.Context, registry registrydelegate.RegistryDelegate,
 		apiDelegate.HandleError(error2.ErrBadRequest, "images are not in the same repository")
 		return
 	}
+	if repoName, ok := forbiddenRepository(clientAuth, fromDigest); ok {
+		log.Debugf("client is not allowed to access %s", repoName)
+		apiDelegate.HandleError(error2.ErrForbidden, repoName)
+		return
+	}
+	pol, _ := ctx.Value(contextKey("policy")).(policy.Policy)
+	if pol != nil {
+		acceptedAlgorithms, err = authorizeRequest(pol, fromDigest, acceptedAlgorithms)
+		if err != nil {
+			log.WithError(err).Debug("request is not allowed by the policy")
+			apiDelegate.HandleError(error2.ErrForbidden, err.Error())
+			return
+		}
+	}
 
 	// resolve images to ensure they exist
 	srcFrom, fromImage, fromDescriptor, err := registry.Resolve(fromDigest, true, creds)
@@ -182,11 +392,34 @@ func readDelta(ctx context.Context, registry registrydelegate.RegistryDelegate,
 		apiDelegate.HandleError(error2.ErrIncompatibleArtifacts, "cannot build a delta from images")
 		return
 	}
+	// checkCompatability ensures that there is an artifact in the target manifest.
+	artifactsTo, _ := extractArtifacts(&mfTo)
 	manifOpts := registrydelegate.DeltaManifestOptions{
 		From:         fromImage,
 		To:           toImage,
 		DifferChoice: algorithmchoice.ChooseAlgorithms(acceptedAlgorithms, &mfFrom, &mfTo),
+		TargetDigest: artifactsTo[0].Digest,
+	}
+	limits, _ := ctx.Value(contextKey("limits")).(Limits)
+	if err := checkLimits(&mfFrom, &mfTo, manifOpts.Differ.Name(), limits); err != nil {
+		log.WithError(err).Debug("received request for artifacts that exceed the limits")
+		if errors.Is(err, error2.ErrQuotaExceeded) {
+			apiDelegate.HandleError(error2.ErrQuotaExceeded, "the estimated resource usage exceeds the quotas of the server")
+			return
+		}
+		apiDelegate.HandleError(error2.ErrArtifactTooLarge, "artifacts exceed the limits of the server")
+		return
+	}
+	if pol != nil {
+		if err := authorizeDelta(pol, &mfFrom, &mfTo, manifOpts.DifferChoice); err != nil {
+			log.WithError(err).Debug("delta is not allowed by the policy")
+			apiDelegate.HandleError(error2.ErrForbidden, err.Error())
+			return
+		}
 	}
+	// The size of the artifacts is used to estimate the duration of the delta creation.
+	size := artifactSize(&mfFrom, &mfTo)
+	ctx = context.WithValue(ctx, contextKey("artifactSize"), size)
 
 	deltaImage, err := delegate.GetDeltaLocation(manifOpts)
 	if err != nil {
@@ -195,48 +428,48 @@ func readDelta(ctx context.Context, registry registrydelegate.RegistryDelegate,
 		return
 	}
 
-	// Ensure we do not push the delta to a different registry than the original source images.
-	// We only have to check on of the images because we already previously ensured the sources images are in the same repo.
-	// This should be refactored in the future because it is a bit hacky.
-	err = ociutils.CheckRegistryMatch(fromDigest, deltaImage)
-	if err != nil {
-		log.WithError(err).Error("source images not in the same registry as the delta image")
-		apiDelegate.HandleError(error2.ErrBadRequest, "source images not in the same registry as the delta image")
+	// create dummy manifest
+	deltaImageWithTag := deltaImage
+	if handleExistingDelta(ctx, registry, delegate, apiDelegate, deltaImageWithTag, toImage, manifOpts, creds) {
 		return
 	}
 
-	// create dummy manifest
-	deltaImageWithTag := deltaImage
-	log.Debugf("looking for delta at %s", deltaImageWithTag)
-	if deltaSrc, deltaImageDigest, deltaDescriptor, err := registry.Resolve(deltaImageWithTag, false, creds); err == nil {
-		log.Debugf("found delta at %s", deltaImageDigest)
-		mfDelta, err := registry.LoadManifest(deltaDescriptor, deltaSrc)
+	// Lock the delta location so the delta is only created once, even across replicas.
+	var lease lock.Lease
+	defer func() { releaseLock(ctx, lease) }()
+	if locker, ok := ctx.Value(contextKey("locker")).(lock.Locker); ok {
+		lease, err = locker.TryLock(ctx, deltaImageWithTag)
+		if errors.Is(err, lock.ErrLocked) {
+			log.Debugf("delta %s is being created by someone else", deltaImageWithTag)
+			handleAccepted(ctx, apiDelegate, deltaImageWithTag, retryAfter(ctx, manifOpts, time.Time{}))
+			return
+		}
 		if err != nil {
-			log.WithError(err).Error("failed to load manifest")
+			log.WithError(err).Error("failed to acquire lock")
 			apiDelegate.HandleError(error2.ErrInternal, "")
 			return
 		}
-		dummy, expired := delegate.IsDummy(mfDelta)
-		// the delta has been created
-		if !dummy {
-			// All deltas that get actually served get served here.
-			apiDelegate.HandleSuccess(apicommon.ReadDeltaResponse{
-				TargetImage: toImage,
-				DeltaImage:  deltaImageDigest,
-			})
+		// The delta might have been created by the previous holder of the lock.
+		if handleExistingDelta(ctx, registry, delegate, apiDelegate, deltaImageWithTag, toImage, manifOpts, creds) {
 			return
 		}
-		if expired {
-			metrics.ExpiredDummiesCounter.Inc()
-			log.Errorf("delta image %s is expired", deltaImage)
+	}
+
+	// Only delta creations count against the quota, existing deltas are served regardless.
+	// Creations that fail before the job is done are refunded.
+	var refund func()
+	defer func() {
+		if refund != nil {
+			refund()
 		}
-		// dummy exists and has not expired -> someone else is working on creating this delta
-		if !expired {
-			apiDelegate.HandleAccepted()
+	}()
+	if pol != nil {
+		refund, err = pol.RecordCreation(quotaIdentity(apiDelegate.ClientIP(), clientAuth))
+		if err != nil {
+			log.WithError(err).Debug("quota is exhausted")
+			apiDelegate.HandleError(error2.ErrForbidden, err.Error())
 			return
 		}
-	} else {
-		log.Debugf("failed to resolve delta %v", err)
 	}
 
 	// Push dummy to communicate that someone is working on the delta.
@@ -261,19 +494,159 @@ func readDelta(ctx context.Context, registry registrydelegate.RegistryDelegate,
 		return
 	}
 
-	// asynchronously create delta
+	// asynchronously create delta, the job releases the lock once it is done
+	jobLease, jobRefund := lease, refund
+	lease, refund = nil, nil
+	jobDone := func() {}
+	if jobs, ok := ctx.Value(contextKey("jobs")).(*jobs); ok {
+		jobDone = jobs.start(deltaImageWithTag)
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		defer funcutils.PanicOrLogOnErr(rcTo.Close, false, "failed to close reader")
-		defer funcutils.PanicOrLogOnErr(rcFrom.Close, false, "failed to close reader")
-		err := delegate.CreateDelta(ctx, rcFrom, rcTo, manifOpts, registry)
-		if err != nil {
-			log.WithError(err).Error("failed to create delta")
+		defer jobDone()
+		defer releaseLock(ctx, jobLease)
+		jobCtx, cancel := ctx, context.CancelFunc(func() {})
+		if limits.JobTimeout > 0 {
+			jobCtx, cancel = context.WithTimeout(ctx, limits.JobTimeout)
+		}
+		defer cancel()
+		// Differs do not support contexts, closing the artifacts aborts them if the job is cancelled.
+		stop := context.AfterFunc(jobCtx, func() {
+			_ = rcFrom.Close()
+			_ = rcTo.Close()
+		})
+		defer func() {
+			if stop() {
+				funcutils.PanicOrLogOnErr(rcTo.Close, false, "failed to close reader")
+				funcutils.PanicOrLogOnErr(rcFrom.Close, false, "failed to close reader")
+			}
+		}()
+		started := time.Now()
+		if jobLease != nil {
+			// The heartbeat of the delta creation renews the lease so it does not expire while the delta is created.
+			jobCtx = lock.WithLease(jobCtx, jobLease)
+		}
+		err := delegate.CreateDelta(jobCtx, rcFrom, rcTo, manifOpts, registry)
+		if err == nil {
+			if estimates, ok := ctx.Value(contextKey("estimator")).(estimator.Estimator); ok {
+				estimates.Observe(manifOpts.Differ.Name(), manifOpts.Compressor.Name(), size, time.Since(started))
+			}
+			notifyDeltaReady(ctx, apicommon.DeltaReadyNotification{
+				From:        fromDigest,
+				To:          toTarget,
+				TargetImage: toImage,
+				DeltaImage:  deltaImageWithTag,
+			})
+			return
+		}
+		log.WithError(err).Error("failed to create delta")
+		if jobRefund != nil {
+			jobRefund()
+		}
+		// The dummy is only deleted on shutdowns, otherwise it expires to avoid retrying failing jobs right away.
+		if errors.Is(context.Cause(ctx), errShutdown) {
+			cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+			defer cancel()
+			if err := registry.DeleteDummy(cleanupCtx, deltaImageWithTag, manifOpts); err != nil {
+				log.WithError(err).Error("failed to delete dummy")
+			}
 		}
 	}()
 	// tell client has the delta has been accepted
-	apiDelegate.HandleAccepted()
+	handleAccepted(ctx, apiDelegate, deltaImageWithTag, retryAfter(ctx, manifOpts, time.Time{}))
+}
+
+// notifyDeltaReady tells clients about the created delta if the engine has a notifier.
+// Failed notifications are only logged, clients that are not notified fall back to polling.
+func notifyDeltaReady(ctx context.Context, notification apicommon.DeltaReadyNotification) {
+	notifier, ok := ctx.Value(contextKey("notifier")).(notify.Notifier)
+	if !ok {
+		return
+	}
+	// The notification is sent even if the server is shutting down, the delta has been created.
+	if err := notifier.DeltaReady(context.WithoutCancel(ctx), notification); err != nil {
+		log.WithError(err).Warn("failed to send delta notification")
+	}
+}
+
+// handleExistingDelta responds with the delta at deltaImage if it has been created
+// or with accepted if someone is creating it (there is a dummy that has not expired).
+// Returns false if the delta has to be created.
+func handleExistingDelta(ctx context.Context, registry registrydelegate.RegistryDelegate, delegate deltadelegate.DeltaDelegate, apiDelegate apidelegate.APIDelegate, deltaImage, toImage string, manifOpts registrydelegate.DeltaManifestOptions, creds auth.CredentialFunc) bool {
+	log.Debugf("looking for delta at %s", deltaImage)
+	deltaSrc, deltaImageDigest, deltaDescriptor, err := registry.ResolveDelta(deltaImage, manifOpts, creds)
+	if err != nil {
+		log.Debugf("failed to resolve delta %v", err)
+		return false
+	}
+	log.Debugf("found delta at %s", deltaImageDigest)
+	mfDelta, err := registry.LoadManifest(deltaDescriptor, deltaSrc)
+	if err != nil {
+		log.WithError(err).Error("failed to load manifest")
+		apiDelegate.HandleError(error2.ErrInternal, "")
+		return true
+	}
+	dummy, expired := delegate.IsDummy(mfDelta)
+	// the delta has been created
+	if !dummy {
+		// All deltas that get actually served get served here.
+		if usage, ok := ctx.Value(contextKey("usage")).(gc.UsageStore); ok {
+			if err := usage.MarkServed(deltaDescriptor.Digest); err != nil {
+				log.WithError(err).Warn("failed to record delta usage")
+			}
+		}
+		apiDelegate.HandleSuccess(apicommon.ReadDeltaResponse{
+			TargetImage: toImage,
+			DeltaImage:  deltaImageDigest,
+		})
+		return true
+	}
+	if expired {
+		metrics.ExpiredDummiesCounter.Inc()
+		log.Errorf("delta image %s is expired", deltaImage)
+		return false
+	}
+	// dummy exists and has not expired -> someone else is working on creating this delta
+	started, _ := time.Parse(time.RFC3339, mfDelta.Annotations[v1.AnnotationCreated])
+	handleAccepted(ctx, apiDelegate, deltaImage, retryAfter(ctx, manifOpts, started))
+	return true
+}
+
+// retryAfter returns how long clients should wait before they retry the request for a delta that is being created.
+// The creation started at started, which is zero if it is unknown.
+// Returns 0 if the duration of the creation cannot be estimated.
+func retryAfter(ctx context.Context, manifOpts registrydelegate.DeltaManifestOptions, started time.Time) time.Duration {
+	estimates, ok := ctx.Value(contextKey("estimator")).(estimator.Estimator)
+	if !ok {
+		return 0
+	}
+	size, ok := ctx.Value(contextKey("artifactSize")).(int64)
+	if !ok {
+		return 0
+	}
+	estimate, ok := estimates.Estimate(manifOpts.Differ.Name(), manifOpts.Compressor.Name(), size)
+	if !ok {
+		return 0
+	}
+	remaining := estimate
+	if !started.IsZero() {
+		remaining -= time.Since(started)
+	}
+	// Creations that take longer than estimated are checked again after a fraction of the estimate.
+	return max(remaining, estimate/10, minRetryAfter)
+}
+
+// releaseLock releases the lease if it is not nil, it is also released if the context has been cancelled.
+func releaseLock(ctx context.Context, lease lock.Lease) {
+	if lease == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+	if err := lease.Release(ctx); err != nil {
+		log.WithError(err).Warn("failed to release lock")
+	}
 }
 
 // extractArtifacts extracts the v1.Descriptors slice from the Manifest.
@@ -305,3 +678,42 @@ func checkCompatability(from *ociutils.Manifest, to *ociutils.Manifest) error {
 	}
 	return nil
 }
+
+// artifactSize returns the size of the larger artifact of the manifests.
+func artifactSize(from *ociutils.Manifest, to *ociutils.Manifest) int64 {
+	artifactsFrom, errFrom := extractArtifacts(from)
+	artifactsTo, errTo := extractArtifacts(to)
+	if errFrom != nil || errTo != nil {
+		return 0
+	}
+	return max(artifactsFrom[0].Size, artifactsTo[0].Size)
+}
+
+// checkLimits ensures that the artifacts of both manifests do not exceed the maximum artifact size
+// and that the estimated resource usage of creating the delta with the given differ does not exceed the quotas.
+func checkLimits(from *ociutils.Manifest, to *ociutils.Manifest, differ string, limits Limits) error {
+	artifactsFrom, err := extractArtifacts(from)
+	if err != nil {
+		return err
+	}
+	artifactsTo, err := extractArtifacts(to)
+	if err != nil {
+		return err
+	}
+	fromSize, toSize := artifactsFrom[0].Size, artifactsTo[0].Size
+	if limits.MaxArtifactSize > 0 && max(fromSize, toSize) > limits.MaxArtifactSize {
+		return fmt.Errorf("%w: artifacts have %d and %d bytes, the maximum is %d bytes", error2.ErrArtifactTooLarge, fromSize, toSize, limits.MaxArtifactSize)
+	}
+	a, err := algorithmregistry.Delta(differ)
+	if err != nil || a.EstimateResources == nil {
+		return nil
+	}
+	memory, tempDisk := a.EstimateResources(fromSize, toSize)
+	if limits.MaxEstimatedJobMemory > 0 && memory > limits.MaxEstimatedJobMemory {
+		return fmt.Errorf("%w: %s requires an estimated %d bytes of memory, the quota is %d bytes", error2.ErrQuotaExceeded, differ, memory, limits.MaxEstimatedJobMemory)
+	}
+	if limits.MaxEstimatedJobTempDisk > 0 && tempDisk > limits.MaxEstimatedJobTempDisk {
+		return fmt.Errorf("%w: %s requires an estimated %d bytes of disk space, the quota is %d bytes", error2.ErrQuotaExceeded, differ, tempDisk, limits.MaxEstimatedJobTempDisk)
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -26,11 +27,15 @@ import (
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	apidelegate "github.com/unbasical/doras/internal/pkg/delegates/api"
 	deltadelegate "github.com/unbasical/doras/internal/pkg/delegates/delta"
 	registrydelegate "github.com/unbasical/doras/internal/pkg/delegates/registry"
+	"github.com/unbasical/doras/internal/pkg/lock"
+	"github.com/unbasical/doras/internal/pkg/policy"
 	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
 	"github.com/unbasical/doras/internal/pkg/utils/testutils"
 	"github.com/unbasical/doras/pkg/constants"
+	"github.com/unbasical/doras/pkg/deltalocation"
 	"oras.land/oras-go/v2"
 )
 
@@ -39,6 +44,10 @@ type testRegistryDelegate struct {
 	ctx          context.Context
 	expectedAuth string
 	ioLatency    *time.Duration
+	// dummyLatency delays pushing dummies, like the round trips to a registry.
+	dummyLatency time.Duration
+	m            sync.Mutex
+	deleted      []string
 }
 
 func (t *testRegistryDelegate) Resolve(image string, expectDigest bool, creds auth.CredentialFunc) (oras.ReadOnlyTarget, string, v1.Descriptor, error) {
@@ -78,6 +87,10 @@ func (t *testRegistryDelegate) Resolve(image string, expectDigest bool, creds au
 	return t.storage, image, d, nil
 }
 
+func (t *testRegistryDelegate) ResolveDelta(image string, _ registrydelegate.DeltaManifestOptions, creds auth.CredentialFunc) (oras.ReadOnlyTarget, string, v1.Descriptor, error) {
+	return t.Resolve(image, false, creds)
+}
+
 func (t *testRegistryDelegate) LoadManifest(target v1.Descriptor, source oras.ReadOnlyTarget) (ociutils.Manifest, error) {
 	rc, err := source.Fetch(t.ctx, target)
 	if err != nil {
@@ -133,13 +146,11 @@ func (t *testRegistryDelegate) PushDelta(ctx context.Context, image string, mani
 		return err
 	}
 	deltaDescriptor := v1.Descriptor{
-		MediaType: manifOpts.GetMediaType(),
-		Digest:    digest.NewDigest("sha256", hasher),
-		Size:      n,
-		URLs:      nil,
-		Annotations: map[string]string{
-			constants.OciImageTitle: "delta" + manifOpts.GetFileExt(),
-		},
+		MediaType:   manifOpts.GetMediaType(),
+		Digest:      digest.NewDigest("sha256", hasher),
+		Size:        n,
+		URLs:        nil,
+		Annotations: manifOpts.LayerAnnotations(),
 	}
 	_, err = fp.Seek(0, io.SeekStart)
 	if err != nil {
@@ -156,7 +167,7 @@ func (t *testRegistryDelegate) PushDelta(ctx context.Context, image string, mani
 			constants.DorasAnnotationTo:   manifOpts.To,
 		},
 	}
-	mfDescriptor, err := oras.PackManifest(t.ctx, t.storage, oras.PackManifestVersion1_1, "application/vnd.example+type", opts)
+	mfDescriptor, err := oras.PackManifest(t.ctx, t.storage, oras.PackManifestVersion1_1, constants.DorasDeltaArtifactType, opts)
 	if err != nil {
 		return err
 	}
@@ -169,6 +180,7 @@ func (t *testRegistryDelegate) PushDelta(ctx context.Context, image string, mani
 }
 
 func (t *testRegistryDelegate) PushDummy(image string, manifOpts registrydelegate.DeltaManifestOptions) error {
+	time.Sleep(t.dummyLatency)
 	_, tag, _, err := ociutils.ParseOciImageString(image)
 	if err != nil {
 		return err
@@ -184,7 +196,7 @@ func (t *testRegistryDelegate) PushDummy(image string, manifOpts registrydelegat
 			constants.DorasAnnotationIsDummy: "true",
 		},
 	}
-	mfDescriptor, err := oras.PackManifest(ctx, t.storage, oras.PackManifestVersion1_1, "application/vnd.example+type", opts)
+	mfDescriptor, err := oras.PackManifest(ctx, t.storage, oras.PackManifestVersion1_1, constants.DorasDeltaArtifactType, opts)
 	if err != nil {
 		return fmt.Errorf("failed to pack manifest: %w", err)
 	}
@@ -196,8 +208,22 @@ func (t *testRegistryDelegate) PushDummy(image string, manifOpts registrydelegat
 	return nil
 }
 
+func (t *testRegistryDelegate) DeleteDummy(_ context.Context, image string, _ registrydelegate.DeltaManifestOptions) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.deleted = append(t.deleted, image)
+	return nil
+}
+
+func (t *testRegistryDelegate) RenewDummy(context.Context, string, registrydelegate.DeltaManifestOptions) error {
+	return nil
+}
+
 type testAPIDelegate struct {
 	creds              auth.Credential
+	clientAuth         auth2.RegistryAuth
+	clientAuthErr      error
+	clientIP           string
 	fromImage          string
 	toImage            string
 	acceptedAlgorithms []string
@@ -206,6 +232,11 @@ type testAPIDelegate struct {
 	response           apicommon.ReadDeltaResponse
 	hasHandledCallback bool
 	lastStatusCode     int
+	retryAfter         time.Duration
+	wait               time.Duration
+	pending            int
+	batch              []apicommon.ReadDeltaRequest
+	batchResults       []apidelegate.BatchResult
 }
 
 func (t *testAPIDelegate) HandleNoNewVersion() {
@@ -213,11 +244,38 @@ func (t *testAPIDelegate) HandleNoNewVersion() {
 	t.hasHandledCallback = true
 }
 
+func (t *testAPIDelegate) ClientIP() string {
+	return t.clientIP
+}
+
 func (t *testAPIDelegate) RequestContext() (context.Context, error) {
 	return context.Background(), nil
 }
 
+func (t *testAPIDelegate) ExtractWait() (time.Duration, error) {
+	return t.wait, nil
+}
+
+func (t *testAPIDelegate) HandlePending(time.Duration) {
+	t.pending++
+}
+
+func (t *testAPIDelegate) ExtractBatch() ([]apicommon.ReadDeltaRequest, error) {
+	if len(t.batch) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	return t.batch, nil
+}
+
+func (t *testAPIDelegate) HandleBatch(results []apidelegate.BatchResult) {
+	t.lastStatusCode = http.StatusOK
+	t.batchResults = results
+}
+
 func (t *testAPIDelegate) ExtractClientAuth() (auth2.RegistryAuth, error) {
+	if t.clientAuth != nil || t.clientAuthErr != nil {
+		return t.clientAuth, t.clientAuthErr
+	}
 	if t.creds.AccessToken != "" {
 		return auth2.NewClientAuthFromToken(t.creds.AccessToken), nil
 	}
@@ -248,8 +306,9 @@ func (t *testAPIDelegate) HandleSuccess(response any) {
 	t.hasHandledCallback = true
 }
 
-func (t *testAPIDelegate) HandleAccepted() {
+func (t *testAPIDelegate) HandleAccepted(retryAfter time.Duration) {
 	t.lastStatusCode = http.StatusAccepted
+	t.retryAfter = retryAfter
 }
 
 func Test_readDelta(t *testing.T) {
@@ -297,7 +356,10 @@ func Test_readDelta(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	delegate := deltadelegate.NewDeltaDelegate(5 * time.Minute)
+	delegate := deltadelegate.NewDeltaDelegate(5*time.Minute, nil)
+	targetDelegate := deltadelegate.NewDeltaDelegate(5*time.Minute, deltalocation.Targets{
+		{Source: "registry.example.org", Repository: "cache.example.org/deltas"},
+	})
 	type args struct {
 		registry         registrydelegate.RegistryDelegate
 		delegate         deltadelegate.DeltaDelegate
@@ -305,12 +367,31 @@ func Test_readDelta(t *testing.T) {
 		expectErr        bool
 		expectStatusCode int
 		latency          *time.Duration
+		expectDeltaRepo  string
+		limits           Limits
+		// wantErr is the expected error, it is only checked if set.
+		wantErr error
 	}
 	latency := time.Millisecond * 100
 	tests := []struct {
 		name string
 		args args
 	}{
+		{
+			name: "success (separate storage target)",
+			args: args{
+				registry: registryMock,
+				delegate: targetDelegate,
+				apiDelegate: testAPIDelegate{
+					fromImage:          bsdiffImage1,
+					toImage:            bsdiffImage2,
+					acceptedAlgorithms: []string{"bsdiff", "zstd"},
+				},
+				expectErr:        false,
+				expectStatusCode: http.StatusOK,
+				expectDeltaRepo:  "cache.example.org/deltas/foobar",
+			},
+		},
 		{
 			name: "success (bsdiff)",
 			args: args{
@@ -466,6 +547,54 @@ func Test_readDelta(t *testing.T) {
 				expectStatusCode: http.StatusBadRequest,
 			},
 		},
+		{
+			name: "artifact too large",
+			args: args{
+				registry: registryMock,
+				delegate: delegate,
+				apiDelegate: testAPIDelegate{
+					fromImage:          bsdiffImage1,
+					toImage:            bsdiffImage2,
+					acceptedAlgorithms: []string{"bsdiff"},
+				},
+				limits:           Limits{MaxArtifactSize: 1},
+				expectErr:        true,
+				expectStatusCode: http.StatusBadRequest,
+				wantErr:          error2.ErrArtifactTooLarge,
+			},
+		},
+		{
+			name: "memory quota exceeded",
+			args: args{
+				registry: registryMock,
+				delegate: delegate,
+				apiDelegate: testAPIDelegate{
+					fromImage:          bsdiffImage1,
+					toImage:            bsdiffImage2,
+					acceptedAlgorithms: []string{"bsdiff"},
+				},
+				limits:           Limits{MaxEstimatedJobMemory: 1},
+				expectErr:        true,
+				expectStatusCode: http.StatusBadRequest,
+				wantErr:          error2.ErrQuotaExceeded,
+			},
+		},
+		{
+			name: "temporary disk quota exceeded",
+			args: args{
+				registry: registryMock,
+				delegate: delegate,
+				apiDelegate: testAPIDelegate{
+					fromImage:          tardiffImage1,
+					toImage:            tardiffImage2,
+					acceptedAlgorithms: []string{"tardiff"},
+				},
+				limits:           Limits{MaxEstimatedJobTempDisk: 1},
+				expectErr:        true,
+				expectStatusCode: http.StatusBadRequest,
+				wantErr:          error2.ErrQuotaExceeded,
+			},
+		},
 		{
 			name: "success (tardiff with latency)",
 			args: args{
@@ -489,6 +618,7 @@ func Test_readDelta(t *testing.T) {
 			// which spawns a go routine.
 			wg := &sync.WaitGroup{}
 			ctx := context.WithValue(context.Background(), contextKey("wg"), wg)
+			ctx = context.WithValue(ctx, contextKey("limits"), tt.args.limits)
 			registryMock.ioLatency = tt.args.latency
 			for {
 				readDelta(ctx, tt.args.registry, tt.args.delegate, &tt.args.apiDelegate, false)
@@ -505,6 +635,12 @@ func Test_readDelta(t *testing.T) {
 			if tt.args.expectStatusCode != tt.args.apiDelegate.lastStatusCode {
 				t.Fatalf("readDelta() error = %v, wantErr %v", err, tt.args.apiDelegate.lastStatusCode)
 			}
+			if tt.args.wantErr != nil && !errors.Is(err, tt.args.wantErr) {
+				t.Fatalf("readDelta() error = %v, wantErr %v", err, tt.args.wantErr)
+			}
+			if tt.args.expectDeltaRepo != "" && !strings.HasPrefix(tt.args.apiDelegate.response.DeltaImage, tt.args.expectDeltaRepo+"@") {
+				t.Fatalf("expected delta in %s, got %s", tt.args.expectDeltaRepo, tt.args.apiDelegate.response.DeltaImage)
+			}
 		})
 	}
 }
@@ -539,18 +675,65 @@ func Test_readDelta_Token(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	delegate := deltadelegate.NewDeltaDelegate(5 * time.Minute)
+	delegate := deltadelegate.NewDeltaDelegate(5*time.Minute, nil)
 
 	type args struct {
 		registry    registrydelegate.RegistryDelegate
 		delegate    deltadelegate.DeltaDelegate
 		apiDelegate testAPIDelegate
 		expectErr   bool
+		// wantErr is the expected error, defaults to error2.ErrUnauthorized.
+		wantErr      error
+		optionalAuth bool
 	}
 	tests := []struct {
 		name string
 		args args
 	}{
+		{
+			name: "device token scoped to the repository",
+			args: args{
+				registry: registryMock,
+				delegate: delegate,
+				apiDelegate: testAPIDelegate{
+					clientAuth:         auth2.NewScopedClientAuth("device-1", []string{"registry.example.org/foobar"}, credFunc),
+					fromImage:          image1,
+					toImage:            image2,
+					acceptedAlgorithms: []string{"bsdiff", "tardiff", "zstd", "gzip"},
+				},
+			},
+		},
+		{
+			name: "device token scoped to another repository",
+			args: args{
+				registry: registryMock,
+				delegate: delegate,
+				apiDelegate: testAPIDelegate{
+					clientAuth:         auth2.NewScopedClientAuth("device-1", []string{"registry.example.org/other"}, credFunc),
+					fromImage:          image1,
+					toImage:            image2,
+					acceptedAlgorithms: []string{"bsdiff", "tardiff", "zstd", "gzip"},
+				},
+				expectErr: true,
+				wantErr:   error2.ErrForbidden,
+			},
+		},
+		{
+			name: "invalid device token is rejected if auth is optional",
+			args: args{
+				// The registry allows anonymous access.
+				registry: &testRegistryDelegate{storage: storageTarget},
+				delegate: delegate,
+				apiDelegate: testAPIDelegate{
+					clientAuthErr:      fmt.Errorf("%w: token has expired", error2.ErrUnauthorized),
+					fromImage:          image1,
+					toImage:            image2,
+					acceptedAlgorithms: []string{"bsdiff", "tardiff", "zstd", "gzip"},
+				},
+				expectErr:    true,
+				optionalAuth: true,
+			},
+		},
 		{
 			name: "valid token",
 			args: args{
@@ -613,7 +796,7 @@ func Test_readDelta_Token(t *testing.T) {
 			wg := &sync.WaitGroup{}
 			ctx := context.WithValue(context.Background(), contextKey("wg"), wg)
 			for {
-				readDelta(ctx, tt.args.registry, tt.args.delegate, &tt.args.apiDelegate, true)
+				readDelta(ctx, tt.args.registry, tt.args.delegate, &tt.args.apiDelegate, !tt.args.optionalAuth)
 				if tt.args.apiDelegate.hasHandledCallback {
 					break
 				}
@@ -623,11 +806,565 @@ func Test_readDelta_Token(t *testing.T) {
 				t.Fatalf("readDelta() error = %v, wantErr %v", err, tt.args.expectErr)
 				return
 			}
-			if tt.args.expectErr && !errors.Is(err, error2.ErrUnauthorized) {
-				t.Fatalf("readDelta() error = %v, expectedErr %v", err, error2.ErrUnauthorized)
+			wantErr := tt.args.wantErr
+			if wantErr == nil {
+				wantErr = error2.ErrUnauthorized
+			}
+			if tt.args.expectErr && !errors.Is(err, wantErr) {
+				t.Fatalf("readDelta() error = %v, expectedErr %v", err, wantErr)
 			}
 			response := tt.args.apiDelegate.response
 			fmt.Printf("%v\n", response)
 		})
 	}
 }
+
+// blockingDeltaDelegate blocks delta creations until they are cancelled.
+type blockingDeltaDelegate struct {
+	deltadelegate.DeltaDelegate
+}
+
+func (b *blockingDeltaDelegate) CreateDelta(ctx context.Context, _, _ io.ReadCloser, _ registrydelegate.DeltaManifestOptions, _ registrydelegate.RegistryDelegate) error {
+	<-ctx.Done()
+	return context.Cause(ctx)
+}
+
+func Test_engine_Stop(t *testing.T) {
+	tests := []struct {
+		name          string
+		limits        Limits
+		expectDeleted bool
+	}{
+		{name: "shutdown deletes dummy", expectDeleted: true},
+		{name: "timeout keeps dummy", limits: Limits{JobTimeout: 10 * time.Millisecond}, expectDeleted: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			files := []testutils.FileDescription{
+				{Name: "foobar", Data: []byte("foo"), Tag: "v1", NeedsUnpack: false},
+				{Name: "foobar", Data: []byte("bar"), Tag: "v2", NeedsUnpack: false},
+			}
+			storage, err := testutils.StorageFromFiles(ctx, t.TempDir(), files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			registryMock := &testRegistryDelegate{
+				storage: storage.(oras.Target),
+			}
+			_, image1, d, err := registryMock.Resolve("registry.example.org/foobar:v1", false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			image1 = strings.ReplaceAll(image1, ":v1", "@"+d.Digest.String())
+			delegate := &blockingDeltaDelegate{DeltaDelegate: deltadelegate.NewDeltaDelegate(5*time.Minute, nil)}
+			e := NewEngine(registryMock, delegate, WithLimits(tt.limits))
+			apiDelegate := &testAPIDelegate{
+				fromImage:          image1,
+				toImage:            "registry.example.org/foobar:v2",
+				acceptedAlgorithms: []string{"bsdiff"},
+			}
+			e.HandleReadDelta(apiDelegate)
+			if apiDelegate.lastStatusCode != http.StatusAccepted {
+				t.Fatalf("expected request to be accepted, got status %d: %v", apiDelegate.lastStatusCode, apiDelegate.lastErr)
+			}
+			stopCtx := ctx
+			if tt.expectDeleted {
+				var cancel context.CancelFunc
+				stopCtx, cancel = context.WithCancel(ctx)
+				cancel()
+			}
+			e.Stop(stopCtx)
+			if deleted := len(registryMock.deleted) > 0; deleted != tt.expectDeleted {
+				t.Errorf("expected dummy deletion to be %v, got %v", tt.expectDeleted, registryMock.deleted)
+			}
+		})
+	}
+}
+
+// countingDeltaDelegate counts delta creations instead of creating deltas.
+type countingDeltaDelegate struct {
+	deltadelegate.DeltaDelegate
+	created atomic.Int32
+}
+
+func (c *countingDeltaDelegate) CreateDelta(_ context.Context, _, _ io.ReadCloser, _ registrydelegate.DeltaManifestOptions, _ registrydelegate.RegistryDelegate) error {
+	c.created.Add(1)
+	return nil
+}
+
+func Test_engine_Replicas(t *testing.T) {
+	ctx := context.Background()
+	files := []testutils.FileDescription{
+		{Name: "foobar", Data: []byte("foo"), Tag: "v1", NeedsUnpack: false},
+		{Name: "foobar", Data: []byte("bar"), Tag: "v2", NeedsUnpack: false},
+	}
+	storage, err := testutils.StorageFromFiles(ctx, t.TempDir(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locker, err := lock.NewFileLocker(t.TempDir(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delegate := &countingDeltaDelegate{DeltaDelegate: deltadelegate.NewDeltaDelegate(5*time.Minute, nil)}
+	// Replicas share the storage and the locks but not their in-process state.
+	replicas := make([]Engine, 4)
+	for i := range replicas {
+		registryMock := &testRegistryDelegate{storage: storage.(oras.Target), dummyLatency: 10 * time.Millisecond}
+		replicas[i] = NewEngine(registryMock, delegate, WithLocker(locker))
+	}
+	_, image1, d, err := (&testRegistryDelegate{storage: storage.(oras.Target)}).Resolve("registry.example.org/foobar:v1", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image1 = strings.ReplaceAll(image1, ":v1", "@"+d.Digest.String())
+	wg := sync.WaitGroup{}
+	for i := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			apiDelegate := &testAPIDelegate{
+				fromImage:          image1,
+				toImage:            "registry.example.org/foobar:v2",
+				acceptedAlgorithms: []string{"bsdiff"},
+			}
+			replicas[i%len(replicas)].HandleReadDelta(apiDelegate)
+			if apiDelegate.lastErr != nil {
+				t.Error(apiDelegate.lastErr)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, e := range replicas {
+		e.Stop(ctx)
+	}
+	if n := delegate.created.Load(); n != 1 {
+		t.Errorf("expected the delta to be created once, got %d", n)
+	}
+}
+
+func Test_engine_Policy(t *testing.T) {
+	ctx := context.Background()
+	files := []testutils.FileDescription{
+		{Name: "foobar", Data: []byte("foo"), Tag: "v1", NeedsUnpack: false},
+		{Name: "foobar", Data: []byte("bar"), Tag: "v2", NeedsUnpack: false},
+		{Name: "foobar", Data: []byte("baz"), Tag: "v3", NeedsUnpack: false},
+	}
+	type request struct {
+		to         string
+		algorithms []string
+		// username authenticates the request with basic auth instead of the token of device-1.
+		username string
+		ip       string
+		wantErr  error
+	}
+	tests := []struct {
+		name     string
+		config   policy.Config
+		requests []request
+	}{
+		{
+			name:     "allowed",
+			config:   policy.Config{Repositories: []string{"registry.example.org/*"}, Algorithms: []string{"bsdiff", "zstd"}, MaxArtifactSize: 1 << 20},
+			requests: []request{{to: "v2", algorithms: []string{"bsdiff", "zstd"}}},
+		},
+		{
+			name:     "repository is not allowed",
+			config:   policy.Config{Repositories: []string{"registry.example.org/apps/*"}},
+			requests: []request{{to: "v2", algorithms: []string{"bsdiff"}, wantErr: error2.ErrForbidden}},
+		},
+		{
+			name:     "algorithm is not allowed",
+			config:   policy.Config{Algorithms: []string{"tardiff"}},
+			requests: []request{{to: "v2", algorithms: []string{"bsdiff"}, wantErr: error2.ErrForbidden}},
+		},
+		{
+			name:     "fallback algorithm is not allowed",
+			config:   policy.Config{Algorithms: []string{"tardiff"}},
+			requests: []request{{to: "v2", algorithms: []string{"tardiff"}, wantErr: error2.ErrForbidden}},
+		},
+		{
+			name:     "artifact is too large",
+			config:   policy.Config{MaxArtifactSize: 2},
+			requests: []request{{to: "v2", algorithms: []string{"bsdiff"}, wantErr: error2.ErrForbidden}},
+		},
+		{
+			name:   "quota",
+			config: policy.Config{Quotas: []policy.Quota{{Identity: "device-*", MaxDeltaCreations: 1}}},
+			requests: []request{
+				{to: "v2", algorithms: []string{"bsdiff"}},
+				// The delta is being created, polling does not count against the quota.
+				{to: "v2", algorithms: []string{"bsdiff"}},
+				{to: "v3", algorithms: []string{"bsdiff"}, wantErr: error2.ErrForbidden},
+			},
+		},
+		{
+			name:   "quota of clients without verified identity",
+			config: policy.Config{Quotas: []policy.Quota{{Identity: "ip:*", MaxDeltaCreations: 1}}},
+			requests: []request{
+				{to: "v2", algorithms: []string{"bsdiff"}, username: "device-1", ip: "192.0.2.1"},
+				// Clients cannot evade the quota of their IP by changing the username.
+				{to: "v3", algorithms: []string{"bsdiff"}, username: "device-2", ip: "192.0.2.1", wantErr: error2.ErrForbidden},
+				{to: "v3", algorithms: []string{"bsdiff"}, username: "device-2", ip: "192.0.2.2"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol, err := policy.New(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Each case has its own storage, so dummies of other cases do not count as existing deltas.
+			storage, err := testutils.StorageFromFiles(ctx, t.TempDir(), files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			registryMock := &testRegistryDelegate{storage: storage.(oras.Target)}
+			_, image1, d, err := registryMock.Resolve("registry.example.org/foobar:v1", false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			image1 = strings.ReplaceAll(image1, ":v1", "@"+d.Digest.String())
+			delegate := &countingDeltaDelegate{DeltaDelegate: deltadelegate.NewDeltaDelegate(5*time.Minute, nil)}
+			e := NewEngine(registryMock, delegate, WithPolicy(pol))
+			defer e.Stop(ctx)
+			for _, r := range tt.requests {
+				var clientAuth auth2.RegistryAuth = auth2.NewScopedClientAuth("device-1", []string{"registry.example.org/foobar"}, nil)
+				if r.username != "" {
+					clientAuth = auth2.NewClientAuthFromUsernamePassword(r.username, "secret")
+				}
+				apiDelegate := &testAPIDelegate{
+					clientAuth:         clientAuth,
+					clientIP:           r.ip,
+					fromImage:          image1,
+					toImage:            "registry.example.org/foobar:" + r.to,
+					acceptedAlgorithms: r.algorithms,
+				}
+				e.HandleReadDelta(apiDelegate)
+				if r.wantErr != nil {
+					if !errors.Is(apiDelegate.lastErr, r.wantErr) {
+						t.Fatalf("expected error %v, got %v", r.wantErr, apiDelegate.lastErr)
+					}
+					continue
+				}
+				if apiDelegate.lastStatusCode != http.StatusAccepted {
+					t.Fatalf("expected request to be accepted, got status %d: %v %s", apiDelegate.lastStatusCode, apiDelegate.lastErr, apiDelegate.lastErrMsg)
+				}
+			}
+		})
+	}
+}
+
+// failingDeltaDelegate fails all delta creations.
+type failingDeltaDelegate struct {
+	deltadelegate.DeltaDelegate
+}
+
+func (f *failingDeltaDelegate) CreateDelta(_ context.Context, _, _ io.ReadCloser, _ registrydelegate.DeltaManifestOptions, _ registrydelegate.RegistryDelegate) error {
+	return errors.New("delta creation failed")
+}
+
+func Test_engine_QuotaRefund(t *testing.T) {
+	ctx := context.Background()
+	files := []testutils.FileDescription{
+		{Name: "foobar", Data: []byte("foo"), Tag: "v1", NeedsUnpack: false},
+		{Name: "foobar", Data: []byte("bar"), Tag: "v2", NeedsUnpack: false},
+		{Name: "foobar", Data: []byte("baz"), Tag: "v3", NeedsUnpack: false},
+	}
+	storage, err := testutils.StorageFromFiles(ctx, t.TempDir(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registryMock := &testRegistryDelegate{storage: storage.(oras.Target)}
+	_, image1, d, err := registryMock.Resolve("registry.example.org/foobar:v1", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image1 = strings.ReplaceAll(image1, ":v1", "@"+d.Digest.String())
+	pol, err := policy.New(policy.Config{Quotas: []policy.Quota{{Identity: "device-*", MaxDeltaCreations: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(registryMock, &failingDeltaDelegate{DeltaDelegate: deltadelegate.NewDeltaDelegate(5*time.Minute, nil)}, WithPolicy(pol))
+	defer e.Stop(ctx)
+	request := func(to string) *testAPIDelegate {
+		apiDelegate := &testAPIDelegate{
+			clientAuth:         auth2.NewScopedClientAuth("device-1", []string{"registry.example.org/foobar"}, nil),
+			fromImage:          image1,
+			toImage:            "registry.example.org/foobar:" + to,
+			acceptedAlgorithms: []string{"bsdiff"},
+		}
+		e.HandleReadDelta(apiDelegate)
+		return apiDelegate
+	}
+	if res := request("v2"); res.lastStatusCode != http.StatusAccepted {
+		t.Fatalf("expected request to be accepted, got status %d: %v %s", res.lastStatusCode, res.lastErr, res.lastErrMsg)
+	}
+	// The failed creation is refunded once the job is done, so the quota allows another creation.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res := request("v3")
+		if res.lastStatusCode == http.StatusAccepted {
+			break
+		}
+		if !errors.Is(res.lastErr, error2.ErrForbidden) || time.Now().After(deadline) {
+			t.Fatalf("expected the failed creation to be refunded, got status %d: %v %s", res.lastStatusCode, res.lastErr, res.lastErrMsg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_engine_RetryAfter(t *testing.T) {
+	ctx := context.Background()
+	files := []testutils.FileDescription{
+		{Name: "foobar", Data: []byte("foo"), Tag: "v1", NeedsUnpack: false},
+		{Name: "foobar", Data: []byte("bar"), Tag: "v2", NeedsUnpack: false},
+		{Name: "foobar", Data: []byte("baz"), Tag: "v3", NeedsUnpack: false},
+	}
+	storage, err := testutils.StorageFromFiles(ctx, t.TempDir(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registryMock := &testRegistryDelegate{storage: storage.(oras.Target)}
+	_, image1, d, err := registryMock.Resolve("registry.example.org/foobar:v1", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image1 = strings.ReplaceAll(image1, ":v1", "@"+d.Digest.String())
+	delegate := &blockingDeltaDelegate{DeltaDelegate: deltadelegate.NewDeltaDelegate(5*time.Minute, nil)}
+	e := NewEngine(registryMock, delegate)
+	defer func() {
+		stopCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		e.Stop(stopCtx)
+	}()
+	request := func(to string) time.Duration {
+		t.Helper()
+		apiDelegate := &testAPIDelegate{
+			fromImage:          image1,
+			toImage:            "registry.example.org/foobar:" + to,
+			acceptedAlgorithms: []string{"bsdiff"},
+		}
+		e.HandleReadDelta(apiDelegate)
+		if apiDelegate.lastStatusCode != http.StatusAccepted {
+			t.Fatalf("expected request to be accepted, got status %d: %v", apiDelegate.lastStatusCode, apiDelegate.lastErr)
+		}
+		return apiDelegate.retryAfter
+	}
+	// Without previous creations there is no estimate.
+	if got := request("v2"); got != 0 {
+		t.Errorf("expected no suggestion without previous creations, got %v", got)
+	}
+	e.(*engine).estimates.Observe("bsdiff", "", 3, time.Minute)
+	if got := request("v3"); got != time.Minute {
+		t.Errorf("expected the estimate for a new creation, got %v", got)
+	}
+	// The creation is in progress, the time that has passed is subtracted from the estimate.
+	if got := request("v3"); got < minRetryAfter || got > time.Minute {
+		t.Errorf("expected the remaining time of the creation, got %v", got)
+	}
+}
+
+// gatedDeltaDelegate creates deltas once the gate is opened.
+type gatedDeltaDelegate struct {
+	deltadelegate.DeltaDelegate
+	gate chan struct{}
+}
+
+func (g *gatedDeltaDelegate) CreateDelta(ctx context.Context, from, to io.ReadCloser, manifOpts registrydelegate.DeltaManifestOptions, registry registrydelegate.RegistryDelegate) error {
+	select {
+	case <-g.gate:
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+	return g.DeltaDelegate.CreateDelta(ctx, from, to, manifOpts, registry)
+}
+
+func Test_engine_Wait(t *testing.T) {
+	tests := []struct {
+		name        string
+		wait        time.Duration
+		open        bool
+		stopWaiting bool
+		wantStatus  int
+	}{
+		{name: "delta is created", wait: time.Minute, open: true, wantStatus: http.StatusOK},
+		{name: "timeout", wait: 50 * time.Millisecond, wantStatus: http.StatusAccepted},
+		{name: "shutdown", wait: time.Minute, stopWaiting: true, wantStatus: http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			files := []testutils.FileDescription{
+				{Name: "foobar", Data: []byte("foo"), Tag: "v1", NeedsUnpack: false},
+				{Name: "foobar", Data: []byte("bar"), Tag: "v2", NeedsUnpack: false},
+			}
+			storage, err := testutils.StorageFromFiles(ctx, t.TempDir(), files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			registryMock := &testRegistryDelegate{storage: storage.(oras.Target)}
+			_, image1, d, err := registryMock.Resolve("registry.example.org/foobar:v1", false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			image1 = strings.ReplaceAll(image1, ":v1", "@"+d.Digest.String())
+			delegate := &gatedDeltaDelegate{DeltaDelegate: deltadelegate.NewDeltaDelegate(5*time.Minute, nil), gate: make(chan struct{})}
+			e := NewEngine(registryMock, delegate)
+			defer func() {
+				stopCtx, cancel := context.WithCancel(ctx)
+				cancel()
+				e.Stop(stopCtx)
+			}()
+			apiDelegate := &testAPIDelegate{
+				fromImage:          image1,
+				toImage:            "registry.example.org/foobar:v2",
+				acceptedAlgorithms: []string{"bsdiff"},
+				wait:               tt.wait,
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				e.HandleReadDelta(apiDelegate)
+			}()
+			time.Sleep(20 * time.Millisecond)
+			if tt.open {
+				close(delegate.gate)
+			}
+			if tt.stopWaiting {
+				e.StopWaiting()
+			}
+			// The request is handled again once the job finishes, not after the poll interval.
+			select {
+			case <-done:
+			case <-time.After(waitPollInterval / 2):
+				t.Fatal("request did not finish in time")
+			}
+			if apiDelegate.lastStatusCode != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %v", tt.wantStatus, apiDelegate.lastStatusCode, apiDelegate.lastErr)
+			}
+			if apiDelegate.pending == 0 {
+				t.Error("expected the client to be notified while waiting")
+			}
+		})
+	}
+}
+
+func Test_engine_HandleReadDeltas(t *testing.T) {
+	ctx := context.Background()
+	files := []testutils.FileDescription{
+		{Name: "foobar", Data: []byte("foo"), Tag: "v1", NeedsUnpack: false},
+		{Name: "foobar", Data: []byte("bar"), Tag: "v2", NeedsUnpack: false},
+	}
+	storage, err := testutils.StorageFromFiles(ctx, t.TempDir(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registryMock := &testRegistryDelegate{storage: storage.(oras.Target)}
+	_, image1, d, err := registryMock.Resolve("registry.example.org/foobar:v1", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image1 = strings.ReplaceAll(image1, ":v1", "@"+d.Digest.String())
+	delegate := &countingDeltaDelegate{DeltaDelegate: deltadelegate.NewDeltaDelegate(5*time.Minute, nil)}
+	e := NewEngine(registryMock, delegate)
+	defer e.Stop(ctx)
+	apiDelegate := &testAPIDelegate{
+		batch: []apicommon.ReadDeltaRequest{
+			{From: image1, To: "registry.example.org/foobar:v2", AcceptedAlgorithms: []string{"bsdiff"}},
+			{From: image1, To: image1, AcceptedAlgorithms: []string{"bsdiff"}},
+			{From: image1, To: "registry.example.org/foobar:v3", AcceptedAlgorithms: []string{"bsdiff"}},
+			{From: image1},
+		},
+	}
+	e.HandleReadDeltas(apiDelegate)
+	if len(apiDelegate.batchResults) != len(apiDelegate.batch) {
+		t.Fatalf("expected %d results, got %d", len(apiDelegate.batch), len(apiDelegate.batchResults))
+	}
+	results := apiDelegate.batchResults
+	if !results[0].Accepted {
+		t.Errorf("expected the first request to be accepted, got %+v", results[0])
+	}
+	if !results[1].NoNewVersion {
+		t.Errorf("expected identical images, got %+v", results[1])
+	}
+	if !errors.Is(results[2].Err, error2.ErrInvalidOciImage) {
+		t.Errorf("expected unresolvable image, got %+v", results[2])
+	}
+	if !errors.Is(results[3].Err, error2.ErrBadRequest) {
+		t.Errorf("expected bad request, got %+v", results[3])
+	}
+	// The batch is rejected as a whole if it cannot be extracted.
+	apiDelegate = &testAPIDelegate{}
+	e.HandleReadDeltas(apiDelegate)
+	if !errors.Is(apiDelegate.lastErr, error2.ErrBadRequest) {
+		t.Errorf("expected bad request, got %v", apiDelegate.lastErr)
+	}
+}
+
+// recordingNotifier records the notifications it has been asked to send.
+type recordingNotifier struct {
+	notifications chan apicommon.DeltaReadyNotification
+}
+
+func (r *recordingNotifier) DeltaReady(_ context.Context, notification apicommon.DeltaReadyNotification) error {
+	r.notifications <- notification
+	return nil
+}
+
+func (r *recordingNotifier) Close() error {
+	return nil
+}
+
+func Test_engine_notifiesCreatedDeltas(t *testing.T) {
+	ctx := context.Background()
+	files := []testutils.FileDescription{
+		{Name: "foobar", Data: []byte("foo"), Tag: "v1", NeedsUnpack: false},
+		{Name: "foobar", Data: []byte("bar"), Tag: "v2", NeedsUnpack: false},
+	}
+	storage, err := testutils.StorageFromFiles(ctx, t.TempDir(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registryMock := &testRegistryDelegate{storage: storage.(oras.Target)}
+	_, image1, d, err := registryMock.Resolve("registry.example.org/foobar:v1", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image1 = strings.ReplaceAll(image1, ":v1", "@"+d.Digest.String())
+	notifier := &recordingNotifier{notifications: make(chan apicommon.DeltaReadyNotification, 1)}
+	e := NewEngine(registryMock, deltadelegate.NewDeltaDelegate(5*time.Minute, nil), WithNotifier(notifier))
+	defer e.Stop(ctx)
+	request := func() *testAPIDelegate {
+		apiDelegate := &testAPIDelegate{
+			fromImage:          image1,
+			toImage:            "registry.example.org/foobar:v2",
+			acceptedAlgorithms: []string{"bsdiff"},
+		}
+		e.HandleReadDelta(apiDelegate)
+		return apiDelegate
+	}
+	if apiDelegate := request(); apiDelegate.lastStatusCode != http.StatusAccepted {
+		t.Fatalf("expected request to be accepted, got status %d: %v", apiDelegate.lastStatusCode, apiDelegate.lastErr)
+	}
+	var notification apicommon.DeltaReadyNotification
+	select {
+	case notification = <-notifier.notifications:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no notification has been sent")
+	}
+	if notification.From != image1 || notification.To != "registry.example.org/foobar:v2" || notification.DeltaImage == "" {
+		t.Errorf("unexpected notification %+v", notification)
+	}
+	// Existing deltas are served without notifications.
+	if apiDelegate := request(); apiDelegate.lastStatusCode != http.StatusOK {
+		t.Fatalf("expected the delta, got status %d: %v", apiDelegate.lastStatusCode, apiDelegate.lastErr)
+	}
+	select {
+	case notification := <-notifier.notifications:
+		t.Errorf("unexpected notification %+v", notification)
+	default:
+	}
+}
@@ -0,0 +1,105 @@
+package dorasengine
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	apidelegate "github.com/unbasical/doras/internal/pkg/delegates/api"
+)
+
+// waitPollInterval is the interval at which waiting requests look for deltas that are created by other replicas.
+const waitPollInterval = 5 * time.Second
+
+// jobs notifies requests that wait for deltas when the creations of the deltas in this process finish.
+type jobs struct {
+	m    sync.Mutex
+	done map[string]chan struct{}
+}
+
+func newJobs() *jobs {
+	return &jobs{done: make(map[string]chan struct{})}
+}
+
+// start registers the creation of the delta at the location, the returned function has to be called once it finishes.
+func (j *jobs) start(location string) func() {
+	j.m.Lock()
+	defer j.m.Unlock()
+	done := make(chan struct{})
+	j.done[location] = done
+	return func() {
+		j.m.Lock()
+		defer j.m.Unlock()
+		if j.done[location] == done {
+			delete(j.done, location)
+		}
+		close(done)
+	}
+}
+
+// wait returns a channel that is closed once the creation of the delta at the location finishes.
+// Returns nil if the delta is not being created by this process.
+func (j *jobs) wait(location string) <-chan struct{} {
+	j.m.Lock()
+	defer j.m.Unlock()
+	return j.done[location]
+}
+
+// waitingDelegate defers the response to accepted requests, so they can be handled again once the delta has been created.
+type waitingDelegate struct {
+	apidelegate.APIDelegate
+	accepted   bool
+	retryAfter time.Duration
+	// deltaImage is the location of the delta that is being created.
+	deltaImage string
+}
+
+func (w *waitingDelegate) HandleAccepted(retryAfter time.Duration) {
+	w.accepted = true
+	w.retryAfter = retryAfter
+}
+
+// handleAccepted responds that the delta at deltaImage is being created.
+// Requests that wait for the delta are told where it is created.
+func handleAccepted(ctx context.Context, apiDelegate apidelegate.APIDelegate, deltaImage string, retryAfter time.Duration) {
+	if w, ok := ctx.Value(contextKey("waiter")).(*waitingDelegate); ok {
+		w.deltaImage = deltaImage
+	}
+	apiDelegate.HandleAccepted(retryAfter)
+}
+
+// waitForDelta handles the request until the delta has been created or the client waited for the given duration.
+// The request is handled again whenever the creation of the delta in this process finishes
+// and every waitPollInterval to find deltas that have been created by other replicas.
+func (d *engine) waitForDelta(ctx context.Context, apiDelegate apidelegate.APIDelegate, wait time.Duration) {
+	requestCtx, err := apiDelegate.RequestContext()
+	if err != nil {
+		requestCtx = context.Background()
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		w := &waitingDelegate{APIDelegate: apiDelegate}
+		readDelta(context.WithValue(ctx, contextKey("waiter"), w), d.registry, d.delegate, w, d.requireClientAuth)
+		if !w.accepted {
+			return
+		}
+		apiDelegate.HandlePending(w.retryAfter)
+		poll := time.NewTimer(waitPollInterval)
+		select {
+		case <-d.jobs.wait(w.deltaImage):
+		case <-poll.C:
+		case <-timeout.C:
+			apiDelegate.HandleAccepted(w.retryAfter)
+			return
+		case <-d.stopWaiting:
+			apiDelegate.HandleAccepted(w.retryAfter)
+			return
+		case <-requestCtx.Done():
+			log.Debug("client stopped waiting for the delta")
+			return
+		}
+		poll.Stop()
+	}
+}
@@ -0,0 +1,86 @@
+// Package estimator estimates how long delta creations take, servers use it to tell clients when to retry their requests.
+package estimator
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// smoothing is the weight of new observations, older observations decay so estimates adapt to changing load.
+const smoothing = 0.3
+
+// Estimator estimates the duration of delta creations from the durations of previous creations with similar artifacts.
+// Creations are similar if they use the same algorithms and their artifacts are in the same size class (powers of two).
+// Observations are kept in memory, each replica only knows its own creations and starts without estimates after restarts.
+type Estimator interface {
+	// Observe records the duration of a delta creation with the algorithms for artifacts of the given size.
+	Observe(differ, compressor string, size int64, d time.Duration)
+	// Estimate returns the estimated duration of a delta creation, false is returned if there are no previous creations with the algorithms.
+	// If there are no creations in the size class of the artifacts, the duration of the closest class is scaled to the size.
+	Estimate(differ, compressor string, size int64) (time.Duration, bool)
+}
+
+type key struct {
+	differ     string
+	compressor string
+}
+
+// class is the smoothed duration per byte of the creations in a size class.
+type class struct {
+	secondsPerByte float64
+}
+
+type estimator struct {
+	m       sync.Mutex
+	classes map[key]map[int]class
+}
+
+// New returns an Estimator without previous creations.
+func New() Estimator {
+	return &estimator{classes: make(map[key]map[int]class)}
+}
+
+// sizeClass returns the size class of artifacts, sizes in [2^(n-1), 2^n) are in class n.
+func sizeClass(size int64) int {
+	return bits.Len64(uint64(max(size, 1)))
+}
+
+func (e *estimator) Observe(differ, compressor string, size int64, d time.Duration) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	k := key{differ: differ, compressor: compressor}
+	if e.classes[k] == nil {
+		e.classes[k] = make(map[int]class)
+	}
+	rate := d.Seconds() / float64(max(size, 1))
+	c, ok := e.classes[k][sizeClass(size)]
+	if ok {
+		rate = smoothing*rate + (1-smoothing)*c.secondsPerByte
+	}
+	e.classes[k][sizeClass(size)] = class{secondsPerByte: rate}
+}
+
+func (e *estimator) Estimate(differ, compressor string, size int64) (time.Duration, bool) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	classes := e.classes[key{differ: differ, compressor: compressor}]
+	target := sizeClass(size)
+	closest, found := 0, false
+	for n := range classes {
+		if !found || abs(n-target) < abs(closest-target) || (abs(n-target) == abs(closest-target) && n > closest) {
+			closest, found = n, true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	return time.Duration(classes[closest].secondsPerByte * float64(max(size, 1)) * float64(time.Second)), true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,46 @@
+package estimator
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_estimator_Estimate(t *testing.T) {
+	const mib = 1 << 20
+	e := New()
+	e.Observe("bsdiff", "zstd", 10*mib, 10*time.Second)
+	e.Observe("bsdiff", "zstd", 1000*mib, 2000*time.Second)
+	tests := []struct {
+		name       string
+		differ     string
+		compressor string
+		size       int64
+		want       time.Duration
+		wantOK     bool
+	}{
+		{name: "same size", differ: "bsdiff", compressor: "zstd", size: 10 * mib, want: 10 * time.Second, wantOK: true},
+		{name: "same size class", differ: "bsdiff", compressor: "zstd", size: 12 * mib, want: 12 * time.Second, wantOK: true},
+		{name: "closest size class", differ: "bsdiff", compressor: "zstd", size: 40 * mib, want: 40 * time.Second, wantOK: true},
+		{name: "larger artifacts", differ: "bsdiff", compressor: "zstd", size: 600 * mib, want: 1200 * time.Second, wantOK: true},
+		{name: "other algorithms", differ: "tardiff", compressor: "zstd", size: 10 * mib},
+		{name: "other compressor", differ: "bsdiff", compressor: "gzip", size: 10 * mib},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := e.Estimate(tt.differ, tt.compressor, tt.size)
+			if ok != tt.wantOK || (got-tt.want).Abs() > time.Millisecond {
+				t.Errorf("Estimate() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func Test_estimator_Observe(t *testing.T) {
+	e := New()
+	e.Observe("bsdiff", "", 100, 10*time.Second)
+	e.Observe("bsdiff", "", 100, 20*time.Second)
+	// New observations are weighted with the smoothing factor.
+	if got, _ := e.Estimate("bsdiff", "", 100); (got - 13*time.Second).Abs() > time.Millisecond {
+		t.Errorf("expected smoothed estimate of 13s, got %v", got)
+	}
+}
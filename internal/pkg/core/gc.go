@@ -0,0 +1,57 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/unbasical/doras/configs"
+	"github.com/unbasical/doras/internal/pkg/gc"
+	"github.com/unbasical/doras/internal/pkg/storage"
+	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// newCollector constructs a gc.Collector with the policy from the server config.
+func newCollector(config configs.ServerConfig, repositories storage.Provider, creds auth.CredentialFunc, usage gc.UsageStore, dryRun bool) gc.Collector {
+	dummyExpirationMins := config.CliOpts.DummyExpirationDurationMins
+	if dummyExpirationMins == 0 {
+		dummyExpirationMins = 5
+	}
+	policy := gc.Policy{
+		MaxAge:          time.Duration(config.CliOpts.GCMaxAgeDays) * 24 * time.Hour,
+		UnusedFor:       time.Duration(config.CliOpts.GCUnusedDays) * 24 * time.Hour,
+		DummyExpiration: time.Duration(dummyExpirationMins) * time.Minute,
+		DryRun:          dryRun,
+	}
+	return gc.NewCollector(repositories, creds, policy, usage)
+}
+
+// CollectGarbage deletes stale deltas and expired dummies in the given repositories.
+// If no repositories are provided the repositories from the config file are used.
+func CollectGarbage(ctx context.Context, config configs.ServerConfig, repositories []string, dryRun bool) ([]gc.Report, error) {
+	if len(repositories) == 0 {
+		repositories = config.ConfigFile.GC.Repositories
+	}
+	if len(repositories) == 0 {
+		return nil, errors.New("no repositories provided")
+	}
+	usage, err := gc.NewUsageStore(config.CliOpts.DeltaUsageFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer funcutils.PanicOrLogOnErr(usage.Close, false, "failed to persist delta usage")
+	storageProvider, err := newStorageProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	collector := newCollector(config, storageProvider, loadCredentials(config), usage, dryRun)
+	var reports []gc.Report
+	var errs []error
+	for _, repoName := range repositories {
+		report, err := collector.Collect(ctx, repoName)
+		reports = append(reports, report)
+		errs = append(errs, err)
+	}
+	return reports, errors.Join(errs...)
+}
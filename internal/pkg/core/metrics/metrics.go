@@ -23,6 +23,13 @@ var (
 			Help: "Total number of expired dummies",
 		},
 	)
+	ThrottledRequestsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "throttled_requests_total",
+			Help: "Total number of requests that were rejected because the client exceeded its rate limit",
+		},
+		[]string{"path"},
+	)
 	DeltaCreationDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "delta_creation_duration_seconds",
@@ -55,6 +62,7 @@ func init() {
 	// register universal metrics
 	DorasRegisterer.MustRegister(DeltaRequestCounter)
 	DorasRegisterer.MustRegister(ExpiredDummiesCounter)
+	DorasRegisterer.MustRegister(ThrottledRequestsCounter)
 	DorasRegisterer.MustRegister(DeltaCreationDuration)
 }
 
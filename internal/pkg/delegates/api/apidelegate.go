@@ -1,14 +1,46 @@
 package apidelegate
 
 import (
+	"context"
+	"time"
+
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
 	auth2 "github.com/unbasical/doras/internal/pkg/auth"
 )
 
+// BatchResult is the result of a single request of a batch, it records the handler that has been called.
+type BatchResult struct {
+	// Delta is set by HandleSuccess.
+	Delta *apicommon.ReadDeltaResponse
+	// Accepted and RetryAfter are set by HandleAccepted.
+	Accepted   bool
+	RetryAfter time.Duration
+	// NoNewVersion is set by HandleNoNewVersion.
+	NoNewVersion bool
+	// Err and ErrMsg are set by HandleError.
+	Err    error
+	ErrMsg string
+}
+
 type APIDelegate interface {
 	ExtractParams() (fromImage, toImage string, acceptedAlgorithms []string, err error)
 	ExtractClientAuth() (auth2.RegistryAuth, error)
+	// ClientIP returns the IP of the client, it identifies clients without verified identity.
+	ClientIP() string
+	// ExtractBatch returns the requests of a batch, requests without accepted algorithms accept the default algorithms.
+	ExtractBatch() ([]apicommon.ReadDeltaRequest, error)
+	// ExtractWait returns how long the client waits for the delta to be created, 0 if it does not want to wait.
+	ExtractWait() (time.Duration, error)
+	// RequestContext returns the context of the request, it is done if the client disconnects.
+	RequestContext() (context.Context, error)
 	HandleError(err error, msg string)
 	HandleSuccess(response any)
-	HandleAccepted()
+	// HandleAccepted responds that the delta is being created, clients should retry after retryAfter (0 if there is no estimate).
+	HandleAccepted(retryAfter time.Duration)
+	// HandlePending notifies the client that the delta is still being created while the request waits for it.
+	// Only clients that stream the progress of the request are notified.
+	HandlePending(retryAfter time.Duration)
 	HandleNoNewVersion()
+	// HandleBatch responds with the results of the requests of a batch in the order of the requests.
+	HandleBatch(results []BatchResult)
 }
@@ -7,31 +7,38 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/unbasical/doras/internal/pkg/core/metrics"
 	"io"
-	"strings"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/algorithmchoice"
+	"github.com/unbasical/doras/internal/pkg/lock"
+	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
 	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/internal/pkg/utils/readerutils"
 
 	registrydelegate "github.com/unbasical/doras/internal/pkg/delegates/registry"
 
 	"github.com/opencontainers/go-digest"
 	"github.com/unbasical/doras/pkg/constants"
+	"github.com/unbasical/doras/pkg/deltalocation"
 )
 
 type delegate struct {
 	activeDeltaCreations    map[string]any
 	m                       sync.Mutex
 	dummyExpirationDuration time.Duration
+	targets                 deltalocation.Targets
 }
 
 // NewDeltaDelegate construct a DeltaDelegate that is used to handle delta creation operations.
-func NewDeltaDelegate(dummyExpirationDuration time.Duration) DeltaDelegate {
+// The targets determine in which repository the deltas of a source repository are stored.
+func NewDeltaDelegate(dummyExpirationDuration time.Duration, targets deltalocation.Targets) DeltaDelegate {
 	return &delegate{
 		activeDeltaCreations:    make(map[string]any),
 		m:                       sync.Mutex{},
 		dummyExpirationDuration: dummyExpirationDuration,
+		targets:                 targets,
 	}
 }
 
@@ -40,8 +47,8 @@ func (d *delegate) IsDummy(mf ociutils.Manifest) (isDummy bool, expired bool) {
 		return false, false
 	}
 	isDummy = true
-	ts := mf.Annotations["org.opencontainers.image.created"]
-	t, err := time.Parse(time.RFC3339, ts)
+	// Dummies are renewed while the delta is created, they expire relative to the last heartbeat.
+	t, err := ociutils.LastHeartbeat(mf.Annotations)
 	if err != nil {
 		return false, false
 	}
@@ -51,48 +58,95 @@ func (d *delegate) IsDummy(mf ociutils.Manifest) (isDummy bool, expired bool) {
 	return
 }
 
-func (d *delegate) GetDeltaLocation(deltaMf registrydelegate.DeltaManifestOptions) (string, error) {
-	digestFrom, err := extractDigest(deltaMf.From)
-	if err != nil {
-		return "", err
-	}
-	digestTo, err := extractDigest(deltaMf.To)
-	if err != nil {
-		return "", err
+// startHeartbeat renews the dummy of the delta and the lease of the context (see lock.WithLease) periodically
+// so they do not expire while the delta is created.
+// The returned function stops the heartbeat and waits for a running renewal.
+func (d *delegate) startHeartbeat(ctx context.Context, dst registrydelegate.RegistryDelegate, image string, manifOpts registrydelegate.DeltaManifestOptions) (stop func()) {
+	// Renew a few times per expiration duration so a single failed renewal does not expire the dummy.
+	// Leases live at least as long as dummies, so they are renewed in time as well.
+	interval := d.dummyExpirationDuration / 3
+	if interval <= 0 {
+		return func() {}
 	}
-	dgstIdentifier := digest.FromBytes([]byte(digestFrom.Encoded() + digestTo.Encoded() + deltaMf.GetTagSuffix()))
-	repoName, _, _, err := ociutils.ParseOciImageString(deltaMf.From)
-	if err != nil {
-		return "", err
+	lease := lock.LeaseFromContext(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		renewDummy := true
+		for renewDummy || lease != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if renewDummy {
+				err := dst.RenewDummy(ctx, image, manifOpts)
+				if errors.Is(err, registrydelegate.ErrDummyLost) {
+					log.WithError(err).Warnf("stopped renewing dummy at %s", image)
+					renewDummy = false
+				} else if err != nil {
+					log.WithError(err).Warnf("failed to renew dummy at %s", image)
+				}
+			}
+			if lease != nil {
+				err := lease.Renew(ctx)
+				if errors.Is(err, lock.ErrNotHeld) {
+					log.WithError(err).Warnf("lost the lock of %s, the delta might be created by someone else", image)
+					lease = nil
+				} else if err != nil {
+					log.WithError(err).Warnf("failed to renew the lock of %s", image)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
 	}
-	tag := fmt.Sprintf("_delta-%s", dgstIdentifier.Encoded())
-	image := fmt.Sprintf("%s:%s", repoName, tag)
-	return image, nil
 }
 
-func extractDigest(image string) (*digest.Digest, error) {
-	_, tag, isDigest, err := ociutils.ParseOciImageString(image)
+func (d *delegate) GetDeltaLocation(deltaMf registrydelegate.DeltaManifestOptions) (string, error) {
+	repoName, _, _, err := ociutils.ParseOciImageString(deltaMf.From)
 	if err != nil {
-		return nil, err
-	}
-	if !isDigest {
-		return nil, errors.New("expected image with digest")
+		return "", err
 	}
-	dgst := strings.TrimPrefix(tag, "@sha256:")
-	val := digest.NewDigestFromEncoded("sha256", dgst)
-	return &val, nil
+	return deltalocation.GetDeltaLocationInRepository(d.targets.Repository(repoName), deltaMf.From, deltaMf.To, deltaMf.GetTagSuffix())
 }
 
 func (d *delegate) CreateDelta(ctx context.Context, from, to io.ReadCloser, manifOpts registrydelegate.DeltaManifestOptions, dst registrydelegate.RegistryDelegate) error {
-	deltaReader, err := manifOpts.Diff(from, to)
+	deltaLocationWithTag, err := d.GetDeltaLocation(manifOpts)
 	if err != nil {
 		return err
 	}
-	compressedDelta, err := manifOpts.Compress(deltaReader)
+	stopHeartbeat := d.startHeartbeat(ctx, dst, deltaLocationWithTag, manifOpts)
+	defer stopHeartbeat()
+	// Archive algorithms (tardiff) reconstruct the uncompressed archive, record its digest so clients can verify the output.
+	var toReader io.Reader = to
+	var getTarDigest func() (digest.Digest, error)
+	if algorithmchoice.IsArchiveAlgorithm(manifOpts.Differ) {
+		var digestReader io.ReadCloser
+		digestReader, getTarDigest = readerutils.NewDecompressedDigestReader(to)
+		defer funcutils.PanicOrLogOnErr(digestReader.Close, false, "failed to close digest reader")
+		toReader = digestReader
+	}
+	deltaReader, err := manifOpts.Diff(from, toReader)
 	if err != nil {
 		return err
 	}
-	deltaLocationWithTag, err := d.GetDeltaLocation(manifOpts)
+	// Differs do not support contexts, closing the delta aborts pushing it if the context is cancelled.
+	stop := context.AfterFunc(ctx, func() { _ = deltaReader.Close() })
+	defer stop()
+	// Archive differs read the target entirely before they return.
+	if getTarDigest != nil {
+		manifOpts.TargetTarDigest, err = getTarDigest()
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to compute digest of the target archive: %w", err), deltaReader.Close())
+		}
+	}
+	compressedDelta, err := manifOpts.Compress(deltaReader)
 	if err != nil {
 		return err
 	}
@@ -127,6 +181,7 @@ type DeltaDelegate interface {
 	// This method should handle synchronization at the instance level.
 	IsDummy(mf ociutils.Manifest) (isDummy bool, expired bool)
 	// GetDeltaLocation returns the image at which the delta with the given options is/should be stored.
+	// The image is located in the source repository unless a different storage target is configured for it.
 	GetDeltaLocation(deltaMf registrydelegate.DeltaManifestOptions) (string, error)
 	// CreateDelta constructs the delta and pushes it to the registry.
 	// This method should handle synchronization at the instance level.
@@ -0,0 +1,127 @@
+package deltadelegate
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	registrydelegate "github.com/unbasical/doras/internal/pkg/delegates/registry"
+	"github.com/unbasical/doras/internal/pkg/lock"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/pkg/constants"
+)
+
+// renewingRegistryDelegate counts renewals and reports the dummy as lost after lostAfter renewals.
+type renewingRegistryDelegate struct {
+	registrydelegate.RegistryDelegate
+	renewals  atomic.Int32
+	lostAfter int32
+}
+
+func (r *renewingRegistryDelegate) RenewDummy(context.Context, string, registrydelegate.DeltaManifestOptions) error {
+	if r.renewals.Add(1) >= r.lostAfter {
+		return registrydelegate.ErrDummyLost
+	}
+	return nil
+}
+
+func Test_delegate_startHeartbeat(t *testing.T) {
+	tests := []struct {
+		name      string
+		lostAfter int32
+		want      func(n int32) bool
+	}{
+		{name: "renews until stopped", lostAfter: 1000, want: func(n int32) bool { return n >= 3 }},
+		{name: "stops once the dummy is lost", lostAfter: 2, want: func(n int32) bool { return n == 2 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDeltaDelegate(30*time.Millisecond, nil).(*delegate)
+			dst := &renewingRegistryDelegate{lostAfter: tt.lostAfter}
+			stop := d.startHeartbeat(context.Background(), dst, "registry.example.org/foo:bar", registrydelegate.DeltaManifestOptions{})
+			time.Sleep(100 * time.Millisecond)
+			stop()
+			n := dst.renewals.Load()
+			if !tt.want(n) {
+				t.Errorf("unexpected number of renewals %d", n)
+			}
+			// No renewals after the heartbeat has been stopped.
+			time.Sleep(30 * time.Millisecond)
+			if dst.renewals.Load() != n {
+				t.Error("expected heartbeat to be stopped")
+			}
+		})
+	}
+}
+
+func Test_delegate_startHeartbeat_renewsLease(t *testing.T) {
+	ctx := context.Background()
+	const key = "registry.example.org/foo:bar"
+	locker := lock.NewLocalLocker(40 * time.Millisecond)
+	lease, err := locker.TryLock(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDeltaDelegate(30*time.Millisecond, nil).(*delegate)
+	// The dummy is lost right away, the lease is renewed regardless.
+	stop := d.startHeartbeat(lock.WithLease(ctx, lease), &renewingRegistryDelegate{lostAfter: 1}, key, registrydelegate.DeltaManifestOptions{})
+	time.Sleep(150 * time.Millisecond)
+	if _, err := locker.TryLock(ctx, key); !errors.Is(err, lock.ErrLocked) {
+		t.Errorf("expected the lease to outlive its ttl while the heartbeat runs, got %v", err)
+	}
+	stop()
+	time.Sleep(60 * time.Millisecond)
+	if _, err := locker.TryLock(ctx, key); err != nil {
+		t.Errorf("expected the lease to expire once the heartbeat has been stopped, got %v", err)
+	}
+}
+
+func Test_delegate_IsDummy(t *testing.T) {
+	d := NewDeltaDelegate(5*time.Minute, nil)
+	now := time.Now().UTC()
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantDummy   bool
+		wantExpired bool
+	}{
+		{name: "delta", annotations: map[string]string{}},
+		{
+			name: "recent heartbeat",
+			annotations: map[string]string{
+				constants.DorasAnnotationIsDummy:   "true",
+				"org.opencontainers.image.created": now.Add(-time.Hour).Format(time.RFC3339),
+				constants.DorasAnnotationHeartbeat: now.Add(-time.Minute).Format(time.RFC3339),
+			},
+			wantDummy: true,
+		},
+		{
+			name: "expired heartbeat",
+			annotations: map[string]string{
+				constants.DorasAnnotationIsDummy:   "true",
+				"org.opencontainers.image.created": now.Add(-time.Hour).Format(time.RFC3339),
+				constants.DorasAnnotationHeartbeat: now.Add(-10 * time.Minute).Format(time.RFC3339),
+			},
+			wantDummy:   true,
+			wantExpired: true,
+		},
+		{
+			name: "without heartbeat",
+			annotations: map[string]string{
+				constants.DorasAnnotationIsDummy:   "true",
+				"org.opencontainers.image.created": now.Add(-time.Minute).Format(time.RFC3339),
+			},
+			wantDummy: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isDummy, expired := d.IsDummy(ociutils.Manifest{Annotations: tt.annotations})
+			if isDummy != tt.wantDummy || expired != tt.wantExpired {
+				t.Errorf("IsDummy() = (%v, %v), want (%v, %v)", isDummy, expired, tt.wantDummy, tt.wantExpired)
+			}
+		})
+	}
+}
@@ -8,11 +8,13 @@ import (
 	error2 "github.com/unbasical/doras/internal/pkg/error"
 	"io"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"oras.land/oras-go/v2/registry/remote/auth"
-	"oras.land/oras-go/v2/registry/remote/retry"
 
+	"github.com/unbasical/doras/internal/pkg/storage"
 	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
 
 	"github.com/opencontainers/go-digest"
@@ -21,31 +23,127 @@ import (
 	"github.com/unbasical/doras/internal/pkg/algorithmchoice"
 	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
 	"github.com/unbasical/doras/pkg/constants"
+	"github.com/unbasical/doras/pkg/signature"
 	"oras.land/oras-go/v2"
-	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
 )
 
 type DeltaManifestOptions struct {
 	From string
 	To   string
 	algorithmchoice.DifferChoice
+	// TargetDigest is the digest of the target layer, it is reconstructed by applying the delta.
+	TargetDigest digest.Digest
+	// TargetTarDigest is the digest of the uncompressed target archive.
+	// It is only set for algorithms that reconstruct the uncompressed archive instead of the layer (tardiff).
+	TargetTarDigest digest.Digest
 }
 
+// LayerAnnotations returns the annotations of the layer that holds the delta.
+func (d *DeltaManifestOptions) LayerAnnotations() map[string]string {
+	annotations := map[string]string{
+		constants.OciImageTitle: "delta" + d.GetFileExt(),
+	}
+	if d.TargetDigest != "" {
+		annotations[constants.DorasAnnotationTargetDigest] = d.TargetDigest.String()
+	}
+	if d.TargetTarDigest != "" {
+		annotations[constants.DorasAnnotationTargetTarDigest] = d.TargetTarDigest.String()
+	}
+	return annotations
+}
+
+// DeltaStorageMode determines how deltas are stored in and located within the registry.
+type DeltaStorageMode string
+
+const (
+	// DeltaStorageTag stores deltas at a tag that is derived from the source images and the used algorithms.
+	DeltaStorageTag DeltaStorageMode = "tag"
+	// DeltaStorageReferrers stores deltas as (untagged) OCI 1.1 referrers of the target image's manifest.
+	// Deltas are identified by the from digest and the algorithm which are stored in the annotations.
+	DeltaStorageReferrers DeltaStorageMode = "referrers"
+)
+
+// ErrDummyLost is returned if a dummy cannot be renewed because the delta has been created
+// or because the dummy has been replaced by another instance.
+var ErrDummyLost = errors.New("dummy is no longer owned by this instance")
+
 type registryImpl struct {
+	// m guards the local state, it is never held during requests to registries.
 	m                     sync.Mutex
 	activeDummiesCreation map[string]any
-	credentials           auth.CredentialFunc
-	allowHttp             bool
+	// imageLocks serialize the writes to the tag of a delta, e.g. so a renewed dummy does not replace the delta.
+	imageLocks   map[string]*imageLock
+	credentials  auth.CredentialFunc
+	repositories storage.Provider
+	signer       signature.Signer
+	storageMode  DeltaStorageMode
+	instanceID   string
+}
+
+// imageLock is the lock of an image, it is removed once no one holds or waits for it.
+type imageLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockImage locks the image and returns the function that unlocks it.
+// Only writes to the same image wait for each other, so a slow registry does not stall the other deltas.
+func (r *registryImpl) lockImage(image string) (unlock func()) {
+	r.m.Lock()
+	l, ok := r.imageLocks[image]
+	if !ok {
+		l = &imageLock{}
+		r.imageLocks[image] = l
+	}
+	l.refs++
+	r.m.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		r.m.Lock()
+		defer r.m.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(r.imageLocks, image)
+		}
+	}
+}
+
+// Option configures the RegistryDelegate.
+type Option func(*registryImpl)
+
+// WithInstanceID sets the ID of the instance which is recorded as owner of the dummies it pushes.
+func WithInstanceID(id string) Option {
+	return func(r *registryImpl) {
+		r.instanceID = id
+	}
 }
 
 // NewRegistryDelegate constructs a RegistryDelegate for a given registry that is located at the provided registryUrl.
-func NewRegistryDelegate(creds auth.CredentialFunc, allowHttp bool) RegistryDelegate {
-	return &registryImpl{
+// If a signature.Signer is provided it is used to sign the manifests of pushed deltas.
+// The storageMode determines where deltas are pushed to and where they are looked up.
+func NewRegistryDelegate(creds auth.CredentialFunc, allowHttp bool, signer signature.Signer, storageMode DeltaStorageMode, opts ...Option) RegistryDelegate {
+	return NewRegistryDelegateWithStorage(storage.NewRemoteProvider(allowHttp), creds, signer, storageMode, opts...)
+}
+
+// NewRegistryDelegateWithStorage constructs a RegistryDelegate that reads images from and writes deltas to the repositories
+// of the given storage.Provider, e.g. a local OCI image layout.
+func NewRegistryDelegateWithStorage(repositories storage.Provider, creds auth.CredentialFunc, signer signature.Signer, storageMode DeltaStorageMode, opts ...Option) RegistryDelegate {
+	r := &registryImpl{
 		m:                     sync.Mutex{},
 		activeDummiesCreation: make(map[string]any),
+		imageLocks:            make(map[string]*imageLock),
 		credentials:           creds,
-		allowHttp:             allowHttp,
+		repositories:          repositories,
+		signer:                signer,
+		storageMode:           storageMode,
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
+	return r
 }
 
 func (r *registryImpl) Resolve(image string, expectDigest bool, creds auth.CredentialFunc) (oras.ReadOnlyTarget, string, v1.Descriptor, error) {
@@ -60,19 +158,11 @@ func (r *registryImpl) Resolve(image string, expectDigest bool, creds auth.Crede
 		return nil, "", v1.Descriptor{}, error2.ErrExpectedDigest
 	}
 
-	repository, err := remote.NewRepository(repoName)
+	repository, err := r.repositories.Repository(repoName, creds)
 	if err != nil {
 		return nil, "", v1.Descriptor{}, err
 	}
 
-	repository.Client = &auth.Client{
-		Client:     retry.DefaultClient,
-		Cache:      auth.NewCache(),
-		Credential: creds,
-	}
-	// This is kinda hacky.
-	repository.PlainHTTP = r.allowHttp
-
 	// Resolve and return relevant data.
 	d, err := repository.Resolve(ctx, tag)
 	if err != nil {
@@ -120,14 +210,10 @@ func (r *registryImpl) PushDelta(ctx context.Context, image string, manifOpts De
 	if err != nil {
 		return err
 	}
-	repository, err := remote.NewRepository(repoName)
+	repository, err := r.repositories.Repository(repoName, r.credentials)
 	if err != nil {
 		return err
 	}
-	repository.PlainHTTP = r.allowHttp
-	repository.Client = &auth.Client{
-		Credential: r.credentials,
-	}
 	tempDir := os.TempDir()
 	fp, err := os.CreateTemp(tempDir, "delta_*")
 	if err != nil {
@@ -153,13 +239,11 @@ func (r *registryImpl) PushDelta(ctx context.Context, image string, manifOpts De
 		return errors.New("failed to copy any bytes")
 	}
 	deltaDescriptor := v1.Descriptor{
-		MediaType: manifOpts.GetMediaType(),
-		Digest:    digest.NewDigest("sha256", hasher),
-		Size:      n,
-		URLs:      nil,
-		Annotations: map[string]string{
-			constants.OciImageTitle: "delta" + manifOpts.GetFileExt(),
-		},
+		MediaType:   manifOpts.GetMediaType(),
+		Digest:      digest.NewDigest("sha256", hasher),
+		Size:        n,
+		URLs:        nil,
+		Annotations: manifOpts.LayerAnnotations(),
 	}
 	_, err = fp.Seek(0, io.SeekStart)
 	if err != nil {
@@ -170,18 +254,25 @@ func (r *registryImpl) PushDelta(ctx context.Context, image string, manifOpts De
 	if err != nil {
 		return err
 	}
-	opts := oras.PackManifestOptions{
-		Layers: []v1.Descriptor{deltaDescriptor},
-		ManifestAnnotations: map[string]string{
-			constants.DorasAnnotationFrom: manifOpts.From,
-			constants.DorasAnnotationTo:   manifOpts.To,
-		},
-	}
-	mfDescriptor, err := oras.PackManifest(ctx, repository, oras.PackManifestVersion1_1, "application/vnd.example+type", opts)
+	mfDescriptor, err := r.packDeltaManifest(ctx, repository, manifOpts, deltaDescriptor, nil)
 	if err != nil {
 		return err
 	}
+	// Sign before tagging so clients never observe an unsigned delta.
+	if r.signer != nil {
+		err = r.signer.Sign(ctx, repository, mfDescriptor, repoName)
+		if err != nil {
+			return fmt.Errorf("failed to sign delta manifest: %w", err)
+		}
+	}
+	if r.storageMode == DeltaStorageReferrers {
+		log.Infof("created delta for %s as referrer %s", manifOpts.To, mfDescriptor.Digest.Encoded())
+		return nil
+	}
+	// Tagging is synchronized with renewals of the dummy, so the delta is not replaced by a renewed dummy.
+	unlock := r.lockImage(image)
 	err = repository.Tag(ctx, mfDescriptor, tag)
+	unlock()
 	if err != nil {
 		return err
 	}
@@ -189,57 +280,256 @@ func (r *registryImpl) PushDelta(ctx context.Context, image string, manifOpts De
 	return nil
 }
 
+// packDeltaManifest pushes the manifest of a delta (or dummy) with the given layer.
+// If deltas are stored as referrers the target image is set as the subject of the manifest.
+func (r *registryImpl) packDeltaManifest(ctx context.Context, repository oras.GraphTarget, manifOpts DeltaManifestOptions, layer v1.Descriptor, annotations map[string]string) (v1.Descriptor, error) {
+	_, fromDigest, _, err := ociutils.ParseOciImageString(manifOpts.From)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	opts := oras.PackManifestOptions{
+		Layers: []v1.Descriptor{layer},
+		ManifestAnnotations: map[string]string{
+			constants.DorasAnnotationFrom:       manifOpts.From,
+			constants.DorasAnnotationTo:         manifOpts.To,
+			constants.DorasAnnotationFromDigest: strings.TrimPrefix(fromDigest, "@"),
+			constants.DorasAnnotationAlgorithm:  manifOpts.GetAlgorithm(),
+		},
+	}
+	for k, v := range annotations {
+		opts.ManifestAnnotations[k] = v
+	}
+	if r.storageMode == DeltaStorageReferrers {
+		_, toDigest, isDigest, err := ociutils.ParseOciImageString(manifOpts.To)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		if !isDigest {
+			return v1.Descriptor{}, fmt.Errorf("expected target image with digest, got %q", manifOpts.To)
+		}
+		subject, err := repository.Resolve(ctx, strings.TrimPrefix(toDigest, "@"))
+		if err != nil {
+			return v1.Descriptor{}, fmt.Errorf("failed to resolve target image: %w", err)
+		}
+		opts.Subject = &subject
+	}
+	return oras.PackManifest(ctx, repository, oras.PackManifestVersion1_1, constants.DorasDeltaArtifactType, opts)
+}
+
 func (r *registryImpl) PushDummy(image string, manifOpts DeltaManifestOptions) error {
 	r.m.Lock()
-	defer r.m.Unlock()
 	// exit early if we're already creating a dummy in parallel
 	if _, ok := r.activeDummiesCreation[image]; ok {
+		r.m.Unlock()
 		return nil
 	}
 	r.activeDummiesCreation[image] = nil
+	r.m.Unlock()
+	defer func() {
+		r.m.Lock()
+		delete(r.activeDummiesCreation, image)
+		r.m.Unlock()
+	}()
+	defer r.lockImage(image)()
 	ctx := context.Background()
 	repoName, tag, _, err := ociutils.ParseOciImageString(image)
 	if err != nil {
 		return err
 	}
-	repository, err := remote.NewRepository(repoName)
+	repository, err := r.repositories.Repository(repoName, r.credentials)
 	if err != nil {
 		return err
 	}
-	repository.PlainHTTP = r.allowHttp
-	repository.Client = &auth.Client{
-		Credential: r.credentials,
+
+	if _, err := r.pushDummy(ctx, repository, tag, manifOpts, time.Now()); err != nil {
+		return err
 	}
+	log.Infof("created dummy at %s", image)
+	return nil
+}
 
+// pushDummy pushes a dummy that has been created at the given time and has a heartbeat of now.
+func (r *registryImpl) pushDummy(ctx context.Context, repository oras.GraphTarget, tag string, manifOpts DeltaManifestOptions, created time.Time) (v1.Descriptor, error) {
 	// Dummy manifests use the empty descriptor and set a value in the annotations to indicate a dummy.
-	opts := oras.PackManifestOptions{
-		Layers: []v1.Descriptor{v1.DescriptorEmptyJSON},
-		ManifestAnnotations: map[string]string{
-			constants.DorasAnnotationFrom:    manifOpts.From,
-			constants.DorasAnnotationTo:      manifOpts.To,
-			constants.DorasAnnotationIsDummy: "true",
-		},
+	annotations := map[string]string{
+		constants.DorasAnnotationIsDummy:   "true",
+		constants.DorasAnnotationHeartbeat: time.Now().UTC().Format(time.RFC3339),
+		v1.AnnotationCreated:               created.UTC().Format(time.RFC3339),
 	}
-	mfDescriptor, err := oras.PackManifest(ctx, repository, oras.PackManifestVersion1_1, "application/vnd.example+type", opts)
+	if r.instanceID != "" {
+		annotations[constants.DorasAnnotationOwner] = r.instanceID
+	}
+	mfDescriptor, err := r.packDeltaManifest(ctx, repository, manifOpts, v1.DescriptorEmptyJSON, annotations)
 	if err != nil {
-		return fmt.Errorf("failed to pack manifest: %w", err)
+		return v1.Descriptor{}, fmt.Errorf("failed to pack manifest: %w", err)
 	}
-	err = repository.Tag(ctx, mfDescriptor, tag)
+	if r.storageMode != DeltaStorageReferrers {
+		err = repository.Tag(ctx, mfDescriptor, tag)
+		if err != nil {
+			return v1.Descriptor{}, fmt.Errorf("failed to tag manifest: %w", err)
+		}
+	}
+	return mfDescriptor, nil
+}
+
+func (r *registryImpl) RenewDummy(ctx context.Context, image string, manifOpts DeltaManifestOptions) error {
+	// The dummy is only replaced if it has not been replaced by the delta since it has been loaded.
+	defer r.lockImage(image)()
+	src, _, d, err := r.ResolveDelta(image, manifOpts, r.credentials)
 	if err != nil {
-		return fmt.Errorf("failed to tag manifest: %w", err)
+		return err
 	}
-	delete(r.activeDummiesCreation, image)
-	log.Infof("created dummy at %s", image)
+	mf, err := r.LoadManifest(d, src)
+	if err != nil {
+		return err
+	}
+	if mf.Annotations[constants.DorasAnnotationIsDummy] != "true" || mf.Annotations[constants.DorasAnnotationOwner] != r.instanceID {
+		return ErrDummyLost
+	}
+	// The creation time is kept, only the heartbeat changes.
+	created, err := time.Parse(time.RFC3339, mf.Annotations[v1.AnnotationCreated])
+	if err != nil {
+		return fmt.Errorf("failed to parse creation timestamp: %w", err)
+	}
+	repoName, tag, _, err := ociutils.ParseOciImageString(image)
+	if err != nil {
+		return err
+	}
+	repository, err := r.repositories.Repository(repoName, r.credentials)
+	if err != nil {
+		return err
+	}
+	renewed, err := r.pushDummy(ctx, repository, tag, manifOpts, created)
+	if err != nil {
+		return err
+	}
+	// Referrers are not replaced, the previous dummy is deleted.
+	if r.storageMode == DeltaStorageReferrers && renewed.Digest != d.Digest {
+		deleter, ok := src.(content.Deleter)
+		if !ok {
+			return errors.New("repository does not support deleting manifests")
+		}
+		if err := deleter.Delete(ctx, d); err != nil && !errors.Is(err, errdef.ErrNotFound) {
+			return fmt.Errorf("failed to delete previous dummy: %w", err)
+		}
+	}
+	log.Debugf("renewed dummy at %s", image)
 	return nil
 }
 
+func (r *registryImpl) DeleteDummy(ctx context.Context, image string, manifOpts DeltaManifestOptions) error {
+	src, _, d, err := r.ResolveDelta(image, manifOpts, r.credentials)
+	if errors.Is(err, errdef.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mf, err := r.LoadManifest(d, src)
+	if err != nil {
+		return err
+	}
+	// The delta might have been created by another instance in the meantime.
+	if mf.Annotations[constants.DorasAnnotationIsDummy] != "true" {
+		return nil
+	}
+	deleter, ok := src.(content.Deleter)
+	if !ok {
+		return errors.New("repository does not support deleting manifests")
+	}
+	if err := deleter.Delete(ctx, d); err != nil && !errors.Is(err, errdef.ErrNotFound) {
+		return err
+	}
+	log.Infof("deleted dummy at %s", image)
+	return nil
+}
+
+func (r *registryImpl) ResolveDelta(image string, manifOpts DeltaManifestOptions, creds auth.CredentialFunc) (oras.ReadOnlyTarget, string, v1.Descriptor, error) {
+	if r.storageMode != DeltaStorageReferrers {
+		deltaRepo, _, _, err := ociutils.ParseOciImageString(image)
+		if err != nil {
+			return nil, "", v1.Descriptor{}, err
+		}
+		sourceRepo, _, _, err := ociutils.ParseOciImageString(manifOpts.To)
+		if err != nil {
+			return nil, "", v1.Descriptor{}, err
+		}
+		// Deltas in a separate storage target are accessed with the server credentials,
+		// the client credentials are only valid for the source registry and were already checked when resolving the source images.
+		if deltaRepo != sourceRepo {
+			creds = r.credentials
+		}
+		return r.Resolve(image, false, creds)
+	}
+	// The target image is the subject of the delta, resolving it also ensures the client has access.
+	src, _, subject, err := r.Resolve(manifOpts.To, true, creds)
+	if err != nil {
+		return nil, "", v1.Descriptor{}, err
+	}
+	repository, ok := src.(oras.ReadOnlyGraphTarget)
+	if !ok {
+		return nil, "", v1.Descriptor{}, errors.New("repository does not support listing referrers")
+	}
+	repoName, _, _, err := ociutils.ParseOciImageString(manifOpts.To)
+	if err != nil {
+		return nil, "", v1.Descriptor{}, err
+	}
+	_, fromDigest, _, err := ociutils.ParseOciImageString(manifOpts.From)
+	if err != nil {
+		return nil, "", v1.Descriptor{}, err
+	}
+	fromDigest = strings.TrimPrefix(fromDigest, "@")
+	referrers, err := ociutils.Referrers(context.Background(), repository, subject, constants.DorasDeltaArtifactType)
+	if err != nil {
+		return nil, "", v1.Descriptor{}, err
+	}
+	var found *v1.Descriptor
+	for _, d := range referrers {
+		if d.Annotations[constants.DorasAnnotationFromDigest] != fromDigest || d.Annotations[constants.DorasAnnotationAlgorithm] != manifOpts.GetAlgorithm() {
+			continue
+		}
+		// Deltas take precedence over dummies, the dummy with the most recent heartbeat is used if there are multiple.
+		if d.Annotations[constants.DorasAnnotationIsDummy] != "true" {
+			found = &d
+			break
+		}
+		if found == nil || isMoreRecent(d.Annotations, found.Annotations) {
+			found = &d
+		}
+	}
+	if found == nil {
+		return nil, "", v1.Descriptor{}, fmt.Errorf("no delta found for %s: %w", manifOpts.To, errdef.ErrNotFound)
+	}
+	imageDigest := fmt.Sprintf("%s@%s", repoName, found.Digest.String())
+	return repository, imageDigest, *found, nil
+}
+
+// isMoreRecent checks if the dummy with the annotations a has a more recent heartbeat than the dummy with the annotations b.
+func isMoreRecent(a, b map[string]string) bool {
+	heartbeatA, errA := ociutils.LastHeartbeat(a)
+	heartbeatB, errB := ociutils.LastHeartbeat(b)
+	if errA != nil || errB != nil {
+		return errB != nil && errA == nil
+	}
+	return heartbeatA.After(heartbeatB)
+}
+
 type RegistryDelegate interface {
 	// Resolve the provided image.
 	// Enforces whether the image is tagged or uses a digest.
 	// If an authToken is provided it, and ONLY it has to be used to authenticate to the registry.
 	Resolve(image string, expectDigest bool, creds auth.CredentialFunc) (oras.ReadOnlyTarget, string, v1.Descriptor, error)
+	// ResolveDelta resolves the delta (or dummy) with the given options.
+	// Depending on the DeltaStorageMode the delta is located at the provided image or among the referrers of the target image.
+	ResolveDelta(image string, manifOpts DeltaManifestOptions, creds auth.CredentialFunc) (oras.ReadOnlyTarget, string, v1.Descriptor, error)
 	LoadManifest(target v1.Descriptor, source oras.ReadOnlyTarget) (ociutils.Manifest, error)
 	LoadArtifact(mf ociutils.Manifest, source oras.ReadOnlyTarget) (io.ReadCloser, error)
 	PushDelta(ctx context.Context, image string, manifOpts DeltaManifestOptions, content io.ReadCloser) error
 	PushDummy(image string, manifOpts DeltaManifestOptions) error
+	// RenewDummy updates the heartbeat of the dummy of the delta with the given options, its creation time is kept.
+	// Returns ErrDummyLost if the delta has been created or if the dummy is owned by another instance.
+	RenewDummy(ctx context.Context, image string, manifOpts DeltaManifestOptions) error
+	// DeleteDummy deletes the dummy of the delta with the given options so the delta can be created by other requests.
+	// Nothing is deleted if the delta has been created in the meantime.
+	DeleteDummy(ctx context.Context, image string, manifOpts DeltaManifestOptions) error
 }
@@ -0,0 +1,329 @@
+package registrydelegate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/unbasical/doras/internal/pkg/algorithmchoice"
+	"github.com/unbasical/doras/internal/pkg/compression/gzip"
+	"github.com/unbasical/doras/internal/pkg/compression/zstd"
+	"github.com/unbasical/doras/internal/pkg/delta/bsdiff"
+	"github.com/unbasical/doras/internal/pkg/utils/compressionutils"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+	"github.com/unbasical/doras/pkg/algorithm/compression"
+	"github.com/unbasical/doras/pkg/constants"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func pushImage(t *testing.T, repo *remote.Repository, data string) v1.Descriptor {
+	t.Helper()
+	ctx := context.Background()
+	d := v1.Descriptor{
+		MediaType: "application/vnd.test.file",
+		Digest:    digest.FromString(data),
+		Size:      int64(len(data)),
+	}
+	err := repo.Push(ctx, d, bytes.NewReader([]byte(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfDescriptor, err := oras.PackManifest(ctx, repo, oras.PackManifestVersion1_1, "application/vnd.test.artifact", oras.PackManifestOptions{
+		Layers: []v1.Descriptor{d},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfDescriptor
+}
+
+func TestRegistryImpl_ResolveDelta(t *testing.T) {
+	ctx := context.Background()
+	repoName := testutils.LaunchInProcessRegistry(t) + "/foo"
+	repo, err := remote.NewRepository(repoName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.PlainHTTP = true
+	from := pushImage(t, repo, "from")
+	to := pushImage(t, repo, "to")
+	manifOpts := DeltaManifestOptions{
+		From: fmt.Sprintf("%s@%s", repoName, from.Digest),
+		To:   fmt.Sprintf("%s@%s", repoName, to.Digest),
+		DifferChoice: algorithmchoice.DifferChoice{
+			Differ:     bsdiff.NewDiffer(),
+			Compressor: compressionutils.NewNopCompressor(),
+		},
+	}
+	tests := []struct {
+		name        string
+		storageMode DeltaStorageMode
+		image       string
+		wantTags    bool
+	}{
+		{name: "tag", storageMode: DeltaStorageTag, image: repoName + ":_delta-tag", wantTags: true},
+		{name: "referrers", storageMode: DeltaStorageReferrers, image: repoName + ":_delta-referrers", wantTags: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistryDelegate(nil, true, nil, tt.storageMode)
+			if _, _, _, err := r.ResolveDelta(tt.image, manifOpts, nil); err == nil {
+				t.Fatal("expected error for missing delta")
+			}
+			err := r.PushDummy(tt.image, manifOpts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src, _, d, err := r.ResolveDelta(tt.image, manifOpts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mf, err := r.LoadManifest(d, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mf.Annotations[constants.DorasAnnotationIsDummy] != "true" {
+				t.Fatal("expected dummy")
+			}
+			err = r.PushDelta(ctx, tt.image, manifOpts, io.NopCloser(strings.NewReader("delta")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			src, deltaImage, d, err := r.ResolveDelta(tt.image, manifOpts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(deltaImage, repoName+"@sha256:") {
+				t.Errorf("expected delta image with digest, got %q", deltaImage)
+			}
+			mf, err = r.LoadManifest(d, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mf.Annotations[constants.DorasAnnotationIsDummy] == "true" {
+				t.Fatal("expected delta instead of dummy")
+			}
+			if got := mf.Annotations[constants.DorasAnnotationFromDigest]; got != from.Digest.String() {
+				t.Errorf("expected from digest %s, got %s", from.Digest, got)
+			}
+			if got := mf.Annotations[constants.DorasAnnotationAlgorithm]; got != "bsdiff" {
+				t.Errorf("expected algorithm bsdiff, got %s", got)
+			}
+			var tags []string
+			err = repo.Tags(ctx, "", func(page []string) error {
+				tags = append(tags, page...)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tag := tt.image[strings.LastIndex(tt.image, ":")+1:]
+			if slices.Contains(tags, tag) != tt.wantTags {
+				t.Errorf("unexpected tags %v", tags)
+			}
+		})
+	}
+}
+
+func TestRegistryImpl_DeleteDummy(t *testing.T) {
+	ctx := context.Background()
+	repoName := testutils.LaunchInProcessRegistry(t) + "/foo"
+	repo, err := remote.NewRepository(repoName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.PlainHTTP = true
+	from := pushImage(t, repo, "from")
+	to := pushImage(t, repo, "to")
+	manifOpts := func(c compression.Compressor) DeltaManifestOptions {
+		return DeltaManifestOptions{
+			From: fmt.Sprintf("%s@%s", repoName, from.Digest),
+			To:   fmt.Sprintf("%s@%s", repoName, to.Digest),
+			DifferChoice: algorithmchoice.DifferChoice{
+				Differ:     bsdiff.NewDiffer(),
+				Compressor: c,
+			},
+		}
+	}
+	deltaOpts, dummyOpts := manifOpts(gzip.NewCompressor()), manifOpts(zstd.NewCompressor())
+	tests := []struct {
+		name        string
+		storageMode DeltaStorageMode
+		prefix      string
+	}{
+		{name: "tag", storageMode: DeltaStorageTag, prefix: repoName + ":_delete-tag"},
+		{name: "referrers", storageMode: DeltaStorageReferrers, prefix: repoName + ":_delete-referrers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistryDelegate(nil, true, nil, tt.storageMode)
+			deltaImage, dummyImage := tt.prefix+"-delta", tt.prefix+"-dummy"
+
+			// Deltas are not deleted.
+			if err := r.PushDelta(ctx, deltaImage, deltaOpts, io.NopCloser(strings.NewReader("delta"))); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.DeleteDummy(ctx, deltaImage, deltaOpts); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, _, err := r.ResolveDelta(deltaImage, deltaOpts, nil); err != nil {
+				t.Fatalf("expected delta to be kept, got %v", err)
+			}
+
+			// Deleting a missing dummy is not an error.
+			if err := r.DeleteDummy(ctx, dummyImage, dummyOpts); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.PushDummy(dummyImage, dummyOpts); err != nil {
+				t.Fatal(err)
+			}
+			_, _, dummy, err := r.ResolveDelta(dummyImage, dummyOpts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.DeleteDummy(ctx, dummyImage, dummyOpts); err != nil {
+				t.Fatal(err)
+			}
+			// The test registry keeps dangling tags, hence the manifest is resolved by its digest.
+			if _, err := repo.Resolve(ctx, dummy.Digest.String()); !errors.Is(err, errdef.ErrNotFound) {
+				t.Errorf("expected dummy to be deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRegistryImpl_RenewDummy(t *testing.T) {
+	ctx := context.Background()
+	repoName := testutils.LaunchInProcessRegistry(t) + "/foo"
+	repo, err := remote.NewRepository(repoName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.PlainHTTP = true
+	from := pushImage(t, repo, "from")
+	to := pushImage(t, repo, "to")
+	manifOpts := func(c compression.Compressor) DeltaManifestOptions {
+		return DeltaManifestOptions{
+			From: fmt.Sprintf("%s@%s", repoName, from.Digest),
+			To:   fmt.Sprintf("%s@%s", repoName, to.Digest),
+			DifferChoice: algorithmchoice.DifferChoice{
+				Differ:     bsdiff.NewDiffer(),
+				Compressor: c,
+			},
+		}
+	}
+	deltaOpts, dummyOpts := manifOpts(gzip.NewCompressor()), manifOpts(zstd.NewCompressor())
+	tests := []struct {
+		name        string
+		storageMode DeltaStorageMode
+		prefix      string
+	}{
+		{name: "tag", storageMode: DeltaStorageTag, prefix: repoName + ":_renew-tag"},
+		{name: "referrers", storageMode: DeltaStorageReferrers, prefix: repoName + ":_renew-referrers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistryDelegate(nil, true, nil, tt.storageMode, WithInstanceID("instance-a"))
+			other := NewRegistryDelegate(nil, true, nil, tt.storageMode, WithInstanceID("instance-b"))
+			deltaImage, dummyImage := tt.prefix+"-delta", tt.prefix+"-dummy"
+
+			// Dummies are not renewed once the delta has been created.
+			if err := r.PushDummy(deltaImage, deltaOpts); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.PushDelta(ctx, deltaImage, deltaOpts, io.NopCloser(strings.NewReader("delta"))); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.RenewDummy(ctx, deltaImage, deltaOpts); !errors.Is(err, ErrDummyLost) {
+				t.Errorf("expected ErrDummyLost once the delta has been created, got %v", err)
+			}
+
+			if err := r.PushDummy(dummyImage, dummyOpts); err != nil {
+				t.Fatal(err)
+			}
+			load := func() (v1.Descriptor, ociutils.Manifest) {
+				src, _, d, err := r.ResolveDelta(dummyImage, dummyOpts, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				mf, err := r.LoadManifest(d, src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return d, mf
+			}
+			dummy, mf := load()
+			if owner := mf.Annotations[constants.DorasAnnotationOwner]; owner != "instance-a" {
+				t.Errorf("expected owner instance-a, got %q", owner)
+			}
+			if err := other.RenewDummy(ctx, dummyImage, dummyOpts); !errors.Is(err, ErrDummyLost) {
+				t.Errorf("expected ErrDummyLost for other instances, got %v", err)
+			}
+			// Timestamps have a resolution of seconds.
+			time.Sleep(time.Second)
+			if err := r.RenewDummy(ctx, dummyImage, dummyOpts); err != nil {
+				t.Fatal(err)
+			}
+			renewed, renewedMf := load()
+			if renewed.Digest == dummy.Digest {
+				t.Fatal("expected dummy to be replaced")
+			}
+			if created := renewedMf.Annotations[v1.AnnotationCreated]; created != mf.Annotations[v1.AnnotationCreated] {
+				t.Errorf("expected creation time %s to be kept, got %s", mf.Annotations[v1.AnnotationCreated], created)
+			}
+			if heartbeat := renewedMf.Annotations[constants.DorasAnnotationHeartbeat]; heartbeat <= mf.Annotations[constants.DorasAnnotationHeartbeat] {
+				t.Errorf("expected heartbeat to advance, got %s", heartbeat)
+			}
+			// The previous dummy is replaced, referrers are deleted.
+			if _, err := repo.Resolve(ctx, dummy.Digest.String()); tt.storageMode == DeltaStorageReferrers && !errors.Is(err, errdef.ErrNotFound) {
+				t.Errorf("expected previous dummy to be deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRegistryImpl_lockImage(t *testing.T) {
+	r := NewRegistryDelegate(nil, true, nil, DeltaStorageTag).(*registryImpl)
+	unlock := r.lockImage("registry.example/foo:a")
+	// Other images are not blocked while the image is locked, e.g. by a renewal with a slow registry.
+	done := make(chan struct{})
+	go func() {
+		r.lockImage("registry.example/foo:b")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock of another image is blocked")
+	}
+	locked := make(chan struct{})
+	go func() {
+		r.lockImage("registry.example/foo:a")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("expected the image to be locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock of the image has not been released")
+	}
+	if n := len(r.imageLocks); n != 0 {
+		t.Errorf("expected unused locks to be removed, got %d", n)
+	}
+}
@@ -82,7 +82,7 @@ func (a *patcher) PatchFilesystem(artifactDir string, patch io.Reader, expected
 		return err
 	}
 	if expected != nil && digest.NewDigest("sha256", hasher) != *expected {
-		return fmt.Errorf("expected sha256 digest %v, got %v", expected, digest.NewDigest("sha256", hasher))
+		return fmt.Errorf("%w: expected sha256 digest %v, got %v", delta.ErrDigestMismatch, expected, digest.NewDigest("sha256", hasher))
 	}
 	// Make sure file is written to the disk before we swap files.
 	err = fpTemp.Sync()
@@ -2,6 +2,7 @@ package bsdiff
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"io/fs"
 	"os"
@@ -139,6 +140,9 @@ func TestPatcher_PatchFilesystem(t *testing.T) {
 				if !tt.wantErr {
 					t.Fatalf("unexpected error: %v", err)
 				}
+				if tt.args.expected != nil && !errors.Is(err, delta.ErrDigestMismatch) {
+					t.Fatalf("expected digest mismatch, got: %v", err)
+				}
 				if !bytes.Equal(oldData, got) {
 					t.Fatal("old file was modified despite error")
 				}
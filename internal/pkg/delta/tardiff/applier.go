@@ -2,6 +2,8 @@ package tardiff
 
 import (
 	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
@@ -62,6 +64,9 @@ func (a *applier) PatchFilesystem(artifactDir string, patch io.Reader, expected
 		_ = os.RemoveAll(extractDir)
 	}()
 	err = tarutils.ExtractCompressedTar(extractDir, "", tempfile.Name(), expected, compressionutils.NewNopDecompressor())
+	if errors.Is(err, tarutils.ErrDigestMismatch) {
+		return fmt.Errorf("%w: %w", delta.ErrDigestMismatch, err)
+	}
 	if err != nil {
 		return err
 	}
@@ -49,8 +49,8 @@ func (c *differ) Diff(oldfile io.Reader, newfile io.Reader) (io.ReadCloser, erro
 	toFinished := make(chan func() (*os.File, error), 1)
 
 	// load files in parallel
-	go loadToTempFile(oldfile, "from.*.tar.gz", fromFinished)
-	go loadToTempFile(newfile, "to.*.tar.gz", toFinished)
+	go loadToTempFile(oldfile, "from-*.tardiff", fromFinished)
+	go loadToTempFile(newfile, "to-*.tardiff", toFinished)
 	fpFrom, errFrom := (<-fromFinished)()
 	fpTo, errTo := (<-toFinished)()
 
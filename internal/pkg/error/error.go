@@ -22,4 +22,9 @@ var (
 	ErrExpectedDigest              = errors.New("expected digest")
 	ErrUnauthorized                = errors.New("unauthorized")
 	ErrFailedToResolve             = errors.New("failed to resolve")
+	ErrArtifactTooLarge            = errors.New("artifact is too large")
+	ErrQuotaExceeded               = errors.New("quota exceeded")
+	ErrForbidden                   = errors.New("forbidden")
+	ErrTooManyRequests             = errors.New("too many requests")
+	ErrNoTarget                    = errors.New("no target")
 )
@@ -0,0 +1,350 @@
+// Package gc implements the garbage collection of deltas, dummies and registry locks that are no longer needed.
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/storage"
+	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/pkg/constants"
+	"github.com/unbasical/doras/pkg/deltalocation"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// Policy determines which deltas are deleted.
+// Deltas whose source images no longer exist are always deleted.
+type Policy struct {
+	// MaxAge is the retention period of deltas, older deltas are deleted. Zero disables the check.
+	MaxAge time.Duration
+	// UnusedFor deletes deltas that have not been served (or created) within this period. Zero disables the check.
+	// The usage only covers the processes that share the UsageStore, with several replicas it is only safe
+	// if all of them record their usage in the same file (see NewUsageStore), otherwise deltas served by other replicas are deleted.
+	UnusedFor time.Duration
+	// DummyExpiration is the duration after which dummies are considered to be expired.
+	DummyExpiration time.Duration
+	// DryRun only reports what would be deleted.
+	DryRun bool
+}
+
+// Reason describes why a delta is deleted.
+type Reason string
+
+const (
+	// ReasonMissingSource indicates that the image from or to which the delta leads no longer exists.
+	ReasonMissingSource Reason = "missing-source"
+	// ReasonRetention indicates that the delta is older than the retention period.
+	ReasonRetention Reason = "retention"
+	// ReasonUnused indicates that the delta has not been served for a long time.
+	ReasonUnused Reason = "unused"
+	// ReasonExpiredDummy indicates an expired dummy.
+	ReasonExpiredDummy Reason = "expired-dummy"
+	// ReasonExpiredLock indicates an expired (or released) lock of the registry locks (see lock.NewRegistryLocker).
+	ReasonExpiredLock Reason = "expired-lock"
+)
+
+// Entry is a delta (or dummy or lock) that was (or would be, for dry runs) deleted.
+type Entry struct {
+	// Image identifies the delta manifest by digest.
+	Image string
+	// Tag is the tag of the delta, it is empty for deltas that are stored as referrers.
+	Tag    string
+	Reason Reason
+}
+
+// Report summarizes a garbage collection run on a repository.
+type Report struct {
+	Repository string
+	DryRun     bool
+	Deleted    []Entry
+	// Kept is the number of deltas, dummies and locks that were not deleted.
+	Kept int
+}
+
+// Collector deletes stale deltas and expired dummies.
+type Collector interface {
+	// Collect runs the garbage collection on the given repository.
+	// Errors that only affect individual deltas do not abort the run, they are returned alongside the report.
+	Collect(ctx context.Context, repoName string) (Report, error)
+}
+
+type collector struct {
+	repositories storage.Provider
+	credentials  auth.CredentialFunc
+	policy       Policy
+	usage        UsageStore
+	now          func() time.Time
+}
+
+// NewCollector returns a Collector that uses the given credentials to access the repositories.
+// The UsageStore is required to delete unused deltas, it may be nil if Policy.UnusedFor is not set.
+func NewCollector(repositories storage.Provider, creds auth.CredentialFunc, policy Policy, usage UsageStore) Collector {
+	return &collector{
+		repositories: repositories,
+		credentials:  creds,
+		policy:       policy,
+		usage:        usage,
+		now:          time.Now,
+	}
+}
+
+// repository is the functionality the garbage collection requires from the storage.
+type repository interface {
+	oras.GraphTarget
+	registry.TagLister
+	content.Deleter
+}
+
+// candidate is a delta manifest that is considered for deletion.
+type candidate struct {
+	descriptor v1.Descriptor
+	tag        string
+}
+
+func (c *collector) Collect(ctx context.Context, repoName string) (Report, error) {
+	report := Report{Repository: repoName, DryRun: c.policy.DryRun}
+	repository, err := c.repository(repoName)
+	if err != nil {
+		return report, err
+	}
+	candidates, err := c.listCandidates(ctx, repository)
+	if err != nil {
+		return report, err
+	}
+	var errs []error
+	for _, cand := range candidates {
+		image := fmt.Sprintf("%s@%s", repoName, cand.descriptor.Digest.String())
+		reason, ok, err := c.evaluate(ctx, repository, cand.descriptor)
+		if errors.Is(err, errdef.ErrNotFound) {
+			// The manifest was deleted concurrently (or the registry keeps dangling tags).
+			log.Debugf("skipping %s: %v", image, err)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to evaluate %s: %w", image, err))
+			continue
+		}
+		if !ok {
+			report.Kept++
+			continue
+		}
+		if !c.policy.DryRun {
+			if err := c.delete(ctx, repository, cand.descriptor); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete %s: %w", image, err))
+				continue
+			}
+			log.Infof("deleted %s (%s)", image, reason)
+		}
+		report.Deleted = append(report.Deleted, Entry{Image: image, Tag: cand.tag, Reason: reason})
+	}
+	return report, errors.Join(errs...)
+}
+
+// listCandidates returns all deltas, dummies and locks of the repository.
+// Deltas are either stored at tags with the delta prefix or as referrers of tagged images, locks at tags with the lock prefix.
+func (c *collector) listCandidates(ctx context.Context, repository repository) ([]candidate, error) {
+	var tags []string
+	err := repository.Tags(ctx, "", func(t []string) error {
+		tags = append(tags, t...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags: %w", err)
+	}
+	seen := make(map[string]any)
+	var candidates []candidate
+	for _, tag := range tags {
+		// Skip tags of the referrers tag schema and legacy signature tags.
+		if strings.HasPrefix(tag, "sha256-") {
+			continue
+		}
+		d, err := repository.Resolve(ctx, tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve tag %q: %w", tag, err)
+		}
+		if strings.HasPrefix(tag, deltalocation.TagPrefix) || strings.HasPrefix(tag, constants.DorasLockTagPrefix) {
+			if _, ok := seen[d.Digest.String()]; !ok {
+				seen[d.Digest.String()] = nil
+				candidates = append(candidates, candidate{descriptor: d, tag: tag})
+			}
+			continue
+		}
+		referrers, err := ociutils.Referrers(ctx, repository, d, constants.DorasDeltaArtifactType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list referrers of %q: %w", tag, err)
+		}
+		for _, r := range referrers {
+			if _, ok := seen[r.Digest.String()]; !ok {
+				seen[r.Digest.String()] = nil
+				candidates = append(candidates, candidate{descriptor: r})
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// evaluate checks whether the delta should be deleted according to the policy.
+func (c *collector) evaluate(ctx context.Context, repository repository, d v1.Descriptor) (Reason, bool, error) {
+	mfReader, err := repository.Fetch(ctx, d)
+	if err != nil {
+		return "", false, err
+	}
+	defer funcutils.PanicOrLogOnErr(mfReader.Close, false, "failed to close reader")
+	mf, err := ociutils.ParseManifestJSON(mfReader)
+	if err != nil {
+		return "", false, err
+	}
+	now := c.now().UTC()
+	if _, ok := mf.Annotations[constants.DorasAnnotationLockKey]; ok {
+		return evaluateLock(mf.Annotations, now)
+	}
+	if _, ok := mf.Annotations[constants.DorasAnnotationFrom]; !ok {
+		// Not a delta created by Doras.
+		return "", false, nil
+	}
+	created, err := time.Parse(time.RFC3339, mf.Annotations[v1.AnnotationCreated])
+	if err != nil {
+		return "", false, fmt.Errorf("failed to parse creation timestamp: %w", err)
+	}
+	if mf.Annotations[constants.DorasAnnotationIsDummy] == "true" {
+		heartbeat, err := ociutils.LastHeartbeat(mf.Annotations)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to parse heartbeat: %w", err)
+		}
+		if now.After(heartbeat.Add(c.policy.DummyExpiration)) {
+			return ReasonExpiredDummy, true, nil
+		}
+		return "", false, nil
+	}
+	for _, key := range []string{constants.DorasAnnotationFrom, constants.DorasAnnotationTo} {
+		exists, err := c.imageExists(ctx, mf.Annotations[key])
+		if err != nil {
+			return "", false, err
+		}
+		if !exists {
+			return ReasonMissingSource, true, nil
+		}
+	}
+	if c.policy.MaxAge > 0 && now.After(created.Add(c.policy.MaxAge)) {
+		return ReasonRetention, true, nil
+	}
+	if c.policy.UnusedFor > 0 && c.usage != nil {
+		lastUsed := created
+		usage, ok, err := c.usage.Get(d.Digest)
+		if err != nil {
+			return "", false, err
+		}
+		if ok && usage.LastServed.After(lastUsed) {
+			lastUsed = usage.LastServed
+		}
+		if now.After(lastUsed.Add(c.policy.UnusedFor)) {
+			return ReasonUnused, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// evaluateLock checks whether the lock manifest has expired, locks without expiration are kept.
+// Expired locks are no longer held, deleting them does not affect locks that are acquired concurrently
+// because their manifests have other digests.
+func evaluateLock(annotations map[string]string, now time.Time) (Reason, bool, error) {
+	expires, ok := annotations[constants.DorasAnnotationLockExpires]
+	if !ok {
+		return "", false, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, expires)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to parse lock expiration: %w", err)
+	}
+	if now.After(t) {
+		return ReasonExpiredLock, true, nil
+	}
+	return "", false, nil
+}
+
+func (c *collector) repository(repoName string) (repository, error) {
+	target, err := c.repositories.Repository(repoName, c.credentials)
+	if err != nil {
+		return nil, err
+	}
+	repo, ok := target.(repository)
+	if !ok {
+		return nil, fmt.Errorf("storage of %s does not support garbage collection", repoName)
+	}
+	return repo, nil
+}
+
+// imageExists checks if the image (identified by its digest) exists.
+// The image is not necessarily located in the repository of the delta (see deltalocation.Targets).
+func (c *collector) imageExists(ctx context.Context, image string) (bool, error) {
+	repoName, dgst, isDigest, err := ociutils.ParseOciImageString(image)
+	if err != nil {
+		return false, err
+	}
+	if !isDigest {
+		return false, fmt.Errorf("expected image with digest, got %q", image)
+	}
+	repository, err := c.repository(repoName)
+	if err != nil {
+		return false, err
+	}
+	_, err = repository.Resolve(ctx, strings.TrimPrefix(dgst, "@"))
+	if errors.Is(err, errdef.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// delete removes the delta manifest and the manifests that refer to it (e.g. signatures).
+// Blobs are not deleted, they are cleaned up by the garbage collection of the registry.
+func (c *collector) delete(ctx context.Context, repository repository, d v1.Descriptor) error {
+	referrers, err := registry.Referrers(ctx, repository, d, "")
+	if err != nil {
+		return err
+	}
+	for _, r := range referrers {
+		if err := repository.Delete(ctx, r); err != nil && !errors.Is(err, errdef.ErrNotFound) {
+			return err
+		}
+	}
+	if err := repository.Delete(ctx, d); err != nil && !errors.Is(err, errdef.ErrNotFound) {
+		return err
+	}
+	if c.usage != nil {
+		return c.usage.Forget(d.Digest)
+	}
+	return nil
+}
+
+// RunPeriodically collects garbage in the given repositories at the given interval until the context is cancelled.
+func RunPeriodically(ctx context.Context, c Collector, repositories []string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, repoName := range repositories {
+			report, err := c.Collect(ctx, repoName)
+			if err != nil {
+				log.WithError(err).Errorf("garbage collection failed for %s", repoName)
+			}
+			log.Infof("garbage collection in %s deleted %d and kept %d deltas", repoName, len(report.Deleted), report.Kept)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/unbasical/doras/internal/pkg/algorithmchoice"
+	"github.com/unbasical/doras/internal/pkg/compression/zstd"
+	registrydelegate "github.com/unbasical/doras/internal/pkg/delegates/registry"
+	"github.com/unbasical/doras/internal/pkg/delta/bsdiff"
+	"github.com/unbasical/doras/internal/pkg/storage"
+	"github.com/unbasical/doras/internal/pkg/utils/compressionutils"
+	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+	"github.com/unbasical/doras/pkg/constants"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func pushImage(t *testing.T, repo *remote.Repository, data, tag string) v1.Descriptor {
+	t.Helper()
+	ctx := context.Background()
+	d := v1.Descriptor{
+		MediaType: "application/vnd.test.file",
+		Digest:    digest.FromString(data),
+		Size:      int64(len(data)),
+	}
+	err := repo.Push(ctx, d, bytes.NewReader([]byte(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfDescriptor, err := oras.PackManifest(ctx, repo, oras.PackManifestVersion1_1, "application/vnd.test.artifact", oras.PackManifestOptions{
+		Layers: []v1.Descriptor{d},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Tag(ctx, mfDescriptor, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfDescriptor
+}
+
+func TestCollector_Collect(t *testing.T) {
+	ctx := context.Background()
+	repoName := testutils.LaunchInProcessRegistry(t) + "/foo"
+	repo, err := remote.NewRepository(repoName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.PlainHTTP = true
+	images := make(map[string]string)
+	var v4Descriptor v1.Descriptor
+	for _, version := range []string{"v1", "v2", "v3", "v4"} {
+		d := pushImage(t, repo, version, version)
+		images[version] = fmt.Sprintf("%s@%s", repoName, d.Digest)
+		v4Descriptor = d
+	}
+
+	// Deltas are pushed the same way the Doras server does it.
+	bsdiffChoice := algorithmchoice.DifferChoice{Differ: bsdiff.NewDiffer(), Compressor: compressionutils.NewNopCompressor()}
+	zstdChoice := algorithmchoice.DifferChoice{Differ: bsdiff.NewDiffer(), Compressor: zstd.NewCompressor()}
+	tagDelegate := registrydelegate.NewRegistryDelegate(nil, true, nil, registrydelegate.DeltaStorageTag)
+	referrersDelegate := registrydelegate.NewRegistryDelegate(nil, true, nil, registrydelegate.DeltaStorageReferrers)
+	pushDelta := func(delegate registrydelegate.RegistryDelegate, tag, from, to string, choice algorithmchoice.DifferChoice) {
+		err := delegate.PushDelta(ctx, repoName+":"+tag, registrydelegate.DeltaManifestOptions{
+			From:         images[from],
+			To:           images[to],
+			DifferChoice: choice,
+		}, io.NopCloser(strings.NewReader("delta")))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pushDelta(tagDelegate, "_delta-a", "v1", "v2", bsdiffChoice)
+	err = tagDelegate.PushDummy(repoName+":_delta-b", registrydelegate.DeltaManifestOptions{
+		From:         images["v1"],
+		To:           images["v3"],
+		DifferChoice: bsdiffChoice,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushDelta(tagDelegate, "_delta-c", "v1", "v4", bsdiffChoice)
+	// Deltas that are stored as referrers are not tagged, the tag is ignored.
+	pushDelta(referrersDelegate, "_delta-d", "v2", "v3", zstdChoice)
+	// Deleting v4 turns delta c into a delta with a missing source image.
+	err = repo.Delete(ctx, v4Descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deltaA := resolveTag(t, repo, "_delta-a")
+	now := time.Now()
+	// A lock of the registry locker, the garbage collection deletes it once it expired.
+	pushLock(t, repo, "doras-lock-a", now.Add(30*time.Minute))
+	tests := []struct {
+		name   string
+		policy Policy
+		now    time.Time
+		usage  map[digest.Digest]Usage
+		want   map[string]Reason
+		kept   int
+	}{
+		{
+			name:   "missing source",
+			policy: Policy{DummyExpiration: 5 * time.Minute},
+			now:    now,
+			want:   map[string]Reason{"_delta-c": ReasonMissingSource},
+			kept:   4,
+		},
+		{
+			name:   "expired dummy",
+			policy: Policy{DummyExpiration: 5 * time.Minute},
+			now:    now.Add(time.Hour),
+			want:   map[string]Reason{"_delta-b": ReasonExpiredDummy, "_delta-c": ReasonMissingSource, "doras-lock-a": ReasonExpiredLock},
+			kept:   2,
+		},
+		{
+			name:   "retention",
+			policy: Policy{DummyExpiration: 5 * time.Minute, MaxAge: 24 * time.Hour},
+			now:    now.Add(48 * time.Hour),
+			want:   map[string]Reason{"_delta-a": ReasonRetention, "_delta-b": ReasonExpiredDummy, "_delta-c": ReasonMissingSource, "": ReasonRetention, "doras-lock-a": ReasonExpiredLock},
+			kept:   0,
+		},
+		{
+			name:   "unused",
+			policy: Policy{DummyExpiration: 5 * time.Minute, UnusedFor: 24 * time.Hour},
+			now:    now.Add(48 * time.Hour),
+			usage:  map[digest.Digest]Usage{deltaA: {Count: 1, LastServed: now.Add(47 * time.Hour)}},
+			want:   map[string]Reason{"_delta-b": ReasonExpiredDummy, "_delta-c": ReasonMissingSource, "": ReasonUnused, "doras-lock-a": ReasonExpiredLock},
+			kept:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.policy.DryRun = true
+			usage := &memoryUsageStore{deltas: make(map[digest.Digest]Usage)}
+			maps.Copy(usage.deltas, tt.usage)
+			c := NewCollector(storage.NewRemoteProvider(true), nil, tt.policy, usage).(*collector)
+			c.now = func() time.Time { return tt.now }
+			report, err := c.Collect(ctx, repoName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]Reason)
+			for _, e := range report.Deleted {
+				got[e.Tag] = e.Reason
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("Collect() deleted = %v, want %v", got, tt.want)
+			}
+			if report.Kept != tt.kept {
+				t.Errorf("Collect() kept = %d, want %d", report.Kept, tt.kept)
+			}
+		})
+	}
+
+	// The dry runs above must not have deleted anything, now actually delete the expired dummy and the stale delta.
+	deltaB := resolveTag(t, repo, "_delta-b")
+	c := NewCollector(storage.NewRemoteProvider(true), nil, Policy{DummyExpiration: 5 * time.Minute}, nil).(*collector)
+	c.now = func() time.Time { return now.Add(time.Hour) }
+	report, err := c.Collect(ctx, repoName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := make([]string, 0, len(report.Deleted))
+	for _, e := range report.Deleted {
+		deleted = append(deleted, e.Tag)
+	}
+	slices.Sort(deleted)
+	if !slices.Equal(deleted, []string{"_delta-b", "_delta-c", "doras-lock-a"}) {
+		t.Fatalf("unexpected deleted deltas %v", deleted)
+	}
+	if _, err := repo.Resolve(ctx, deltaB.String()); !errors.Is(err, errdef.ErrNotFound) {
+		t.Errorf("expected dummy to be deleted, got %v", err)
+	}
+	if _, err := repo.Resolve(ctx, deltaA.String()); err != nil {
+		t.Errorf("expected delta to be kept, got %v", err)
+	}
+	// A second run has nothing left to delete.
+	report, err = c.Collect(ctx, repoName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Deleted) != 0 || report.Kept != 2 {
+		t.Errorf("unexpected second run report %+v", report)
+	}
+}
+
+// pushLock pushes a lock manifest like the registry locker that expires at the given time.
+func pushLock(t *testing.T, repo *remote.Repository, tag string, expires time.Time) {
+	t.Helper()
+	ctx := context.Background()
+	d, err := oras.PackManifest(ctx, repo, oras.PackManifestVersion1_1, constants.DorasLockArtifactType, oras.PackManifestOptions{
+		ManifestAnnotations: map[string]string{
+			constants.DorasAnnotationLockKey:     repo.Reference.String() + ":" + tag,
+			constants.DorasAnnotationLockExpires: expires.UTC().Format(time.RFC3339Nano),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Tag(ctx, d, tag); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func resolveTag(t *testing.T, repo *remote.Repository, tag string) digest.Digest {
+	t.Helper()
+	d, err := repo.Resolve(context.Background(), tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.Digest
+}
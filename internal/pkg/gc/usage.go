@@ -0,0 +1,252 @@
+package gc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
+)
+
+// usageFlushInterval is the interval in which served deltas are written to the usage file.
+const usageFlushInterval = time.Minute
+
+// Usage records how often a delta was served to clients.
+type Usage struct {
+	Count      uint64    `json:"count"`
+	LastServed time.Time `json:"last_served"`
+}
+
+// UsageStore keeps track of the deltas that are served by the server.
+// It is used to collect deltas that have not been served for a long time.
+type UsageStore interface {
+	// MarkServed records that the delta with the given manifest digest was served.
+	MarkServed(dgst digest.Digest) error
+	// Get returns the usage of the delta with the given manifest digest.
+	// Returns false if the delta has never been served.
+	Get(dgst digest.Digest) (Usage, bool, error)
+	// Forget removes the usage of a (deleted) delta.
+	Forget(dgst digest.Digest) error
+	// Close persists the recorded usage and stops the store.
+	Close() error
+}
+
+type usageState struct {
+	Deltas map[digest.Digest]Usage `json:"deltas"`
+}
+
+// NewUsageStore returns a UsageStore that persists the usage to the file at the given path.
+// Served deltas are buffered in memory and added to the file every minute and on Close, so serving deltas does not wait for the file.
+// The file can be shared between processes, e.g. a running server and the gc command, and between replicas on a shared
+// file system that supports flock; each process adds its usage to the file, so they do not overwrite each other.
+// If the path is empty the usage is only kept in memory.
+func NewUsageStore(path string) (UsageStore, error) {
+	if path == "" {
+		return &memoryUsageStore{deltas: make(map[digest.Digest]Usage)}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	s := &fileUsageStore{path: path, pending: make(map[digest.Digest]Usage), stop: make(chan struct{}), stopped: make(chan struct{})}
+	// The file is checked right away, so corrupt files are reported on start.
+	if _, err := s.read(); err != nil {
+		return nil, err
+	}
+	go s.flushPeriodically()
+	return s, nil
+}
+
+type memoryUsageStore struct {
+	mu     sync.Mutex
+	deltas map[digest.Digest]Usage
+}
+
+func (s *memoryUsageStore) MarkServed(dgst digest.Digest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deltas[dgst] = markServed(s.deltas[dgst])
+	return nil
+}
+
+func (s *memoryUsageStore) Get(dgst digest.Digest) (Usage, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.deltas[dgst]
+	return u, ok, nil
+}
+
+func (s *memoryUsageStore) Forget(dgst digest.Digest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.deltas, dgst)
+	return nil
+}
+
+func (s *memoryUsageStore) Close() error {
+	return nil
+}
+
+// fileUsageStore buffers the usage of served deltas and adds it to the file periodically.
+type fileUsageStore struct {
+	path string
+	// mu guards pending, the usage that has not been added to the file yet.
+	mu      sync.Mutex
+	pending map[digest.Digest]Usage
+	// fileMu serializes the writes to the file of this process, other processes are excluded by the file lock.
+	fileMu    sync.Mutex
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *fileUsageStore) MarkServed(dgst digest.Digest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[dgst] = markServed(s.pending[dgst])
+	return nil
+}
+
+func (s *fileUsageStore) Get(dgst digest.Digest) (Usage, bool, error) {
+	state, err := s.read()
+	if err != nil {
+		return Usage{}, false, err
+	}
+	u, ok := state.Deltas[dgst]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, pending := s.pending[dgst]; pending {
+		return mergeUsage(u, p), true, nil
+	}
+	return u, ok, nil
+}
+
+func (s *fileUsageStore) Forget(dgst digest.Digest) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	s.mu.Lock()
+	delete(s.pending, dgst)
+	s.mu.Unlock()
+	return s.modify(func(state *usageState) {
+		delete(state.Deltas, dgst)
+	})
+}
+
+func (s *fileUsageStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.stopped
+	})
+	return s.flush()
+}
+
+func (s *fileUsageStore) flushPeriodically() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				log.WithError(err).Warn("failed to persist delta usage")
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// flush adds the pending usage to the file, it is kept pending if the file cannot be written.
+func (s *fileUsageStore) flush() error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[digest.Digest]Usage)
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := s.modify(func(state *usageState) {
+		for dgst, u := range pending {
+			state.Deltas[dgst] = mergeUsage(state.Deltas[dgst], u)
+		}
+	})
+	if err != nil {
+		s.mu.Lock()
+		for dgst, u := range pending {
+			s.pending[dgst] = mergeUsage(s.pending[dgst], u)
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// read decodes the file, the usage is empty if the file does not exist or is empty.
+func (s *fileUsageStore) read() (*usageState, error) {
+	state := &usageState{Deltas: make(map[digest.Digest]Usage)}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(data) == 0) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse delta usage %s: %w", s.path, err)
+	}
+	if state.Deltas == nil {
+		state.Deltas = make(map[digest.Digest]Usage)
+	}
+	return state, nil
+}
+
+// modify applies f to the file, the modifications of processes are serialized with a file lock (flock)
+// and written to a synced temporary file that replaces the file.
+func (s *fileUsageStore) modify(f func(state *usageState)) error {
+	fileLock := flock.New(s.path + ".lock")
+	if err := fileLock.Lock(); err != nil {
+		return err
+	}
+	defer funcutils.PanicOrLogOnErr(fileLock.Unlock, false, "failed to unlock delta usage")
+	state, err := s.read()
+	if err != nil {
+		return err
+	}
+	f(state)
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(data)
+	if err = errors.Join(err, fp.Sync(), fp.Close()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func markServed(u Usage) Usage {
+	u.Count++
+	u.LastServed = time.Now().UTC()
+	return u
+}
+
+// mergeUsage adds the usage of b to a.
+func mergeUsage(a, b Usage) Usage {
+	a.Count += b.Count
+	if b.LastServed.After(a.LastServed) {
+		a.LastServed = b.LastServed
+	}
+	return a
+}
@@ -0,0 +1,99 @@
+package gc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestUsageStore(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{name: "memory", path: ""},
+		{name: "file", path: filepath.Join(t.TempDir(), "usage.json")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dgst := digest.FromString("delta")
+			s, err := NewUsageStore(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok, err := s.Get(dgst); ok || err != nil {
+				t.Fatalf("expected no usage, got ok=%v err=%v", ok, err)
+			}
+			for range 2 {
+				if err := s.MarkServed(dgst); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.path != "" {
+				// The usage is shared with other processes through the file once it has been persisted.
+				if err := s.Close(); err != nil {
+					t.Fatal(err)
+				}
+				s, err = NewUsageStore(tt.path)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			u, ok, err := s.Get(dgst)
+			if err != nil || !ok {
+				t.Fatalf("expected usage, got ok=%v err=%v", ok, err)
+			}
+			if u.Count != 2 || u.LastServed.IsZero() {
+				t.Errorf("unexpected usage %+v", u)
+			}
+			if err := s.Forget(dgst); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok, _ := s.Get(dgst); ok {
+				t.Error("expected usage to be forgotten")
+			}
+		})
+	}
+}
+
+func TestFileUsageStore_replicas(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	dgst := digest.FromString("delta")
+	// Replicas that share the file add their usage, they do not overwrite the usage of each other.
+	var stores []UsageStore
+	for range 2 {
+		s, err := NewUsageStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, s)
+		if err := s.MarkServed(dgst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Buffered usage is reported before it has been persisted.
+	if u, ok, err := stores[0].Get(dgst); err != nil || !ok || u.Count != 1 {
+		t.Fatalf("expected the buffered usage, got %+v ok=%v err=%v", u, ok, err)
+	}
+	for _, s := range stores {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, ok, err := stores[0].Get(dgst)
+	if err != nil || !ok || u.Count != 2 {
+		t.Errorf("expected the usage of both replicas, got %+v ok=%v err=%v", u, ok, err)
+	}
+}
+
+func TestNewUsageStore_corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewUsageStore(path); err == nil {
+		t.Error("expected an error for a corrupt usage file")
+	}
+}
@@ -0,0 +1,133 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
+)
+
+// fileLockState is the content of a lock file.
+type fileLockState struct {
+	Key     string    `json:"key"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+type fileLocker struct {
+	dir string
+	ttl time.Duration
+}
+
+type fileLease struct {
+	locker *fileLocker
+	key    string
+	token  string
+}
+
+// NewFileLocker returns an embedded Locker that stores locks as files in dir.
+// Updates of the lock files are serialized with file locks (flock),
+// so all replicas have to share dir on a file system that supports them, e.g. a local volume.
+// Locks expire after the ttl, a ttl of 0 disables expiration.
+func NewFileLocker(dir string, ttl time.Duration) (Locker, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	return &fileLocker{dir: dir, ttl: ttl}, nil
+}
+
+func (l *fileLocker) path(key string) string {
+	return filepath.Join(l.dir, hashKey(key)+".json")
+}
+
+// update calls f with the current state of the lock while holding the file lock, f returns the new state.
+// A nil state removes the lock file.
+func (l *fileLocker) update(ctx context.Context, key string, f func(current *fileLockState) (*fileLockState, error)) error {
+	p := l.path(key)
+	fileLock := flock.New(p + ".lock")
+	locked, err := fileLock.TryLockContext(ctx, 10*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return fmt.Errorf("failed to lock %s", fileLock.Path())
+	}
+	defer funcutils.PanicOrLogOnErr(fileLock.Unlock, false, "failed to unlock lock file")
+
+	var current *fileLockState
+	data, err := os.ReadFile(p)
+	switch {
+	case err == nil:
+		current = &fileLockState{}
+		if err := json.Unmarshal(data, current); err != nil {
+			return fmt.Errorf("failed to parse lock file %s: %w", p, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+	next, err := f(current)
+	if err != nil {
+		return err
+	}
+	if next == nil {
+		if current == nil {
+			return nil
+		}
+		return os.Remove(p)
+	}
+	data, err = json.Marshal(next)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers that do not hold the file lock never see partial state.
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (l *fileLocker) TryLock(ctx context.Context, key string) (Lease, error) {
+	lease := &fileLease{locker: l, key: key, token: newToken()}
+	err := l.update(ctx, key, func(current *fileLockState) (*fileLockState, error) {
+		if current != nil && (current.Expires.IsZero() || time.Now().Before(current.Expires)) {
+			return nil, ErrLocked
+		}
+		next := &fileLockState{Key: key, Token: lease.token}
+		if l.ttl > 0 {
+			next.Expires = time.Now().Add(l.ttl)
+		}
+		return next, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+func (l *fileLease) Renew(ctx context.Context) error {
+	return l.locker.update(ctx, l.key, func(current *fileLockState) (*fileLockState, error) {
+		if current == nil || current.Token != l.token || (!current.Expires.IsZero() && !time.Now().Before(current.Expires)) {
+			return current, ErrNotHeld
+		}
+		if l.locker.ttl > 0 {
+			current.Expires = time.Now().Add(l.locker.ttl)
+		}
+		return current, nil
+	})
+}
+
+func (l *fileLease) Release(ctx context.Context) error {
+	return l.locker.update(ctx, l.key, func(current *fileLockState) (*fileLockState, error) {
+		if current == nil || current.Token != l.token {
+			return current, ErrNotHeld
+		}
+		return nil, nil
+	})
+}
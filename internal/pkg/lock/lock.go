@@ -0,0 +1,128 @@
+// Package lock provides locks that coordinate delta creations across Doras replicas.
+// A delta is only created by the replica that holds the lock of its location,
+// registry dummies communicate the creation to clients but cannot prevent duplicate work on their own.
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLocked is returned if the lock is held by someone else.
+	ErrLocked = errors.New("lock is held by someone else")
+	// ErrNotHeld is returned if a lease is released that is no longer held, e.g. because it expired.
+	ErrNotHeld = errors.New("lock is not held")
+	// ErrConditionsUnsupported is returned by registry locks if the registry ignores conditional requests.
+	ErrConditionsUnsupported = errors.New("registry ignores conditional requests, it cannot be used for locks")
+)
+
+// Locker acquires locks that are identified by a key, e.g. the location of a delta.
+type Locker interface {
+	// TryLock acquires the lock for the key without blocking.
+	// Returns ErrLocked if the lock is held by someone else.
+	// Locks expire after the TTL of the Locker so locks of crashed replicas do not block forever.
+	TryLock(ctx context.Context, key string) (Lease, error)
+}
+
+// Lease is an acquired lock.
+type Lease interface {
+	// Release releases the lock, returns ErrNotHeld if the lock has expired and has been acquired by someone else.
+	Release(ctx context.Context) error
+	// Renew extends the lock by the TTL of the Locker so it does not expire while it is in use.
+	// Returns ErrNotHeld if the lock has expired and has been acquired by someone else.
+	Renew(ctx context.Context) error
+}
+
+// leaseKey is the context key of the lease of a delta creation.
+type leaseKey struct{}
+
+// WithLease returns a context that carries the lease, e.g. so the heartbeat of a delta creation can renew it.
+func WithLease(ctx context.Context, lease Lease) context.Context {
+	return context.WithValue(ctx, leaseKey{}, lease)
+}
+
+// LeaseFromContext returns the lease of the context or nil if it has none.
+func LeaseFromContext(ctx context.Context) Lease {
+	lease, _ := ctx.Value(leaseKey{}).(Lease)
+	return lease
+}
+
+// newToken returns a random token that identifies a lease.
+func newToken() string {
+	b := make([]byte, 16)
+	// rand.Read never returns an error.
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// hashKey returns a key that can be used in file names, tags, etc.
+func hashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+type localLocker struct {
+	m     sync.Mutex
+	ttl   time.Duration
+	locks map[string]localLease
+}
+
+type localLease struct {
+	locker  *localLocker
+	key     string
+	token   string
+	expires time.Time
+}
+
+// NewLocalLocker returns a Locker that only coordinates within the process.
+// Locks expire after the ttl, a ttl of 0 disables expiration.
+func NewLocalLocker(ttl time.Duration) Locker {
+	return &localLocker{
+		ttl:   ttl,
+		locks: make(map[string]localLease),
+	}
+}
+
+func (l *localLocker) TryLock(_ context.Context, key string) (Lease, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if current, ok := l.locks[key]; ok && (current.expires.IsZero() || time.Now().Before(current.expires)) {
+		return nil, ErrLocked
+	}
+	lease := localLease{locker: l, key: key, token: newToken()}
+	if l.ttl > 0 {
+		lease.expires = time.Now().Add(l.ttl)
+	}
+	l.locks[key] = lease
+	return &lease, nil
+}
+
+func (l *localLease) Renew(_ context.Context) error {
+	l.locker.m.Lock()
+	defer l.locker.m.Unlock()
+	current, ok := l.locker.locks[l.key]
+	if !ok || current.token != l.token || (!current.expires.IsZero() && !time.Now().Before(current.expires)) {
+		return ErrNotHeld
+	}
+	if l.locker.ttl > 0 {
+		current.expires = time.Now().Add(l.locker.ttl)
+		l.locker.locks[l.key] = current
+	}
+	return nil
+}
+
+func (l *localLease) Release(_ context.Context) error {
+	l.locker.m.Lock()
+	defer l.locker.m.Unlock()
+	if current, ok := l.locker.locks[l.key]; !ok || current.token != l.token {
+		return ErrNotHeld
+	}
+	delete(l.locker.locks, l.key)
+	return nil
+}
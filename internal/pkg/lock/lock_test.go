@@ -0,0 +1,291 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+)
+
+// conditionalRegistry wraps a registry and enforces conditional manifest pushes (If-Match/If-None-Match),
+// like registries that support compare-and-set.
+func conditionalRegistry(next http.Handler) http.Handler {
+	m := sync.Mutex{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+		if r.Method != http.MethodPut || !strings.Contains(r.URL.Path, "/manifests/") || (ifMatch == "" && ifNoneMatch == "") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.Lock()
+		defer m.Unlock()
+		head := httptest.NewRecorder()
+		next.ServeHTTP(head, httptest.NewRequest(http.MethodHead, r.URL.String(), nil))
+		etag := ""
+		if head.Code == http.StatusOK {
+			etag = `"` + head.Header().Get("Docker-Content-Digest") + `"`
+		}
+		if (ifNoneMatch == "*" && etag != "") || (ifMatch != "" && ifMatch != etag) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// launchConditionalRegistry starts an in-process registry that supports conditional requests.
+func launchConditionalRegistry(t *testing.T) string {
+	srv := httptest.NewServer(conditionalRegistry(registry.New(registry.Logger(log.New(io.Discard, "", 0)))))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// newLockers returns constructors of Lockers that share their locks, like the replicas of a Doras deployment.
+func newLockers(t *testing.T) map[string]func(ttl time.Duration) Locker {
+	dir := t.TempDir()
+	redisAddress := testutils.LaunchRedis(t, "secret")
+	local := map[time.Duration]Locker{}
+	nodes := launchRaftCluster(t, 3)
+	next := 0
+	return map[string]func(ttl time.Duration) Locker{
+		"local": func(ttl time.Duration) Locker {
+			// Local locks are only shared within the process.
+			if _, ok := local[ttl]; !ok {
+				local[ttl] = NewLocalLocker(ttl)
+			}
+			return local[ttl]
+		},
+		"file": func(ttl time.Duration) Locker {
+			l, err := NewFileLocker(dir, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return l
+		},
+		"redis": func(ttl time.Duration) Locker {
+			l, err := NewRedisLocker(redisAddress, "secret", ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return l
+		},
+		"registry": func(ttl time.Duration) Locker {
+			return NewRegistryLocker(nil, true, ttl)
+		},
+		"raft": func(ttl time.Duration) Locker {
+			// Replicas use different nodes, so commands of followers are forwarded to the leader.
+			next++
+			return &raftLocker{node: nodes[next%len(nodes)], ttl: ttl}
+		},
+	}
+}
+
+func TestLocker(t *testing.T) {
+	ctx := context.Background()
+	host := launchConditionalRegistry(t)
+	for name, newLocker := range newLockers(t) {
+		t.Run(name, func(t *testing.T) {
+			key := host + "/foo:" + name
+			other := host + "/foo:" + name + "-other"
+			replica1, replica2 := newLocker(time.Minute), newLocker(time.Minute)
+			lease, err := replica1.TryLock(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := replica2.TryLock(ctx, key); !errors.Is(err, ErrLocked) {
+				t.Fatalf("expected ErrLocked, got %v", err)
+			}
+			otherLease, err := replica2.TryLock(ctx, other)
+			if err != nil {
+				t.Fatalf("expected locks to be independent, got %v", err)
+			}
+			if err := lease.Release(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := lease.Release(ctx); !errors.Is(err, ErrNotHeld) {
+				t.Errorf("expected ErrNotHeld, got %v", err)
+			}
+			lease, err = replica2.TryLock(ctx, key)
+			if err != nil {
+				t.Fatalf("expected released lock to be acquired, got %v", err)
+			}
+			for _, l := range []Lease{lease, otherLease} {
+				if err := l.Release(ctx); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestLocker_Expiration(t *testing.T) {
+	ctx := context.Background()
+	host := launchConditionalRegistry(t)
+	for name, newLocker := range newLockers(t) {
+		t.Run(name, func(t *testing.T) {
+			key := host + "/foo:expiration-" + name
+			replica1, replica2 := newLocker(50*time.Millisecond), newLocker(50*time.Millisecond)
+			expired, err := replica1.TryLock(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(100 * time.Millisecond)
+			lease, err := replica2.TryLock(ctx, key)
+			if err != nil {
+				t.Fatalf("expected expired lock to be acquired, got %v", err)
+			}
+			if err := expired.Release(ctx); !errors.Is(err, ErrNotHeld) {
+				t.Errorf("expected ErrNotHeld, got %v", err)
+			}
+			if err := lease.Release(ctx); err != nil && !errors.Is(err, ErrNotHeld) {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestLocker_Renew(t *testing.T) {
+	ctx := context.Background()
+	host := launchConditionalRegistry(t)
+	for name, newLocker := range newLockers(t) {
+		t.Run(name, func(t *testing.T) {
+			key := host + "/foo:renew-" + name
+			const ttl = 300 * time.Millisecond
+			replica1, replica2 := newLocker(ttl), newLocker(ttl)
+			lease, err := replica1.TryLock(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Renewed leases outlive their ttl.
+			for range 4 {
+				time.Sleep(ttl / 3)
+				if err := lease.Renew(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := replica2.TryLock(ctx, key); !errors.Is(err, ErrLocked) {
+				t.Fatalf("expected ErrLocked, got %v", err)
+			}
+			// Expired leases cannot be renewed once someone else has acquired the lock.
+			time.Sleep(ttl + 50*time.Millisecond)
+			other, err := replica2.TryLock(ctx, key)
+			if err != nil {
+				t.Fatalf("expected expired lock to be acquired, got %v", err)
+			}
+			if err := lease.Renew(ctx); !errors.Is(err, ErrNotHeld) {
+				t.Errorf("expected ErrNotHeld, got %v", err)
+			}
+			if err := other.Release(ctx); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestLocker_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	host := launchConditionalRegistry(t)
+	for name, newLocker := range newLockers(t) {
+		t.Run(name, func(t *testing.T) {
+			key := host + "/foo:concurrent-" + name
+			replicas := make([]Locker, 8)
+			for i := range replicas {
+				replicas[i] = newLocker(time.Minute)
+			}
+			var acquired atomic.Int32
+			wg := sync.WaitGroup{}
+			for _, replica := range replicas {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := replica.TryLock(ctx, key)
+					if err == nil {
+						acquired.Add(1)
+						return
+					}
+					if !errors.Is(err, ErrLocked) {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+			if n := acquired.Load(); n != 1 {
+				t.Errorf("expected exactly one replica to acquire the lock, got %d", n)
+			}
+		})
+	}
+}
+
+func TestNewRedisLocker(t *testing.T) {
+	ctx := context.Background()
+	if _, err := NewRedisLocker("127.0.0.1:6379", "", 0); err == nil {
+		t.Error("expected error for missing ttl")
+	}
+	address := testutils.LaunchRedis(t, "secret")
+	l, err := NewRedisLocker(address, "wrong", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.TryLock(ctx, "foo"); err == nil || errors.Is(err, ErrLocked) {
+		t.Errorf("expected authentication error, got %v", err)
+	}
+	// The password of URLs is used unless another password is provided.
+	l, err = NewRedisLocker("redis://:secret@"+address+"/0", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease, err := l.TryLock(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lease.Release(ctx); err != nil {
+		t.Error(err)
+	}
+	if _, err := NewRedisLocker("http://"+address, "", time.Minute); err == nil {
+		t.Error("expected error for unsupported URL scheme")
+	}
+}
+
+func TestRegistryLocker_conditionsUnsupported(t *testing.T) {
+	ctx := context.Background()
+	// The registry ignores conditional requests, so locks would be last-writer-wins.
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(srv.Close)
+	l := NewRegistryLocker(nil, true, time.Minute)
+	if _, err := l.TryLock(ctx, strings.TrimPrefix(srv.URL, "http://")+"/foo:bar"); !errors.Is(err, ErrConditionsUnsupported) {
+		t.Errorf("expected %v, got %v", ErrConditionsUnsupported, err)
+	}
+}
+
+func Test_push(t *testing.T) {
+	ctx := context.Background()
+	l := NewRegistryLocker(nil, true, time.Minute).(*registryLocker)
+	repo, tag, err := l.repository(launchConditionalRegistry(t) + "/foo:bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := push(ctx, repo, tag, "", map[string]string{"foo": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The registry rejects pushes that expect no manifest at a tag that exists.
+	if _, err := push(ctx, repo, tag, "", map[string]string{"foo": "2"}); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked for a tag that exists, got %v", err)
+	}
+	if _, err := push(ctx, repo, tag, "sha256:0000000000000000000000000000000000000000000000000000000000000000", map[string]string{"foo": "3"}); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked for a stale digest, got %v", err)
+	}
+	if _, err := push(ctx, repo, tag, first, map[string]string{"foo": "4"}); err != nil {
+		t.Errorf("expected push with the current digest to succeed, got %v", err)
+	}
+}
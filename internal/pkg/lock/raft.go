@@ -0,0 +1,601 @@
+package lock
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
+	"github.com/unbasical/doras/internal/pkg/utils/tlsutils"
+)
+
+// ErrNoLeader is returned if the Raft cluster has no leader, e.g. because a majority of the replicas is unavailable.
+var ErrNoLeader = errors.New("the raft cluster has no leader")
+
+const (
+	// raftConnection and forwardConnection are the first byte of connections between replicas,
+	// Raft and forwarded commands share the address of a replica.
+	raftConnection    byte = 'R'
+	forwardConnection byte = 'F'
+	// raftTimeout limits dials, the application of commands and the first byte of connections.
+	raftTimeout = 10 * time.Second
+)
+
+// RaftConfig configures the embedded Raft cluster of the raft lock backend.
+type RaftConfig struct {
+	// NodeID identifies the replica in the cluster, it has to be unique and must not change.
+	NodeID string
+	// Address is the host:port at which the replica listens and at which it is reachable by the other replicas.
+	Address string
+	// Dir is the directory in which the Raft log (a bolt database) and the snapshots of the replica are stored.
+	Dir string
+	// Peers maps the node IDs of all replicas, including this one, to their addresses.
+	// A new cluster is bootstrapped with them, the configuration of existing clusters is kept in the Raft log.
+	Peers map[string]string
+	// CertPath and KeyPath are the PEM encoded certificate and key of the replica, they are reloaded if the files change.
+	// The certificate has to be valid for the address of the replica and usable for servers and clients.
+	CertPath string
+	KeyPath  string
+	// CAPath is the PEM encoded CA that issues the certificates of the replicas, replicas only accept connections
+	// of peers with a certificate of the CA (mutual TLS), so the CA should be dedicated to the cluster.
+	CAPath string
+}
+
+// tlsConfig returns the TLS configuration of the connections between the replicas, both sides are authenticated by the CA.
+func (c RaftConfig) tlsConfig() (*tls.Config, error) {
+	if c.CertPath == "" || c.KeyPath == "" || c.CAPath == "" {
+		return nil, errors.New("the raft lock backend requires a certificate, a key and a CA for mutual TLS")
+	}
+	reloader, err := tlsutils.NewCertificateReloader(c.CertPath, c.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load raft certificate: %w", err)
+	}
+	pool, err := tlsutils.LoadCertPool(c.CAPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load raft CA: %w", err)
+	}
+	return &tls.Config{
+		MinVersion:           tls.VersionTLS13,
+		GetCertificate:       reloader.GetCertificate,
+		GetClientCertificate: reloader.GetClientCertificate,
+		ClientAuth:           tls.RequireAndVerifyClientCert,
+		ClientCAs:            pool,
+		RootCAs:              pool,
+	}, nil
+}
+
+// raftOp is the operation of a command.
+type raftOp string
+
+const (
+	raftOpLock    raftOp = "lock"
+	raftOpRenew   raftOp = "renew"
+	raftOpRelease raftOp = "release"
+)
+
+// raftCommand is an entry of the Raft log.
+// The time at which it has been issued is part of the command, so all replicas agree on expirations.
+type raftCommand struct {
+	Op      raftOp    `json:"op"`
+	Key     string    `json:"key"`
+	Token   string    `json:"token"`
+	Now     time.Time `json:"now"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// raftResult is the result of applying a command.
+type raftResult string
+
+const (
+	raftResultOK      raftResult = "ok"
+	raftResultLocked  raftResult = "locked"
+	raftResultNotHeld raftResult = "not_held"
+	raftResultInvalid raftResult = "invalid"
+)
+
+func (r raftResult) err() error {
+	switch r {
+	case raftResultOK:
+		return nil
+	case raftResultLocked:
+		return ErrLocked
+	case raftResultNotHeld:
+		return ErrNotHeld
+	default:
+		return fmt.Errorf("failed to apply command: %s", r)
+	}
+}
+
+// forwardResponse is the response to a command that has been forwarded to the leader.
+type forwardResponse struct {
+	Result raftResult `json:"result,omitempty"`
+	Error  string     `json:"error,omitempty"`
+	// NotLeader is set if the command has not been applied because the replica is not the leader (anymore).
+	NotLeader bool `json:"not_leader,omitempty"`
+}
+
+// raftLock is a lock in the state of the cluster.
+type raftLock struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// raftFSM is the state machine that is replicated by Raft, it holds the locks.
+type raftFSM struct {
+	m     sync.Mutex
+	locks map[string]raftLock
+}
+
+func (f *raftFSM) Apply(entry *raft.Log) any {
+	var cmd raftCommand
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return raftResultInvalid
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	// Expired locks are removed so locks of crashed replicas do not accumulate.
+	for key, l := range f.locks {
+		if !l.Expires.IsZero() && !cmd.Now.Before(l.Expires) {
+			delete(f.locks, key)
+		}
+	}
+	current, held := f.locks[cmd.Key]
+	switch cmd.Op {
+	case raftOpLock:
+		// Retried commands of the holder succeed.
+		if held && current.Token != cmd.Token {
+			return raftResultLocked
+		}
+		f.locks[cmd.Key] = raftLock{Token: cmd.Token, Expires: cmd.Expires}
+	case raftOpRenew:
+		if !held || current.Token != cmd.Token {
+			return raftResultNotHeld
+		}
+		f.locks[cmd.Key] = raftLock{Token: cmd.Token, Expires: cmd.Expires}
+	case raftOpRelease:
+		if !held || current.Token != cmd.Token {
+			return raftResultNotHeld
+		}
+		delete(f.locks, cmd.Key)
+	default:
+		return raftResultInvalid
+	}
+	return raftResultOK
+}
+
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	locks := make(map[string]raftLock, len(f.locks))
+	for key, l := range f.locks {
+		locks[key] = l
+	}
+	return raftSnapshot(locks), nil
+}
+
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer funcutils.PanicOrLogOnErr(rc.Close, false, "failed to close snapshot")
+	locks := make(map[string]raftLock)
+	if err := json.NewDecoder(rc).Decode(&locks); err != nil {
+		return err
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.locks = locks
+	return nil
+}
+
+// raftSnapshot is a snapshot of the locks.
+type raftSnapshot map[string]raftLock
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(map[string]raftLock(s)); err != nil {
+		return errors.Join(err, sink.Cancel())
+	}
+	return sink.Close()
+}
+
+func (s raftSnapshot) Release() {}
+
+// raftStreamLayer demultiplexes the connections of a listener,
+// Raft connections are passed on to the Raft transport and forwarded commands are handled by forward.
+// Connections in both directions use mutual TLS, peers without a certificate of the cluster CA are rejected by the handshake.
+type raftStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	tlsConfig *tls.Config
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	forward   func(conn net.Conn)
+}
+
+func newRaftStreamLayer(l net.Listener, advertise net.Addr, tlsConfig *tls.Config, forward func(conn net.Conn)) *raftStreamLayer {
+	s := &raftStreamLayer{
+		Listener:  tls.NewListener(l, tlsConfig),
+		advertise: advertise,
+		tlsConfig: tlsConfig,
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+		forward:   forward,
+	}
+	go s.serve()
+	return s
+}
+
+// serve reads the first byte of accepted connections to find out what they are used for.
+func (s *raftStreamLayer) serve() {
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			log.WithError(err).Warn("failed to accept raft connection")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go s.dispatch(conn)
+	}
+}
+
+func (s *raftStreamLayer) dispatch(conn net.Conn) {
+	b := make([]byte, 1)
+	_ = conn.SetReadDeadline(time.Now().Add(raftTimeout))
+	// The first read completes the handshake, which verifies the certificate of the peer.
+	if _, err := io.ReadFull(conn, b); err != nil {
+		log.WithError(err).Debugf("rejected raft connection of %s", conn.RemoteAddr())
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	switch b[0] {
+	case raftConnection:
+		select {
+		case s.conns <- conn:
+		case <-s.closed:
+			_ = conn.Close()
+		}
+	case forwardConnection:
+		s.forward(conn)
+	default:
+		_ = conn.Close()
+	}
+}
+
+func (s *raftStreamLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *raftStreamLayer) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.Listener.Close()
+	})
+	return err
+}
+
+func (s *raftStreamLayer) Addr() net.Addr {
+	return s.advertise
+}
+
+func (s *raftStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return s.dial(string(address), timeout, raftConnection)
+}
+
+// dial connects to the replica at the address, the first byte tells it what the connection is used for.
+// The certificate of the replica has to be valid for the host of the address.
+func (s *raftStreamLayer) dial(address string, timeout time.Duration, kind byte) (net.Conn, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, s.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{kind}); err != nil {
+		return nil, errors.Join(err, conn.Close())
+	}
+	return conn, nil
+}
+
+// raftNode is a replica of the Raft cluster.
+type raftNode struct {
+	raft   *raft.Raft
+	layer  *raftStreamLayer
+	store  *raftboltdb.BoltStore
+	logger hclog.Logger
+}
+
+type raftLocker struct {
+	node *raftNode
+	ttl  time.Duration
+}
+
+type raftLease struct {
+	locker *raftLocker
+	key    string
+	token  string
+}
+
+// NewRaftLocker returns an embedded Locker whose locks are replicated by the replicas with Raft,
+// the Raft log is stored in a bolt database.
+// Locks are acquired as long as a majority of the replicas is available, commands of followers are forwarded to the leader.
+// Raft and forwarded commands use mutual TLS with the certificates of the config, which are required.
+// Locks expire after the ttl, a ttl of 0 disables expiration.
+// The returned Locker implements io.Closer, closing it stops the replica.
+func NewRaftLocker(config RaftConfig, ttl time.Duration) (Locker, error) {
+	l, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", config.Address, err)
+	}
+	node, err := newRaftNode(config, l, raft.DefaultConfig())
+	if err != nil {
+		return nil, errors.Join(err, l.Close())
+	}
+	return &raftLocker{node: node, ttl: ttl}, nil
+}
+
+func newRaftNode(config RaftConfig, l net.Listener, raftConfig *raft.Config) (*raftNode, error) {
+	if config.NodeID == "" || config.Dir == "" {
+		return nil, errors.New("the raft lock backend requires a node ID and a directory")
+	}
+	if config.Peers[config.NodeID] != config.Address {
+		return nil, fmt.Errorf("the peers have to contain the node %s with the address %s", config.NodeID, config.Address)
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raft address: %w", err)
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create raft directory: %w", err)
+	}
+	logger := hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Warn, Output: log.StandardLogger().Out})
+	raftConfig.LocalID = raft.ServerID(config.NodeID)
+	raftConfig.Logger = logger
+	store, err := raftboltdb.New(raftboltdb.Options{Path: filepath.Join(config.Dir, "raft.db")})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log: %w", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(config.Dir, 2, logger)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to open raft snapshots: %w", err), store.Close())
+	}
+	node := &raftNode{store: store, logger: logger}
+	node.layer = newRaftStreamLayer(l, advertise, tlsConfig, node.handleForward)
+	transport := raft.NewNetworkTransportWithConfig(&raft.NetworkTransportConfig{
+		Stream:  node.layer,
+		MaxPool: 3,
+		Timeout: raftTimeout,
+		Logger:  logger,
+	})
+	node.raft, err = raft.NewRaft(raftConfig, &raftFSM{locks: make(map[string]raftLock)}, store, store, snapshots, transport)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to start raft: %w", err), transport.Close(), store.Close())
+	}
+	exists, err := raft.HasExistingState(store, store, snapshots)
+	if err != nil {
+		return nil, errors.Join(err, node.close())
+	}
+	if !exists {
+		ids := make([]string, 0, len(config.Peers))
+		for id := range config.Peers {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		servers := make([]raft.Server, 0, len(ids))
+		for _, id := range ids {
+			servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(config.Peers[id])})
+		}
+		// All replicas bootstrap with the same configuration, replicas that lose the race keep the elected configuration.
+		err := node.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+		if err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+			return nil, errors.Join(fmt.Errorf("failed to bootstrap raft cluster: %w", err), node.close())
+		}
+	}
+	return node, nil
+}
+
+// ParseRaftPeers parses peers of the form id=host:port.
+func ParseRaftPeers(peers []string) (map[string]string, error) {
+	parsed := make(map[string]string, len(peers))
+	for _, peer := range peers {
+		id, address, ok := strings.Cut(peer, "=")
+		if !ok || id == "" || address == "" {
+			return nil, fmt.Errorf("invalid raft peer %q, expected id=host:port", peer)
+		}
+		if _, exists := parsed[id]; exists {
+			return nil, fmt.Errorf("duplicate raft peer %q", id)
+		}
+		parsed[id] = address
+	}
+	return parsed, nil
+}
+
+// apply applies the command on the leader, commands of followers are forwarded to the leader.
+func (n *raftNode) apply(ctx context.Context, cmd raftCommand) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	timeout := raftTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	deadline := time.Now().Add(timeout)
+	// Commands that reached a replica which is not the leader have not been applied, they are retried while the leadership changes.
+	for {
+		err := n.applyOnce(ctx, data, time.Until(deadline))
+		if !errors.Is(err, raft.ErrNotLeader) || time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// applyOnce applies the command on the leader or forwards it to the leader.
+func (n *raftNode) applyOnce(ctx context.Context, data []byte, timeout time.Duration) error {
+	if n.raft.State() == raft.Leader {
+		result, err := n.applyLocal(data, timeout)
+		if err != nil {
+			return err
+		}
+		return result.err()
+	}
+	leader, err := n.leader(ctx, timeout)
+	if err != nil {
+		return err
+	}
+	return n.forward(ctx, leader, data, timeout)
+}
+
+// leader returns the address of the leader, it waits until the replica knows the leader, e.g. during elections.
+func (n *raftNode) leader(ctx context.Context, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if leader, _ := n.raft.LeaderWithID(); leader != "" {
+			return string(leader), nil
+		}
+		if time.Now().After(deadline) {
+			return "", ErrNoLeader
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (n *raftNode) applyLocal(data []byte, timeout time.Duration) (raftResult, error) {
+	f := n.raft.Apply(data, timeout)
+	if err := f.Error(); err != nil {
+		return "", err
+	}
+	result, ok := f.Response().(raftResult)
+	if !ok {
+		return "", fmt.Errorf("unexpected result %v", f.Response())
+	}
+	return result, nil
+}
+
+// forward sends the command to the leader at the address and waits for the result.
+func (n *raftNode) forward(ctx context.Context, leader string, data []byte, timeout time.Duration) error {
+	conn, err := n.layer.dial(leader, timeout, forwardConnection)
+	if err != nil {
+		return fmt.Errorf("failed to forward command to the leader: %w", err)
+	}
+	defer funcutils.PanicOrLogOnErr(conn.Close, false, "failed to close connection")
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	if err := json.NewEncoder(conn).Encode(json.RawMessage(data)); err != nil {
+		return err
+	}
+	var res forwardResponse
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return fmt.Errorf("failed to read the result of the leader: %w", err)
+	}
+	if res.NotLeader {
+		return fmt.Errorf("%s is not the leader anymore: %w", leader, raft.ErrNotLeader)
+	}
+	if res.Error != "" {
+		return fmt.Errorf("leader failed to apply command: %s", res.Error)
+	}
+	return res.Result.err()
+}
+
+// handleForward applies a command that has been forwarded by a follower.
+func (n *raftNode) handleForward(conn net.Conn) {
+	defer funcutils.PanicOrLogOnErr(conn.Close, false, "failed to close connection")
+	if err := conn.SetDeadline(time.Now().Add(raftTimeout)); err != nil {
+		return
+	}
+	var data json.RawMessage
+	if err := json.NewDecoder(conn).Decode(&data); err != nil {
+		return
+	}
+	var res forwardResponse
+	result, err := raftResult(""), raft.ErrNotLeader
+	if n.raft.State() == raft.Leader {
+		result, err = n.applyLocal(data, raftTimeout)
+	}
+	switch {
+	case errors.Is(err, raft.ErrNotLeader):
+		res.NotLeader = true
+	case err != nil:
+		res.Error = err.Error()
+	default:
+		res.Result = result
+	}
+	if err := json.NewEncoder(conn).Encode(res); err != nil {
+		log.WithError(err).Debug("failed to respond to forwarded command")
+	}
+}
+
+func (n *raftNode) close() error {
+	err := n.raft.Shutdown().Error()
+	return errors.Join(err, n.layer.Close(), n.store.Close())
+}
+
+func (l *raftLocker) expires(now time.Time) time.Time {
+	if l.ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(l.ttl)
+}
+
+func (l *raftLocker) TryLock(ctx context.Context, key string) (Lease, error) {
+	lease := &raftLease{locker: l, key: key, token: newToken()}
+	now := time.Now()
+	err := l.node.apply(ctx, raftCommand{Op: raftOpLock, Key: key, Token: lease.token, Now: now, Expires: l.expires(now)})
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// Close stops the replica.
+func (l *raftLocker) Close() error {
+	return l.node.close()
+}
+
+func (l *raftLease) Renew(ctx context.Context) error {
+	now := time.Now()
+	return l.locker.node.apply(ctx, raftCommand{Op: raftOpRenew, Key: l.key, Token: l.token, Now: now, Expires: l.locker.expires(now)})
+}
+
+func (l *raftLease) Release(ctx context.Context) error {
+	return l.locker.node.apply(ctx, raftCommand{Op: raftOpRelease, Key: l.key, Token: l.token, Now: time.Now()})
+}
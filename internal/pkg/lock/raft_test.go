@@ -0,0 +1,175 @@
+package lock
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+)
+
+// launchRaftCluster starts a Raft cluster of n replicas on the loopback interface and waits until it has elected a leader.
+func launchRaftCluster(t *testing.T, n int) []*raftNode {
+	dir := t.TempDir()
+	ca := testutils.NewCertificateAuthority(t)
+	listeners := make([]net.Listener, n)
+	peers := make(map[string]string, n)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = l
+		peers[fmt.Sprintf("node-%d", i)] = l.Addr().String()
+	}
+	nodes := make([]*raftNode, n)
+	for i, l := range listeners {
+		id := fmt.Sprintf("node-%d", i)
+		config := raft.DefaultConfig()
+		config.HeartbeatTimeout = 100 * time.Millisecond
+		config.ElectionTimeout = 100 * time.Millisecond
+		config.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.CommitTimeout = 5 * time.Millisecond
+		certPath, keyPath := ca.Issue(t, id, "localhost")
+		node, err := newRaftNode(RaftConfig{
+			NodeID:   id,
+			Address:  peers[id],
+			Dir:      filepath.Join(dir, id),
+			Peers:    peers,
+			CertPath: certPath,
+			KeyPath:  keyPath,
+			CAPath:   ca.CertPath,
+		}, l, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = node
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			// Nodes that have been stopped by the test are nil.
+			if node != nil {
+				_ = node.close()
+			}
+		}
+	})
+	waitForLeader(t, nodes)
+	return nodes
+}
+
+// waitForLeader returns the index of the leader among the nodes.
+func waitForLeader(t *testing.T, nodes []*raftNode) int {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, node := range nodes {
+			if node != nil && node.raft.State() == raft.Leader {
+				return i
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader has been elected")
+	return -1
+}
+
+func TestRaftLocker_Failover(t *testing.T) {
+	ctx := context.Background()
+	nodes := launchRaftCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+	follower := nodes[(leader+1)%len(nodes)]
+	lease, err := (&raftLocker{node: follower, ttl: time.Minute}).TryLock(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lock survives the loss of the leader.
+	if err := nodes[leader].close(); err != nil {
+		t.Fatal(err)
+	}
+	nodes[leader] = nil
+	waitForLeader(t, nodes)
+	if _, err := (&raftLocker{node: follower, ttl: time.Minute}).TryLock(ctx, "foo"); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked after the failover, got %v", err)
+	}
+	if err := lease.Release(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRaftLocker_unauthenticatedForward(t *testing.T) {
+	ctx := context.Background()
+	nodes := launchRaftCluster(t, 3)
+	leader := nodes[waitForLeader(t, nodes)]
+	cmd, err := json.Marshal(raftCommand{Op: raftOpLock, Key: "foo", Token: "intruder", Now: time.Now(), Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A replica of another cluster has a valid certificate, but not one of the CA of this cluster.
+	ca := testutils.NewCertificateAuthority(t)
+	certPath, keyPath := ca.Issue(t, "intruder", "localhost")
+	config, err := RaftConfig{CertPath: certPath, KeyPath: keyPath, CAPath: ca.CertPath}.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The intruder trusts any certificate of the leader, only the leader authenticates the intruder.
+	config.RootCAs = nil
+	config.InsecureSkipVerify = true
+	tests := []struct {
+		name string
+		dial func() (net.Conn, error)
+	}{
+		{name: "plaintext", dial: func() (net.Conn, error) { return net.Dial("tcp", leader.layer.Addr().String()) }},
+		{name: "foreign certificate", dial: func() (net.Conn, error) { return tls.Dial("tcp", leader.layer.Addr().String(), config) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tt.dial()
+			if err != nil {
+				// The handshake might already fail on the side of the intruder.
+				return
+			}
+			defer func() { _ = conn.Close() }()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			_, _ = conn.Write(append([]byte{forwardConnection}, cmd...))
+			var res forwardResponse
+			if err := json.NewDecoder(conn).Decode(&res); err == nil {
+				t.Errorf("expected the connection to be rejected, got %+v", res)
+			}
+		})
+	}
+	lease, err := (&raftLocker{node: leader, ttl: time.Minute}).TryLock(ctx, "foo")
+	if err != nil {
+		t.Fatalf("expected the lock to be free, got %v", err)
+	}
+	if err := lease.Release(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRaftConfig_tlsConfig(t *testing.T) {
+	if _, err := (RaftConfig{}).tlsConfig(); err == nil {
+		t.Error("expected an error without certificates")
+	}
+}
+
+func TestParseRaftPeers(t *testing.T) {
+	peers, err := ParseRaftPeers([]string{"node-0=10.0.0.1:7000", "node-1=10.0.0.2:7000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers["node-1"] != "10.0.0.2:7000" {
+		t.Errorf("unexpected peers %v", peers)
+	}
+	for _, invalid := range [][]string{{"node-0"}, {"=10.0.0.1:7000"}, {"node-0=a:1", "node-0=b:1"}} {
+		if _, err := ParseRaftPeers(invalid); err == nil {
+			t.Errorf("expected an error for %v", invalid)
+		}
+	}
+}
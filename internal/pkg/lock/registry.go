@@ -0,0 +1,280 @@
+package lock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/pkg/constants"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+	"oras.land/oras-go/v2/registry/remote/retry"
+)
+
+// registryProbeTag is the tag of the manifest that is pushed to detect registries which ignore conditional requests.
+const registryProbeTag = constants.DorasLockTagPrefix + "probe"
+
+// unsatisfiableDigest is the expected digest of the probe, it never matches the manifest at the probe tag.
+const unsatisfiableDigest = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000000")
+
+type registryLocker struct {
+	ttl       time.Duration
+	plainHTTP bool
+	client    *auth.Client
+	// supported records the registries that honor conditional requests, registries that ignore them are not recorded.
+	supported sync.Map
+}
+
+type registryLease struct {
+	locker *registryLocker
+	repo   *remote.Repository
+	key    string
+	tag    string
+	token  string
+	digest digest.Digest
+}
+
+// NewRegistryLocker returns a Locker that stores locks as manifests in the repository of the key,
+// which is expected to be an image, e.g. the location of a delta.
+// Lock manifests are swapped with conditional requests (If-Match/If-None-Match with the manifest digest as ETag),
+// which registries use as compare-and-set.
+// Many registries (e.g. distribution, Docker Hub or GHCR) ignore the conditions, which turns the swap into last-writer-wins.
+// Such registries are detected with a probe before the first lock of a registry and TryLock fails with ErrConditionsUnsupported.
+// Released locks are deleted, locks that expired without being released are deleted by the garbage collection.
+// Locks expire after the ttl, a ttl of 0 disables expiration.
+func NewRegistryLocker(creds auth.CredentialFunc, allowHttp bool, ttl time.Duration) Locker {
+	return &registryLocker{
+		ttl:       ttl,
+		plainHTTP: allowHttp,
+		client: &auth.Client{
+			Client:     &http.Client{Transport: conditionalTransport{base: retry.NewTransport(nil)}},
+			Cache:      auth.NewCache(),
+			Credential: creds,
+		},
+	}
+}
+
+// conditionsKey is the context key of the headers that make a manifest push conditional.
+type conditionsKey struct{}
+
+// conditionalTransport adds the conditions of the request context to manifest pushes.
+type conditionalTransport struct {
+	base http.RoundTripper
+}
+
+func (t conditionalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	conditions, ok := req.Context().Value(conditionsKey{}).(http.Header)
+	if ok && req.Method == http.MethodPut && strings.Contains(req.URL.Path, "/manifests/") {
+		req = req.Clone(req.Context())
+		for k, v := range conditions {
+			req.Header[k] = v
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// repository returns the repository of the key and the tag of its lock.
+func (l *registryLocker) repository(key string) (*remote.Repository, string, error) {
+	repoName, _, _, err := ociutils.ParseOciImageString(key)
+	if err != nil {
+		return nil, "", err
+	}
+	repo, err := remote.NewRepository(repoName)
+	if err != nil {
+		return nil, "", err
+	}
+	repo.Client = l.client
+	repo.PlainHTTP = l.plainHTTP
+	return repo, constants.DorasLockTagPrefix + hashKey(key)[:32], nil
+}
+
+// checkConditions returns ErrConditionsUnsupported if the registry of the repository ignores conditional requests.
+// The probe pushes a manifest with a condition that cannot be satisfied, registries that honor the condition reject it.
+// Registries that accept it are probed again for each lock, the probe manifest is deleted if the registry allows it.
+func (l *registryLocker) checkConditions(ctx context.Context, repo *remote.Repository) error {
+	registry := repo.Reference.Registry
+	if _, ok := l.supported.Load(registry); ok {
+		return nil
+	}
+	d, err := push(ctx, repo, registryProbeTag, unsatisfiableDigest, map[string]string{
+		constants.DorasAnnotationLockKey:     registryProbeTag,
+		constants.DorasAnnotationLockExpires: time.Unix(0, 0).UTC().Format(time.RFC3339Nano),
+	})
+	if errors.Is(err, ErrLocked) {
+		l.supported.Store(registry, struct{}{})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to probe conditional requests of %s: %w", registry, err)
+	}
+	deleteManifest(ctx, repo, d)
+	return fmt.Errorf("%w: %s", ErrConditionsUnsupported, registry)
+}
+
+// deleteManifest deletes the lock manifest with the digest, failures are only logged because
+// some registries do not allow deleting manifests and the garbage collection deletes expired locks.
+func deleteManifest(ctx context.Context, repo *remote.Repository, d digest.Digest) {
+	err := repo.Manifests().Delete(ctx, v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: d})
+	if err != nil && !errors.Is(err, errdef.ErrNotFound) {
+		log.WithError(err).Debugf("failed to delete lock manifest %s", d)
+	}
+}
+
+// current returns the descriptor and annotations of the lock manifest at the tag.
+func current(ctx context.Context, repo *remote.Repository, tag string) (v1.Descriptor, map[string]string, error) {
+	desc, rc, err := repo.FetchReference(ctx, tag)
+	if err != nil {
+		return v1.Descriptor{}, nil, err
+	}
+	defer funcutils.PanicOrLogOnErr(rc.Close, false, "failed to close reader")
+	var mf v1.Manifest
+	if err := json.NewDecoder(content.NewVerifyReader(rc, desc)).Decode(&mf); err != nil {
+		return v1.Descriptor{}, nil, fmt.Errorf("failed to parse lock manifest: %w", err)
+	}
+	return desc, mf.Annotations, nil
+}
+
+// isHeld checks if the lock manifest with the annotations has not expired.
+func isHeld(annotations map[string]string) bool {
+	expires, ok := annotations[constants.DorasAnnotationLockExpires]
+	if !ok {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339Nano, expires)
+	return err != nil || time.Now().Before(t)
+}
+
+// push pushes a lock manifest to the tag if the manifest at the tag has the expected digest.
+// An empty digest expects that there is no manifest at the tag.
+func push(ctx context.Context, repo *remote.Repository, tag string, expected digest.Digest, annotations map[string]string) (digest.Digest, error) {
+	empty := v1.DescriptorEmptyJSON
+	exists, err := repo.Exists(ctx, empty)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		if err := repo.Push(ctx, empty, bytes.NewReader(empty.Data)); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+			return "", err
+		}
+	}
+	empty.Data = nil
+	data, err := json.Marshal(v1.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: constants.DorasLockArtifactType,
+		Config:       empty,
+		Layers:       []v1.Descriptor{empty},
+		Annotations:  annotations,
+	})
+	if err != nil {
+		return "", err
+	}
+	desc := content.NewDescriptorFromBytes(v1.MediaTypeImageManifest, data)
+	conditions := http.Header{}
+	if expected == "" {
+		conditions.Set("If-None-Match", "*")
+	} else {
+		conditions.Set("If-Match", fmt.Sprintf("%q", expected.String()))
+	}
+	err = repo.PushReference(context.WithValue(ctx, conditionsKey{}, conditions), desc, bytes.NewReader(data), tag)
+	var errResp *errcode.ErrorResponse
+	if errors.As(err, &errResp) && errResp.StatusCode == http.StatusPreconditionFailed {
+		return "", ErrLocked
+	}
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest, nil
+}
+
+func (l *registryLocker) TryLock(ctx context.Context, key string) (Lease, error) {
+	repo, tag, err := l.repository(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.checkConditions(ctx, repo); err != nil {
+		return nil, err
+	}
+	var expected digest.Digest
+	desc, annotations, err := current(ctx, repo, tag)
+	switch {
+	case errors.Is(err, errdef.ErrNotFound):
+	case err != nil:
+		return nil, err
+	case isHeld(annotations):
+		return nil, ErrLocked
+	default:
+		expected = desc.Digest
+	}
+	lease := &registryLease{locker: l, repo: repo, key: key, tag: tag, token: newToken()}
+	lease.digest, err = push(ctx, repo, tag, expected, lease.annotations())
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// annotations returns the annotations of the lock manifest of the lease, the lock expires after the ttl from now on.
+func (l *registryLease) annotations() map[string]string {
+	annotations := map[string]string{
+		constants.DorasAnnotationLockKey:   l.key,
+		constants.DorasAnnotationLockToken: l.token,
+	}
+	if l.locker.ttl > 0 {
+		annotations[constants.DorasAnnotationLockExpires] = time.Now().Add(l.locker.ttl).UTC().Format(time.RFC3339Nano)
+	}
+	return annotations
+}
+
+// Renew replaces the lock manifest with one that expires later, the lock is lost if the manifest has been replaced.
+func (l *registryLease) Renew(ctx context.Context) error {
+	desc, annotations, err := current(ctx, l.repo, l.tag)
+	if err != nil {
+		return err
+	}
+	if desc.Digest != l.digest || !isHeld(annotations) {
+		return ErrNotHeld
+	}
+	d, err := push(ctx, l.repo, l.tag, l.digest, l.annotations())
+	if errors.Is(err, ErrLocked) {
+		return ErrNotHeld
+	}
+	if err != nil {
+		return err
+	}
+	l.digest = d
+	return nil
+}
+
+// Release replaces the lock manifest with an expired one and deletes it afterward.
+// Replacing the manifest is conditional, so only the holder releases the lock, and deleting it by digest
+// does not affect locks that have been acquired in between. Expired locks that cannot be deleted are deleted by the garbage collection.
+func (l *registryLease) Release(ctx context.Context) error {
+	d, err := push(ctx, l.repo, l.tag, l.digest, map[string]string{
+		constants.DorasAnnotationLockKey:     l.key,
+		constants.DorasAnnotationLockExpires: time.Unix(0, 0).UTC().Format(time.RFC3339Nano),
+	})
+	if errors.Is(err, ErrLocked) {
+		return ErrNotHeld
+	}
+	if err != nil {
+		return err
+	}
+	deleteManifest(ctx, l.repo, d)
+	return nil
+}
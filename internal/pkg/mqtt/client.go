@@ -0,0 +1,253 @@
+// Package mqtt wraps the Eclipse Paho MQTT client to publish and subscribe with QoS 1.
+// It is used to notify devices about created deltas over the connections they already hold.
+package mqtt
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ErrClosed is returned by calls on a client whose connection has been closed.
+var ErrClosed = errors.New("mqtt connection closed")
+
+// ErrRefused is returned if the broker refuses the connection.
+var ErrRefused = errors.New("mqtt connection refused")
+
+// connectTimeout limits the time to connect to brokers if the context has no deadline.
+const connectTimeout = 10 * time.Second
+
+// defaultKeepAlive is the interval in which the client pings the broker if no other keep alive is configured.
+const defaultKeepAlive = 30 * time.Second
+
+// Message is an application message that has been published on a topic.
+type Message struct {
+	Topic   string
+	Payload []byte
+}
+
+// Client is a connection to an MQTT broker.
+type Client interface {
+	// Publish publishes the payload on the topic with QoS 1 and waits until the broker acknowledged it.
+	Publish(ctx context.Context, topic string, payload []byte) error
+	// Subscribe subscribes to the topic filter with QoS 1 and waits until the broker acknowledged the subscription.
+	// The handler is called for each message that matches the filter, it must not block because it delays other messages.
+	Subscribe(ctx context.Context, filter string, handler func(Message)) error
+	// Done is closed once the connection is lost or closed, Err returns the reason afterward.
+	Done() <-chan struct{}
+	Err() error
+	// Close disconnects from the broker.
+	Close() error
+}
+
+type options struct {
+	clientID  string
+	username  string
+	password  string
+	tlsConfig *tls.Config
+	keepAlive time.Duration
+}
+
+// Option configures the client.
+type Option func(*options)
+
+// WithClientID sets the client identifier, a random identifier is used by default.
+func WithClientID(clientID string) Option {
+	return func(o *options) {
+		o.clientID = clientID
+	}
+}
+
+// WithCredentials authenticates the client with the user name and password.
+// MQTT 3.1.1 does not allow passwords without user name, the password is ignored if the user name is empty.
+func WithCredentials(username, password string) Option {
+	return func(o *options) {
+		o.username = username
+		o.password = password
+	}
+}
+
+// WithTLSConfig makes the client use the TLS configuration for brokers with TLS (mqtts://, ssl:// or tls://).
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = config
+	}
+}
+
+// WithKeepAlive sets the interval in which the client pings the broker, the broker closes connections that stay silent for longer.
+func WithKeepAlive(keepAlive time.Duration) Option {
+	return func(o *options) {
+		o.keepAlive = keepAlive
+	}
+}
+
+// subackFailure is the return code of subscriptions that have been rejected by the broker.
+const subackFailure = 0x80
+
+type subscription struct {
+	filter  string
+	handler func(Message)
+}
+
+type client struct {
+	paho paho.Client
+	// m guards the subscriptions.
+	m             sync.Mutex
+	subscriptions []subscription
+	done          chan struct{}
+	closeOnce     sync.Once
+	err           error
+}
+
+// Dial connects to the broker, e.g. tcp://broker.example:1883 or mqtts://broker.example:8883.
+// The connection uses a clean session and is not re-established, subscriptions have to be renewed after the connection is lost.
+func Dial(ctx context.Context, broker string, opts ...Option) (Client, error) {
+	o := options{keepAlive: defaultKeepAlive}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.clientID == "" {
+		b := make([]byte, 8)
+		// rand.Read never returns an error.
+		_, _ = rand.Read(b)
+		o.clientID = "doras-" + hex.EncodeToString(b)
+	}
+	timeout := connectTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	c := &client{done: make(chan struct{})}
+	pahoOpts := paho.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(o.clientID).
+		SetProtocolVersion(4).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetConnectRetry(false).
+		SetConnectTimeout(timeout).
+		SetKeepAlive(o.keepAlive).
+		SetTLSConfig(o.tlsConfig).
+		SetDefaultPublishHandler(c.handlePublish).
+		SetConnectionLostHandler(func(_ paho.Client, err error) { c.fail(err) })
+	if o.username != "" {
+		pahoOpts.SetUsername(o.username).SetPassword(o.password)
+	}
+	c.paho = paho.NewClient(pahoOpts)
+	token := c.paho.Connect()
+	if err := c.wait(ctx, token); err != nil {
+		c.paho.Disconnect(0)
+		// Return codes above the ones of MQTT 3.1.1 are used by paho for network errors and protocol violations.
+		if connect, ok := token.(*paho.ConnectToken); ok && connect.ReturnCode() != packets.Accepted && connect.ReturnCode() <= packets.ErrRefusedNotAuthorised {
+			return nil, fmt.Errorf("%w: %v", ErrRefused, err)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *client) Publish(ctx context.Context, topic string, payload []byte) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	return c.wait(ctx, c.paho.Publish(topic, 1, false, payload))
+}
+
+// Subscribe registers the handler once the broker acknowledged the subscription,
+// messages of rejected or failed subscriptions are never passed to it.
+func (c *client) Subscribe(ctx context.Context, filter string, handler func(Message)) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	// Without callback, paho passes the messages to the default handler (handlePublish).
+	token := c.paho.Subscribe(filter, 1, nil)
+	if err := c.wait(ctx, token); err != nil {
+		return err
+	}
+	if sub, ok := token.(*paho.SubscribeToken); ok && sub.Result()[filter] == subackFailure {
+		return fmt.Errorf("broker rejected the subscription to %q", filter)
+	}
+	c.m.Lock()
+	c.subscriptions = append(c.subscriptions, subscription{filter: filter, handler: handler})
+	c.m.Unlock()
+	return nil
+}
+
+func (c *client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *client) Close() error {
+	c.fail(ErrClosed)
+	return nil
+}
+
+// wait waits until the token completed, the connection is lost or the context is done.
+func (c *client) wait(ctx context.Context, token paho.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handlePublish passes the message to the handlers of the matching subscriptions, paho acknowledges it afterward.
+func (c *client) handlePublish(_ paho.Client, m paho.Message) {
+	c.m.Lock()
+	subscriptions := append([]subscription{}, c.subscriptions...)
+	c.m.Unlock()
+	for _, s := range subscriptions {
+		if Matches(s.filter, m.Topic()) {
+			s.handler(Message{Topic: m.Topic(), Payload: m.Payload()})
+		}
+	}
+}
+
+// fail disconnects from the broker, the first error is recorded.
+func (c *client) fail(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		if c.paho.IsConnectionOpen() {
+			c.paho.Disconnect(250)
+		}
+	})
+}
+
+// Matches checks whether the topic matches the topic filter, filters may contain the wildcards + and #.
+func Matches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
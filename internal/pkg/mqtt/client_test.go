@@ -0,0 +1,155 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+)
+
+func TestClient_PublishSubscribe(t *testing.T) {
+	broker := testutils.LaunchMQTTBroker(t, "user", "secret")
+	ctx := context.Background()
+	subscriber, err := Dial(ctx, broker, WithCredentials("user", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	received := make(chan Message, 2)
+	if err := subscriber.Subscribe(ctx, "doras/+/ready", func(m Message) { received <- m }); err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := Dial(ctx, broker, WithCredentials("user", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	if err := publisher.Publish(ctx, "doras/other/created", []byte("ignored")); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(ctx, "doras/app/ready", []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-received:
+		if m.Topic != "doras/app/ready" || string(m.Payload) != "payload" {
+			t.Errorf("unexpected message %q on %q", m.Payload, m.Topic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message has not been received")
+	}
+	select {
+	case m := <-received:
+		t.Errorf("unexpected message %q on %q", m.Payload, m.Topic)
+	default:
+	}
+}
+
+func TestClient_Subscribe_rejected(t *testing.T) {
+	broker := testutils.LaunchMQTTBroker(t, "", "")
+	ctx := context.Background()
+	c, err := Dial(ctx, broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	received := make(chan Message, 1)
+	// The broker rejects the filter because the wildcard # has to be the last level.
+	if err := c.Subscribe(ctx, "doras/#/ready", func(m Message) { received <- m }); err == nil {
+		t.Fatal("expected the subscription to be rejected")
+	}
+	if err := c.Subscribe(ctx, "doras/+", func(Message) {}); err != nil {
+		t.Fatal(err)
+	}
+	// The handler of the rejected subscription is not registered, even though its filter matches the topic.
+	if err := c.Publish(ctx, "doras/ready", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-received:
+		t.Errorf("unexpected message on %q for a rejected subscription", m.Topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDial(t *testing.T) {
+	broker := testutils.LaunchMQTTBroker(t, "user", "secret")
+	tests := []struct {
+		name    string
+		broker  string
+		opts    []Option
+		wantErr error
+		// wantAnyErr is set if an error without sentinel is expected.
+		wantAnyErr bool
+	}{
+		{name: "authenticated", broker: broker, opts: []Option{WithCredentials("user", "secret"), WithClientID("device")}},
+		// MQTT 3.1.1 does not allow passwords without user name, it is not sent to the broker.
+		{name: "password without user name", broker: testutils.LaunchMQTTBroker(t, "", ""), opts: []Option{WithCredentials("", "secret")}},
+		{name: "wrong password", broker: broker, opts: []Option{WithCredentials("user", "wrong")}, wantErr: ErrRefused},
+		{name: "unsupported scheme", broker: "http://127.0.0.1:1883", wantAnyErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Dial(context.Background(), tt.broker, tt.opts...)
+			if tt.wantAnyErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if err == nil {
+				_ = c.Close()
+			}
+		})
+	}
+}
+
+func TestClient_Done(t *testing.T) {
+	broker := testutils.LaunchMQTTBroker(t, "", "")
+	c, err := Dial(context.Background(), broker, WithKeepAlive(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The broker answers pings, the connection stays open for longer than one and a half keep alive intervals.
+	select {
+	case <-c.Done():
+		t.Fatalf("connection has been closed: %v", c.Err())
+	case <-time.After(4 * time.Second):
+	}
+	_ = c.Close()
+	<-c.Done()
+	if !errors.Is(c.Err(), ErrClosed) {
+		t.Errorf("expected %v, got %v", ErrClosed, c.Err())
+	}
+	if err := c.Publish(context.Background(), "doras", nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected %v, got %v", ErrClosed, err)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{filter: "doras/deltas", topic: "doras/deltas", want: true},
+		{filter: "doras/deltas", topic: "doras/deltas/app", want: false},
+		{filter: "doras/+", topic: "doras/deltas", want: true},
+		{filter: "doras/+", topic: "doras", want: false},
+		{filter: "doras/#", topic: "doras/deltas/app", want: true},
+		{filter: "#", topic: "doras", want: true},
+		{filter: "doras/+/ready", topic: "doras/app/created", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter+" "+tt.topic, func(t *testing.T) {
+			if got := Matches(tt.filter, tt.topic); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Package notify tells clients about created deltas so they do not have to poll for them.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/mqtt"
+)
+
+// publishTimeout limits the time to publish a notification, including connecting to the broker.
+const publishTimeout = 10 * time.Second
+
+// Notifier notifies clients about deltas.
+type Notifier interface {
+	// DeltaReady is called once a delta has been created.
+	DeltaReady(ctx context.Context, notification apicommon.DeltaReadyNotification) error
+	// Close releases the resources of the notifier.
+	Close() error
+}
+
+type mqttNotifier struct {
+	broker string
+	topic  string
+	opts   []mqtt.Option
+	// m guards the client, it is connected by the first notification and reconnected if the connection is lost.
+	m      sync.Mutex
+	client mqtt.Client
+}
+
+// NewMQTTNotifier returns a Notifier that publishes notifications as JSON on the topic of the broker, e.g. tcp://broker.example:1883.
+// The broker is connected once the first delta has been created, lost connections are reestablished by the next notification.
+func NewMQTTNotifier(broker, topic string, opts ...mqtt.Option) Notifier {
+	return &mqttNotifier{broker: broker, topic: topic, opts: opts}
+}
+
+func (n *mqttNotifier) DeltaReady(ctx context.Context, notification apicommon.DeltaReadyNotification) error {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	n.m.Lock()
+	defer n.m.Unlock()
+	if n.client != nil && n.client.Err() != nil {
+		log.WithError(n.client.Err()).Debug("reconnecting to mqtt broker")
+		n.client = nil
+	}
+	if n.client == nil {
+		client, err := mqtt.Dial(ctx, n.broker, n.opts...)
+		if err != nil {
+			return err
+		}
+		n.client = client
+	}
+	return n.client.Publish(ctx, n.topic, payload)
+}
+
+func (n *mqttNotifier) Close() error {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if n.client == nil {
+		return nil
+	}
+	err := n.client.Close()
+	n.client = nil
+	return err
+}
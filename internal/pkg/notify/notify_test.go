@@ -0,0 +1,77 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/mqtt"
+	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+)
+
+func TestMQTTNotifier_DeltaReady(t *testing.T) {
+	broker := testutils.LaunchMQTTBroker(t, "doras", "secret")
+	ctx := context.Background()
+	subscriber, err := mqtt.Dial(ctx, broker, mqtt.WithCredentials("doras", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	received := make(chan mqtt.Message, 2)
+	if err := subscriber.Subscribe(ctx, "doras/deltas", func(m mqtt.Message) { received <- m }); err != nil {
+		t.Fatal(err)
+	}
+	n := NewMQTTNotifier(broker, "doras/deltas", mqtt.WithCredentials("doras", "secret"))
+	defer n.Close()
+	want := apicommon.DeltaReadyNotification{
+		From:        "registry.example/app@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		To:          "registry.example/app:v2",
+		TargetImage: "registry.example/app@sha256:1111111111111111111111111111111111111111111111111111111111111111",
+		DeltaImage:  "registry.example/app:delta",
+	}
+	// The second notification reuses the connection of the first one.
+	for range 2 {
+		if err := n.DeltaReady(ctx, want); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-received:
+			var got apicommon.DeltaReadyNotification
+			if err := json.Unmarshal(m.Payload, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("expected %v, got %v", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("notification has not been received")
+		}
+	}
+}
+
+func TestMQTTNotifier_DeltaReady_reconnect(t *testing.T) {
+	broker := testutils.LaunchMQTTBroker(t, "", "")
+	n := NewMQTTNotifier(broker, "doras/deltas").(*mqttNotifier)
+	defer n.Close()
+	if err := n.DeltaReady(context.Background(), apicommon.DeltaReadyNotification{}); err != nil {
+		t.Fatal(err)
+	}
+	lost := n.client
+	_ = lost.Close()
+	<-lost.Done()
+	if err := n.DeltaReady(context.Background(), apicommon.DeltaReadyNotification{}); err != nil {
+		t.Fatal(err)
+	}
+	if n.client == lost {
+		t.Error("expected the notifier to reconnect")
+	}
+}
+
+func TestMQTTNotifier_DeltaReady_unreachable(t *testing.T) {
+	n := NewMQTTNotifier("tcp://127.0.0.1:1", "doras/deltas")
+	if err := n.DeltaReady(context.Background(), apicommon.DeltaReadyNotification{}); err == nil {
+		t.Error("expected an error")
+	}
+}
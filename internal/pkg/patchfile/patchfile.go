@@ -0,0 +1,74 @@
+// Package patchfile implements self-describing patch files, which are created by `doras-cli diff` and applied by `doras-cli patch`.
+// A patch file consists of the line `DORAS-PATCH v1`, a single line JSON encoded Header and the (compressed) patch.
+package patchfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const magic = "DORAS-PATCH v1\n"
+
+// maxHeaderSize limits the size of the header line to reject files that are not patch files early.
+const maxHeaderSize = 4096
+
+// ErrInvalidPatchFile is returned if a file is not a patch file.
+var ErrInvalidPatchFile = errors.New("invalid patch file")
+
+// Header describes how a patch has to be applied.
+type Header struct {
+	// MediaType identifies the algorithms that were used to create the patch, e.g. `application/bsdiff+zstd`.
+	MediaType string `json:"mediaType"`
+	// OutputDigest is the digest of the output of the patcher, it is used to verify the patched artifact.
+	// For directories this is the digest of the tar archive of the directory.
+	OutputDigest digest.Digest `json:"outputDigest"`
+	// Directory is set if the patch was created from directories, the output of the patcher is extracted to a directory.
+	Directory bool `json:"directory,omitempty"`
+}
+
+// Write writes the header followed by the patch to w.
+func Write(w io.Writer, h Header, patch io.Reader) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, magic+string(data)+"\n"); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, patch)
+	return err
+}
+
+// Read reads the header of a patch file, the returned reader yields the patch.
+func Read(r io.Reader) (Header, io.Reader, error) {
+	br := bufio.NewReaderSize(r, maxHeaderSize)
+	// ReadSlice does not read past the buffer, so lines are limited to maxHeaderSize.
+	line, err := br.ReadSlice('\n')
+	if err != nil || string(line) != magic {
+		return Header{}, nil, fmt.Errorf("%w: missing magic string", ErrInvalidPatchFile)
+	}
+	line, err = br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return Header{}, nil, fmt.Errorf("%w: header exceeds %d bytes", ErrInvalidPatchFile, maxHeaderSize)
+	}
+	if err != nil {
+		return Header{}, nil, fmt.Errorf("%w: failed to read header: %w", ErrInvalidPatchFile, err)
+	}
+	var h Header
+	if err := json.Unmarshal(bytes.TrimSuffix(line, []byte("\n")), &h); err != nil {
+		return Header{}, nil, fmt.Errorf("%w: failed to parse header: %w", ErrInvalidPatchFile, err)
+	}
+	if h.MediaType == "" {
+		return Header{}, nil, fmt.Errorf("%w: missing media type", ErrInvalidPatchFile)
+	}
+	if err := h.OutputDigest.Validate(); err != nil {
+		return Header{}, nil, fmt.Errorf("%w: %w", ErrInvalidPatchFile, err)
+	}
+	return h, br, nil
+}
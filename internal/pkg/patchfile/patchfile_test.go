@@ -0,0 +1,83 @@
+package patchfile
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestWriteAndRead(t *testing.T) {
+	h := Header{
+		MediaType:    "application/bsdiff+zstd",
+		OutputDigest: digest.FromString("output"),
+		Directory:    true,
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, h, strings.NewReader("patch\ndata")); err != nil {
+		t.Fatal(err)
+	}
+	got, patch, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != h {
+		t.Errorf("expected header %v, got %v", h, got)
+	}
+	data, err := io.ReadAll(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "patch\ndata" {
+		t.Errorf("unexpected patch %q", data)
+	}
+}
+
+func TestRead_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "empty", data: ""},
+		{name: "missing magic", data: "BSDIFF40"},
+		{name: "missing header", data: magic},
+		{name: "invalid header", data: magic + "{\n"},
+		{name: "missing media type", data: magic + `{"outputDigest":"` + digest.FromString("").String() + "\"}\n"},
+		{name: "invalid digest", data: magic + `{"mediaType":"application/bsdiff","outputDigest":"sha256:foo"}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Read(strings.NewReader(tt.data))
+			if !errors.Is(err, ErrInvalidPatchFile) {
+				t.Errorf("expected ErrInvalidPatchFile, got %v", err)
+			}
+		})
+	}
+}
+
+// endlessReader yields an endless line of a's and counts the bytes that have been read.
+type endlessReader struct {
+	n int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	r.n += len(p)
+	return len(p), nil
+}
+
+func TestRead_OversizedHeader(t *testing.T) {
+	r := &endlessReader{}
+	_, _, err := Read(io.MultiReader(strings.NewReader(magic), r))
+	if !errors.Is(err, ErrInvalidPatchFile) {
+		t.Errorf("expected ErrInvalidPatchFile, got %v", err)
+	}
+	if r.n > maxHeaderSize {
+		t.Errorf("expected at most %d bytes of the header to be read, got %d", maxHeaderSize, r.n)
+	}
+}
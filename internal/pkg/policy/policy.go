@@ -0,0 +1,196 @@
+// Package policy restricts the delta requests that are accepted by the server.
+// Requests are checked before images are resolved, the chosen algorithms and the artifacts are checked once they are known.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/unbasical/doras/pkg/algorithm/registry"
+)
+
+// ErrDenied is returned if a request is not allowed by the policy, it is wrapped with the reason.
+var ErrDenied = errors.New("denied by policy")
+
+// defaultQuotaWindow is the duration in which quotas are counted if no window is configured.
+const defaultQuotaWindow = time.Hour
+
+// Quota limits the delta creations of the clients whose identity matches the pattern.
+// Each identity has its own quota, e.g. the pattern "device-*" limits each device separately.
+type Quota struct {
+	// Identity is matched with path.Match against the identity of the client, the first matching quota is used.
+	Identity string
+	// MaxDeltaCreations is the number of deltas the client can request to be created per window.
+	MaxDeltaCreations int
+}
+
+// Config configures a Policy, zero values do not restrict requests.
+type Config struct {
+	// Repositories which are allowed (e.g. registry.example.org/apps/*), patterns are matched with path.Match.
+	Repositories []string
+	// Algorithms that are allowed (differs and compressors), uncompressed deltas are always allowed.
+	Algorithms []string
+	// MaxArtifactSize is the maximum size of artifacts in bytes.
+	MaxArtifactSize int64
+	Quotas          []Quota
+	// QuotaWindow is the duration in which delta creations are counted, defaults to an hour.
+	QuotaWindow time.Duration
+}
+
+// Policy decides which delta requests are accepted.
+// Quotas are counted in memory, hence they apply to each replica.
+type Policy interface {
+	// Authorize checks a request for the repository before images are resolved.
+	// Returns the accepted algorithms without the ones that are not allowed.
+	Authorize(repository string, acceptedAlgorithms []string) ([]string, error)
+	// AuthorizeDelta checks the chosen algorithms and the size of the artifacts.
+	AuthorizeDelta(differ, compressor string, fromSize, toSize int64) error
+	// RecordCreation counts a delta creation against the quota of the identity.
+	// Returns an error without counting it if the quota is exhausted.
+	// Deltas that exist are served regardless of the quota, so clients can poll for the deltas they requested.
+	// The returned function refunds the creation if it fails, creations of windows that have ended are not refunded.
+	RecordCreation(identity string) (refund func(), err error)
+}
+
+type window struct {
+	start time.Time
+	count int
+}
+
+type policy struct {
+	config  Config
+	m       sync.Mutex
+	windows map[string]window
+}
+
+// New returns a Policy with the configuration.
+func New(config Config) (Policy, error) {
+	for _, pattern := range config.Repositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %q: %w", pattern, err)
+		}
+	}
+	for _, q := range config.Quotas {
+		if _, err := path.Match(q.Identity, ""); err != nil {
+			return nil, fmt.Errorf("invalid identity pattern %q: %w", q.Identity, err)
+		}
+		if q.MaxDeltaCreations < 0 {
+			return nil, fmt.Errorf("invalid quota of identity %q", q.Identity)
+		}
+	}
+	for _, name := range config.Algorithms {
+		if !registry.IsSupported(name) {
+			return nil, fmt.Errorf("%w: %q", registry.ErrUnknownAlgorithm, name)
+		}
+	}
+	if config.QuotaWindow <= 0 {
+		config.QuotaWindow = defaultQuotaWindow
+	}
+	return &policy{config: config, windows: make(map[string]window)}, nil
+}
+
+func (p *policy) Authorize(repository string, acceptedAlgorithms []string) ([]string, error) {
+	if len(p.config.Repositories) > 0 && !matchesAny(p.config.Repositories, repository) {
+		return nil, fmt.Errorf("%w: repository %s is not allowed", ErrDenied, repository)
+	}
+	if len(p.config.Algorithms) > 0 {
+		acceptedAlgorithms = slices.DeleteFunc(slices.Clone(acceptedAlgorithms), func(name string) bool {
+			return !slices.Contains(p.config.Algorithms, name)
+		})
+		if !slices.ContainsFunc(acceptedAlgorithms, func(name string) bool { return slices.Contains(registry.Differs(), name) }) {
+			return nil, fmt.Errorf("%w: none of the accepted differs is allowed (allowed: %v)", ErrDenied, p.config.Algorithms)
+		}
+	}
+	return acceptedAlgorithms, nil
+}
+
+func (p *policy) AuthorizeDelta(differ, compressor string, fromSize, toSize int64) error {
+	if len(p.config.Algorithms) > 0 && !slices.Contains(p.config.Algorithms, differ) {
+		return fmt.Errorf("%w: differ %s is not allowed", ErrDenied, differ)
+	}
+	if len(p.config.Algorithms) > 0 && compressor != "" && !slices.Contains(p.config.Algorithms, compressor) {
+		return fmt.Errorf("%w: compressor %s is not allowed", ErrDenied, compressor)
+	}
+	if p.config.MaxArtifactSize > 0 && max(fromSize, toSize) > p.config.MaxArtifactSize {
+		return fmt.Errorf("%w: artifacts have %d and %d bytes, the maximum is %d bytes", ErrDenied, fromSize, toSize, p.config.MaxArtifactSize)
+	}
+	return nil
+}
+
+func (p *policy) RecordCreation(identity string) (func(), error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	now := time.Now()
+	if err := p.checkQuotaLocked(identity, now); err != nil {
+		return nil, err
+	}
+	if _, ok := p.quota(identity); !ok {
+		return func() {}, nil
+	}
+	w := p.windows[identity]
+	p.windows[identity] = window{start: w.start, count: w.count + 1}
+	var once sync.Once
+	return func() { once.Do(func() { p.refund(identity, w.start) }) }, nil
+}
+
+// refund removes a creation from the window of the identity if the window that started at start has not ended.
+func (p *policy) refund(identity string, start time.Time) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	w, ok := p.windows[identity]
+	if !ok || !w.start.Equal(start) || w.count == 0 {
+		return
+	}
+	p.windows[identity] = window{start: w.start, count: w.count - 1}
+}
+
+// checkQuotaLocked returns an error if the quota of the identity is exhausted, the mutex has to be held.
+// Windows that have ended are reset.
+func (p *policy) checkQuotaLocked(identity string, now time.Time) error {
+	q, ok := p.quota(identity)
+	if !ok {
+		return nil
+	}
+	w, ok := p.windows[identity]
+	if !ok || now.Sub(w.start) >= p.config.QuotaWindow {
+		p.pruneLocked(now)
+		w = window{start: now}
+		p.windows[identity] = w
+	}
+	if w.count >= q.MaxDeltaCreations {
+		return fmt.Errorf("%w: quota of %d delta creations per %s is exhausted until %s",
+			ErrDenied, q.MaxDeltaCreations, p.config.QuotaWindow, w.start.Add(p.config.QuotaWindow).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// pruneLocked removes windows that have ended, the mutex has to be held.
+func (p *policy) pruneLocked(now time.Time) {
+	for identity, w := range p.windows {
+		if now.Sub(w.start) >= p.config.QuotaWindow {
+			delete(p.windows, identity)
+		}
+	}
+}
+
+// quota returns the first quota whose pattern matches the identity.
+func (p *policy) quota(identity string) (Quota, bool) {
+	for _, q := range p.config.Quotas {
+		if ok, err := path.Match(q.Identity, identity); err == nil && ok {
+			return q, true
+		}
+	}
+	return Quota{}, false
+}
+
+// matchesAny checks if the name matches one of the patterns.
+func matchesAny(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		ok, err := path.Match(pattern, name)
+		return err == nil && ok
+	})
+}
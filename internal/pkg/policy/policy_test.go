@@ -0,0 +1,140 @@
+package policy
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "empty", config: Config{}},
+		{name: "valid", config: Config{Repositories: []string{"registry.example.org/*"}, Algorithms: []string{"bsdiff", "zstd"}, Quotas: []Quota{{Identity: "device-*", MaxDeltaCreations: 1}}}},
+		{name: "invalid repository pattern", config: Config{Repositories: []string{"registry.example.org/["}}, wantErr: true},
+		{name: "invalid identity pattern", config: Config{Quotas: []Quota{{Identity: "["}}}, wantErr: true},
+		{name: "negative quota", config: Config{Quotas: []Quota{{Identity: "*", MaxDeltaCreations: -1}}}, wantErr: true},
+		{name: "unknown algorithm", config: Config{Algorithms: []string{"foodiff"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_policy_Authorize(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     Config
+		repository string
+		accepted   []string
+		want       []string
+		wantErr    bool
+	}{
+		{name: "no restrictions", repository: "registry.example.org/foo", accepted: []string{"bsdiff", "gzip"}, want: []string{"bsdiff", "gzip"}},
+		{name: "allowed repository", config: Config{Repositories: []string{"registry.example.org/apps/*"}}, repository: "registry.example.org/apps/foo", accepted: []string{"bsdiff"}, want: []string{"bsdiff"}},
+		{name: "repository is not allowed", config: Config{Repositories: []string{"registry.example.org/apps/*"}}, repository: "registry.example.org/foo", accepted: []string{"bsdiff"}, wantErr: true},
+		{name: "filters algorithms", config: Config{Algorithms: []string{"bsdiff", "zstd"}}, repository: "registry.example.org/foo", accepted: []string{"tardiff", "bsdiff", "gzip", "zstd"}, want: []string{"bsdiff", "zstd"}},
+		{name: "no allowed differ", config: Config{Algorithms: []string{"bsdiff", "zstd"}}, repository: "registry.example.org/foo", accepted: []string{"tardiff", "zstd"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.Authorize(tt.repository, tt.accepted)
+			if tt.wantErr {
+				if !errors.Is(err, ErrDenied) {
+					t.Fatalf("expected %v, got %v", ErrDenied, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected algorithms %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_policy_AuthorizeDelta(t *testing.T) {
+	p, err := New(Config{Algorithms: []string{"bsdiff", "zstd"}, MaxArtifactSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		differ     string
+		compressor string
+		fromSize   int64
+		toSize     int64
+		wantErr    bool
+	}{
+		{name: "allowed", differ: "bsdiff", compressor: "zstd", fromSize: 100, toSize: 50},
+		{name: "uncompressed", differ: "bsdiff", fromSize: 100, toSize: 50},
+		{name: "differ is not allowed", differ: "tardiff", compressor: "zstd", fromSize: 1, toSize: 1, wantErr: true},
+		{name: "compressor is not allowed", differ: "bsdiff", compressor: "gzip", fromSize: 1, toSize: 1, wantErr: true},
+		{name: "artifact is too large", differ: "bsdiff", compressor: "zstd", fromSize: 1, toSize: 101, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.AuthorizeDelta(tt.differ, tt.compressor, tt.fromSize, tt.toSize)
+			if tt.wantErr != errors.Is(err, ErrDenied) {
+				t.Errorf("AuthorizeDelta() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_policy_RecordCreation(t *testing.T) {
+	const quotaWindow = 50 * time.Millisecond
+	p, err := New(Config{
+		Quotas: []Quota{
+			{Identity: "device-*", MaxDeltaCreations: 2},
+			{Identity: "blocked", MaxDeltaCreations: 0},
+		},
+		QuotaWindow: quotaWindow,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := func(identity string, wantErr bool) func() {
+		t.Helper()
+		refund, err := p.RecordCreation(identity)
+		if wantErr != errors.Is(err, ErrDenied) {
+			t.Fatalf("RecordCreation(%q) error = %v, wantErr %v", identity, err, wantErr)
+		}
+		return refund
+	}
+	record("device-1", false)
+	refund := record("device-1", false)
+	record("device-1", true)
+	// Failed creations are refunded once.
+	refund()
+	refund()
+	refund = record("device-1", false)
+	record("device-1", true)
+	// Each identity has its own quota.
+	record("device-2", false)
+	record("blocked", true)
+	// Identities without quota are not limited.
+	for range 5 {
+		record("laptop", false)
+	}
+	time.Sleep(quotaWindow)
+	record("device-1", false)
+	// Creations of windows that have ended are not refunded.
+	refund()
+	record("device-1", false)
+	record("device-1", true)
+}
@@ -0,0 +1,89 @@
+// Package ratelimit limits the request rate of clients with token buckets.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// pruneInterval is the interval at which buckets that have been refilled are removed.
+const pruneInterval = time.Minute
+
+// Limiter limits the request rate of each client, clients are identified by a key (e.g. their identity or IP).
+type Limiter interface {
+	// Allow takes a token from the bucket of the key.
+	// If the bucket is empty the request is not allowed and the duration until a token is available is returned.
+	Allow(key string) (ok bool, retryAfter time.Duration)
+	// AllowN takes n tokens from the bucket of the key, e.g. for the requests of a batch.
+	// More tokens than the burst are taken once the bucket is full, the following requests wait until the debt is refilled.
+	AllowN(key string, n int) (ok bool, retryAfter time.Duration)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type limiter struct {
+	rate      float64
+	burst     float64
+	m         sync.Mutex
+	buckets   map[string]bucket
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// New returns a Limiter that allows rate (has to be positive) requests per second and bursts of burst requests per key.
+// Each bucket starts full, a burst smaller than one is treated as one.
+func New(rate float64, burst int) Limiter {
+	return &limiter{
+		rate:    rate,
+		burst:   math.Max(float64(burst), 1),
+		buckets: make(map[string]bucket),
+		now:     time.Now,
+	}
+}
+
+func (l *limiter) Allow(key string) (bool, time.Duration) {
+	return l.AllowN(key, 1)
+}
+
+func (l *limiter) AllowN(key string, n int) (bool, time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	now := l.now()
+	l.pruneLocked(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = bucket{tokens: l.burst, last: now}
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	required := math.Min(float64(n), l.burst)
+	if b.tokens < required {
+		l.buckets[key] = b
+		return false, time.Duration((required - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens -= float64(n)
+	l.buckets[key] = b
+	return true, 0
+}
+
+// refill returns the tokens of the bucket at the given time.
+func (l *limiter) refill(b bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// pruneLocked removes full buckets, they behave like buckets of unknown keys. The mutex has to be held.
+func (l *limiter) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_limiter_Allow(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(2, 3).(*limiter)
+	l.now = func() time.Time { return now }
+	allow := func(key string, want bool, wantRetryAfter time.Duration) {
+		t.Helper()
+		ok, retryAfter := l.Allow(key)
+		if ok != want || retryAfter != wantRetryAfter {
+			t.Fatalf("Allow(%q) = %v, %v, want %v, %v", key, ok, retryAfter, want, wantRetryAfter)
+		}
+	}
+	// The bucket starts full.
+	for range 3 {
+		allow("a", true, 0)
+	}
+	allow("a", false, 500*time.Millisecond)
+	// Each key has its own bucket.
+	allow("b", true, 0)
+	now = now.Add(250 * time.Millisecond)
+	allow("a", false, 250*time.Millisecond)
+	now = now.Add(250 * time.Millisecond)
+	allow("a", true, 0)
+	allow("a", false, 500*time.Millisecond)
+	// The bucket does not exceed the burst.
+	now = now.Add(time.Hour)
+	for range 3 {
+		allow("a", true, 0)
+	}
+	allow("a", false, 500*time.Millisecond)
+	// Full buckets are pruned.
+	if _, ok := l.buckets["b"]; ok {
+		t.Error("expected full bucket to be pruned")
+	}
+}
+
+func Test_limiter_AllowN(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(2, 3).(*limiter)
+	l.now = func() time.Time { return now }
+	allowN := func(n int, want bool, wantRetryAfter time.Duration) {
+		t.Helper()
+		ok, retryAfter := l.AllowN("a", n)
+		if ok != want || retryAfter != wantRetryAfter {
+			t.Fatalf("AllowN(%d) = %v, %v, want %v, %v", n, ok, retryAfter, want, wantRetryAfter)
+		}
+	}
+	allowN(2, true, 0)
+	allowN(2, false, 500*time.Millisecond)
+	now = now.Add(500 * time.Millisecond)
+	allowN(2, true, 0)
+	// More tokens than the burst are taken once the bucket is full, the debt has to be refilled.
+	now = now.Add(time.Hour)
+	allowN(5, true, 0)
+	allowN(1, false, 1500*time.Millisecond)
+}
@@ -0,0 +1,289 @@
+// Package rollout decides which image each device of a fleet runs, so new versions can be rolled out gradually.
+// A rollout selects a percentage of the devices of some groups once it has started,
+// devices run the target of the latest rollout that selected them.
+package rollout
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+)
+
+// ErrNoTarget is returned if no rollout has selected the device.
+var ErrNoTarget = errors.New("no rollout targets the device")
+
+// ErrAmbiguous is returned if rollouts of several repositories selected the device and the repository has not been specified.
+var ErrAmbiguous = errors.New("rollouts of several repositories target the device")
+
+// Rollout rolls out the target image to the devices it selects.
+type Rollout struct {
+	// Name identifies the rollout, its state is kept as long as the name and the target do not change.
+	Name string
+	// Target is the image that is rolled out, e.g. registry.example.org/app:v2.
+	// Tags are resolved once the rollout has started, later pushes to the tag do not change the rollout.
+	Target string
+	// Percentage of the devices (0 to 100) that are selected, devices are selected by a hash of their ID.
+	// Increasing the percentage keeps the selected devices, devices that have been selected stay selected if it is decreased.
+	Percentage uint
+	// Groups restrict the rollout to the devices of the groups, all devices are eligible if it is empty.
+	Groups []string
+	// Start is the time at which devices are selected, the rollout is active right away if it is zero.
+	Start time.Time
+}
+
+// Config configures the rollouts of a Manager.
+type Config struct {
+	Rollouts []Rollout
+	// Groups map the names of device groups to patterns of device IDs, patterns are matched with path.Match.
+	Groups map[string][]string
+}
+
+// Target is the image a device should run.
+type Target struct {
+	// Rollout is the name of the rollout that selected the device.
+	Rollout    string
+	Repository string
+	// Image identifies the target by its digest, e.g. registry.example.org/app@sha256:...
+	Image  string
+	Digest digest.Digest
+}
+
+// Device identifies the device that asks for its target.
+type Device struct {
+	ID string
+	// Verified is set if the server verified the ID, e.g. with a device token or a client certificate.
+	// Only the selections of verified devices are recorded, other devices are selected by the hash of their ID alone.
+	Verified bool
+}
+
+// maxRecordedDevices limits the devices whose selection is recorded per rollout, so the state stays bounded.
+// Devices that are not recorded are selected by the hash of their ID alone.
+const maxRecordedDevices = 100_000
+
+// Resolver resolves the image to the digest of its manifest.
+type Resolver func(ctx context.Context, image string) (digest.Digest, error)
+
+// Manager manages the rollouts of the fleet.
+type Manager interface {
+	// Target returns the image the device should run.
+	// If the repository (e.g. registry.example.org/app) is not empty, only the rollouts of the repository are considered.
+	Target(ctx context.Context, device Device, repository string) (Target, error)
+}
+
+// pin is the digest of the target of a rollout, it is resolved once the rollout has been started.
+type pin struct {
+	Target   string        `json:"target"`
+	Digest   digest.Digest `json:"digest"`
+	PinnedAt time.Time     `json:"pinned_at"`
+}
+
+// state is the state of the rollouts, the keys are the names of the rollouts.
+type state struct {
+	Pins map[string]pin `json:"pins"`
+	// Devices are the verified devices that have been selected by the rollouts and the time they were selected.
+	Devices map[string]map[string]time.Time `json:"devices"`
+}
+
+type rollout struct {
+	Rollout
+	repository string
+	// digest is set if the target is identified by a digest, it does not have to be resolved.
+	digest digest.Digest
+}
+
+type manager struct {
+	rollouts []rollout
+	groups   map[string][]string
+	resolve  Resolver
+	// m serializes the accesses to the state, it is not held while targets are resolved.
+	m     sync.Mutex
+	store store
+	now   func() time.Time
+}
+
+// New returns a Manager with the rollouts of the configuration.
+// Its state is persisted to the file at the path, it is shared by replicas that use the same file.
+// If the path is empty the state is only kept in memory.
+// The state of rollouts which are not configured anymore or whose target changed is discarded.
+func New(config Config, statePath string, resolve Resolver) (Manager, error) {
+	rollouts, err := validate(config)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newStore(statePath)
+	if err != nil {
+		return nil, err
+	}
+	m := &manager{rollouts: rollouts, groups: config.Groups, resolve: resolve, store: s, now: time.Now}
+	err = s.modify(context.Background(), func(st *state) error {
+		for name, p := range st.Pins {
+			if i := slices.IndexFunc(rollouts, func(r rollout) bool { return r.Name == name }); i < 0 || rollouts[i].Target != p.Target {
+				delete(st.Pins, name)
+				delete(st.Devices, name)
+			}
+		}
+		for name := range st.Devices {
+			if !slices.ContainsFunc(rollouts, func(r rollout) bool { return r.Name == name }) {
+				delete(st.Devices, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// validate checks the configuration and returns the rollouts with their repositories.
+func validate(config Config) ([]rollout, error) {
+	for group, patterns := range config.Groups {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid device pattern %q of group %q: %w", pattern, group, err)
+			}
+		}
+	}
+	rollouts := make([]rollout, 0, len(config.Rollouts))
+	for _, r := range config.Rollouts {
+		if r.Name == "" {
+			return nil, fmt.Errorf("rollout of %q has no name", r.Target)
+		}
+		if slices.ContainsFunc(rollouts, func(other rollout) bool { return other.Name == r.Name }) {
+			return nil, fmt.Errorf("duplicate rollout %q", r.Name)
+		}
+		repository, tag, isDigest, err := ociutils.ParseOciImageString(r.Target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target of rollout %q: %w", r.Name, err)
+		}
+		var dgst digest.Digest
+		if isDigest {
+			dgst = digest.Digest(strings.TrimPrefix(tag, "@"))
+		}
+		if r.Percentage > 100 {
+			return nil, fmt.Errorf("invalid percentage %d of rollout %q", r.Percentage, r.Name)
+		}
+		for _, group := range r.Groups {
+			if _, ok := config.Groups[group]; !ok {
+				return nil, fmt.Errorf("unknown device group %q of rollout %q", group, r.Name)
+			}
+		}
+		rollouts = append(rollouts, rollout{Rollout: r, repository: repository, digest: dgst})
+	}
+	return rollouts, nil
+}
+
+func (m *manager) Target(ctx context.Context, device Device, repository string) (Target, error) {
+	now := m.now()
+	selected, p, pinned, known, err := m.selectRollout(now, device, repository)
+	if err != nil {
+		return Target{}, err
+	}
+	if !pinned {
+		// Resolving the target is a round trip to the registry, requests of other devices do not wait for it.
+		dgst := selected.digest
+		if dgst == "" {
+			if dgst, err = m.resolve(ctx, selected.Target); err != nil {
+				return Target{}, fmt.Errorf("failed to resolve target of rollout %q: %w", selected.Name, err)
+			}
+		}
+		p = pin{Target: selected.Target, Digest: dgst, PinnedAt: now.UTC()}
+	}
+	record := device.Verified && !known
+	switch {
+	case !pinned:
+		m.m.Lock()
+		err = m.store.modify(ctx, func(st *state) error {
+			// The target might have been pinned in the meantime, by this or another replica that shares the state.
+			if existing, ok := st.Pins[selected.Name]; ok && existing.Target == p.Target {
+				p = existing
+			}
+			st.Pins[selected.Name] = p
+			if record {
+				st.addDevice(selected.Name, device.ID, now)
+			}
+			return nil
+		})
+		m.m.Unlock()
+	case record:
+		// Devices are recorded once, the state is not rewritten for each of them.
+		m.m.Lock()
+		err = m.store.record(ctx, selected.Name, device.ID, now)
+		m.m.Unlock()
+	}
+	if err != nil {
+		return Target{}, err
+	}
+	return Target{
+		Rollout:    selected.Name,
+		Repository: selected.repository,
+		Image:      selected.repository + "@" + p.Digest.String(),
+		Digest:     p.Digest,
+	}, nil
+}
+
+// selectRollout returns the rollout whose target the device should run and its pin if it has been pinned.
+// known reports whether the selection of the device has been recorded or cannot be recorded anymore.
+func (m *manager) selectRollout(now time.Time, device Device, repository string) (selected *rollout, p pin, pinned, known bool, err error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	st, err := m.store.load()
+	if err != nil {
+		return nil, pin{}, false, false, err
+	}
+	for i := range m.rollouts {
+		r := &m.rollouts[i]
+		if (repository != "" && r.repository != repository) || now.Before(r.Start) || !m.selects(st, r, device.ID) {
+			continue
+		}
+		if selected != nil && selected.repository != r.repository {
+			return nil, pin{}, false, false, ErrAmbiguous
+		}
+		// Later rollouts take precedence if they started at the same time.
+		if selected == nil || !r.Start.Before(selected.Start) {
+			selected = r
+		}
+	}
+	if selected == nil {
+		return nil, pin{}, false, false, ErrNoTarget
+	}
+	p, pinned = st.Pins[selected.Name]
+	devices := st.Devices[selected.Name]
+	_, known = devices[device.ID]
+	return selected, p, pinned, known || len(devices) >= maxRecordedDevices, nil
+}
+
+// selects reports whether the rollout selects the device, devices that have been selected before stay selected.
+func (m *manager) selects(st *state, r *rollout, device string) bool {
+	if len(r.Groups) > 0 && !slices.ContainsFunc(r.Groups, func(group string) bool { return matchesAny(m.groups[group], device) }) {
+		return false
+	}
+	if _, ok := st.Devices[r.Name][device]; ok {
+		return true
+	}
+	return bucket(r.Name, device) < r.Percentage
+}
+
+// bucket assigns the device to one of 100 buckets, each rollout assigns the devices differently.
+func bucket(rollout, device string) uint {
+	h := sha256.Sum256([]byte(rollout + "\x00" + device))
+	return uint(binary.BigEndian.Uint64(h[:8]) % 100)
+}
+
+// matchesAny checks if the name matches one of the patterns.
+func matchesAny(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		ok, err := path.Match(pattern, name)
+		return err == nil && ok
+	})
+}
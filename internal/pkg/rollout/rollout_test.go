@@ -0,0 +1,297 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+var (
+	digestV1 = digest.FromString("v1")
+	digestV2 = digest.FromString("v2")
+	digestV3 = digest.FromString("v3")
+)
+
+// testRegistry resolves the tags of registry.example.org/app, tags can be moved by the tests.
+type testRegistry struct {
+	tags     map[string]digest.Digest
+	resolved int
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{tags: map[string]digest.Digest{
+		"registry.example.org/app:v1": digestV1,
+		"registry.example.org/app:v2": digestV2,
+		"registry.example.org/app:v3": digestV3,
+	}}
+}
+
+func (r *testRegistry) resolve(_ context.Context, image string) (digest.Digest, error) {
+	r.resolved++
+	dgst, ok := r.tags[image]
+	if !ok {
+		return "", fmt.Errorf("%s not found", image)
+	}
+	return dgst, nil
+}
+
+func TestNew_invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "no name", config: Config{Rollouts: []Rollout{{Target: "registry.example.org/app:v2"}}}},
+		{name: "duplicate name", config: Config{Rollouts: []Rollout{{Name: "v2", Target: "registry.example.org/app:v2"}, {Name: "v2", Target: "registry.example.org/app:v3"}}}},
+		{name: "invalid target", config: Config{Rollouts: []Rollout{{Name: "v2", Target: "app"}}}},
+		{name: "percentage", config: Config{Rollouts: []Rollout{{Name: "v2", Target: "registry.example.org/app:v2", Percentage: 101}}}},
+		{name: "unknown group", config: Config{Rollouts: []Rollout{{Name: "v2", Target: "registry.example.org/app:v2", Groups: []string{"canary"}}}}},
+		{name: "invalid pattern", config: Config{Groups: map[string][]string{"canary": {"["}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.config, "", newTestRegistry().resolve); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestManager_Target(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	config := Config{
+		Groups: map[string][]string{"canary": {"lab-*"}},
+		Rollouts: []Rollout{
+			{Name: "stable", Target: "registry.example.org/app:v1", Percentage: 100},
+			{Name: "canary", Target: "registry.example.org/app:v2", Percentage: 100, Groups: []string{"canary"}, Start: now.Add(-time.Hour)},
+			{Name: "next", Target: "registry.example.org/app:v3", Percentage: 100, Start: now.Add(time.Hour)},
+			{Name: "tools", Target: "registry.example.org/tools@" + digestV1.String(), Percentage: 100, Groups: []string{"canary"}},
+		},
+	}
+	tests := []struct {
+		name       string
+		device     string
+		repository string
+		want       digest.Digest
+		wantErr    error
+	}{
+		{name: "stable", device: "device-1", want: digestV1},
+		{name: "stable of the repository", device: "device-1", repository: "registry.example.org/app", want: digestV1},
+		{name: "canary", device: "lab-1", repository: "registry.example.org/app", want: digestV2},
+		{name: "digest target", device: "lab-1", repository: "registry.example.org/tools", want: digestV1},
+		{name: "several repositories", device: "lab-1", wantErr: ErrAmbiguous},
+		{name: "no rollout of the repository", device: "device-1", repository: "registry.example.org/other", wantErr: ErrNoTarget},
+	}
+	m, err := New(config, "", newTestRegistry().resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.(*manager).now = func() time.Time { return now }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.Target(context.Background(), Device{ID: tt.device}, tt.repository)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if got.Digest != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got.Digest)
+			}
+			if tt.want != "" && got.Image != got.Repository+"@"+tt.want.String() {
+				t.Errorf("unexpected image %s", got.Image)
+			}
+		})
+	}
+}
+
+func TestManager_Target_percentage(t *testing.T) {
+	const devices = 200
+	selected := func(m Manager, prefix string, verified bool) map[string]bool {
+		s := make(map[string]bool)
+		for i := range devices {
+			device := fmt.Sprintf("%s-%d", prefix, i)
+			target, err := m.Target(context.Background(), Device{ID: device, Verified: verified}, "")
+			if errors.Is(err, ErrNoTarget) {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target.Digest != digestV2 {
+				t.Fatalf("unexpected target %v", target)
+			}
+			s[device] = true
+		}
+		return s
+	}
+	statePath := filepath.Join(t.TempDir(), "rollouts.json")
+	config := Config{Rollouts: []Rollout{{Name: "v2", Target: "registry.example.org/app:v2", Percentage: 10}}}
+	m, err := New(config, statePath, newTestRegistry().resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canaries := selected(m, "device", true)
+	if len(canaries) < devices*5/100 || len(canaries) > devices*15/100 {
+		t.Fatalf("expected about 10%% of the devices to be selected, got %d", len(canaries))
+	}
+	// Increasing the percentage keeps the selected devices.
+	config.Rollouts[0].Percentage = 50
+	m, err = New(config, statePath, newTestRegistry().resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := selected(m, "device", true)
+	for device := range canaries {
+		if !half[device] {
+			t.Errorf("%s is not selected anymore", device)
+		}
+	}
+	if unverified := selected(m, "unverified", false); len(unverified) == 0 {
+		t.Fatal("expected devices that are not verified to be selected")
+	}
+	// Pausing the rollout keeps the verified devices that have been selected, the state is persisted.
+	config.Rollouts[0].Percentage = 0
+	m, err = New(config, statePath, newTestRegistry().resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paused := selected(m, "device", true); len(paused) != len(half) {
+		t.Errorf("expected %d devices to keep the target, got %d", len(half), len(paused))
+	}
+	// The selections of devices that are not verified are not recorded.
+	if paused := selected(m, "unverified", false); len(paused) != 0 {
+		t.Errorf("expected the selections of unverified devices not to be recorded, got %d", len(paused))
+	}
+}
+
+func TestManager_Target_pinned(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "rollouts.json")
+	registry := newTestRegistry()
+	config := Config{Rollouts: []Rollout{{Name: "latest", Target: "registry.example.org/app:latest", Percentage: 100}}}
+	registry.tags["registry.example.org/app:latest"] = digestV2
+	m, err := New(config, statePath, registry.resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := func(m Manager) digest.Digest {
+		t.Helper()
+		got, err := m.Target(context.Background(), Device{ID: "device-1"}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Digest
+	}
+	if got := target(m); got != digestV2 {
+		t.Fatalf("expected %v, got %v", digestV2, got)
+	}
+	// Pushes to the tag do not change the started rollout, not even after a restart.
+	registry.tags["registry.example.org/app:latest"] = digestV3
+	if got := target(m); got != digestV2 {
+		t.Errorf("expected the pinned digest %v, got %v", digestV2, got)
+	}
+	m, err = New(config, statePath, registry.resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := target(m); got != digestV2 {
+		t.Errorf("expected the pinned digest %v after a restart, got %v", digestV2, got)
+	}
+	if registry.resolved != 1 {
+		t.Errorf("expected the tag to be resolved once, got %d", registry.resolved)
+	}
+	// Changing the target starts the rollout over.
+	config.Rollouts[0].Target = "registry.example.org/app:v1"
+	m, err = New(config, statePath, registry.resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := target(m); got != digestV1 {
+		t.Errorf("expected %v, got %v", digestV1, got)
+	}
+}
+
+func TestManager_Target_unresolvable(t *testing.T) {
+	config := Config{Rollouts: []Rollout{{Name: "missing", Target: "registry.example.org/app:missing", Percentage: 100}}}
+	m, err := New(config, "", newTestRegistry().resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Target(context.Background(), Device{ID: "device-1"}, ""); err == nil || errors.Is(err, ErrNoTarget) {
+		t.Errorf("expected a resolution error, got %v", err)
+	}
+}
+
+func TestManager_Target_resolveWithoutLock(t *testing.T) {
+	config := Config{Rollouts: []Rollout{
+		{Name: "app", Target: "registry.example.org/app:v2", Percentage: 100},
+		{Name: "tools", Target: "registry.example.org/tools@" + digestV1.String(), Percentage: 100},
+	}}
+	resolving, unblock := make(chan struct{}), make(chan struct{})
+	m, err := New(config, filepath.Join(t.TempDir(), "rollouts.json"), func(context.Context, string) (digest.Digest, error) {
+		close(resolving)
+		<-unblock
+		return digestV2, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := m.Target(context.Background(), Device{ID: "device-1", Verified: true}, "registry.example.org/app")
+		done <- err
+	}()
+	<-resolving
+	// Other requests are answered while the target is resolved.
+	if _, err := m.Target(context.Background(), Device{ID: "device-2", Verified: true}, "registry.example.org/tools"); err != nil {
+		t.Fatal(err)
+	}
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNew_corruptState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "rollouts.json")
+	if err := os.WriteFile(statePath, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{Rollouts: []Rollout{{Name: "v2", Target: "registry.example.org/app:v2", Percentage: 100}}}
+	if _, err := New(config, statePath, newTestRegistry().resolve); err == nil {
+		t.Error("expected an error for a corrupt state file")
+	}
+}
+
+func TestManager_Target_modifiedState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "rollouts.json")
+	registry := newTestRegistry()
+	registry.tags["registry.example.org/app:latest"] = digestV2
+	config := Config{Rollouts: []Rollout{{Name: "latest", Target: "registry.example.org/app:latest", Percentage: 100}}}
+	m, err := New(config, statePath, registry.resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := func() digest.Digest {
+		t.Helper()
+		got, err := m.Target(context.Background(), Device{ID: "device-1", Verified: true}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Digest
+	}
+	if got := target(); got != digestV2 {
+		t.Fatalf("expected %v, got %v", digestV2, got)
+	}
+	// Pins that are removed from the state file, e.g. by another replica or an operator, stay removed.
+	if err := os.WriteFile(statePath, []byte(`{"pins":{},"devices":{}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	registry.tags["registry.example.org/app:latest"] = digestV3
+	if got := target(); got != digestV3 {
+		t.Errorf("expected the target to be pinned again to %v, got %v", digestV3, got)
+	}
+}
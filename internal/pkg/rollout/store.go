@@ -0,0 +1,282 @@
+package rollout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
+)
+
+// store persists the state of the rollouts, the manager serializes its calls.
+type store interface {
+	// load returns the current state, it must not be modified.
+	load() (*state, error)
+	// modify calls the function with the current state and persists the modified state.
+	modify(ctx context.Context, f func(*state) error) error
+	// record persists that the rollout selected the device, it is cheaper than modify.
+	record(ctx context.Context, rollout, device string, at time.Time) error
+}
+
+func newStore(path string) (store, error) {
+	if path == "" {
+		return &memoryStore{st: newState()}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory of the rollout state: %w", err)
+	}
+	return &fileStore{path: path}, nil
+}
+
+func newState() state {
+	return state{Pins: make(map[string]pin), Devices: make(map[string]map[string]time.Time)}
+}
+
+// init initializes the maps of states that have been decoded from empty or partial files.
+func (st *state) init() {
+	if st.Pins == nil {
+		st.Pins = make(map[string]pin)
+	}
+	if st.Devices == nil {
+		st.Devices = make(map[string]map[string]time.Time)
+	}
+}
+
+// addDevice records that the rollout selected the device, unless it is known or the rollout recorded too many devices.
+func (st *state) addDevice(rollout, device string, at time.Time) {
+	devices := st.Devices[rollout]
+	if devices == nil {
+		devices = make(map[string]time.Time)
+		st.Devices[rollout] = devices
+	}
+	if _, ok := devices[device]; !ok && len(devices) < maxRecordedDevices {
+		devices[device] = at.UTC()
+	}
+}
+
+type memoryStore struct {
+	st state
+}
+
+func (s *memoryStore) load() (*state, error) {
+	return &s.st, nil
+}
+
+func (s *memoryStore) modify(_ context.Context, f func(*state) error) error {
+	return f(&s.st)
+}
+
+func (s *memoryStore) record(_ context.Context, rollout, device string, at time.Time) error {
+	s.st.addDevice(rollout, device, at)
+	return nil
+}
+
+// journalEntry is a line of the journal, it records the selection of a device.
+type journalEntry struct {
+	Rollout string    `json:"rollout"`
+	Device  string    `json:"device"`
+	At      time.Time `json:"at"`
+}
+
+// fileStore keeps the state in a file that is shared by the replicas that use the same path.
+// Selections of devices are appended to a journal next to the state (<path>.journal), so recording a device does not rewrite the state.
+// Modifications are serialized with a file lock (flock) and written to a synced temporary file that replaces the state,
+// the journal is folded into the replaced state and removed, so readers never see partial state.
+// The parsed state is cached, it is parsed again once the state file has been replaced or changed (by its size and mtime)
+// and only the new lines of the journal are applied to it.
+type fileStore struct {
+	path string
+	// cached is the state of the file version plus the first offset bytes of the journal file.
+	cached  *state
+	version os.FileInfo
+	journal os.FileInfo
+	offset  int64
+}
+
+func (s *fileStore) journalPath() string {
+	return s.path + ".journal"
+}
+
+// stat returns the info of the file, it is nil if the file does not exist.
+func stat(path string) (os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return info, err
+}
+
+// sameVersion reports whether both infos describe the same unchanged file.
+func sameVersion(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// load returns the cached state after it has been refreshed with the changes of the files.
+func (s *fileStore) load() (*state, error) {
+	version, err := stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if s.cached == nil || !sameVersion(s.version, version) {
+		st, err := s.read()
+		if err != nil {
+			return nil, err
+		}
+		s.cached, s.version, s.journal, s.offset = st, version, nil, 0
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	return s.cached, nil
+}
+
+// read decodes the state of the file, the state is empty if the file does not exist or is empty.
+func (s *fileStore) read() (*state, error) {
+	st := newState()
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(data) == 0) {
+		return &st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("failed to parse rollout state %s: %w", s.path, err)
+	}
+	st.init()
+	return &st, nil
+}
+
+// replay applies the lines of the journal that have been appended since the last call to the cached state.
+// The journal is read from the start if it has been replaced, lines that are still being written are skipped.
+func (s *fileStore) replay() error {
+	f, err := os.Open(s.journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer funcutils.PanicOrLogOnErr(f.Close, false, "failed to close rollout journal")
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if s.journal == nil || !os.SameFile(s.journal, info) {
+		s.journal, s.offset = info, 0
+	}
+	if info.Size() <= s.offset {
+		return nil
+	}
+	if _, err := f.Seek(s.offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(f, info.Size()-s.offset))
+	if err != nil {
+		return err
+	}
+	n := bytes.LastIndexByte(data, '\n') + 1
+	for _, line := range bytes.Split(data[:n], []byte("\n")) {
+		var entry journalEntry
+		if len(line) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("failed to parse rollout journal %s: %w", s.journalPath(), err)
+		}
+		s.cached.addDevice(entry.Rollout, entry.Device, entry.At)
+	}
+	s.offset += int64(n)
+	return nil
+}
+
+// lock acquires the file lock that serializes the writes of the replicas.
+func (s *fileStore) lock(ctx context.Context) (*flock.Flock, error) {
+	fileLock := flock.New(s.path + ".lock")
+	locked, err := fileLock.TryLockContext(ctx, 10*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, fmt.Errorf("failed to lock %s", fileLock.Path())
+	}
+	return fileLock, nil
+}
+
+func (s *fileStore) modify(ctx context.Context, f func(*state) error) error {
+	fileLock, err := s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer funcutils.PanicOrLogOnErr(fileLock.Unlock, false, "failed to unlock rollout state")
+
+	// The cached state is not modified, it is discarded if f fails.
+	s.cached = nil
+	st, err := s.load()
+	if err != nil {
+		return err
+	}
+	s.cached = nil
+	if err := f(st); err != nil {
+		return err
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(data)
+	if err = errors.Join(err, fp.Sync(), fp.Close()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	// The journal has been folded into the state, it is applied again if it cannot be removed which does not change the state.
+	if err := os.Remove(s.journalPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return syncDir(filepath.Dir(s.path))
+}
+
+func (s *fileStore) record(ctx context.Context, rollout, device string, at time.Time) error {
+	data, err := json.Marshal(journalEntry{Rollout: rollout, Device: device, At: at.UTC()})
+	if err != nil {
+		return err
+	}
+	// The lock keeps the journal from being removed between folding it into the state and appending to it.
+	fileLock, err := s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer funcutils.PanicOrLogOnErr(fileLock.Unlock, false, "failed to unlock rollout state")
+	fp, err := os.OpenFile(s.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(append(data, '\n'))
+	return errors.Join(err, fp.Sync(), fp.Close())
+}
+
+// syncDir syncs the directory, so the renames and removals of its entries are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return errors.Join(d.Sync(), d.Close())
+}
@@ -0,0 +1,82 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "rollouts.json")
+	// Both stores share the file like two replicas.
+	a, b := &fileStore{path: path}, &fileStore{path: path}
+	devices := func(s *fileStore) map[string]time.Time {
+		t.Helper()
+		st, err := s.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.Devices["v2"]
+	}
+	now := time.Now()
+	if err := a.record(ctx, "v2", "device-1", now); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(devices(b)); n != 1 {
+		t.Fatalf("expected the recorded device to be shared, got %d devices", n)
+	}
+	// Only new lines of the journal are applied, lines that are still being written are skipped.
+	fp, err := os.OpenFile(a.journalPath(), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteString(`{"rollout":"v2","device":"device-2"`); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(devices(b)); n != 1 {
+		t.Fatalf("expected the partial line to be skipped, got %d devices", n)
+	}
+	if _, err := fp.WriteString(`,"at":"2024-01-01T00:00:00Z"}` + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(devices(b)); n != 2 {
+		t.Fatalf("expected the completed line to be applied, got %d devices", n)
+	}
+	// Modifications fold the journal into the state, the cache of the other store is invalidated.
+	if err := a.modify(ctx, func(st *state) error {
+		st.addDevice("v2", "device-3", now)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(a.journalPath()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the journal to be removed, got %v", err)
+	}
+	if n := len(devices(b)); n != 3 {
+		t.Fatalf("expected the modified state, got %d devices", n)
+	}
+	if err := b.record(ctx, "v2", "device-4", now); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(devices(a)); n != 4 {
+		t.Fatalf("expected the new journal to be applied, got %d devices", n)
+	}
+	// Failed modifications do not change the cached state.
+	errModify := errors.New("modify failed")
+	if err := a.modify(ctx, func(st *state) error {
+		delete(st.Devices, "v2")
+		return errModify
+	}); !errors.Is(err, errModify) {
+		t.Fatalf("expected %v, got %v", errModify, err)
+	}
+	if n := len(devices(a)); n != 4 {
+		t.Errorf("expected the state to be kept, got %d devices", n)
+	}
+}
@@ -0,0 +1,120 @@
+// Package storage provides access to the repositories in which source images and deltas are stored.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/unbasical/doras/internal/pkg/utils/fileutils"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/retry"
+)
+
+// Provider returns the storage of OCI repositories.
+type Provider interface {
+	// Repository returns the storage of the repository with the given name (e.g. `registry.example.org/foo/bar`).
+	// The credentials are used to access the repository if the storage requires authentication.
+	Repository(repoName string, creds auth.CredentialFunc) (oras.GraphTarget, error)
+}
+
+type remoteProvider struct {
+	allowHttp bool
+}
+
+// NewRemoteProvider returns a Provider that accesses repositories in remote registries.
+func NewRemoteProvider(allowHttp bool) Provider {
+	return &remoteProvider{allowHttp: allowHttp}
+}
+
+func (p *remoteProvider) Repository(repoName string, creds auth.CredentialFunc) (oras.GraphTarget, error) {
+	repository, err := remote.NewRepository(repoName)
+	if err != nil {
+		return nil, err
+	}
+	repository.Client = &auth.Client{
+		Client:     retry.DefaultClient,
+		Cache:      auth.NewCache(),
+		Credential: creds,
+	}
+	repository.PlainHTTP = p.allowHttp
+	return repository, nil
+}
+
+// LayoutProvider is a Provider that stores repositories as local OCI image layouts.
+type LayoutProvider interface {
+	Provider
+	// ExistingRepository is like Repository but it does not create missing repositories.
+	// Returns errdef.ErrNotFound if the repository does not exist.
+	ExistingRepository(repoName string) (oras.ReadOnlyGraphTarget, error)
+}
+
+type layoutProvider struct {
+	root   string
+	m      sync.Mutex
+	stores map[string]*oci.Store
+}
+
+// NewLayoutProvider returns a Provider that stores repositories as OCI image layouts below the root directory.
+// The registry part of the repository name is ignored, e.g. `registry.example.org/foo/bar` is stored at `<root>/foo/bar`.
+// Credentials are ignored.
+func NewLayoutProvider(root string) LayoutProvider {
+	return &layoutProvider{
+		root:   root,
+		stores: make(map[string]*oci.Store),
+	}
+}
+
+func (p *layoutProvider) Repository(repoName string, _ auth.CredentialFunc) (oras.GraphTarget, error) {
+	dir, err := p.layoutDir(repoName)
+	if err != nil {
+		return nil, err
+	}
+	return p.store(dir)
+}
+
+func (p *layoutProvider) ExistingRepository(repoName string) (oras.ReadOnlyGraphTarget, error) {
+	dir, err := p.layoutDir(repoName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, v1.ImageLayoutFile)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("repository %s: %w", repoName, errdef.ErrNotFound)
+		}
+		return nil, err
+	}
+	return p.store(dir)
+}
+
+// layoutDir returns the directory of the layout that stores the repository.
+func (p *layoutProvider) layoutDir(repoName string) (string, error) {
+	_, path, found := strings.Cut(repoName, "/")
+	if !found || path == "" {
+		return "", fmt.Errorf("invalid repository name %q", repoName)
+	}
+	return fileutils.EnsureSubPath(p.root, path)
+}
+
+func (p *layoutProvider) store(dir string) (*oci.Store, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	// The store keeps the index in memory, all users of a layout have to share the same instance.
+	if store, ok := p.stores[dir]; ok {
+		return store, nil
+	}
+	store, err := oci.New(dir)
+	if err != nil {
+		return nil, err
+	}
+	p.stores[dir] = store
+	return store, nil
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/errdef"
+)
+
+func TestLayoutProvider_Repository(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	p := NewLayoutProvider(root)
+
+	if _, err := p.ExistingRepository("registry.example.org/foo/bar"); !errors.Is(err, errdef.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for missing repository, got %v", err)
+	}
+	repo, err := p.Repository("registry.example.org/foo/bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello")
+	d := v1.Descriptor{MediaType: "application/octet-stream", Digest: digest.FromBytes(data), Size: int64(len(data))}
+	if err := repo.Push(ctx, d, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "foo", "bar", v1.ImageLayoutFile)); err != nil {
+		t.Fatalf("expected layout at the repository path: %v", err)
+	}
+
+	// The registry is ignored and the same store is shared by all users of the layout.
+	existing, err := p.ExistingRepository("other.example.org/foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing != repo {
+		t.Error("expected the same store for the same repository")
+	}
+	if ok, err := existing.Exists(ctx, d); err != nil || !ok {
+		t.Errorf("expected pushed blob to exist, got %v, %v", ok, err)
+	}
+}
+
+func TestLayoutProvider_InvalidRepository(t *testing.T) {
+	p := NewLayoutProvider(t.TempDir())
+	tests := []struct {
+		name     string
+		repoName string
+	}{
+		{name: "no path", repoName: "registry.example.org"},
+		{name: "empty path", repoName: "registry.example.org/"},
+		{name: "escapes root", repoName: "registry.example.org/../foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := p.Repository(tt.repoName, nil); err == nil {
+				t.Errorf("expected error for %q", tt.repoName)
+			}
+		})
+	}
+}
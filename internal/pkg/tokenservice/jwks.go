@@ -0,0 +1,181 @@
+package tokenservice
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// jwksMaxAge is the duration after which the keys are fetched again.
+	jwksMaxAge = time.Hour
+	// jwksMinRefreshInterval limits how often the keys are fetched because of unknown key IDs.
+	jwksMinRefreshInterval = 10 * time.Second
+	// jwksFetchTimeout limits a fetch of the keys, so a hanging endpoint does not block authentications.
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// jwk is a JSON web key, only the members of public signing keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwks fetches the keys that are used to verify device JWTs from a JWKS endpoint.
+// Concurrent fetches are coalesced and run without holding the mutex, cached keys are served while the keys are refreshed.
+type jwks struct {
+	url    string
+	client *http.Client
+	// minRefreshInterval limits how often the keys are fetched because of unknown key IDs.
+	minRefreshInterval time.Duration
+	fetches            singleflight.Group
+	// m guards the keys, it is not held while the keys are fetched.
+	m       sync.Mutex
+	keys    map[string]any
+	fetched time.Time
+}
+
+func newJWKS(url string, client *http.Client) *jwks {
+	if client == nil {
+		client = &http.Client{Timeout: jwksFetchTimeout}
+	}
+	return &jwks{url: url, client: client, minRefreshInterval: jwksMinRefreshInterval}
+}
+
+// key returns the key with the ID, the keys are fetched again if they are outdated or the key is unknown.
+// Known keys are returned right away and refreshed in the background once they are outdated.
+func (s *jwks) key(ctx context.Context, kid string) (any, error) {
+	s.m.Lock()
+	key, ok := s.keys[kid]
+	fetched := s.fetched
+	s.m.Unlock()
+	outdated := time.Since(fetched) > jwksMaxAge
+	if ok {
+		if outdated {
+			s.fetches.DoChan("", s.fetch)
+		}
+		return key, nil
+	}
+	if outdated || time.Since(fetched) > s.minRefreshInterval {
+		select {
+		case res := <-s.fetches.DoChan("", s.fetch):
+			if res.Err != nil {
+				return nil, fmt.Errorf("failed to fetch keys: %w", res.Err)
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to fetch keys: %w", ctx.Err())
+		}
+		s.m.Lock()
+		key, ok = s.keys[kid]
+		s.m.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// fetch replaces the keys with the keys of the endpoint.
+// The fetch is shared by the callers of key, so it is not bound to the context of one of them.
+func (s *jwks) fetch() (any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer funcutils.PanicOrLogOnErr(resp.Body.Close, false, "failed to close response body")
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Skip keys that are not supported instead of rejecting the whole set.
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.keys, s.fetched = keys, time.Now()
+	return nil, nil
+}
+
+// publicKey returns the public key of RSA, EC (P-256) and OKP (Ed25519) keys.
+func (k *jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		// Validates that the point is on the curve.
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); len(x) != 32 || len(y) != 32 || err != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
@@ -0,0 +1,149 @@
+package tokenservice
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// jwtHeader is the JOSE header of a JWT.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// audience is the aud claim which is either a string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(data, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+// claims are the claims of device JWTs and tokens that are issued by the service.
+type claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  audience `json:"aud,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	// Repositories the token allows to read, only set for tokens that are issued by the service.
+	Repositories []string `json:"repositories,omitempty"`
+}
+
+// leeway is the tolerated clock skew when the validity of tokens is checked.
+const leeway = time.Minute
+
+// validAt checks if the claims are valid at the time, the expiration is required.
+func (c *claims) validAt(t time.Time) error {
+	if c.ExpiresAt == 0 {
+		return errors.New("token does not expire")
+	}
+	if t.After(time.Unix(c.ExpiresAt, 0).Add(leeway)) {
+		return errors.New("token has expired")
+	}
+	if c.NotBefore != 0 && t.Add(leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+// jwt is a parsed but not yet verified JWT.
+type jwt struct {
+	header       jwtHeader
+	claims       claims
+	signingInput string
+	signature    []byte
+}
+
+// parseJWT parses a JWS compact serialization, the signature is not verified.
+func parseJWT(token string) (*jwt, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var t jwt
+	for i, target := range []any{&t.header, &t.claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return nil, fmt.Errorf("malformed token: %w", err)
+		}
+		if err := json.Unmarshal(data, target); err != nil {
+			return nil, fmt.Errorf("malformed token: %w", err)
+		}
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %w", err)
+	}
+	t.signingInput = parts[0] + "." + parts[1]
+	t.signature = signature
+	return &t, nil
+}
+
+// verify checks the signature of the token with the key, the algorithm has to match the type of the key.
+func (t *jwt) verify(key any) error {
+	digest := sha256.Sum256([]byte(t.signingInput))
+	valid := false
+	switch k := key.(type) {
+	case []byte:
+		valid = t.header.Alg == "HS256" && hmac.Equal(t.signature, hs256(k, t.signingInput))
+	case *rsa.PublicKey:
+		valid = t.header.Alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], t.signature) == nil
+	case *ecdsa.PublicKey:
+		// ES256 signatures are the concatenation of r and s.
+		if t.header.Alg == "ES256" && len(t.signature) == 64 {
+			r, s := new(big.Int).SetBytes(t.signature[:32]), new(big.Int).SetBytes(t.signature[32:])
+			valid = ecdsa.Verify(k, digest[:], r, s)
+		}
+	case ed25519.PublicKey:
+		valid = t.header.Alg == "EdDSA" && ed25519.Verify(k, []byte(t.signingInput), t.signature)
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	if !valid {
+		return errors.New("invalid token signature")
+	}
+	return nil
+}
+
+func hs256(secret []byte, signingInput string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// signHS256 returns a JWT with the claims which is signed with the secret.
+func signHS256(secret []byte, kid string, c claims) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT", Kid: kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(hs256(secret, signingInput)), nil
+}
@@ -0,0 +1,258 @@
+package tokenservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	dorasauth "github.com/unbasical/doras/internal/pkg/auth"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+var (
+	// ErrUnauthenticated is returned if a device cannot be authenticated.
+	ErrUnauthenticated = errors.New("device is not authenticated")
+	// ErrForbidden is returned if a device requests a token for a repository that is not on its allow-list.
+	ErrForbidden = errors.New("repository is not allowed for the device")
+	// ErrNoRepositories is returned if a token is requested without repositories.
+	ErrNoRepositories = errors.New("no repositories requested")
+	// ErrNotIssued is returned if a token was not issued by the service, e.g. a registry token.
+	ErrNotIssued = errors.New("token was not issued by the token service")
+	// ErrInvalidToken is returned for tokens of the service that are expired or have been tampered with.
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+const (
+	// tokenIssuer is the issuer and audience of the tokens.
+	tokenIssuer = "doras"
+	// tokenKeyID identifies the key of the tokens.
+	tokenKeyID = "doras-token-service"
+	// minSecretLength is the minimum length of the secret that is used to sign tokens.
+	minSecretLength = 32
+)
+
+// Device can request tokens for the repositories on its allow-list.
+type Device struct {
+	// ID of the device, devices that authenticate with a JWT are identified by its subject.
+	ID string
+	// KeySHA256 is the hex encoded SHA-256 hash of the device key, devices without a key can only authenticate with JWTs.
+	KeySHA256 string
+	// Repositories the device may read (e.g. registry.example.org/apps/*), patterns are matched with path.Match.
+	Repositories []string
+}
+
+// Config configures the token service.
+type Config struct {
+	// Secret signs the tokens, it has to be shared by all replicas.
+	Secret []byte
+	// TTL is the lifetime of tokens.
+	TTL     time.Duration
+	Devices []Device
+	// JWKSURL is the endpoint of the keys that sign device JWTs, JWTs are not accepted if it is empty.
+	JWKSURL string
+	// JWTIssuer and JWTAudience are checked if they are set.
+	JWTIssuer   string
+	JWTAudience string
+	// HTTPClient is used to fetch the keys, defaults to a client with a timeout of 10 seconds.
+	HTTPClient *http.Client
+}
+
+// Token is a short-lived token which allows to request deltas for some repositories.
+type Token struct {
+	Token     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// Service issues tokens to devices, the server accesses the registries with its own credentials on their behalf.
+type Service interface {
+	// Issue authenticates the device with the value of the Authorization header and issues a token for the repositories.
+	// Devices authenticate with basic auth (device ID and key) or with a JWT as Bearer token.
+	Issue(ctx context.Context, authorization string, repositories []string) (Token, error)
+	// Authenticate returns the client auth of a token of the service, ErrNotIssued is returned for other tokens.
+	Authenticate(token string) (dorasauth.ScopedRegistryAuth, error)
+}
+
+type service struct {
+	secret      []byte
+	ttl         time.Duration
+	devices     map[string]Device
+	keys        *jwks
+	issuer      string
+	audience    string
+	credentials auth.CredentialFunc
+}
+
+// New returns a Service that accesses registries with the credentials.
+func New(config Config, credentials auth.CredentialFunc) (Service, error) {
+	if len(config.Secret) < minSecretLength {
+		return nil, fmt.Errorf("the secret has to be at least %d bytes long", minSecretLength)
+	}
+	if config.TTL <= 0 {
+		return nil, errors.New("tokens require a ttl")
+	}
+	s := &service{
+		secret:      config.Secret,
+		ttl:         config.TTL,
+		devices:     make(map[string]Device, len(config.Devices)),
+		issuer:      config.JWTIssuer,
+		audience:    config.JWTAudience,
+		credentials: credentials,
+	}
+	if config.JWKSURL != "" {
+		s.keys = newJWKS(config.JWKSURL, config.HTTPClient)
+	}
+	for _, d := range config.Devices {
+		if err := validateDevice(d); err != nil {
+			return nil, fmt.Errorf("invalid device %q: %w", d.ID, err)
+		}
+		if _, ok := s.devices[d.ID]; ok {
+			return nil, fmt.Errorf("duplicate device %q", d.ID)
+		}
+		s.devices[d.ID] = d
+	}
+	return s, nil
+}
+
+func validateDevice(d Device) error {
+	if d.ID == "" {
+		return errors.New("missing ID")
+	}
+	if d.KeySHA256 != "" {
+		if b, err := hex.DecodeString(d.KeySHA256); err != nil || len(b) != sha256.Size {
+			return errors.New("the key has to be a hex encoded SHA-256 hash")
+		}
+	}
+	for _, pattern := range d.Repositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid repository pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (s *service) Issue(ctx context.Context, authorization string, repositories []string) (Token, error) {
+	device, err := s.authenticateDevice(ctx, authorization)
+	if err != nil {
+		return Token{}, err
+	}
+	if len(repositories) == 0 {
+		return Token{}, ErrNoRepositories
+	}
+	for _, repository := range repositories {
+		if !allows(device.Repositories, repository) {
+			return Token{}, fmt.Errorf("%w: %s", ErrForbidden, repository)
+		}
+	}
+	now := time.Now()
+	token := Token{IssuedAt: now, ExpiresAt: now.Add(s.ttl)}
+	token.Token, err = signHS256(s.secret, tokenKeyID, claims{
+		Issuer:       tokenIssuer,
+		Subject:      device.ID,
+		Audience:     audience{tokenIssuer},
+		IssuedAt:     now.Unix(),
+		ExpiresAt:    token.ExpiresAt.Unix(),
+		Repositories: slices.Clone(repositories),
+	})
+	if err != nil {
+		return Token{}, err
+	}
+	log.Debugf("issued token for device %q and repositories %v", device.ID, repositories)
+	return token, nil
+}
+
+// allows checks if the repository matches one of the patterns of the allow-list.
+func allows(patterns []string, repository string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		ok, err := path.Match(pattern, repository)
+		return err == nil && ok
+	})
+}
+
+// authenticateDevice returns the device which is authenticated by the Authorization header.
+func (s *service) authenticateDevice(ctx context.Context, authorization string) (Device, error) {
+	scheme, credentials, _ := strings.Cut(authorization, " ")
+	switch scheme {
+	case "Basic":
+		return s.authenticateKey(credentials)
+	case "Bearer":
+		return s.authenticateJWT(ctx, credentials)
+	default:
+		return Device{}, fmt.Errorf("%w: unsupported authorization scheme", ErrUnauthenticated)
+	}
+}
+
+// authenticateKey authenticates a device with the base64 encoded device ID and key (basic auth).
+func (s *service) authenticateKey(credentials string) (Device, error) {
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return Device{}, fmt.Errorf("%w: invalid basic auth", ErrUnauthenticated)
+	}
+	id, key, _ := strings.Cut(string(decoded), ":")
+	device, ok := s.devices[id]
+	if !ok || device.KeySHA256 == "" {
+		return Device{}, fmt.Errorf("%w: unknown device %q", ErrUnauthenticated, id)
+	}
+	expected, _ := hex.DecodeString(device.KeySHA256)
+	hash := sha256.Sum256([]byte(key))
+	if subtle.ConstantTimeCompare(hash[:], expected) != 1 {
+		return Device{}, fmt.Errorf("%w: invalid key of device %q", ErrUnauthenticated, id)
+	}
+	return device, nil
+}
+
+// authenticateJWT authenticates a device with a JWT that is signed by a key of the JWKS endpoint.
+func (s *service) authenticateJWT(ctx context.Context, token string) (Device, error) {
+	if s.keys == nil {
+		return Device{}, fmt.Errorf("%w: JWTs are not accepted", ErrUnauthenticated)
+	}
+	t, err := parseJWT(token)
+	if err != nil {
+		return Device{}, fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+	key, err := s.keys.key(ctx, t.header.Kid)
+	if err != nil {
+		return Device{}, fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+	if err := t.verify(key); err != nil {
+		return Device{}, fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+	if err := t.claims.validAt(time.Now()); err != nil {
+		return Device{}, fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+	if s.issuer != "" && t.claims.Issuer != s.issuer {
+		return Device{}, fmt.Errorf("%w: unexpected issuer %q", ErrUnauthenticated, t.claims.Issuer)
+	}
+	if s.audience != "" && !slices.Contains(t.claims.Audience, s.audience) {
+		return Device{}, fmt.Errorf("%w: unexpected audience %v", ErrUnauthenticated, t.claims.Audience)
+	}
+	device, ok := s.devices[t.claims.Subject]
+	if !ok {
+		return Device{}, fmt.Errorf("%w: unknown device %q", ErrUnauthenticated, t.claims.Subject)
+	}
+	return device, nil
+}
+
+func (s *service) Authenticate(token string) (dorasauth.ScopedRegistryAuth, error) {
+	t, err := parseJWT(token)
+	if err != nil || t.header.Kid != tokenKeyID || t.claims.Issuer != tokenIssuer {
+		return nil, ErrNotIssued
+	}
+	if err := t.verify(s.secret); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	if err := t.claims.validAt(time.Now()); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	return dorasauth.NewScopedClientAuth(t.claims.Subject, t.claims.Repositories, s.credentials), nil
+}
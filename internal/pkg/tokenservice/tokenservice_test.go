@@ -0,0 +1,355 @@
+package tokenservice
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// testKey is a signing key of the local identity provider.
+type testKey struct {
+	kid    string
+	alg    string
+	signer crypto.Signer
+}
+
+func (k testKey) jwk() map[string]string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := k.signer.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": k.kid, "use": "sig", "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": k.kid, "crv": "P-256", "x": b64(pub.X.FillBytes(make([]byte, 32))), "y": b64(pub.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": k.kid, "crv": "Ed25519", "x": b64(pub)}
+	default:
+		panic("unsupported key")
+	}
+}
+
+// sign returns a JWT with the claims that is signed by the key.
+func (k testKey) sign(t *testing.T, c claims) string {
+	header, _ := json.Marshal(jwtHeader{Alg: k.alg, Typ: "JWT", Kid: k.kid})
+	payload, _ := json.Marshal(c)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	var err error
+	switch key := k.signer.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signingInput))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// identityProvider serves the keys of a local JWKS endpoint.
+type identityProvider struct {
+	m        sync.Mutex
+	keys     []testKey
+	requests int
+}
+
+func (p *identityProvider) add(k testKey) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.keys = append(p.keys, k)
+}
+
+func (p *identityProvider) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.requests++
+	keys := make([]map[string]string, 0, len(p.keys))
+	for _, k := range p.keys {
+		keys = append(keys, k.jwk())
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
+
+func newTestKeys(t *testing.T) (rsaKey, ecKey, edKey testKey) {
+	r, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{kid: "rsa", alg: "RS256", signer: r}, testKey{kid: "ec", alg: "ES256", signer: e}, testKey{kid: "ed", alg: "EdDSA", signer: ed}
+}
+
+func keyHash(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func basicAuth(id, key string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(id+":"+key))
+}
+
+const (
+	testIssuer   = "https://idp.example.org"
+	testAudience = "doras"
+)
+
+func newTestService(t *testing.T, provider *identityProvider) Service {
+	idp := httptest.NewServer(provider)
+	t.Cleanup(idp.Close)
+	serverCreds := auth.StaticCredential("registry.example.org", auth.Credential{Username: "doras", Password: "secret"})
+	s, err := New(Config{
+		Secret: []byte(strings.Repeat("s", minSecretLength)),
+		TTL:    5 * time.Minute,
+		Devices: []Device{
+			{ID: "device-1", KeySHA256: keyHash("device-key"), Repositories: []string{"registry.example.org/apps/*"}},
+			{ID: "device-2", Repositories: []string{"registry.example.org/apps/foo", "registry.example.org/tools/*"}},
+		},
+		JWKSURL:     idp.URL,
+		JWTIssuer:   testIssuer,
+		JWTAudience: testAudience,
+	}, serverCreds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestService_Issue(t *testing.T) {
+	rsaKey, ecKey, edKey := newTestKeys(t)
+	provider := &identityProvider{keys: []testKey{rsaKey, ecKey, edKey}}
+	s := newTestService(t, provider)
+	now := time.Now()
+	valid := claims{Issuer: testIssuer, Subject: "device-2", Audience: audience{testAudience}, ExpiresAt: now.Add(time.Minute).Unix()}
+	with := func(modify func(c *claims)) claims {
+		c := valid
+		modify(&c)
+		return c
+	}
+	_, _, otherKey := newTestKeys(t)
+	tests := []struct {
+		name          string
+		authorization string
+		repositories  []string
+		wantErr       error
+	}{
+		{name: "device key", authorization: basicAuth("device-1", "device-key"), repositories: []string{"registry.example.org/apps/foo", "registry.example.org/apps/bar"}},
+		{name: "wrong device key", authorization: basicAuth("device-1", "other-key"), repositories: []string{"registry.example.org/apps/foo"}, wantErr: ErrUnauthenticated},
+		{name: "device without key", authorization: basicAuth("device-2", ""), repositories: []string{"registry.example.org/apps/foo"}, wantErr: ErrUnauthenticated},
+		{name: "unknown device", authorization: basicAuth("device-3", "device-key"), repositories: []string{"registry.example.org/apps/foo"}, wantErr: ErrUnauthenticated},
+		{name: "repository not on allow-list", authorization: basicAuth("device-1", "device-key"), repositories: []string{"registry.example.org/apps/foo", "registry.example.org/tools/bar"}, wantErr: ErrForbidden},
+		{name: "patterns do not match nested repositories", authorization: basicAuth("device-1", "device-key"), repositories: []string{"registry.example.org/apps/foo/bar"}, wantErr: ErrForbidden},
+		{name: "no repositories", authorization: basicAuth("device-1", "device-key"), wantErr: ErrNoRepositories},
+		{name: "RS256 JWT", authorization: "Bearer " + rsaKey.sign(t, valid), repositories: []string{"registry.example.org/tools/bar"}},
+		{name: "ES256 JWT", authorization: "Bearer " + ecKey.sign(t, valid), repositories: []string{"registry.example.org/apps/foo"}},
+		{name: "EdDSA JWT", authorization: "Bearer " + edKey.sign(t, valid), repositories: []string{"registry.example.org/apps/foo"}},
+		{name: "JWT repository not on allow-list", authorization: "Bearer " + edKey.sign(t, valid), repositories: []string{"registry.example.org/apps/bar"}, wantErr: ErrForbidden},
+		{name: "expired JWT", authorization: "Bearer " + rsaKey.sign(t, with(func(c *claims) { c.ExpiresAt = now.Add(-time.Hour).Unix() })), repositories: []string{"registry.example.org/apps/foo"}, wantErr: ErrUnauthenticated},
+		{name: "JWT without expiration", authorization: "Bearer " + rsaKey.sign(t, with(func(c *claims) { c.ExpiresAt = 0 })), repositories: []string{"registry.example.org/apps/foo"}, wantErr: ErrUnauthenticated},
+		{name: "JWT of other issuer", authorization: "Bearer " + rsaKey.sign(t, with(func(c *claims) { c.Issuer = "https://other.example.org" })), repositories: []string{"registry.example.org/apps/foo"}, wantErr: ErrUnauthenticated},
+		{name: "JWT for other audience", authorization: "Bearer " + rsaKey.sign(t, with(func(c *claims) { c.Audience = audience{"other"} })), repositories: []string{"registry.example.org/apps/foo"}, wantErr: ErrUnauthenticated},
+		{name: "JWT of unknown device", authorization: "Bearer " + rsaKey.sign(t, with(func(c *claims) { c.Subject = "device-3" })), repositories: []string{"registry.example.org/apps/foo"}, wantErr: ErrUnauthenticated},
+		{name: "JWT signed by unknown key", authorization: "Bearer " + testKey{kid: "ed", alg: "EdDSA", signer: otherKey.signer}.sign(t, valid), repositories: []string{"registry.example.org/apps/foo"}, wantErr: ErrUnauthenticated},
+		{name: "JWT with mismatching algorithm", authorization: "Bearer " + testKey{kid: "ec", alg: "RS256", signer: rsaKey.signer}.sign(t, valid), repositories: []string{"registry.example.org/apps/foo"}, wantErr: ErrUnauthenticated},
+		{name: "unsupported scheme", authorization: "Token foo", repositories: []string{"registry.example.org/apps/foo"}, wantErr: ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := s.Issue(context.Background(), tt.authorization, tt.repositories)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if ttl := token.ExpiresAt.Sub(token.IssuedAt); ttl != 5*time.Minute {
+				t.Errorf("unexpected ttl %s", ttl)
+			}
+			clientAuth, err := s.Authenticate(token.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, repository := range tt.repositories {
+				if !clientAuth.Allows(repository) {
+					t.Errorf("expected token to allow %s", repository)
+				}
+			}
+			if clientAuth.Allows("registry.example.org/other") {
+				t.Error("expected token to be scoped to the requested repositories")
+			}
+			credFunc, err := clientAuth.CredentialFunc("registry.example.org")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if creds, _ := credFunc(context.Background(), "registry.example.org"); creds.Username != "doras" {
+				t.Errorf("expected the credentials of the server, got %+v", creds)
+			}
+		})
+	}
+}
+
+func TestService_Authenticate(t *testing.T) {
+	rsaKey, _, _ := newTestKeys(t)
+	s := newTestService(t, &identityProvider{keys: []testKey{rsaKey}})
+	token, err := s.Issue(context.Background(), basicAuth("device-1", "device-key"), []string{"registry.example.org/apps/foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte(strings.Repeat("s", minSecretLength))
+	expired, err := signHS256(secret, tokenKeyID, claims{Issuer: tokenIssuer, ExpiresAt: time.Now().Add(-time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := signHS256([]byte(strings.Repeat("f", minSecretLength)), tokenKeyID, claims{Issuer: tokenIssuer, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token.Token, ".")
+	widened, _ := json.Marshal(claims{Issuer: tokenIssuer, ExpiresAt: time.Now().Add(time.Hour).Unix(), Repositories: []string{"registry.example.org/apps/bar"}})
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(widened) + "." + parts[2]
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "issued token", token: token.Token},
+		{name: "registry token", token: "registry-token", wantErr: ErrNotIssued},
+		{name: "device JWT", token: rsaKey.sign(t, claims{Issuer: testIssuer, ExpiresAt: time.Now().Add(time.Hour).Unix()}), wantErr: ErrNotIssued},
+		{name: "expired", token: expired, wantErr: ErrInvalidToken},
+		{name: "signed with other secret", token: forged, wantErr: ErrInvalidToken},
+		{name: "tampered", token: tampered, wantErr: ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Authenticate(tt.token); !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func Test_jwks_key(t *testing.T) {
+	rsaKey, ecKey, _ := newTestKeys(t)
+	provider := &identityProvider{keys: []testKey{rsaKey}}
+	idp := httptest.NewServer(provider)
+	defer idp.Close()
+	keys := newJWKS(idp.URL, nil)
+	ctx := context.Background()
+	if _, err := keys.key(ctx, "rsa"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.key(ctx, "rsa"); err != nil || provider.requests != 1 {
+		t.Fatalf("expected keys to be cached, got %d requests (%v)", provider.requests, err)
+	}
+	// Rotated keys are fetched once they are used but not more often than the refresh interval.
+	provider.add(ecKey)
+	if _, err := keys.key(ctx, "ec"); err == nil {
+		t.Error("expected unknown key within the refresh interval")
+	}
+	keys.minRefreshInterval = 0
+	if _, err := keys.key(ctx, "ec"); err != nil {
+		t.Errorf("expected rotated key to be fetched, got %v", err)
+	}
+	if _, err := keys.key(ctx, "unknown"); err == nil {
+		t.Error("expected error for unknown key")
+	}
+}
+
+func Test_jwks_hangingEndpoint(t *testing.T) {
+	rsaKey, _, _ := newTestKeys(t)
+	provider := &identityProvider{keys: []testKey{rsaKey}}
+	release := make(chan struct{})
+	// The endpoint serves the keys once and hangs afterwards.
+	var served atomic.Bool
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if served.Swap(true) {
+			<-release
+			return
+		}
+		provider.ServeHTTP(w, r)
+	}))
+	defer idp.Close()
+	defer close(release)
+	keys := newJWKS(idp.URL, nil)
+	ctx := context.Background()
+	if _, err := keys.key(ctx, "rsa"); err != nil {
+		t.Fatal(err)
+	}
+	keys.m.Lock()
+	keys.fetched = time.Now().Add(-2 * jwksMaxAge)
+	keys.m.Unlock()
+	// Cached keys are served while the outdated keys are refreshed.
+	done := make(chan error, 1)
+	go func() {
+		_, err := keys.key(ctx, "rsa")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cached key is blocked by the refresh")
+	}
+	// Callers of unknown keys stop waiting for the refresh once their context is done.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := keys.key(timeoutCtx, "ec"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	secret := []byte(strings.Repeat("s", minSecretLength))
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "short secret", config: Config{Secret: []byte("secret"), TTL: time.Minute}},
+		{name: "missing ttl", config: Config{Secret: secret}},
+		{name: "device without ID", config: Config{Secret: secret, TTL: time.Minute, Devices: []Device{{}}}},
+		{name: "invalid key hash", config: Config{Secret: secret, TTL: time.Minute, Devices: []Device{{ID: "foo", KeySHA256: "key"}}}},
+		{name: "invalid pattern", config: Config{Secret: secret, TTL: time.Minute, Devices: []Device{{ID: "foo", Repositories: []string{"["}}}}},
+		{name: "duplicate device", config: Config{Secret: secret, TTL: time.Minute, Devices: []Device{{ID: "foo"}, {ID: "foo"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.config, nil); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
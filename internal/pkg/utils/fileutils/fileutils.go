@@ -14,6 +14,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
@@ -193,3 +194,35 @@ func (lf *LockedFile) Close() error {
 		lf.f.Close(),
 	)
 }
+
+// RemoveStaleFiles removes the files in dir that match one of the glob patterns and
+// have not been modified for maxAge, e.g. temporary files left behind by killed processes.
+// Returns the number of removed files.
+func RemoveStaleFiles(dir string, patterns []string, maxAge time.Duration) (int, error) {
+	removed := 0
+	var errs []error
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return removed, err
+		}
+		for _, match := range matches {
+			info, err := os.Lstat(match)
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			if !info.Mode().IsRegular() || time.Since(info.ModTime()) < maxAge {
+				continue
+			}
+			if err := os.Remove(match); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+				continue
+			}
+			removed++
+		}
+	}
+	return removed, errors.Join(errs...)
+}
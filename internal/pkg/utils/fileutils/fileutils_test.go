@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 // createTempDirWithFiles creates a temporary directory with specified files and contents
@@ -131,3 +132,38 @@ func TestCompareDirectories(t *testing.T) {
 		}
 	})
 }
+
+func TestRemoveStaleFiles(t *testing.T) {
+	dir := createTempDirWithFiles(t, map[string]string{
+		"delta_stale":    "foo",
+		"delta_fresh":    "foo",
+		"123.tardiff":    "foo",
+		"unrelated":      "foo",
+		"delta_dir/file": "foo",
+	})
+	stale := time.Now().Add(-time.Hour)
+	for _, name := range []string{"delta_stale", "123.tardiff", "unrelated", "delta_dir"} {
+		if err := os.Chtimes(filepath.Join(dir, name), stale, stale); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := RemoveStaleFiles(dir, []string{"delta_*", "*.tardiff"}, 30*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("expected 2 removed files, got %d", removed)
+	}
+	for name, wantExists := range map[string]bool{
+		"delta_stale": false,
+		"123.tardiff": false,
+		"delta_fresh": true,
+		"unrelated":   true,
+		"delta_dir":   true,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != wantExists {
+			t.Errorf("expected %s to exist: %v, got %v", name, wantExists, exists)
+		}
+	}
+}
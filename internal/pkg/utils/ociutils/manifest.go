@@ -2,6 +2,8 @@ package ociutils
 
 import (
 	"errors"
+	"time"
+
 	"github.com/opencontainers/image-spec/specs-go"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/unbasical/doras/pkg/constants"
@@ -20,6 +22,16 @@ func ExtractPathFromManifest(mf *Manifest) (path string, isArchive bool, err err
 	return path, isArchive, nil
 }
 
+// LastHeartbeat returns the time at which a dummy with the annotations has been renewed the last time.
+// Falls back to the creation time for dummies without heartbeats.
+func LastHeartbeat(annotations map[string]string) (time.Time, error) {
+	ts, ok := annotations[constants.DorasAnnotationHeartbeat]
+	if !ok {
+		ts = annotations[v1.AnnotationCreated]
+	}
+	return time.Parse(time.RFC3339, ts)
+}
+
 // Manifest provides `application/vnd.oci.image.manifest.v1+json` mediatype structure when marshalled to JSON.
 type Manifest struct {
 	specs.Versioned
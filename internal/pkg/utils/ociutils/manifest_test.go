@@ -2,7 +2,9 @@ package ociutils
 
 import (
 	"testing"
+	"time"
 
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/unbasical/doras/pkg/constants"
 )
 
@@ -74,3 +76,42 @@ func TestExtractPathFromManifest(t *testing.T) {
 		})
 	}
 }
+
+func TestLastHeartbeat(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name: "heartbeat",
+			annotations: map[string]string{
+				v1.AnnotationCreated:               "2025-01-01T00:00:00Z",
+				constants.DorasAnnotationHeartbeat: "2025-01-01T00:10:00Z",
+			},
+			want: "2025-01-01T00:10:00Z",
+		},
+		{
+			name:        "creation time without heartbeat",
+			annotations: map[string]string{v1.AnnotationCreated: "2025-01-01T00:00:00Z"},
+			want:        "2025-01-01T00:00:00Z",
+		},
+		{
+			name:        "missing timestamps",
+			annotations: map[string]string{},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LastHeartbeat(tt.annotations)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LastHeartbeat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.Format(time.RFC3339) != tt.want {
+				t.Errorf("LastHeartbeat() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
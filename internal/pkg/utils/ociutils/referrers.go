@@ -0,0 +1,58 @@
+package ociutils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry"
+)
+
+// maxReferrerManifestSize limits the size of referrer manifests that are fetched to complete their descriptors.
+const maxReferrerManifestSize = 4 * 1024 * 1024
+
+// Referrers lists the referrers of the subject that have the given artifact type.
+// Not all registries include the artifact type and the annotations of the referrers in the referrers response.
+// Descriptors without annotations are completed by fetching the respective manifest.
+func Referrers(ctx context.Context, src content.ReadOnlyGraphStorage, subject v1.Descriptor, artifactType string) ([]v1.Descriptor, error) {
+	referrers, err := registry.Referrers(ctx, src, subject, "")
+	if err != nil {
+		return nil, err
+	}
+	res := make([]v1.Descriptor, 0, len(referrers))
+	for _, d := range referrers {
+		if len(d.Annotations) == 0 {
+			d, err = completeReferrer(ctx, src, d)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if d.ArtifactType == artifactType {
+			res = append(res, d)
+		}
+	}
+	return res, nil
+}
+
+// completeReferrer sets the artifact type and the annotations of the descriptor according to the manifest it refers to.
+func completeReferrer(ctx context.Context, src content.ReadOnlyStorage, d v1.Descriptor) (v1.Descriptor, error) {
+	if d.Size > maxReferrerManifestSize {
+		return v1.Descriptor{}, fmt.Errorf("referrer %s exceeds size limit", d.Digest)
+	}
+	mfBytes, err := content.FetchAll(ctx, src, d)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	mf, err := ParseManifestJSON(bytes.NewReader(mfBytes))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	d.ArtifactType = mf.ArtifactType
+	if d.ArtifactType == "" {
+		d.ArtifactType = mf.Config.MediaType
+	}
+	d.Annotations = mf.Annotations
+	return d, nil
+}
@@ -7,6 +7,8 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/opencontainers/go-digest"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -129,3 +131,59 @@ func (c *CountingReader) Read(p []byte) (n int, err error) {
 func (c *CountingReader) Close() error {
 	return c.rc.Close()
 }
+
+// decompressedDigestReader passes through the contents of a reader and forwards them to a pipe.
+type decompressedDigestReader struct {
+	tee io.Reader
+	pw  *io.PipeWriter
+}
+
+// NewDecompressedDigestReader wraps r and returns a function that returns the digest of the decompressed contents of r.
+// The compression format is detected automatically, uncompressed contents are hashed as-is.
+// The function blocks until r has been read entirely or the returned reader has been closed.
+// Closing the returned reader does not close r.
+func NewDecompressedDigestReader(r io.Reader) (io.ReadCloser, func() (digest.Digest, error)) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	var dgst digest.Digest
+	var errDigest error
+	go func() {
+		defer close(done)
+		errDigest = func() error {
+			decompressed, _, err := compression.AutoDecompress(pr)
+			if err != nil {
+				return err
+			}
+			digester := digest.Canonical.Digester()
+			_, err = io.Copy(digester.Hash(), decompressed)
+			if err := errors.Join(err, decompressed.Close()); err != nil {
+				return err
+			}
+			dgst = digester.Digest()
+			return nil
+		}()
+		// Drain the pipe in all cases, otherwise reads from the wrapped reader would block.
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+	dr := &decompressedDigestReader{
+		tee: io.TeeReader(r, pw),
+		pw:  pw,
+	}
+	return dr, func() (digest.Digest, error) {
+		<-done
+		return dgst, errDigest
+	}
+}
+
+func (d *decompressedDigestReader) Read(p []byte) (int, error) {
+	n, err := d.tee.Read(p)
+	if errors.Is(err, io.EOF) {
+		_ = d.pw.Close()
+	}
+	return n, err
+}
+
+// Close stops hashing, the digest is not available if the reader has not been read entirely.
+func (d *decompressedDigestReader) Close() error {
+	return d.pw.CloseWithError(errors.New("reader was closed before it was read entirely"))
+}
@@ -3,6 +3,7 @@ package readerutils
 import (
 	"bytes"
 	"github.com/klauspost/compress/gzip"
+	"github.com/opencontainers/go-digest"
 	"io"
 	"testing"
 )
@@ -69,3 +70,50 @@ func TestWriterToReader(t *testing.T) {
 		})
 	}
 }
+
+func TestNewDecompressedDigestReader(t *testing.T) {
+	content := []byte("hello world")
+	gzipped := func() []byte {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		w := gzip.NewWriter(buf)
+		_, err := w.Write(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = w.Close()
+		return buf.Bytes()
+	}()
+	tests := []struct {
+		name     string
+		content  []byte
+		readAll  bool
+		wantErr  bool
+		expected digest.Digest
+	}{
+		{name: "uncompressed", content: content, readAll: true, wantErr: false, expected: digest.FromBytes(content)},
+		{name: "gzip", content: gzipped, readAll: true, wantErr: false, expected: digest.FromBytes(content)},
+		{name: "closed before EOF", content: gzipped, readAll: false, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc, getDigest := NewDecompressedDigestReader(bytes.NewReader(tt.content))
+			if tt.readAll {
+				got, err := io.ReadAll(rc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tt.content) {
+					t.Errorf("reader modified contents, got = %v, want %v", got, tt.content)
+				}
+			}
+			_ = rc.Close()
+			dgst, err := getDigest()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getDigest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if dgst != tt.expected {
+				t.Errorf("getDigest() got = %v, want %v", dgst, tt.expected)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package tarutils
 
 import (
 	"archive/tar"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/opencontainers/go-digest"
@@ -10,8 +11,12 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
+// ErrDigestMismatch is returned if the extracted tar file does not match the expected checksum.
+var ErrDigestMismatch = errors.New("content digest mismatch")
+
 // ExtractCompressedTar decompresses the gzip
 // and extracts tar file to a directory specified by the `dir` parameter.
 func ExtractCompressedTar(dir, prefix, filename string, checksum *digest.Digest, decom compression.Decompressor) (err error) {
@@ -40,7 +45,7 @@ func ExtractCompressedTar(dir, prefix, filename string, checksum *digest.Digest,
 		return err
 	}
 	if verifier != nil && !verifier.Verified() {
-		return errors.New("content digest mismatch")
+		return ErrDigestMismatch
 	}
 	return nil
 }
@@ -136,3 +141,85 @@ func writeFile(path string, r io.Reader, perm os.FileMode) (err error) {
 	// call Sync to make sure file is written to the disk
 	return errors.Join(err, file.Sync())
 }
+
+// TarDirectory walks the directory specified by path, and tar those files with a new
+// path prefix.
+//
+//nolint:revive // This rule is disabled to get around complexity linter errors. It is a slightly modified copy from the oras-go lib https://github.com/oras-project/oras-go/blob/dff56286a744d805bf953ada296e6076c335258b/content/file/utils.go#L36C92-L112.
+func TarDirectory(ctx context.Context, root, prefix string, w io.Writer, removeTimes bool) (err error) {
+	tw := tar.NewWriter(w)
+	defer func() {
+		closeErr := tw.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) (returnErr error) {
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		// Rename path
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.Join(prefix, name)
+		name = filepath.ToSlash(name)
+
+		// Generate header
+		// NOTE: We don't support hard links and treat it as regular files
+		var link string
+		mode := info.Mode()
+		if mode&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		header.Name = name
+		header.Uid = 0
+		header.Gid = 0
+		header.Uname = ""
+		header.Gname = ""
+
+		if removeTimes {
+			header.ModTime = time.Time{}
+			header.AccessTime = time.Time{}
+			header.ChangeTime = time.Time{}
+		}
+
+		// Write file
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("tar: %w", err)
+		}
+		if mode.IsRegular() {
+			fp, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				closeErr := fp.Close()
+				if returnErr == nil {
+					returnErr = closeErr
+				}
+			}()
+
+			if _, err := io.Copy(tw, fp); err != nil {
+				return fmt.Errorf("failed to copy to %s: %w", path, err)
+			}
+		}
+
+		return nil
+	})
+}
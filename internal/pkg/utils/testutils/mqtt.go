@@ -0,0 +1,45 @@
+package testutils
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// LaunchMQTTBroker starts an embedded MQTT broker (mochi-mqtt) and returns its URL (tcp://host:port).
+// Clients have to authenticate if a user name is provided, the broker is shut down once the test has finished.
+func LaunchMQTTBroker(t testing.TB, username, password string) string {
+	server := mochi.New(&mochi.Options{
+		InlineClient: false,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	var err error
+	if username == "" {
+		err = server.AddHook(new(auth.AllowHook), nil)
+	} else {
+		err = server.AddHook(new(auth.Hook), &auth.Options{
+			Ledger: &auth.Ledger{
+				Auth: auth.AuthRules{{Username: auth.RString(username), Password: auth.RString(password), Allow: true}},
+				ACL:  auth.ACLRules{{Username: auth.RString(username), Filters: auth.Filters{"#": auth.ReadWrite}}},
+			},
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	if err := server.AddListener(listener); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	return "tcp://" + listener.Address()
+}
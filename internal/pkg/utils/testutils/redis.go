@@ -0,0 +1,35 @@
+package testutils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// LaunchRedis starts an in-process Redis compatible server (miniredis) and returns its address (host:port).
+// miniredis only expires keys when its clock is advanced, the clock follows the real time so keys expire like on Redis.
+// Clients have to authenticate if a password is provided, the server is shut down once the test has finished.
+func LaunchRedis(t testing.TB, password string) string {
+	s := miniredis.RunT(t)
+	if password != "" {
+		s.RequireAuth(password)
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.FastForward(now.Sub(last))
+				last = now
+			case <-done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { close(done) })
+	return s.Addr()
+}
@@ -3,7 +3,13 @@ package testutils
 import (
 	"context"
 	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
 
+	"github.com/google/go-containerregistry/pkg/registry"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
 )
@@ -40,3 +46,14 @@ func LaunchRegistry(ctx context.Context) string {
 	uri := fmt.Sprintf("%s:%s", hostIP, port)
 	return uri
 }
+
+// LaunchInProcessRegistry starts an in-memory OCI registry (with referrers API support) and returns the server's URI.
+// The registry only supports plain HTTP and is shut down once the test has finished.
+func LaunchInProcessRegistry(t testing.TB) string {
+	srv := httptest.NewServer(registry.New(
+		registry.WithReferrersSupport(true),
+		registry.Logger(log.New(io.Discard, "", 0)),
+	))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
@@ -3,6 +3,7 @@ package testutils
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/unbasical/doras/pkg/constants"
 
@@ -10,6 +11,7 @@ import (
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"oras.land/oras-go/v2"
 	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
 )
 
 // FileDescription represents a file that is stored as an OCI image.
@@ -24,6 +26,8 @@ type FileDescription struct {
 	Tag string
 	// NeedsUnpack indicates if it is an archived file or not.
 	NeedsUnpack bool
+	// Annotations are added to the annotations of the file's layer.
+	Annotations map[string]string
 }
 
 // StorageFromFiles creates an oras.ReadOnlyTarget that stores the given files.
@@ -51,12 +55,16 @@ func StorageFromFiles(ctx context.Context, rootDir string, files []FileDescripti
 			},
 		}
 
+		for k, v := range f.Annotations {
+			d.Annotations[k] = v
+		}
 		if d.MediaType == "" {
 			d.MediaType = "application/vnd.test.file"
 		}
 
 		err = store.Push(ctx, d, bytes.NewReader(f.Data))
-		if err != nil {
+		// Files may share their contents and only differ in their annotations.
+		if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
 			return nil, fmt.Errorf("failed to add file to storage: %w", err)
 		}
 		fileDescriptors = append(fileDescriptors, d)
@@ -0,0 +1,95 @@
+package testutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// CertificateAuthority issues certificates for tests.
+type CertificateAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// CertPath is the path of the PEM encoded CA certificate.
+	CertPath string
+	dir      string
+}
+
+// NewCertificateAuthority creates a self-signed CA, its files are removed once the test has finished.
+func NewCertificateAuthority(t testing.TB) *CertificateAuthority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Doras Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &CertificateAuthority{cert: cert, key: key, dir: t.TempDir()}
+	ca.CertPath = writePEM(t, filepath.Join(ca.dir, "ca.crt"), "CERTIFICATE", der)
+	return ca
+}
+
+// Issue creates a certificate for the common name that can be used by servers (on localhost) and clients.
+// The certificate and key are written to PEM encoded files in the directory of the CA, the paths are returned.
+func (ca *CertificateAuthority) Issue(t testing.TB, commonName string, dnsNames ...string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     append([]string{"localhost"}, dnsNames...),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := serial.String()
+	certPath = writePEM(t, filepath.Join(ca.dir, name+".crt"), "CERTIFICATE", der)
+	keyPath = writePEM(t, filepath.Join(ca.dir, name+".key"), "PRIVATE KEY", keyDER)
+	return certPath, keyPath
+}
+
+func writePEM(t testing.TB, path, blockType string, der []byte) string {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
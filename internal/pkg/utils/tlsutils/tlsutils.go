@@ -0,0 +1,151 @@
+package tlsutils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CertificateReloader serves a key pair from disk and reloads it once the files have changed,
+// this allows to rotate certificates without restarting.
+type CertificateReloader struct {
+	certPath string
+	keyPath  string
+	m        sync.Mutex
+	cert     *tls.Certificate
+	// version identifies the state of the files from which cert was loaded.
+	version string
+}
+
+// NewCertificateReloader loads the PEM encoded certificate (chain) and key at the paths.
+func NewCertificateReloader(certPath, keyPath string) (*CertificateReloader, error) {
+	r := &CertificateReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// fileVersion returns a string that changes if the files are modified.
+func fileVersion(paths ...string) (string, error) {
+	version := ""
+	for _, p := range paths {
+		stat, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		version += fmt.Sprintf("%s:%d:%d;", p, stat.ModTime().UnixNano(), stat.Size())
+	}
+	return version, nil
+}
+
+// reload loads the key pair if the files have changed since it was loaded.
+func (r *CertificateReloader) reload() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	version, err := fileVersion(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+	if version == r.version {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair: %w", err)
+	}
+	if r.cert != nil {
+		log.Infof("reloaded certificate from %s", r.certPath)
+	}
+	r.cert, r.version = &cert, version
+	return nil
+}
+
+// certificate returns the current certificate, the previous certificate is kept if the files cannot be loaded,
+// e.g. because only one of them has been replaced so far.
+func (r *CertificateReloader) certificate() *tls.Certificate {
+	if err := r.reload(); err != nil {
+		log.WithError(err).Warn("failed to reload certificate, using the previous certificate")
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.cert
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate of servers.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+// GetClientCertificate can be used as tls.Config.GetClientCertificate of clients.
+func (r *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+// LoadCertPool returns a pool of the PEM encoded certificates in the file.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// NewServerConfig returns the TLS configuration of a server which serves the certificate of the reloader.
+// If a client CA is provided, client certificates are verified against it and required if requireClientCert is set.
+func NewServerConfig(reloader *CertificateReloader, clientCAPath string, requireClientCert bool) (*tls.Config, error) {
+	if reloader == nil {
+		return nil, errors.New("missing server certificate")
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCAPath == "" {
+		if requireClientCert {
+			return nil, errors.New("requiring client certificates requires a client CA")
+		}
+		return config, nil
+	}
+	pool, err := LoadCertPool(clientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client CA: %w", err)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// Identities returns the identities of a certificate, these are the common name and the DNS, email and URI SANs.
+func Identities(cert *x509.Certificate) []string {
+	identities := make([]string, 0, 1+len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.URIs))
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		identities = append(identities, u.String())
+	}
+	return identities
+}
+
+// VerifiedClientCertificate returns the leaf of the verified client certificate chain of a connection or nil.
+func VerifiedClientCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
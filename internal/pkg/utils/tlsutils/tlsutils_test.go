@@ -0,0 +1,139 @@
+package tlsutils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+)
+
+// copyFile replaces the content of dst with the content of src.
+func copyFile(t *testing.T, src, dst string) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	ca := testutils.NewCertificateAuthority(t)
+	dir := t.TempDir()
+	certPath, keyPath := dir+"/tls.crt", dir+"/tls.key"
+	firstCert, firstKey := ca.Issue(t, "first")
+	secondCert, secondKey := ca.Issue(t, "second")
+	copyFile(t, firstCert, certPath)
+	copyFile(t, firstKey, keyPath)
+
+	r, err := NewCertificateReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if got := commonName(); got != "first" {
+		t.Fatalf("expected first certificate, got %q", got)
+	}
+	// The previous certificate is served as long as the key does not match.
+	copyFile(t, secondCert, certPath)
+	if got := commonName(); got != "first" {
+		t.Errorf("expected previous certificate while the key pair is inconsistent, got %q", got)
+	}
+	copyFile(t, secondKey, keyPath)
+	if got := commonName(); got != "second" {
+		t.Errorf("expected reloaded certificate, got %q", got)
+	}
+	if _, err := NewCertificateReloader(certPath, dir+"/missing.key"); err == nil {
+		t.Error("expected error for missing key")
+	}
+}
+
+func TestNewServerConfig(t *testing.T) {
+	ca := testutils.NewCertificateAuthority(t)
+	serverCert, serverKey := ca.Issue(t, "server")
+	clientCert, clientKey := ca.Issue(t, "device-1")
+	untrusted := testutils.NewCertificateAuthority(t)
+	untrustedCert, untrustedKey := untrusted.Issue(t, "device-2")
+	reloader, err := NewCertificateReloader(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCAs, err := LoadCertPool(ca.CertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name              string
+		clientCA          string
+		requireClientCert bool
+		clientCert        string
+		clientKey         string
+		wantErr           bool
+		wantIdentity      string
+	}{
+		{name: "tls"},
+		{name: "tls ignores client certificates", clientCert: clientCert, clientKey: clientKey},
+		{name: "optional client certificate", clientCA: ca.CertPath},
+		{name: "verified client certificate", clientCA: ca.CertPath, clientCert: clientCert, clientKey: clientKey, wantIdentity: "device-1"},
+		{name: "required client certificate", clientCA: ca.CertPath, requireClientCert: true, wantErr: true},
+		{name: "untrusted client certificate", clientCA: ca.CertPath, clientCert: untrustedCert, clientKey: untrustedKey, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := NewServerConfig(reloader, tt.clientCA, tt.requireClientCert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if cert := VerifiedClientCertificate(r.TLS); cert != nil {
+					_, _ = io.WriteString(w, Identities(cert)[0])
+				}
+			}))
+			srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+			srv.Listener = tls.NewListener(srv.Listener, config)
+			srv.Start()
+			defer srv.Close()
+			clientConfig := &tls.Config{RootCAs: rootCAs}
+			if tt.clientCert != "" {
+				r, err := NewCertificateReloader(tt.clientCert, tt.clientKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				clientConfig.GetClientCertificate = r.GetClientCertificate
+			}
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+			resp, err := c.Get("https://" + srv.Listener.Addr().String())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err != nil {
+				return
+			}
+			defer func() { _ = resp.Body.Close() }()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.wantIdentity {
+				t.Errorf("expected identity %q, got %q", tt.wantIdentity, body)
+			}
+		})
+	}
+	if _, err := NewServerConfig(reloader, "", true); err == nil {
+		t.Error("expected error for required client certificates without a CA")
+	}
+}
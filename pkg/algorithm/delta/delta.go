@@ -1,16 +1,24 @@
 package delta
 
 import (
+	"errors"
+
 	"github.com/opencontainers/go-digest"
 	"github.com/unbasical/doras/pkg/algorithm"
 	"io"
 )
 
+// ErrDigestMismatch is returned by Patcher.PatchFilesystem if the patched artifact does not match the expected digest.
+var ErrDigestMismatch = errors.New("patched artifact does not match the expected digest")
+
 // Patcher abstracts over the delta application aspect of a diffing algorithm.
 type Patcher interface {
 	algorithm.Algorithm
 	// Patch returns a reader that applies the given patch to the input.
 	Patch(old io.Reader, patch io.Reader) (io.Reader, error)
+	// PatchFilesystem applies the patch to the artifact at artifactPath.
+	// If expected is not nil the patched artifact is verified before it replaces the old one,
+	// a mismatch results in an error that wraps ErrDigestMismatch.
 	PatchFilesystem(artifactPath string, patch io.Reader, expected *digest.Digest) error
 }
 
@@ -0,0 +1,361 @@
+// Package registry contains the diffing and compression algorithms Doras supports.
+// Algorithms register under a name and a media type suffix, which identifies them in the media type of delta layers,
+// e.g. `application/bsdiff+zstd` is a bsdiff patch that is compressed with zstd.
+// Third parties can add algorithms with RegisterDelta and RegisterCompression, e.g. in the init function of a package.
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/samber/lo"
+	"github.com/unbasical/doras/internal/pkg/compression/gzip"
+	"github.com/unbasical/doras/internal/pkg/compression/zstd"
+	"github.com/unbasical/doras/internal/pkg/delta/bsdiff"
+	"github.com/unbasical/doras/internal/pkg/delta/tardiff"
+	"github.com/unbasical/doras/internal/pkg/utils/compressionutils"
+	"github.com/unbasical/doras/pkg/algorithm/compression"
+	"github.com/unbasical/doras/pkg/algorithm/delta"
+)
+
+// mediaTypePrefix is the prefix of all delta media types.
+const mediaTypePrefix = "application/"
+
+var (
+	// ErrUnknownAlgorithm is returned if an algorithm is requested that is not registered.
+	ErrUnknownAlgorithm = errors.New("unknown algorithm")
+	// ErrAlreadyRegistered is returned if an algorithm with the same name or media type suffix is already registered.
+	ErrAlreadyRegistered = errors.New("algorithm is already registered")
+	// ErrInvalidAlgorithm is returned if an algorithm cannot be registered because it is incomplete.
+	ErrInvalidAlgorithm = errors.New("invalid algorithm")
+)
+
+// PatcherOptions configure how patches are applied to the filesystem.
+type PatcherOptions struct {
+	// TempDir is the directory in which temporary files are created.
+	TempDir string
+	// KeepOldDir makes patchers replace the contents of directories instead of the directories themselves.
+	KeepOldDir bool
+	// OutputDirPermissions are the permissions of created directories.
+	OutputDirPermissions os.FileMode
+}
+
+// DeltaAlgorithm is a diffing algorithm.
+type DeltaAlgorithm struct {
+	// Name identifies the algorithm, e.g. in the accepted algorithms of delta requests.
+	// It has to match the name of the differ and the patcher.
+	Name string
+	// MediaTypeSuffix identifies the algorithm in the media type of delta layers (`application/<suffix>`).
+	// Defaults to the name.
+	MediaTypeSuffix string
+	// NewDiffer creates the delta.Differ of the algorithm.
+	NewDiffer func() delta.Differ
+	// NewPatcher creates the delta.Patcher of the algorithm.
+	NewPatcher func(opts PatcherOptions) delta.Patcher
+	// Archives is set for algorithms that only support (compressed) tar archives.
+	// Their patches produce the uncompressed archive instead of the target artifact.
+	Archives bool
+	// Compressed is set if patches are compressed already, they are not compressed any further.
+	Compressed bool
+	// Priority determines which of the accepted algorithms is chosen, higher values are preferred.
+	Priority int
+	// Default is set if the algorithm is accepted if a client does not restrict the accepted algorithms.
+	Default bool
+	// EstimateResources estimates the peak memory and temporary disk usage (in bytes) of creating a delta
+	// between artifacts of the given (compressed) sizes, it is used to enforce the quotas of the server.
+	// Algorithms without an estimate are not restricted.
+	EstimateResources func(fromSize, toSize int64) (memory, tempDisk int64)
+}
+
+// CompressionAlgorithm is a compression algorithm that is applied to patches.
+type CompressionAlgorithm struct {
+	// Name identifies the algorithm, e.g. in the accepted algorithms of delta requests.
+	// It has to match the name of the compressor and the decompressor.
+	Name string
+	// MediaTypeSuffix identifies the algorithm in the media type of delta layers (`application/<delta>+<suffix>`).
+	// Defaults to the name.
+	MediaTypeSuffix string
+	// NewCompressor creates the compression.Compressor of the algorithm.
+	NewCompressor func() compression.Compressor
+	// NewDecompressor creates the compression.Decompressor of the algorithm.
+	NewDecompressor func() compression.Decompressor
+	// Priority determines which of the accepted algorithms is chosen, higher values are preferred.
+	Priority int
+	// Default is set if the algorithm is accepted if a client does not restrict the accepted algorithms.
+	Default bool
+}
+
+var (
+	m                     sync.RWMutex
+	deltaAlgorithms       []DeltaAlgorithm
+	compressionAlgorithms []CompressionAlgorithm
+)
+
+func init() {
+	mustRegister(RegisterDelta(DeltaAlgorithm{
+		Name:      "bsdiff",
+		NewDiffer: bsdiff.NewDiffer,
+		NewPatcher: func(opts PatcherOptions) delta.Patcher {
+			return bsdiff.NewPatcherWithTempDir(opts.TempDir)
+		},
+		Default:           true,
+		EstimateResources: estimateBsdiff,
+	}))
+	mustRegister(RegisterDelta(DeltaAlgorithm{
+		Name:      "tardiff",
+		NewDiffer: tardiff.NewCreator,
+		NewPatcher: func(opts PatcherOptions) delta.Patcher {
+			return tardiff.NewPatcherWithTempDir(opts.TempDir, opts.KeepOldDir, opts.OutputDirPermissions)
+		},
+		Archives:          true,
+		Compressed:        true,
+		Priority:          10,
+		Default:           true,
+		EstimateResources: estimateTardiff,
+	}))
+	mustRegister(RegisterCompression(CompressionAlgorithm{
+		Name:            "gzip",
+		NewCompressor:   gzip.NewCompressor,
+		NewDecompressor: gzip.NewDecompressor,
+	}))
+	mustRegister(RegisterCompression(CompressionAlgorithm{
+		Name:            "zstd",
+		NewCompressor:   zstd.NewCompressor,
+		NewDecompressor: zstd.NewDecompressor,
+		Priority:        10,
+		Default:         true,
+	}))
+}
+
+// estimateBsdiff estimates the resources of bsdiff, it holds both artifacts and two suffix sorting arrays
+// (one int per byte of the old artifact each) in memory and buffers the patch in a temporary file.
+func estimateBsdiff(fromSize, toSize int64) (memory, tempDisk int64) {
+	return 17*fromSize + 2*toSize, toSize
+}
+
+// estimateTardiff estimates the resources of tardiff, it copies both archives and the uncompressed data of the
+// old archive (assuming a compression ratio of 4) to temporary files and runs bsdiff on individual files.
+func estimateTardiff(fromSize, toSize int64) (memory, tempDisk int64) {
+	memory, _ = estimateBsdiff(fromSize, toSize)
+	return memory, 5*fromSize + 2*toSize
+}
+
+func mustRegister(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// RegisterDelta adds a diffing algorithm to the registry.
+func RegisterDelta(a DeltaAlgorithm) error {
+	if a.Name == "" || a.NewDiffer == nil || a.NewPatcher == nil {
+		return fmt.Errorf("%w: %q requires a name, a differ and a patcher", ErrInvalidAlgorithm, a.Name)
+	}
+	if a.MediaTypeSuffix == "" {
+		a.MediaTypeSuffix = a.Name
+	}
+	if strings.ContainsAny(a.MediaTypeSuffix, "+/") {
+		return fmt.Errorf("%w: media type suffix %q must not contain '+' or '/'", ErrInvalidAlgorithm, a.MediaTypeSuffix)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if isRegistered(a.Name, a.MediaTypeSuffix) {
+		return fmt.Errorf("%w: %q", ErrAlreadyRegistered, a.Name)
+	}
+	deltaAlgorithms = append(deltaAlgorithms, a)
+	return nil
+}
+
+// RegisterCompression adds a compression algorithm to the registry.
+func RegisterCompression(a CompressionAlgorithm) error {
+	if a.Name == "" || a.NewCompressor == nil || a.NewDecompressor == nil {
+		return fmt.Errorf("%w: %q requires a name, a compressor and a decompressor", ErrInvalidAlgorithm, a.Name)
+	}
+	if a.MediaTypeSuffix == "" {
+		a.MediaTypeSuffix = a.Name
+	}
+	if strings.ContainsAny(a.MediaTypeSuffix, "+/") {
+		return fmt.Errorf("%w: media type suffix %q must not contain '+' or '/'", ErrInvalidAlgorithm, a.MediaTypeSuffix)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if a.Name == "none" || isRegistered(a.Name, a.MediaTypeSuffix) {
+		return fmt.Errorf("%w: %q", ErrAlreadyRegistered, a.Name)
+	}
+	compressionAlgorithms = append(compressionAlgorithms, a)
+	return nil
+}
+
+// isRegistered checks whether the name or suffix is taken, names are unique across differs and compressors
+// because they share the list of accepted algorithms.
+func isRegistered(name, suffix string) bool {
+	for _, a := range deltaAlgorithms {
+		if a.Name == name || a.MediaTypeSuffix == suffix {
+			return true
+		}
+	}
+	for _, a := range compressionAlgorithms {
+		if a.Name == name || a.MediaTypeSuffix == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// Delta returns the diffing algorithm with the given name.
+func Delta(name string) (DeltaAlgorithm, error) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, a := range deltaAlgorithms {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+	return DeltaAlgorithm{}, fmt.Errorf("%w: differ %q (supported: %s)", ErrUnknownAlgorithm, name, strings.Join(deltaNamesLocked(), ", "))
+}
+
+// Compression returns the compression algorithm with the given name.
+// The empty name and `none` refer to an algorithm that does not compress at all.
+func Compression(name string) (CompressionAlgorithm, error) {
+	if name == "" || name == "none" {
+		return noCompression(), nil
+	}
+	m.RLock()
+	defer m.RUnlock()
+	for _, a := range compressionAlgorithms {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+	return CompressionAlgorithm{}, fmt.Errorf("%w: compressor %q (supported: %s)", ErrUnknownAlgorithm, name, strings.Join(compressionNamesLocked(), ", "))
+}
+
+// noCompression returns the algorithm that is used for uncompressed patches, it is not part of the registry.
+func noCompression() CompressionAlgorithm {
+	return CompressionAlgorithm{
+		NewCompressor:   compressionutils.NewNopCompressor,
+		NewDecompressor: compressionutils.NewNopDecompressor,
+	}
+}
+
+// ParseMediaType returns the algorithms that are identified by the media type of a delta layer,
+// e.g. `application/bsdiff+zstd`.
+func ParseMediaType(mediaType string) (DeltaAlgorithm, CompressionAlgorithm, error) {
+	trimmed, ok := strings.CutPrefix(mediaType, mediaTypePrefix)
+	if !ok {
+		return DeltaAlgorithm{}, CompressionAlgorithm{}, fmt.Errorf("%w: media type %q", ErrUnknownAlgorithm, mediaType)
+	}
+	deltaSuffix, compressionSuffix, isCompressed := strings.Cut(trimmed, "+")
+	m.RLock()
+	defer m.RUnlock()
+	i := slices.IndexFunc(deltaAlgorithms, func(a DeltaAlgorithm) bool { return a.MediaTypeSuffix == deltaSuffix })
+	if i < 0 {
+		return DeltaAlgorithm{}, CompressionAlgorithm{}, fmt.Errorf("%w: differ in media type %q", ErrUnknownAlgorithm, mediaType)
+	}
+	if !isCompressed {
+		return deltaAlgorithms[i], noCompression(), nil
+	}
+	j := slices.IndexFunc(compressionAlgorithms, func(a CompressionAlgorithm) bool { return a.MediaTypeSuffix == compressionSuffix })
+	if j < 0 {
+		return DeltaAlgorithm{}, CompressionAlgorithm{}, fmt.Errorf("%w: compressor in media type %q", ErrUnknownAlgorithm, mediaType)
+	}
+	return deltaAlgorithms[i], compressionAlgorithms[j], nil
+}
+
+// MediaType returns the media type of delta layers that were created with the given algorithms.
+// The compression algorithm is omitted if the patch is not compressed.
+func MediaType(d DeltaAlgorithm, c CompressionAlgorithm) string {
+	mediaType := mediaTypePrefix + d.MediaTypeSuffix
+	if c.MediaTypeSuffix != "" {
+		mediaType += "+" + c.MediaTypeSuffix
+	}
+	return mediaType
+}
+
+// Differs returns the names of the registered diffing algorithms.
+func Differs() []string {
+	m.RLock()
+	defer m.RUnlock()
+	return deltaNamesLocked()
+}
+
+// Compressors returns the names of the registered compression algorithms.
+func Compressors() []string {
+	m.RLock()
+	defer m.RUnlock()
+	return compressionNamesLocked()
+}
+
+// IsSupported checks whether an algorithm with the given name is registered.
+func IsSupported(name string) bool {
+	m.RLock()
+	defer m.RUnlock()
+	return slices.Contains(deltaNamesLocked(), name) || slices.Contains(compressionNamesLocked(), name)
+}
+
+// DefaultAlgorithms returns the names of the algorithms that are accepted if a client does not restrict them.
+func DefaultAlgorithms() []string {
+	m.RLock()
+	defer m.RUnlock()
+	var names []string
+	for _, a := range deltaAlgorithms {
+		if a.Default {
+			names = append(names, a.Name)
+		}
+	}
+	for _, a := range compressionAlgorithms {
+		if a.Default {
+			names = append(names, a.Name)
+		}
+	}
+	return names
+}
+
+// Choose returns the accepted algorithms with the highest priority.
+// Algorithms that require archives are only chosen if isArchive is set.
+// If no diffing algorithm is accepted the generic algorithm with the highest priority is used (bsdiff by default),
+// if no compression algorithm is accepted (or the patches are already compressed) patches are not compressed.
+func Choose(acceptedAlgorithms []string, isArchive bool) (DeltaAlgorithm, CompressionAlgorithm) {
+	m.RLock()
+	defer m.RUnlock()
+	var fallback, chosen *DeltaAlgorithm
+	for i := range deltaAlgorithms {
+		a := &deltaAlgorithms[i]
+		if a.Archives && !isArchive {
+			continue
+		}
+		if fallback == nil || (!a.Archives && (fallback.Archives || a.Priority > fallback.Priority)) {
+			fallback = a
+		}
+		if slices.Contains(acceptedAlgorithms, a.Name) && (chosen == nil || a.Priority > chosen.Priority) {
+			chosen = a
+		}
+	}
+	if chosen == nil {
+		// bsdiff is always registered, hence there is a fallback.
+		chosen = fallback
+	}
+	compressor := noCompression()
+	if chosen.Compressed {
+		return *chosen, compressor
+	}
+	found := false
+	for _, c := range compressionAlgorithms {
+		if slices.Contains(acceptedAlgorithms, c.Name) && (!found || c.Priority > compressor.Priority) {
+			compressor, found = c, true
+		}
+	}
+	return *chosen, compressor
+}
+
+func deltaNamesLocked() []string {
+	return lo.Map(deltaAlgorithms, func(a DeltaAlgorithm, _ int) string { return a.Name })
+}
+
+func compressionNamesLocked() []string {
+	return lo.Map(compressionAlgorithms, func(a CompressionAlgorithm, _ int) string { return a.Name })
+}
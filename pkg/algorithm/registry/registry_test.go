@@ -0,0 +1,145 @@
+package registry
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/unbasical/doras/internal/pkg/delta/bsdiff"
+	"github.com/unbasical/doras/internal/pkg/utils/compressionutils"
+	"github.com/unbasical/doras/pkg/algorithm/delta"
+)
+
+func TestParseMediaType(t *testing.T) {
+	tests := []struct {
+		name           string
+		mediaType      string
+		wantDelta      string
+		wantCompressor string
+		wantErr        error
+	}{
+		{name: "uncompressed", mediaType: "application/bsdiff", wantDelta: "bsdiff"},
+		{name: "compressed", mediaType: "application/bsdiff+zstd", wantDelta: "bsdiff", wantCompressor: "zstd"},
+		{name: "tardiff", mediaType: "application/tardiff+gzip", wantDelta: "tardiff", wantCompressor: "gzip"},
+		{name: "unknown differ", mediaType: "application/foo+zstd", wantErr: ErrUnknownAlgorithm},
+		{name: "unknown compressor", mediaType: "application/bsdiff+foo", wantErr: ErrUnknownAlgorithm},
+		{name: "missing prefix", mediaType: "bsdiff", wantErr: ErrUnknownAlgorithm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, c, err := ParseMediaType(tt.mediaType)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if d.Name != tt.wantDelta || c.Name != tt.wantCompressor {
+				t.Errorf("expected %s+%s, got %s+%s", tt.wantDelta, tt.wantCompressor, d.Name, c.Name)
+			}
+			if got := MediaType(d, c); got != tt.mediaType {
+				t.Errorf("expected media type %s, got %s", tt.mediaType, got)
+			}
+		})
+	}
+}
+
+func TestChoose(t *testing.T) {
+	tests := []struct {
+		name           string
+		accepted       []string
+		isArchive      bool
+		wantDelta      string
+		wantCompressor string
+	}{
+		{name: "defaults", accepted: DefaultAlgorithms(), wantDelta: "bsdiff", wantCompressor: "zstd"},
+		{name: "defaults for archives", accepted: DefaultAlgorithms(), isArchive: true, wantDelta: "tardiff"},
+		{name: "gzip", accepted: []string{"bsdiff", "gzip"}, wantDelta: "bsdiff", wantCompressor: "gzip"},
+		{name: "compressor priority", accepted: []string{"bsdiff", "gzip", "zstd"}, wantDelta: "bsdiff", wantCompressor: "zstd"},
+		{name: "uncompressed", accepted: []string{"bsdiff"}, wantDelta: "bsdiff"},
+		{name: "bsdiff for archives", accepted: []string{"bsdiff", "gzip"}, isArchive: true, wantDelta: "bsdiff", wantCompressor: "gzip"},
+		{name: "tardiff without archive", accepted: []string{"tardiff", "zstd"}, wantDelta: "bsdiff", wantCompressor: "zstd"},
+		{name: "no differ accepted", accepted: []string{"zstd"}, wantDelta: "bsdiff", wantCompressor: "zstd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, c := Choose(tt.accepted, tt.isArchive)
+			if d.Name != tt.wantDelta || c.Name != tt.wantCompressor {
+				t.Errorf("expected %s+%s, got %s+%s", tt.wantDelta, tt.wantCompressor, d.Name, c.Name)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	if _, err := Delta("foo"); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("expected ErrUnknownAlgorithm, got %v", err)
+	}
+	if _, err := Compression("foo"); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("expected ErrUnknownAlgorithm, got %v", err)
+	}
+	for _, name := range []string{"", "none"} {
+		c, err := Compression(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.MediaTypeSuffix != "" || c.NewCompressor == nil || c.NewDecompressor == nil {
+			t.Errorf("expected no compression for %q, got %+v", name, c)
+		}
+	}
+	if !IsSupported("tardiff") || !IsSupported("gzip") || IsSupported("none") || IsSupported("foo") {
+		t.Error("unexpected result of IsSupported")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	newPatcher := func(PatcherOptions) delta.Patcher { return bsdiff.NewPatcher() }
+	tests := []struct {
+		name    string
+		delta   *DeltaAlgorithm
+		compr   *CompressionAlgorithm
+		wantErr error
+	}{
+		{name: "duplicate differ", delta: &DeltaAlgorithm{Name: "bsdiff", NewDiffer: bsdiff.NewDiffer, NewPatcher: newPatcher}, wantErr: ErrAlreadyRegistered},
+		{name: "duplicate suffix", delta: &DeltaAlgorithm{Name: "bsdiff2", MediaTypeSuffix: "bsdiff", NewDiffer: bsdiff.NewDiffer, NewPatcher: newPatcher}, wantErr: ErrAlreadyRegistered},
+		{name: "name of compressor", delta: &DeltaAlgorithm{Name: "zstd", MediaTypeSuffix: "foo", NewDiffer: bsdiff.NewDiffer, NewPatcher: newPatcher}, wantErr: ErrAlreadyRegistered},
+		{name: "missing patcher", delta: &DeltaAlgorithm{Name: "foo", NewDiffer: bsdiff.NewDiffer}, wantErr: ErrInvalidAlgorithm},
+		{name: "invalid suffix", delta: &DeltaAlgorithm{Name: "foo", MediaTypeSuffix: "foo+bar", NewDiffer: bsdiff.NewDiffer, NewPatcher: newPatcher}, wantErr: ErrInvalidAlgorithm},
+		{name: "none", compr: &CompressionAlgorithm{Name: "none", NewCompressor: compressionutils.NewNopCompressor, NewDecompressor: compressionutils.NewNopDecompressor}, wantErr: ErrAlreadyRegistered},
+		{name: "missing decompressor", compr: &CompressionAlgorithm{Name: "foo", NewCompressor: compressionutils.NewNopCompressor}, wantErr: ErrInvalidAlgorithm},
+		// the following algorithms are not chosen by default because of their priority
+		{name: "custom differ", delta: &DeltaAlgorithm{Name: "testdiff", MediaTypeSuffix: "vnd.test.diff", NewDiffer: bsdiff.NewDiffer, NewPatcher: newPatcher, Priority: -1}},
+		{name: "custom compressor", compr: &CompressionAlgorithm{Name: "testcompress", NewCompressor: compressionutils.NewNopCompressor, NewDecompressor: compressionutils.NewNopDecompressor, Priority: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.delta != nil {
+				err = RegisterDelta(*tt.delta)
+			} else {
+				err = RegisterCompression(*tt.compr)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	if !slices.Contains(Differs(), "testdiff") || !slices.Contains(Compressors(), "testcompress") {
+		t.Fatalf("custom algorithms are not listed: %v, %v", Differs(), Compressors())
+	}
+	d, c, err := ParseMediaType("application/vnd.test.diff+testcompress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "testdiff" || c.Name != "testcompress" {
+		t.Errorf("unexpected algorithms %s+%s", d.Name, c.Name)
+	}
+	d, c = Choose([]string{"testdiff", "testcompress"}, false)
+	if d.Name != "testdiff" || c.Name != "testcompress" {
+		t.Errorf("expected custom algorithms to be chosen, got %s+%s", d.Name, c.Name)
+	}
+	if slices.Contains(DefaultAlgorithms(), "testdiff") {
+		t.Error("custom algorithm should not be accepted by default")
+	}
+}
@@ -0,0 +1,471 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: api/doras/v1/doras.proto
+
+package dorasv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// DeltaStatus is the status of a requested delta.
+type DeltaStatus int32
+
+const (
+	DeltaStatus_DELTA_STATUS_UNSPECIFIED DeltaStatus = 0
+	// The delta has been created.
+	DeltaStatus_DELTA_STATUS_READY DeltaStatus = 1
+	// The delta is being created.
+	DeltaStatus_DELTA_STATUS_PENDING DeltaStatus = 2
+	// The images are identical, there is no delta.
+	DeltaStatus_DELTA_STATUS_IDENTICAL DeltaStatus = 3
+)
+
+// Enum value maps for DeltaStatus.
+var (
+	DeltaStatus_name = map[int32]string{
+		0: "DELTA_STATUS_UNSPECIFIED",
+		1: "DELTA_STATUS_READY",
+		2: "DELTA_STATUS_PENDING",
+		3: "DELTA_STATUS_IDENTICAL",
+	}
+	DeltaStatus_value = map[string]int32{
+		"DELTA_STATUS_UNSPECIFIED": 0,
+		"DELTA_STATUS_READY":       1,
+		"DELTA_STATUS_PENDING":     2,
+		"DELTA_STATUS_IDENTICAL":   3,
+	}
+)
+
+func (x DeltaStatus) Enum() *DeltaStatus {
+	p := new(DeltaStatus)
+	*p = x
+	return p
+}
+
+func (x DeltaStatus) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (DeltaStatus) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_doras_v1_doras_proto_enumTypes[0].Descriptor()
+}
+
+func (DeltaStatus) Type() protoreflect.EnumType {
+	return &file_api_doras_v1_doras_proto_enumTypes[0]
+}
+
+func (x DeltaStatus) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use DeltaStatus.Descriptor instead.
+func (DeltaStatus) EnumDescriptor() ([]byte, []int) {
+	return file_api_doras_v1_doras_proto_rawDescGZIP(), []int{0}
+}
+
+type ReadDeltaRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Image identified by a digest from which a delta is requested.
+	From string `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"`
+	// Image identified by a tag or a digest to which a delta is requested.
+	To string `protobuf:"bytes,2,opt,name=to,proto3" json:"to,omitempty"`
+	// Accepted algorithms, the default algorithms are accepted if it is empty.
+	AcceptedAlgorithms []string `protobuf:"bytes,3,rep,name=accepted_algorithms,json=acceptedAlgorithms,proto3" json:"accepted_algorithms,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
+}
+
+func (x *ReadDeltaRequest) Reset() {
+	*x = ReadDeltaRequest{}
+	mi := &file_api_doras_v1_doras_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReadDeltaRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReadDeltaRequest) ProtoMessage() {}
+
+func (x *ReadDeltaRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_doras_v1_doras_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReadDeltaRequest.ProtoReflect.Descriptor instead.
+func (*ReadDeltaRequest) Descriptor() ([]byte, []int) {
+	return file_api_doras_v1_doras_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ReadDeltaRequest) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *ReadDeltaRequest) GetTo() string {
+	if x != nil {
+		return x.To
+	}
+	return ""
+}
+
+func (x *ReadDeltaRequest) GetAcceptedAlgorithms() []string {
+	if x != nil {
+		return x.AcceptedAlgorithms
+	}
+	return nil
+}
+
+type ReadDeltaResponse struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Status DeltaStatus            `protobuf:"varint,1,opt,name=status,proto3,enum=doras.v1.DeltaStatus" json:"status,omitempty"`
+	// Image the delta leads to, set if the delta is ready.
+	TargetImage string `protobuf:"bytes,2,opt,name=target_image,json=targetImage,proto3" json:"target_image,omitempty"`
+	// Location of the delta, set if the delta is ready.
+	DeltaImage string `protobuf:"bytes,3,opt,name=delta_image,json=deltaImage,proto3" json:"delta_image,omitempty"`
+	// Time at which the delta is expected to be created (RFC 3339), set if the delta is pending and the server can estimate it.
+	EstimatedCompletion string `protobuf:"bytes,4,opt,name=estimated_completion,json=estimatedCompletion,proto3" json:"estimated_completion,omitempty"`
+	unknownFields       protoimpl.UnknownFields
+	sizeCache           protoimpl.SizeCache
+}
+
+func (x *ReadDeltaResponse) Reset() {
+	*x = ReadDeltaResponse{}
+	mi := &file_api_doras_v1_doras_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReadDeltaResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReadDeltaResponse) ProtoMessage() {}
+
+func (x *ReadDeltaResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_doras_v1_doras_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReadDeltaResponse.ProtoReflect.Descriptor instead.
+func (*ReadDeltaResponse) Descriptor() ([]byte, []int) {
+	return file_api_doras_v1_doras_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ReadDeltaResponse) GetStatus() DeltaStatus {
+	if x != nil {
+		return x.Status
+	}
+	return DeltaStatus_DELTA_STATUS_UNSPECIFIED
+}
+
+func (x *ReadDeltaResponse) GetTargetImage() string {
+	if x != nil {
+		return x.TargetImage
+	}
+	return ""
+}
+
+func (x *ReadDeltaResponse) GetDeltaImage() string {
+	if x != nil {
+		return x.DeltaImage
+	}
+	return ""
+}
+
+func (x *ReadDeltaResponse) GetEstimatedCompletion() string {
+	if x != nil {
+		return x.EstimatedCompletion
+	}
+	return ""
+}
+
+type CapabilitiesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CapabilitiesRequest) Reset() {
+	*x = CapabilitiesRequest{}
+	mi := &file_api_doras_v1_doras_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CapabilitiesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CapabilitiesRequest) ProtoMessage() {}
+
+func (x *CapabilitiesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_doras_v1_doras_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CapabilitiesRequest.ProtoReflect.Descriptor instead.
+func (*CapabilitiesRequest) Descriptor() ([]byte, []int) {
+	return file_api_doras_v1_doras_proto_rawDescGZIP(), []int{2}
+}
+
+type CapabilitiesResponse struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Version     string                 `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	Differs     []string               `protobuf:"bytes,2,rep,name=differs,proto3" json:"differs,omitempty"`
+	Compressors []string               `protobuf:"bytes,3,rep,name=compressors,proto3" json:"compressors,omitempty"`
+	// Algorithms that are used if a request does not provide accepted algorithms.
+	DefaultAlgorithms []string `protobuf:"bytes,4,rep,name=default_algorithms,json=defaultAlgorithms,proto3" json:"default_algorithms,omitempty"`
+	// Deltas are not created for larger artifacts (in bytes), 0 if there is no limit.
+	MaxArtifactSize int64 `protobuf:"varint,5,opt,name=max_artifact_size,json=maxArtifactSize,proto3" json:"max_artifact_size,omitempty"`
+	// Longest duration in seconds for which WatchDelta waits for deltas.
+	MaxWait int64 `protobuf:"varint,6,opt,name=max_wait,json=maxWait,proto3" json:"max_wait,omitempty"`
+	// Set if requests without credentials are rejected.
+	AuthRequired bool `protobuf:"varint,7,opt,name=auth_required,json=authRequired,proto3" json:"auth_required,omitempty"`
+	// Schemes of the credentials in the authorization metadata, e.g. Bearer and Basic.
+	AuthSchemes []string `protobuf:"bytes,8,rep,name=auth_schemes,json=authSchemes,proto3" json:"auth_schemes,omitempty"`
+	// Set if the server verifies client certificates that identify devices.
+	ClientCertificates bool `protobuf:"varint,9,opt,name=client_certificates,json=clientCertificates,proto3" json:"client_certificates,omitempty"`
+	// Set if the server issues device tokens (POST /api/v1/token of the HTTP API).
+	TokenService  bool `protobuf:"varint,10,opt,name=token_service,json=tokenService,proto3" json:"token_service,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CapabilitiesResponse) Reset() {
+	*x = CapabilitiesResponse{}
+	mi := &file_api_doras_v1_doras_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CapabilitiesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CapabilitiesResponse) ProtoMessage() {}
+
+func (x *CapabilitiesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_doras_v1_doras_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CapabilitiesResponse.ProtoReflect.Descriptor instead.
+func (*CapabilitiesResponse) Descriptor() ([]byte, []int) {
+	return file_api_doras_v1_doras_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *CapabilitiesResponse) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *CapabilitiesResponse) GetDiffers() []string {
+	if x != nil {
+		return x.Differs
+	}
+	return nil
+}
+
+func (x *CapabilitiesResponse) GetCompressors() []string {
+	if x != nil {
+		return x.Compressors
+	}
+	return nil
+}
+
+func (x *CapabilitiesResponse) GetDefaultAlgorithms() []string {
+	if x != nil {
+		return x.DefaultAlgorithms
+	}
+	return nil
+}
+
+func (x *CapabilitiesResponse) GetMaxArtifactSize() int64 {
+	if x != nil {
+		return x.MaxArtifactSize
+	}
+	return 0
+}
+
+func (x *CapabilitiesResponse) GetMaxWait() int64 {
+	if x != nil {
+		return x.MaxWait
+	}
+	return 0
+}
+
+func (x *CapabilitiesResponse) GetAuthRequired() bool {
+	if x != nil {
+		return x.AuthRequired
+	}
+	return false
+}
+
+func (x *CapabilitiesResponse) GetAuthSchemes() []string {
+	if x != nil {
+		return x.AuthSchemes
+	}
+	return nil
+}
+
+func (x *CapabilitiesResponse) GetClientCertificates() bool {
+	if x != nil {
+		return x.ClientCertificates
+	}
+	return false
+}
+
+func (x *CapabilitiesResponse) GetTokenService() bool {
+	if x != nil {
+		return x.TokenService
+	}
+	return false
+}
+
+var File_api_doras_v1_doras_proto protoreflect.FileDescriptor
+
+const file_api_doras_v1_doras_proto_rawDesc = "" +
+	"\n" +
+	"\x18api/doras/v1/doras.proto\x12\bdoras.v1\"g\n" +
+	"\x10ReadDeltaRequest\x12\x12\n" +
+	"\x04from\x18\x01 \x01(\tR\x04from\x12\x0e\n" +
+	"\x02to\x18\x02 \x01(\tR\x02to\x12/\n" +
+	"\x13accepted_algorithms\x18\x03 \x03(\tR\x12acceptedAlgorithms\"\xb9\x01\n" +
+	"\x11ReadDeltaResponse\x12-\n" +
+	"\x06status\x18\x01 \x01(\x0e2\x15.doras.v1.DeltaStatusR\x06status\x12!\n" +
+	"\ftarget_image\x18\x02 \x01(\tR\vtargetImage\x12\x1f\n" +
+	"\vdelta_image\x18\x03 \x01(\tR\n" +
+	"deltaImage\x121\n" +
+	"\x14estimated_completion\x18\x04 \x01(\tR\x13estimatedCompletion\"\x15\n" +
+	"\x13CapabilitiesRequest\"\x80\x03\n" +
+	"\x14CapabilitiesResponse\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\tR\aversion\x12\x18\n" +
+	"\adiffers\x18\x02 \x03(\tR\adiffers\x12 \n" +
+	"\vcompressors\x18\x03 \x03(\tR\vcompressors\x12-\n" +
+	"\x12default_algorithms\x18\x04 \x03(\tR\x11defaultAlgorithms\x12*\n" +
+	"\x11max_artifact_size\x18\x05 \x01(\x03R\x0fmaxArtifactSize\x12\x19\n" +
+	"\bmax_wait\x18\x06 \x01(\x03R\amaxWait\x12#\n" +
+	"\rauth_required\x18\a \x01(\bR\fauthRequired\x12!\n" +
+	"\fauth_schemes\x18\b \x03(\tR\vauthSchemes\x12/\n" +
+	"\x13client_certificates\x18\t \x01(\bR\x12clientCertificates\x12#\n" +
+	"\rtoken_service\x18\n" +
+	" \x01(\bR\ftokenService*y\n" +
+	"\vDeltaStatus\x12\x1c\n" +
+	"\x18DELTA_STATUS_UNSPECIFIED\x10\x00\x12\x16\n" +
+	"\x12DELTA_STATUS_READY\x10\x01\x12\x18\n" +
+	"\x14DELTA_STATUS_PENDING\x10\x02\x12\x1a\n" +
+	"\x16DELTA_STATUS_IDENTICAL\x10\x032\xec\x01\n" +
+	"\fDeltaService\x12D\n" +
+	"\tReadDelta\x12\x1a.doras.v1.ReadDeltaRequest\x1a\x1b.doras.v1.ReadDeltaResponse\x12G\n" +
+	"\n" +
+	"WatchDelta\x12\x1a.doras.v1.ReadDeltaRequest\x1a\x1b.doras.v1.ReadDeltaResponse0\x01\x12M\n" +
+	"\fCapabilities\x12\x1d.doras.v1.CapabilitiesRequest\x1a\x1e.doras.v1.CapabilitiesResponseB5Z3github.com/unbasical/doras/pkg/api/doras/v1;dorasv1b\x06proto3"
+
+var (
+	file_api_doras_v1_doras_proto_rawDescOnce sync.Once
+	file_api_doras_v1_doras_proto_rawDescData []byte
+)
+
+func file_api_doras_v1_doras_proto_rawDescGZIP() []byte {
+	file_api_doras_v1_doras_proto_rawDescOnce.Do(func() {
+		file_api_doras_v1_doras_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_api_doras_v1_doras_proto_rawDesc), len(file_api_doras_v1_doras_proto_rawDesc)))
+	})
+	return file_api_doras_v1_doras_proto_rawDescData
+}
+
+var file_api_doras_v1_doras_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_api_doras_v1_doras_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_api_doras_v1_doras_proto_goTypes = []any{
+	(DeltaStatus)(0),             // 0: doras.v1.DeltaStatus
+	(*ReadDeltaRequest)(nil),     // 1: doras.v1.ReadDeltaRequest
+	(*ReadDeltaResponse)(nil),    // 2: doras.v1.ReadDeltaResponse
+	(*CapabilitiesRequest)(nil),  // 3: doras.v1.CapabilitiesRequest
+	(*CapabilitiesResponse)(nil), // 4: doras.v1.CapabilitiesResponse
+}
+var file_api_doras_v1_doras_proto_depIdxs = []int32{
+	0, // 0: doras.v1.ReadDeltaResponse.status:type_name -> doras.v1.DeltaStatus
+	1, // 1: doras.v1.DeltaService.ReadDelta:input_type -> doras.v1.ReadDeltaRequest
+	1, // 2: doras.v1.DeltaService.WatchDelta:input_type -> doras.v1.ReadDeltaRequest
+	3, // 3: doras.v1.DeltaService.Capabilities:input_type -> doras.v1.CapabilitiesRequest
+	2, // 4: doras.v1.DeltaService.ReadDelta:output_type -> doras.v1.ReadDeltaResponse
+	2, // 5: doras.v1.DeltaService.WatchDelta:output_type -> doras.v1.ReadDeltaResponse
+	4, // 6: doras.v1.DeltaService.Capabilities:output_type -> doras.v1.CapabilitiesResponse
+	4, // [4:7] is the sub-list for method output_type
+	1, // [1:4] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_api_doras_v1_doras_proto_init() }
+func file_api_doras_v1_doras_proto_init() {
+	if File_api_doras_v1_doras_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_doras_v1_doras_proto_rawDesc), len(file_api_doras_v1_doras_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_api_doras_v1_doras_proto_goTypes,
+		DependencyIndexes: file_api_doras_v1_doras_proto_depIdxs,
+		EnumInfos:         file_api_doras_v1_doras_proto_enumTypes,
+		MessageInfos:      file_api_doras_v1_doras_proto_msgTypes,
+	}.Build()
+	File_api_doras_v1_doras_proto = out.File
+	file_api_doras_v1_doras_proto_goTypes = nil
+	file_api_doras_v1_doras_proto_depIdxs = nil
+}
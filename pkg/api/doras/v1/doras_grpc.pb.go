@@ -0,0 +1,215 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: api/doras/v1/doras.proto
+
+package dorasv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	DeltaService_ReadDelta_FullMethodName    = "/doras.v1.DeltaService/ReadDelta"
+	DeltaService_WatchDelta_FullMethodName   = "/doras.v1.DeltaService/WatchDelta"
+	DeltaService_Capabilities_FullMethodName = "/doras.v1.DeltaService/Capabilities"
+)
+
+// DeltaServiceClient is the client API for DeltaService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// DeltaService serves deltas between OCI images, it is the gRPC counterpart of the HTTP API (see docs/cloud-api.md).
+// Requests are authenticated with the authorization metadata (Bearer or Basic) or client certificates.
+type DeltaServiceClient interface {
+	// ReadDelta requests a delta, it does not wait for the delta to be created.
+	ReadDelta(ctx context.Context, in *ReadDeltaRequest, opts ...grpc.CallOption) (*ReadDeltaResponse, error)
+	// WatchDelta requests a delta and streams its status until it has been created or the server stops waiting.
+	// The stream ends after the first response that is not pending.
+	WatchDelta(ctx context.Context, in *ReadDeltaRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ReadDeltaResponse], error)
+	// Capabilities describes the server, clients use it to negotiate the accepted algorithms.
+	Capabilities(ctx context.Context, in *CapabilitiesRequest, opts ...grpc.CallOption) (*CapabilitiesResponse, error)
+}
+
+type deltaServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDeltaServiceClient(cc grpc.ClientConnInterface) DeltaServiceClient {
+	return &deltaServiceClient{cc}
+}
+
+func (c *deltaServiceClient) ReadDelta(ctx context.Context, in *ReadDeltaRequest, opts ...grpc.CallOption) (*ReadDeltaResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReadDeltaResponse)
+	err := c.cc.Invoke(ctx, DeltaService_ReadDelta_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deltaServiceClient) WatchDelta(ctx context.Context, in *ReadDeltaRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ReadDeltaResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &DeltaService_ServiceDesc.Streams[0], DeltaService_WatchDelta_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ReadDeltaRequest, ReadDeltaResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type DeltaService_WatchDeltaClient = grpc.ServerStreamingClient[ReadDeltaResponse]
+
+func (c *deltaServiceClient) Capabilities(ctx context.Context, in *CapabilitiesRequest, opts ...grpc.CallOption) (*CapabilitiesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CapabilitiesResponse)
+	err := c.cc.Invoke(ctx, DeltaService_Capabilities_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeltaServiceServer is the server API for DeltaService service.
+// All implementations must embed UnimplementedDeltaServiceServer
+// for forward compatibility.
+//
+// DeltaService serves deltas between OCI images, it is the gRPC counterpart of the HTTP API (see docs/cloud-api.md).
+// Requests are authenticated with the authorization metadata (Bearer or Basic) or client certificates.
+type DeltaServiceServer interface {
+	// ReadDelta requests a delta, it does not wait for the delta to be created.
+	ReadDelta(context.Context, *ReadDeltaRequest) (*ReadDeltaResponse, error)
+	// WatchDelta requests a delta and streams its status until it has been created or the server stops waiting.
+	// The stream ends after the first response that is not pending.
+	WatchDelta(*ReadDeltaRequest, grpc.ServerStreamingServer[ReadDeltaResponse]) error
+	// Capabilities describes the server, clients use it to negotiate the accepted algorithms.
+	Capabilities(context.Context, *CapabilitiesRequest) (*CapabilitiesResponse, error)
+	mustEmbedUnimplementedDeltaServiceServer()
+}
+
+// UnimplementedDeltaServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedDeltaServiceServer struct{}
+
+func (UnimplementedDeltaServiceServer) ReadDelta(context.Context, *ReadDeltaRequest) (*ReadDeltaResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReadDelta not implemented")
+}
+func (UnimplementedDeltaServiceServer) WatchDelta(*ReadDeltaRequest, grpc.ServerStreamingServer[ReadDeltaResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchDelta not implemented")
+}
+func (UnimplementedDeltaServiceServer) Capabilities(context.Context, *CapabilitiesRequest) (*CapabilitiesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Capabilities not implemented")
+}
+func (UnimplementedDeltaServiceServer) mustEmbedUnimplementedDeltaServiceServer() {}
+func (UnimplementedDeltaServiceServer) testEmbeddedByValue()                      {}
+
+// UnsafeDeltaServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DeltaServiceServer will
+// result in compilation errors.
+type UnsafeDeltaServiceServer interface {
+	mustEmbedUnimplementedDeltaServiceServer()
+}
+
+func RegisterDeltaServiceServer(s grpc.ServiceRegistrar, srv DeltaServiceServer) {
+	// If the following call pancis, it indicates UnimplementedDeltaServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&DeltaService_ServiceDesc, srv)
+}
+
+func _DeltaService_ReadDelta_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReadDeltaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeltaServiceServer).ReadDelta(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeltaService_ReadDelta_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeltaServiceServer).ReadDelta(ctx, req.(*ReadDeltaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DeltaService_WatchDelta_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReadDeltaRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DeltaServiceServer).WatchDelta(m, &grpc.GenericServerStream[ReadDeltaRequest, ReadDeltaResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type DeltaService_WatchDeltaServer = grpc.ServerStreamingServer[ReadDeltaResponse]
+
+func _DeltaService_Capabilities_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CapabilitiesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeltaServiceServer).Capabilities(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeltaService_Capabilities_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeltaServiceServer).Capabilities(ctx, req.(*CapabilitiesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// DeltaService_ServiceDesc is the grpc.ServiceDesc for DeltaService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DeltaService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "doras.v1.DeltaService",
+	HandlerType: (*DeltaServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ReadDelta",
+			Handler:    _DeltaService_ReadDelta_Handler,
+		},
+		{
+			MethodName: "Capabilities",
+			Handler:    _DeltaService_Capabilities_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchDelta",
+			Handler:       _DeltaService_WatchDelta_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/doras/v1/doras.proto",
+}
@@ -7,6 +7,12 @@ import (
 	"time"
 )
 
+// ErrMaxRetries is returned once the client has to give up retrying.
+var ErrMaxRetries = errors.New("maximum retries exceeded")
+
+// DefaultMaxRetries is the number of retries of the default Strategy and of the default Retries.
+const DefaultMaxRetries = 40
+
 // exponentialBackoffWithJitter implements the Strategy interface
 type exponentialBackoffWithJitter struct {
 	baseDelay      time.Duration // Base delay between retries (e.g., 100ms)
@@ -33,7 +39,7 @@ func NewExponentialBackoffWithJitter(baseDelay, maxDelay time.Duration, maxAttem
 // Wait calculates the next backoff time with exponential backoff and jitter
 func (e *exponentialBackoffWithJitter) Wait() error {
 	if e.currentAttempt >= e.maxAttempt {
-		return errors.New("maximum retries exceeded")
+		return ErrMaxRetries
 	}
 	// Calculate the exponential backoff delay
 	var delay time.Duration
@@ -71,5 +77,26 @@ type Strategy interface {
 func DefaultBackoff() Strategy {
 	const defaultBaseDelay = 100 * time.Millisecond
 	const defaultMaxDelay = 30 * time.Second
-	return NewExponentialBackoffWithJitter(defaultBaseDelay, defaultMaxDelay, 40)
+	return NewExponentialBackoffWithJitter(defaultBaseDelay, defaultMaxDelay, DefaultMaxRetries)
+}
+
+// Retries counts the retries of a request whose delay is chosen by the server (e.g. with a Retry-After header),
+// so clients give up if the server keeps asking them to retry.
+type Retries struct {
+	attempts    uint
+	maxAttempts uint
+}
+
+// NewRetries returns Retries which allow maxAttempts retries.
+func NewRetries(maxAttempts uint) *Retries {
+	return &Retries{maxAttempts: maxAttempts}
+}
+
+// Next counts a retry, ErrMaxRetries is returned if the maximum number of retries has been reached.
+func (r *Retries) Next() error {
+	if r.attempts >= r.maxAttempts {
+		return ErrMaxRetries
+	}
+	r.attempts++
+	return nil
 }
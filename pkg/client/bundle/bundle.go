@@ -0,0 +1,213 @@
+// Package bundle implements offline update bundles, which deliver deltas to devices without network access.
+// A bundle is an OCI image layout tarball that contains a delta manifest, the delta itself,
+// the manifest of the image the delta leads to and the signatures of both manifests.
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/internal/pkg/utils/tarutils"
+	"github.com/unbasical/doras/pkg/constants"
+	"github.com/unbasical/doras/pkg/signature"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry"
+)
+
+// DeltaTag is the tag of the delta manifest within a bundle.
+const DeltaTag = "delta"
+
+// ErrNotADelta is returned if a bundle is created for a manifest that is not a (finished) delta.
+var ErrNotADelta = errors.New("not a delta")
+
+// Bundle is an opened offline update bundle.
+type Bundle struct {
+	// Store contains the delta and the manifests and signatures that are required to verify it.
+	Store oras.ReadOnlyGraphTarget
+	// Delta is the descriptor of the delta manifest.
+	Delta v1.Descriptor
+	// From is the image (with digest) from which the delta was created.
+	From string
+	// To is the image (with digest) to which the delta leads.
+	To string
+}
+
+// Create writes a bundle of the delta to the file at path.
+// The delta and its signatures are copied from deltaSrc,
+// the manifest of the image it leads to (constants.DorasAnnotationTo) and its signatures are copied from targetSrc.
+// The layers of the target image are not included because they are not required to apply the delta.
+func Create(ctx context.Context, deltaSrc oras.ReadOnlyGraphTarget, delta v1.Descriptor, targetSrc oras.ReadOnlyGraphTarget, path string) error {
+	mf, err := fetchManifest(ctx, deltaSrc, delta)
+	if err != nil {
+		return err
+	}
+	toImage, ok := mf.Annotations[constants.DorasAnnotationTo]
+	if !ok || mf.Annotations[constants.DorasAnnotationIsDummy] == "true" {
+		return fmt.Errorf("%s: %w", delta.Digest, ErrNotADelta)
+	}
+	_, dgst, isDigest, err := ociutils.ParseOciImageString(toImage)
+	if err != nil {
+		return err
+	}
+	if !isDigest {
+		return fmt.Errorf("delta target %q is not identified by a digest", toImage)
+	}
+
+	dir, err := os.MkdirTemp("", "doras-bundle-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	store, err := oci.New(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := oras.CopyGraph(ctx, deltaSrc, store, delta, copyGraphOptions); err != nil {
+		return fmt.Errorf("failed to copy delta: %w", err)
+	}
+	if err := copyReferrers(ctx, deltaSrc, store, delta, ""); err != nil {
+		return fmt.Errorf("failed to copy signatures of the delta: %w", err)
+	}
+	target, err := targetSrc.Resolve(ctx, strings.TrimPrefix(dgst, "@"))
+	if err != nil {
+		return fmt.Errorf("failed to resolve delta target %q: %w", toImage, err)
+	}
+	targetBytes, err := content.FetchAll(ctx, targetSrc, target)
+	if err != nil {
+		return err
+	}
+	if err := store.Push(ctx, target, bytes.NewReader(targetBytes)); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return err
+	}
+	for _, artifactType := range []string{signature.CosignArtifactType, signature.NotationArtifactType} {
+		if err := copyReferrers(ctx, targetSrc, store, target, artifactType); err != nil {
+			return fmt.Errorf("failed to copy signatures of the delta target: %w", err)
+		}
+	}
+	// Cosign signatures might be stored at the legacy signature tag.
+	legacyTag := fmt.Sprintf("%s-%s.sig", target.Digest.Algorithm(), target.Digest.Encoded())
+	if d, err := targetSrc.Resolve(ctx, legacyTag); err == nil {
+		if err := oras.CopyGraph(ctx, targetSrc, store, d, copyGraphOptions); err != nil {
+			return err
+		}
+		if err := store.Tag(ctx, d, legacyTag); err != nil {
+			return err
+		}
+	}
+	if err := store.Tag(ctx, delta, DeltaTag); err != nil {
+		return err
+	}
+
+	fp, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = tarutils.TarDirectory(ctx, dir, "", fp, false)
+	if err = errors.Join(err, fp.Close()); err != nil {
+		// Partial bundles are not left behind.
+		if errRemove := os.Remove(path); errRemove != nil {
+			log.WithError(errRemove).Warnf("failed to remove partial bundle %s", path)
+		}
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	log.Debugf("created bundle of %s at %s", delta.Digest, path)
+	return nil
+}
+
+// Open opens the bundle at path.
+// The bundle is read directly from the tarball, it is not extracted.
+func Open(ctx context.Context, path string) (*Bundle, error) {
+	store, err := oci.NewFromTar(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bundle: %w", err)
+	}
+	delta, err := store.Resolve(ctx, DeltaTag)
+	if err != nil {
+		return nil, fmt.Errorf("bundle does not contain a delta: %w", err)
+	}
+	mf, err := fetchManifest(ctx, store, delta)
+	if err != nil {
+		return nil, err
+	}
+	from, okFrom := mf.Annotations[constants.DorasAnnotationFrom]
+	to, okTo := mf.Annotations[constants.DorasAnnotationTo]
+	if !okFrom || !okTo || mf.Annotations[constants.DorasAnnotationIsDummy] == "true" {
+		return nil, fmt.Errorf("%s: %w", delta.Digest, ErrNotADelta)
+	}
+	return &Bundle{
+		Store: store,
+		Delta: delta,
+		From:  from,
+		To:    to,
+	}, nil
+}
+
+// GetTarget returns the content of the bundle for all repositories, this implements fetcher.StorageSource.
+func (b *Bundle) GetTarget(_ string) (oras.ReadOnlyTarget, error) {
+	return b.Store, nil
+}
+
+// copyGraphOptions do not follow the subject of manifests.
+// Otherwise, copying a signature (or a delta that is stored as a referrer) would copy the entire image it refers to.
+var copyGraphOptions = oras.CopyGraphOptions{
+	FindSuccessors: func(ctx context.Context, fetcher content.Fetcher, desc v1.Descriptor) ([]v1.Descriptor, error) {
+		successors, err := content.Successors(ctx, fetcher, desc)
+		if err != nil || desc.MediaType != v1.MediaTypeImageManifest {
+			return successors, err
+		}
+		mfBytes, err := content.FetchAll(ctx, fetcher, desc)
+		if err != nil {
+			return nil, err
+		}
+		var mf v1.Manifest
+		if err := json.Unmarshal(mfBytes, &mf); err != nil {
+			return nil, err
+		}
+		if mf.Subject == nil {
+			return successors, nil
+		}
+		return slices.DeleteFunc(successors, func(d v1.Descriptor) bool {
+			return d.Digest == mf.Subject.Digest
+		}), nil
+	},
+}
+
+// copyReferrers copies the referrers of the subject (e.g. signatures) with the given artifact type.
+// All referrers are copied if the artifact type is empty.
+func copyReferrers(ctx context.Context, src oras.ReadOnlyGraphTarget, dst oras.Target, subject v1.Descriptor, artifactType string) error {
+	referrers, err := registry.Referrers(ctx, src, subject, artifactType)
+	if err != nil {
+		return err
+	}
+	for _, r := range referrers {
+		if err := oras.CopyGraph(ctx, src, dst, r, copyGraphOptions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fetchManifest(ctx context.Context, src oras.ReadOnlyTarget, d v1.Descriptor) (*ociutils.Manifest, error) {
+	rc, err := src.Fetch(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	defer funcutils.PanicOrLogOnErr(rc.Close, false, "failed to close reader")
+	return ociutils.ParseManifestJSON(rc)
+}
@@ -0,0 +1,114 @@
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/unbasical/doras/pkg/constants"
+	"github.com/unbasical/doras/pkg/signature"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/registry"
+)
+
+func pushBlob(t *testing.T, store oras.Target, mediaType string, data []byte) v1.Descriptor {
+	t.Helper()
+	d := v1.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	if err := store.Push(context.Background(), d, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func pushManifest(t *testing.T, store oras.Target, artifactType string, opts oras.PackManifestOptions) v1.Descriptor {
+	t.Helper()
+	d, err := oras.PackManifest(context.Background(), store, oras.PackManifestVersion1_1, artifactType, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestCreateAndOpen(t *testing.T) {
+	ctx := context.Background()
+	repoName := "registry.example.org/foo"
+	src, err := oci.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetLayer := pushBlob(t, src, "application/vnd.test.file", []byte("to"))
+	target := pushManifest(t, src, "application/vnd.test.artifact", oras.PackManifestOptions{Layers: []v1.Descriptor{targetLayer}})
+	targetSignature := pushManifest(t, src, signature.CosignArtifactType, oras.PackManifestOptions{Subject: &target})
+	deltaLayer := pushBlob(t, src, "application/bsdiff", []byte("delta"))
+	annotations := map[string]string{
+		constants.DorasAnnotationFrom: fmt.Sprintf("%s@%s", repoName, digest.FromString("from")),
+		constants.DorasAnnotationTo:   fmt.Sprintf("%s@%s", repoName, target.Digest),
+	}
+	delta := pushManifest(t, src, constants.DorasDeltaArtifactType, oras.PackManifestOptions{
+		Layers:              []v1.Descriptor{deltaLayer},
+		ManifestAnnotations: annotations,
+	})
+	deltaSignature := pushManifest(t, src, signature.CosignArtifactType, oras.PackManifestOptions{Subject: &delta})
+	dummy := pushManifest(t, src, constants.DorasDeltaArtifactType, oras.PackManifestOptions{
+		ManifestAnnotations: map[string]string{
+			constants.DorasAnnotationFrom:    annotations[constants.DorasAnnotationFrom],
+			constants.DorasAnnotationTo:      annotations[constants.DorasAnnotationTo],
+			constants.DorasAnnotationIsDummy: "true",
+		},
+	})
+
+	path := filepath.Join(t.TempDir(), "bundle.tar")
+	if err := Create(ctx, src, dummy, src, path); !errors.Is(err, ErrNotADelta) {
+		t.Fatalf("expected ErrNotADelta for dummy, got %v", err)
+	}
+	if err := Create(ctx, src, delta, src, path); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Open(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Delta.Digest != delta.Digest {
+		t.Errorf("expected delta %s, got %s", delta.Digest, b.Delta.Digest)
+	}
+	if b.From != annotations[constants.DorasAnnotationFrom] || b.To != annotations[constants.DorasAnnotationTo] {
+		t.Errorf("unexpected images from=%s to=%s", b.From, b.To)
+	}
+	tests := []struct {
+		name       string
+		descriptor v1.Descriptor
+		want       bool
+	}{
+		{name: "delta layer", descriptor: deltaLayer, want: true},
+		{name: "target manifest", descriptor: target, want: true},
+		{name: "target layer", descriptor: targetLayer, want: false},
+		{name: "dummy", descriptor: dummy, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := b.Store.Exists(ctx, tt.descriptor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected exists=%v, got %v", tt.want, got)
+			}
+		})
+	}
+	for _, pair := range [][2]v1.Descriptor{{target, targetSignature}, {delta, deltaSignature}} {
+		subject, want := pair[0], pair[1]
+		referrers, err := registry.Referrers(ctx, b.Store, subject, signature.CosignArtifactType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(referrers) != 1 || referrers[0].Digest != want.Digest {
+			t.Errorf("expected signature %s of %s, got %v", want.Digest, subject.Digest, referrers)
+		}
+	}
+}
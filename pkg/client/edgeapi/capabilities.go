@@ -0,0 +1,126 @@
+package edgeapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/utils/buildurl"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
+)
+
+var (
+	// ErrNoCommonAlgorithm is returned if the client and the server do not support a common diffing algorithm.
+	ErrNoCommonAlgorithm = errors.New("client and server do not support a common delta algorithm")
+	// ErrCapabilitiesUnsupported is returned if the server does not advertise its capabilities, e.g. older servers.
+	ErrCapabilitiesUnsupported = errors.New("server does not advertise its capabilities")
+)
+
+// Capabilities returns the capabilities of the server, they are cached after the first successful request.
+func (c *deltaApiClient) Capabilities() (*apicommon.CapabilitiesResponse, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.capabilities != nil {
+		return c.capabilities, nil
+	}
+	if c.capabilitiesUnsupported {
+		return nil, ErrCapabilitiesUnsupported
+	}
+	url := buildurl.New(
+		buildurl.WithBasePath(c.base.DorasURL),
+		buildurl.WithPathElement(apicommon.ApiBasePathV1),
+		buildurl.WithPathElement(apicommon.CapabilitiesApiPath),
+	)
+	resp, err := c.base.Client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var capabilities apicommon.CapabilitiesResponse
+		if err := json.NewDecoder(resp.Body).Decode(&capabilities); err != nil {
+			return nil, err
+		}
+		c.capabilities = &capabilities
+		return c.capabilities, nil
+	case http.StatusNotFound:
+		c.capabilitiesUnsupported = true
+		return nil, ErrCapabilitiesUnsupported
+	default:
+		return nil, fmt.Errorf("unexpected StatusCode: %q for request to %q", resp.Status, url)
+	}
+}
+
+// Negotiate returns the accepted algorithms that are supported by both the client and the server.
+// If no algorithms are provided the default algorithms of the client are used.
+// Negotiated algorithms are cached, ErrNoCommonAlgorithm is returned if there is no common diffing algorithm.
+// If the server does not advertise its capabilities the algorithms are returned unchanged.
+func (c *deltaApiClient) Negotiate(acceptedAlgorithms []string) ([]string, error) {
+	key := strings.Join(acceptedAlgorithms, ",")
+	c.m.Lock()
+	negotiated, ok := c.negotiated[key]
+	c.m.Unlock()
+	if ok {
+		return negotiated, nil
+	}
+	capabilities, err := c.Capabilities()
+	if errors.Is(err, ErrCapabilitiesUnsupported) {
+		log.Debug("server does not advertise its capabilities, algorithms are not negotiated")
+		return acceptedAlgorithms, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	negotiated, err = negotiate(acceptedAlgorithms, capabilities)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("negotiated algorithms %v with server version %q", negotiated, capabilities.Version)
+	c.m.Lock()
+	c.negotiated[key] = negotiated
+	c.m.Unlock()
+	return negotiated, nil
+}
+
+// negotiate returns the accepted algorithms that are registered on the client and supported by the server.
+// Algorithms that are explicitly accepted but not registered on the client are an error because their deltas cannot be applied.
+func negotiate(acceptedAlgorithms []string, capabilities *apicommon.CapabilitiesResponse) ([]string, error) {
+	if len(acceptedAlgorithms) == 0 {
+		acceptedAlgorithms = registry.DefaultAlgorithms()
+	}
+	var negotiated []string
+	hasDiffer := false
+	for _, a := range acceptedAlgorithms {
+		if !registry.IsSupported(a) {
+			return nil, fmt.Errorf("%w: %q", registry.ErrUnknownAlgorithm, a)
+		}
+		_, err := registry.Delta(a)
+		isDiffer := err == nil
+		if (isDiffer && !slices.Contains(capabilities.Differs, a)) || (!isDiffer && !slices.Contains(capabilities.Compressors, a)) {
+			log.Debugf("algorithm %q is not supported by the server", a)
+			continue
+		}
+		hasDiffer = hasDiffer || isDiffer
+		negotiated = append(negotiated, a)
+	}
+	if !hasDiffer {
+		return nil, fmt.Errorf(
+			"%w: accepted %v, server supports differs %v and compressors %v",
+			ErrNoCommonAlgorithm,
+			acceptedAlgorithms,
+			capabilities.Differs,
+			capabilities.Compressors,
+		)
+	}
+	return negotiated, nil
+}
@@ -0,0 +1,103 @@
+package edgeapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
+)
+
+func Test_negotiate(t *testing.T) {
+	capabilities := &apicommon.CapabilitiesResponse{
+		Differs:     []string{"bsdiff"},
+		Compressors: []string{"gzip"},
+	}
+	tests := []struct {
+		name     string
+		accepted []string
+		want     []string
+		wantErr  error
+	}{
+		{name: "all supported", accepted: []string{"bsdiff", "gzip"}, want: []string{"bsdiff", "gzip"}},
+		{name: "unsupported algorithms are removed", accepted: []string{"tardiff", "bsdiff", "zstd", "gzip"}, want: []string{"bsdiff", "gzip"}},
+		{name: "defaults", want: []string{"bsdiff"}},
+		{name: "no common differ", accepted: []string{"tardiff", "gzip"}, wantErr: ErrNoCommonAlgorithm},
+		{name: "only compressors", accepted: []string{"gzip"}, wantErr: ErrNoCommonAlgorithm},
+		{name: "unknown to the client", accepted: []string{"bsdiff", "foo"}, wantErr: registry.ErrUnknownAlgorithm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := negotiate(tt.accepted, capabilities)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDeltaApiClient_Negotiate(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/capabilities" {
+			http.NotFound(w, r)
+			return
+		}
+		requests++
+		_ = json.NewEncoder(w).Encode(apicommon.CapabilitiesResponse{
+			Version:     "test",
+			Differs:     []string{"bsdiff"},
+			Compressors: []string{"zstd"},
+		})
+	}))
+	defer server.Close()
+	c, err := NewEdgeClient(server.URL, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		got, err := c.Negotiate([]string{"tardiff", "bsdiff", "zstd"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, []string{"bsdiff", "zstd"}) {
+			t.Errorf("unexpected algorithms %v", got)
+		}
+	}
+	if _, err := c.Negotiate([]string{"tardiff"}); !errors.Is(err, ErrNoCommonAlgorithm) {
+		t.Errorf("expected ErrNoCommonAlgorithm, got %v", err)
+	}
+	if _, _, err := c.ReadDeltaAsync("registry.example.org/foo@sha256:abc", "registry.example.org/foo:v2", []string{"tardiff"}); !errors.Is(err, ErrNoCommonAlgorithm) {
+		t.Errorf("expected ErrNoCommonAlgorithm, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("expected capabilities to be cached, got %d requests", requests)
+	}
+}
+
+func TestDeltaApiClient_Negotiate_Unsupported(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	c, err := NewEdgeClient(server.URL, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Capabilities(); !errors.Is(err, ErrCapabilitiesUnsupported) {
+		t.Errorf("expected ErrCapabilitiesUnsupported, got %v", err)
+	}
+	accepted := []string{"tardiff", "foo"}
+	got, err := c.Negotiate(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, accepted) {
+		t.Errorf("expected algorithms to be unchanged, got %v", got)
+	}
+}
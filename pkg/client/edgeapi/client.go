@@ -2,15 +2,20 @@ package edgeapi
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/unbasical/doras/internal/pkg/auth"
 	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
 	backoff2 "github.com/unbasical/doras/pkg/backoff"
 	auth2 "oras.land/oras-go/v2/registry/remote/auth"
 
@@ -28,64 +33,122 @@ type deltaApiClient struct {
 	base      *client.DorasBaseClient
 	backoff   backoff2.Strategy
 	plainHTTP bool
+	// tlsConfigured is set if the client uses a custom TLS configuration.
+	tlsConfigured bool
+	// deviceAuth returns the Authorization header of token requests, device tokens are not used if it is nil.
+	deviceAuth func() (string, error)
+	// m guards the cached capabilities of the server and the negotiated algorithms.
+	m                       sync.Mutex
+	capabilities            *apicommon.CapabilitiesResponse
+	capabilitiesUnsupported bool
+	negotiated              map[string][]string
+	// tokens caches the device tokens per repository.
+	tokens map[string]deviceToken
+	// sleep waits before requests are retried.
+	sleep func(time.Duration)
+}
+
+// Option configures the edge client.
+type Option func(*deltaApiClient)
+
+// WithTLSConfig makes the client use the TLS configuration for connections to the Doras server,
+// e.g. to authenticate with a client certificate.
+// Deltas that are read with ReadDeltaAsStream are fetched with the same configuration,
+// other registry connections (e.g. the image pulls of the updater) do not use it.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *deltaApiClient) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		c.base.Client = &http.Client{Transport: transport}
+		c.tlsConfigured = true
+	}
 }
 
 // NewEdgeClient returns a client that can be used to interact with the Doras server API.
-func NewEdgeClient(serverURL string, allowHttp bool, credentialFunc auth2.CredentialFunc) (DeltaApiClient, error) {
+func NewEdgeClient(serverURL string, allowHttp bool, credentialFunc auth2.CredentialFunc, opts ...Option) (DeltaApiClient, error) {
 	//if tokenProvider != nil && allowHttp {
 	//	return nil, errors.New("using a login token while allowing HTTP is not supported to avoid leaking credentials")
 	//}
-	return &deltaApiClient{
-		base:      client.NewBaseClient(serverURL, credentialFunc),
-		backoff:   backoff2.DefaultBackoff(),
-		plainHTTP: allowHttp,
-	}, nil
+	c := &deltaApiClient{
+		base:       client.NewBaseClient(serverURL, credentialFunc),
+		backoff:    backoff2.DefaultBackoff(),
+		plainHTTP:  allowHttp,
+		negotiated: make(map[string][]string),
+		tokens:     make(map[string]deviceToken),
+		sleep:      time.Sleep,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.tlsConfigured && strings.HasPrefix(strings.ToLower(serverURL), "http://") {
+		return nil, errors.New("a TLS configuration requires an HTTPS server URL")
+	}
+	return c, nil
 }
 
 // ReadDeltaAsync requests a delta between the two provided images and returns the server's response.
 // The function does not block if the delta is still being created.
 // If the delta has been created exists will be set to true.
 // If `err == nil && exists` is true then the request has been accepted by the server but the delta has not been created.
+// The accepted algorithms are negotiated with the server before the request is sent.
 func (c *deltaApiClient) ReadDeltaAsync(from, to string, acceptedAlgorithms []string) (res *apicommon.ReadDeltaResponse, exists bool, err error) {
-	url := buildurl.New(
+	res, _, err = c.RequestDelta(from, to, acceptedAlgorithms)
+	return res, res != nil, err
+}
+
+// RequestDelta behaves like ReadDeltaAsync, if the request has been accepted the response is nil
+// and retryAfter is the duration after which the server expects the delta to be created (0 if it has no estimate).
+func (c *deltaApiClient) RequestDelta(from, to string, acceptedAlgorithms []string) (res *apicommon.ReadDeltaResponse, retryAfter time.Duration, err error) {
+	return c.requestDelta(from, to, acceptedAlgorithms, 0)
+}
+
+// requestDelta behaves like RequestDelta, the server holds the request until the delta has been created or wait has passed.
+func (c *deltaApiClient) requestDelta(from, to string, acceptedAlgorithms []string, wait time.Duration) (res *apicommon.ReadDeltaResponse, retryAfter time.Duration, err error) {
+	negotiated, err := c.Negotiate(acceptedAlgorithms)
+	if errors.Is(err, ErrNoCommonAlgorithm) || errors.Is(err, registry.ErrUnknownAlgorithm) {
+		return nil, 0, err
+	}
+	if err != nil {
+		log.WithError(err).Debug("failed to negotiate algorithms, sending request with the accepted algorithms")
+	} else {
+		acceptedAlgorithms = negotiated
+	}
+	urlOpts := []buildurl.Option{
 		buildurl.WithBasePath(c.base.DorasURL),
 		buildurl.WithPathElement(apicommon.ApiBasePathV1),
 		buildurl.WithPathElement(apicommon.DeltaApiPath),
 		buildurl.WithQueryParam(constants.QueryKeyFromDigest, from),
 		buildurl.WithQueryParam(constants.QueryKeyToTag, to),
 		buildurl.WithListQueryParam(constants.QueryKeyAcceptedAlgorithm, acceptedAlgorithms),
-	)
+	}
+	if wait > 0 {
+		urlOpts = append(urlOpts, buildurl.WithQueryParam(constants.QueryKeyWait, wait.String()))
+	}
+	url := buildurl.New(urlOpts...)
 
 	log.Debugf("sending delta request to %s", url)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, false, err
+		return nil, 0, err
 	}
 
-	if c.base.CredentialFunc != nil {
-		log.Debug("attempting to load token")
-		ociUrl, err := ociutils.ParseOciUrl(from)
-		if err != nil {
-			return nil, false, err
-		}
-		creds, err := c.base.CredentialFunc(context.Background(), ociUrl.Host)
-		if err != nil {
-			log.WithError(err).Debug("could not load auth token, using no authentication")
-		} else {
-			setupAuthHeader(creds, req)
-		}
-	} else {
-		log.Warn("no credential provided, using no authentication")
+	repository, err := c.setAuthorization(req, from)
+	if err != nil {
+		return nil, 0, err
 	}
 	resp, err := c.base.Client.Do(req)
 	if err != nil {
-		return nil, false, err
+		return nil, 0, err
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
 			log.Error(err)
 		}
 	}()
+	if resp.StatusCode == http.StatusUnauthorized && c.deviceAuth != nil {
+		// The token is requested again with the next request, e.g. if the server has been restarted with a new secret.
+		c.invalidateDeviceToken(repository)
+	}
 	switch resp.StatusCode {
 	case http.StatusOK:
 		var resBody apicommon.ReadDeltaResponse
@@ -93,14 +156,16 @@ func (c *deltaApiClient) ReadDeltaAsync(from, to string, acceptedAlgorithms []st
 		decoder.DisallowUnknownFields()
 		err = decoder.Decode(&resBody)
 		if err != nil {
-			return nil, false, err
+			return nil, 0, err
 		}
-		return &resBody, true, nil
+		return &resBody, 0, nil
 	case http.StatusNoContent:
 		// Map non-error HTTP status code into error so it can be handled by clients.
-		return nil, false, apicommon.ErrImagesIdentical
+		return nil, 0, apicommon.ErrImagesIdentical
 	case http.StatusAccepted:
-		return nil, false, nil
+		return nil, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()), nil
+	case http.StatusTooManyRequests:
+		return nil, 0, &RetryAfterError{Err: apicommon.ErrTooManyRequests, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
 	default:
 		// try parsing an API error from the body, if not return an error
 		var errBody apicommon.APIError
@@ -108,10 +173,43 @@ func (c *deltaApiClient) ReadDeltaAsync(from, to string, acceptedAlgorithms []st
 		decoder.DisallowUnknownFields()
 		decodeErr := decoder.Decode(&errBody)
 		if decodeErr != nil {
-			return nil, false, fmt.Errorf("unexpected StatusCode: %q for request to %q", url, resp.Status)
+			return nil, 0, fmt.Errorf("unexpected StatusCode: %q for request to %q", url, resp.Status)
+		}
+		return nil, 0, errBody
+	}
+}
+
+// setAuthorization authenticates the delta request for the image and returns its repository.
+// Device tokens are used if device credentials are configured, otherwise the registry credentials are sent.
+func (c *deltaApiClient) setAuthorization(req *http.Request, image string) (string, error) {
+	repository, _, _, err := ociutils.ParseOciImageString(image)
+	if err != nil {
+		return "", err
+	}
+	if c.deviceAuth != nil {
+		token, err := c.deviceToken(repository)
+		if err != nil {
+			return "", fmt.Errorf("failed to request device token: %w", err)
 		}
-		return nil, false, errBody
+		req.Header.Set("Authorization", "Bearer "+token)
+		return repository, nil
+	}
+	if c.base.CredentialFunc == nil {
+		log.Warn("no credential provided, using no authentication")
+		return repository, nil
+	}
+	log.Debug("attempting to load token")
+	ociUrl, err := ociutils.ParseOciUrl(image)
+	if err != nil {
+		return "", err
 	}
+	creds, err := c.base.CredentialFunc(context.Background(), ociUrl.Host)
+	if err != nil {
+		log.WithError(err).Debug("could not load auth token, using no authentication")
+	} else {
+		setupAuthHeader(creds, req)
+	}
+	return repository, nil
 }
 
 func setupAuthHeader(creds auth2.Credential, req *http.Request) {
@@ -130,16 +228,34 @@ func setupAuthHeader(creds auth2.Credential, req *http.Request) {
 
 // ReadDelta requests a delta between the two provided images and returns the server's response.
 // Blocks until the delta has been created or an error is detected.
+// If the server asks the client to retry later (e.g. because of rate limiting or because it estimated when the delta is created),
+// the client waits as long as requested instead of backing off, at most backoff.DefaultMaxRetries times.
 // The server supports non-blocking requests for deltas, to use them use the sibling function ReadDeltaAsync.
 func (c *deltaApiClient) ReadDelta(from, to string, acceptedAlgorithms []string) (*apicommon.ReadDeltaResponse, error) {
+	retries := backoff2.NewRetries(backoff2.DefaultMaxRetries)
 	for {
-		response, exists, err := c.ReadDeltaAsync(from, to, acceptedAlgorithms)
+		response, retryAfter, err := c.RequestDelta(from, to, acceptedAlgorithms)
+		var retryErr *RetryAfterError
+		if errors.As(err, &retryErr) && retryErr.RetryAfter > 0 {
+			log.Debugf("server asked to retry after %v", retryErr.RetryAfter)
+			if err := c.waitRetryAfter(retries, retryErr.RetryAfter); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
-		if exists {
+		if response != nil {
 			return response, nil
 		}
+		if retryAfter > 0 {
+			log.Debugf("request was accepted, the server expects the delta to be created after %v", retryAfter)
+			if err := c.waitRetryAfter(retries, retryAfter); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		log.Debugf("request was accepted, trying again after waiting period")
 		err = c.backoff.Wait()
 		if err != nil {
@@ -148,6 +264,57 @@ func (c *deltaApiClient) ReadDelta(from, to string, acceptedAlgorithms []string)
 	}
 }
 
+// WaitForDelta requests a delta between the two provided images and blocks until it has been created or an error is detected.
+// The server holds the requests until the delta has been created (see apicommon.CapabilitiesResponse.MaxWait),
+// which needs far fewer requests than polling with ReadDelta. Falls back to ReadDelta if the server does not support waiting.
+func (c *deltaApiClient) WaitForDelta(from, to string, acceptedAlgorithms []string) (*apicommon.ReadDeltaResponse, error) {
+	capabilities, err := c.Capabilities()
+	if err != nil || capabilities.MaxWait <= 0 {
+		log.Debug("server does not support waiting for deltas, polling instead")
+		return c.ReadDelta(from, to, acceptedAlgorithms)
+	}
+	wait := time.Duration(capabilities.MaxWait) * time.Second
+	retries := backoff2.NewRetries(backoff2.DefaultMaxRetries)
+	for {
+		sent := time.Now()
+		response, _, err := c.requestDelta(from, to, acceptedAlgorithms, wait)
+		var retryErr *RetryAfterError
+		if errors.As(err, &retryErr) && retryErr.RetryAfter > 0 {
+			log.Debugf("server asked to retry after %v", retryErr.RetryAfter)
+			if err := c.waitRetryAfter(retries, retryErr.RetryAfter); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if response != nil {
+			return response, nil
+		}
+		// The server stopped waiting early, e.g. because it shuts down.
+		if time.Since(sent) < wait {
+			if err := c.backoff.Wait(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// Requests which the server held until its maximum wait count as retries, so the client gives up eventually.
+		if err := retries.Next(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// waitRetryAfter waits as long as the server asked, the wait counts against the retries of the request.
+func (c *deltaApiClient) waitRetryAfter(retries *backoff2.Retries, retryAfter time.Duration) error {
+	if err := retries.Next(); err != nil {
+		return fmt.Errorf("%w: the server keeps asking to retry later", err)
+	}
+	c.sleep(retryAfter)
+	return nil
+}
+
 // ReadDeltaAsStream requests a delta between the two provided images and reads it as a stream.
 func (c *deltaApiClient) ReadDeltaAsStream(from, to string, acceptedAlgorithms []string) (*v1.Descriptor, string, io.ReadCloser, error) {
 	response, err := c.ReadDelta(from, to, acceptedAlgorithms)
@@ -188,6 +355,11 @@ func (c *deltaApiClient) ReadDeltaAsStream(from, to string, acceptedAlgorithms [
 // DeltaApiClient abstracts around a client that can request deltas from Doras servers.
 type DeltaApiClient interface {
 	ReadDeltaAsync(from, to string, acceptedAlgorithms []string) (res *apicommon.ReadDeltaResponse, exists bool, err error)
+	RequestDelta(from, to string, acceptedAlgorithms []string) (res *apicommon.ReadDeltaResponse, retryAfter time.Duration, err error)
 	ReadDelta(from, to string, acceptedAlgorithms []string) (*apicommon.ReadDeltaResponse, error)
+	WaitForDelta(from, to string, acceptedAlgorithms []string) (*apicommon.ReadDeltaResponse, error)
 	ReadDeltaAsStream(from, to string, acceptedAlgorithms []string) (*v1.Descriptor, string, io.ReadCloser, error)
+	Capabilities() (*apicommon.CapabilitiesResponse, error)
+	Negotiate(acceptedAlgorithms []string) ([]string, error)
+	Target(device, repository string) (*apicommon.TargetResponse, error)
 }
@@ -0,0 +1,337 @@
+package edgeapi
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/auth"
+	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+	"github.com/unbasical/doras/internal/pkg/utils/tlsutils"
+	"github.com/unbasical/doras/pkg/backoff"
+)
+
+func TestNewEdgeClient_WithTLSConfig(t *testing.T) {
+	ca := testutils.NewCertificateAuthority(t)
+	serverCert, serverKey := ca.Issue(t, "doras")
+	clientCert, clientKey := ca.Issue(t, "device-1")
+	serverReloader, err := tlsutils.NewCertificateReloader(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, err := tlsutils.NewServerConfig(serverReloader, ca.CertPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cert := tlsutils.VerifiedClientCertificate(r.TLS)
+		if cert == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(apicommon.CapabilitiesResponse{Version: cert.Subject.CommonName})
+	}))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.Listener = tls.NewListener(server.Listener, serverConfig)
+	server.Start()
+	defer server.Close()
+	serverURL := "https://" + server.Listener.Addr().String()
+
+	rootCAs, err := tlsutils.LoadCertPool(ca.CertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientReloader, err := tlsutils.NewCertificateReloader(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		config      *tls.Config
+		wantVersion string
+		wantErr     bool
+	}{
+		{name: "client certificate", config: &tls.Config{RootCAs: rootCAs, GetClientCertificate: clientReloader.GetClientCertificate}, wantVersion: "device-1"},
+		{name: "without client certificate", config: &tls.Config{RootCAs: rootCAs}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewEdgeClient(serverURL, false, nil, WithTLSConfig(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.Capabilities()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err == nil && got.Version != tt.wantVersion {
+				t.Errorf("expected the server to identify %q, got %q", tt.wantVersion, got.Version)
+			}
+		})
+	}
+	if _, err := NewEdgeClient("http://localhost:8080", true, nil, WithTLSConfig(&tls.Config{})); err == nil {
+		t.Error("expected error for a TLS configuration with an HTTP server URL")
+	}
+}
+
+func TestDeltaApiClient_deviceToken(t *testing.T) {
+	const from = "registry.example.org/apps/foo@sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	var tokenRequests []apicommon.TokenRequest
+	var authorizations []string
+	rejectToken := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/token":
+			if r.Header.Get("Authorization") != auth.GenerateBasicAuth("device-1", "device-key") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var req apicommon.TokenRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			tokenRequests = append(tokenRequests, req)
+			_ = json.NewEncoder(w).Encode(apicommon.TokenResponse{Token: fmt.Sprintf("token-%d", len(tokenRequests)), ExpiresIn: 300})
+		case "/api/v1/delta":
+			authorizations = append(authorizations, r.Header.Get("Authorization"))
+			if rejectToken {
+				rejectToken = false
+				w.WriteHeader(http.StatusUnauthorized)
+				_ = json.NewEncoder(w).Encode(apicommon.APIError{})
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c, err := NewEdgeClient(server.URL, true, nil, WithDeviceKey("device-1", "device-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadDeltaAsync(from, "registry.example.org/apps/foo:v2", []string{"bsdiff"}); err != nil {
+		t.Fatal(err)
+	}
+	// The cached token is used for the second request.
+	rejectToken = true
+	if _, _, err := c.ReadDeltaAsync(from, "registry.example.org/apps/foo:v2", []string{"bsdiff"}); err == nil {
+		t.Fatal("expected rejected token to return an error")
+	}
+	// The rejected token is not used again.
+	if _, _, err := c.ReadDeltaAsync(from, "registry.example.org/apps/foo:v2", []string{"bsdiff"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Bearer token-1", "Bearer token-1", "Bearer token-2"}; !slices.Equal(authorizations, want) {
+		t.Errorf("expected authorizations %v, got %v", want, authorizations)
+	}
+	if len(tokenRequests) != 2 || !slices.Equal(tokenRequests[0].Repositories, []string{"registry.example.org/apps/foo"}) {
+		t.Errorf("unexpected token requests %+v", tokenRequests)
+	}
+
+	c, err = NewEdgeClient(server.URL, true, nil, WithDeviceKey("device-1", "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadDeltaAsync(from, "registry.example.org/apps/foo:v2", []string{"bsdiff"}); err == nil {
+		t.Error("expected error for invalid device key")
+	}
+}
+
+func TestDeltaApiClient_ReadDelta_RetryAfter(t *testing.T) {
+	const from = "registry.example.org/foo@sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	responses := []func(w http.ResponseWriter){
+		func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+		},
+		func(w http.ResponseWriter) { w.WriteHeader(http.StatusAccepted) },
+		func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusAccepted)
+		},
+		func(w http.ResponseWriter) {
+			_ = json.NewEncoder(w).Encode(apicommon.ReadDeltaResponse{TargetImage: "registry.example.org/foo:v2", DeltaImage: "registry.example.org/foo:delta"})
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/delta" || len(responses) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		respond := responses[0]
+		responses = responses[1:]
+		respond(w)
+	}))
+	defer server.Close()
+	c, err := NewEdgeClient(server.URL, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var waited []time.Duration
+	c.(*deltaApiClient).sleep = func(d time.Duration) { waited = append(waited, d) }
+	c.(*deltaApiClient).backoff = backoff.NewExponentialBackoffWithJitter(time.Millisecond, time.Millisecond, 1)
+	res, err := c.ReadDelta(from, "registry.example.org/foo:v2", []string{"bsdiff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DeltaImage != "registry.example.org/foo:delta" {
+		t.Errorf("unexpected response %+v", res)
+	}
+	// The backoff is only used for the accepted request without an estimate.
+	if !slices.Equal(waited, []time.Duration{3 * time.Second, 5 * time.Second}) {
+		t.Errorf("expected the client to wait as requested by the server, waited %v", waited)
+	}
+}
+
+func TestDeltaApiClient_ReadDelta_maxRetries(t *testing.T) {
+	const from = "registry.example.org/foo@sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		name    string
+		maxWait int64
+		respond func(w http.ResponseWriter)
+	}{
+		{
+			name: "accepted with estimate",
+			respond: func(w http.ResponseWriter) {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusAccepted)
+			},
+		},
+		{
+			name:    "accepted without estimate",
+			respond: func(w http.ResponseWriter) { w.WriteHeader(http.StatusAccepted) },
+		},
+		{
+			name: "rate limited",
+			respond: func(w http.ResponseWriter) {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+			},
+		},
+		{
+			name:    "rate limited while waiting",
+			maxWait: 60,
+			respond: func(w http.ResponseWriter) {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/v1/capabilities":
+					_ = json.NewEncoder(w).Encode(apicommon.CapabilitiesResponse{Differs: []string{"bsdiff"}, MaxWait: tt.maxWait})
+				case "/api/v1/delta":
+					tt.respond(w)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+			c, err := NewEdgeClient(server.URL, true, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.(*deltaApiClient).sleep = func(time.Duration) {}
+			c.(*deltaApiClient).backoff = backoff.NewExponentialBackoffWithJitter(time.Millisecond, time.Millisecond, 3)
+			read := c.ReadDelta
+			if tt.maxWait > 0 {
+				read = c.WaitForDelta
+			}
+			if _, err := read(from, "registry.example.org/foo:v2", []string{"bsdiff"}); !errors.Is(err, backoff.ErrMaxRetries) {
+				t.Fatalf("expected the client to give up, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDeltaApiClient_WaitForDelta(t *testing.T) {
+	const from = "registry.example.org/foo@sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		name         string
+		maxWait      int64
+		wantWait     string
+		wantRequests int
+	}{
+		{name: "long polling", maxWait: 60, wantWait: "1m0s", wantRequests: 2},
+		{name: "server does not support waiting", maxWait: 0, wantWait: "", wantRequests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var waits []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/v1/capabilities":
+					_ = json.NewEncoder(w).Encode(apicommon.CapabilitiesResponse{Differs: []string{"bsdiff"}, MaxWait: tt.maxWait})
+				case "/api/v1/delta":
+					waits = append(waits, r.URL.Query().Get("wait"))
+					if len(waits) == 1 {
+						w.WriteHeader(http.StatusAccepted)
+						return
+					}
+					_ = json.NewEncoder(w).Encode(apicommon.ReadDeltaResponse{TargetImage: "registry.example.org/foo:v2", DeltaImage: "registry.example.org/foo:delta"})
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+			c, err := NewEdgeClient(server.URL, true, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.(*deltaApiClient).backoff = backoff.NewExponentialBackoffWithJitter(time.Millisecond, time.Millisecond, 1)
+			res, err := c.WaitForDelta(from, "registry.example.org/foo:v2", []string{"bsdiff"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.DeltaImage != "registry.example.org/foo:delta" {
+				t.Errorf("unexpected response %+v", res)
+			}
+			if len(waits) != tt.wantRequests {
+				t.Fatalf("expected %d requests, got %d", tt.wantRequests, len(waits))
+			}
+			for _, wait := range waits {
+				if wait != tt.wantWait {
+					t.Errorf("expected wait %q, got %q", tt.wantWait, wait)
+				}
+			}
+		})
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{name: "seconds", header: "120", want: 2 * time.Minute},
+		{name: "http date", header: now.Add(30 * time.Second).Format(http.TimeFormat), want: 30 * time.Second},
+		{name: "date in the past", header: now.Add(-time.Minute).Format(http.TimeFormat), want: 0},
+		{name: "capped", header: "86400", want: maxRetryAfter},
+		{name: "missing", header: "", want: 0},
+		{name: "invalid", header: "soon", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.header, now); got != tt.want {
+				t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
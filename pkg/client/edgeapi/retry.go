@@ -0,0 +1,40 @@
+package edgeapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetryAfter limits how long the client waits if the server asks it to retry later.
+const maxRetryAfter = 10 * time.Minute
+
+// RetryAfterError is returned if the server asks the client to retry the request later,
+// e.g. because the client exceeded its rate limit.
+type RetryAfterError struct {
+	// Err is the error of the server, e.g. apicommon.ErrTooManyRequests.
+	Err error
+	// RetryAfter is the duration the client should wait before it retries the request, 0 if the server did not suggest one.
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %v)", e.Err, e.RetryAfter)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number of seconds or an HTTP date.
+// The duration is capped at maxRetryAfter, 0 is returned for missing or invalid headers.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	var d time.Duration
+	if seconds, err := strconv.ParseUint(header, 10, 32); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		d = date.Sub(now)
+	}
+	return min(max(d, 0), maxRetryAfter)
+}
@@ -0,0 +1,104 @@
+package edgeapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/utils/buildurl"
+	"github.com/unbasical/doras/pkg/constants"
+)
+
+// Target asks the server which image the device should run according to the rollouts of the server.
+// The repository is optional if the rollouts that target the device are restricted to a single repository.
+// Devices that authenticate with device tokens are identified by the token, the device and the repository are required to request it.
+// If no rollout targets the device an error that matches apicommon.ErrNoTarget is returned.
+func (c *deltaApiClient) Target(device, repository string) (*apicommon.TargetResponse, error) {
+	urlOpts := []buildurl.Option{
+		buildurl.WithBasePath(c.base.DorasURL),
+		buildurl.WithPathElement(apicommon.ApiBasePathV1),
+		buildurl.WithPathElement(apicommon.TargetApiPath),
+	}
+	if device != "" {
+		urlOpts = append(urlOpts, buildurl.WithQueryParam(constants.QueryKeyDevice, device))
+	}
+	if repository != "" {
+		urlOpts = append(urlOpts, buildurl.WithQueryParam(constants.QueryKeyRepository, repository))
+	}
+	url := buildurl.New(urlOpts...)
+
+	log.Debugf("sending target request to %s", url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.setTargetAuthorization(req, repository); err != nil {
+		return nil, err
+	}
+	resp, err := c.base.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+	if resp.StatusCode == http.StatusUnauthorized && c.deviceAuth != nil {
+		c.invalidateDeviceToken(repository)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var resBody apicommon.TargetResponse
+		decoder := json.NewDecoder(resp.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&resBody); err != nil {
+			return nil, err
+		}
+		return &resBody, nil
+	case http.StatusTooManyRequests:
+		return nil, &RetryAfterError{Err: apicommon.ErrTooManyRequests, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	default:
+		var errBody apicommon.APIError
+		decoder := json.NewDecoder(resp.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&errBody); err != nil {
+			return nil, fmt.Errorf("unexpected StatusCode: %q for request to %q", resp.Status, url)
+		}
+		return nil, errBody
+	}
+}
+
+// setTargetAuthorization authenticates the target request with a device token for the repository
+// or with the registry credentials of the repository's registry.
+func (c *deltaApiClient) setTargetAuthorization(req *http.Request, repository string) error {
+	if c.deviceAuth != nil {
+		if repository == "" {
+			return errors.New("the repository is required to authenticate with a device token")
+		}
+		token, err := c.deviceToken(repository)
+		if err != nil {
+			return fmt.Errorf("failed to request device token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+	if c.base.CredentialFunc == nil || repository == "" {
+		log.Debug("sending target request without authentication")
+		return nil
+	}
+	host, _, _ := strings.Cut(repository, "/")
+	creds, err := c.base.CredentialFunc(context.Background(), host)
+	if err != nil {
+		log.WithError(err).Debug("could not load auth token, using no authentication")
+		return nil
+	}
+	setupAuthHeader(creds, req)
+	return nil
+}
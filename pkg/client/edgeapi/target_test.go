@@ -0,0 +1,67 @@
+package edgeapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/auth"
+)
+
+func TestDeltaApiClient_Target(t *testing.T) {
+	const image = "registry.example.org/apps/foo@sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/token":
+			if r.Header.Get("Authorization") != auth.GenerateBasicAuth("device-1", "device-key") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(apicommon.TokenResponse{Token: "device-1", ExpiresIn: 300})
+		case "/api/v1/target":
+			device := r.URL.Query().Get("device")
+			if r.Header.Get("Authorization") == "Bearer device-1" {
+				device = "device-1"
+			}
+			if device != "device-1" || r.URL.Query().Get("repository") != "registry.example.org/apps/foo" {
+				w.WriteHeader(http.StatusNotFound)
+				_ = json.NewEncoder(w).Encode(apicommon.ErrNoTarget)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(apicommon.TargetResponse{Image: image, Rollout: "canary"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		opts       []Option
+		device     string
+		repository string
+		wantErr    error
+	}{
+		{name: "device", device: "device-1", repository: "registry.example.org/apps/foo"},
+		{name: "device token", opts: []Option{WithDeviceKey("device-1", "device-key")}, repository: "registry.example.org/apps/foo"},
+		{name: "no target", device: "device-2", repository: "registry.example.org/apps/foo", wantErr: apicommon.ErrNoTarget},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewEdgeClient(server.URL, true, nil, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := c.Target(tt.device, tt.repository)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr == nil && (res.Image != image || res.Rollout != "canary") {
+				t.Errorf("unexpected target %+v", res)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package edgeapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/auth"
+	"github.com/unbasical/doras/internal/pkg/utils/buildurl"
+)
+
+// tokenRenewalMargin is the remaining lifetime at which device tokens are renewed.
+const tokenRenewalMargin = 30 * time.Second
+
+// deviceToken is a token of the token service of the server.
+type deviceToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// WithDeviceKey makes the client authenticate delta requests with short-lived tokens of the token service of the server,
+// the device authenticates with its ID and key to request them. Registry credentials are not sent to the server.
+func WithDeviceKey(deviceID, key string) Option {
+	return func(c *deltaApiClient) {
+		c.deviceAuth = func() (string, error) {
+			return auth.GenerateBasicAuth(deviceID, key), nil
+		}
+	}
+}
+
+// WithDeviceJWT is like WithDeviceKey, but the device authenticates with a JWT of an identity provider which is trusted by the server.
+// The function is called for each token request, so it can return renewed JWTs.
+func WithDeviceJWT(jwt func() (string, error)) Option {
+	return func(c *deltaApiClient) {
+		c.deviceAuth = func() (string, error) {
+			t, err := jwt()
+			if err != nil {
+				return "", err
+			}
+			return "Bearer " + t, nil
+		}
+	}
+}
+
+// deviceToken returns a token for the repository, tokens are cached until they are about to expire.
+func (c *deltaApiClient) deviceToken(repository string) (string, error) {
+	c.m.Lock()
+	cached, ok := c.tokens[repository]
+	c.m.Unlock()
+	if ok && time.Until(cached.expiresAt) > tokenRenewalMargin {
+		return cached.token, nil
+	}
+	authorization, err := c.deviceAuth()
+	if err != nil {
+		return "", fmt.Errorf("failed to load device credentials: %w", err)
+	}
+	body, err := json.Marshal(apicommon.TokenRequest{Repositories: []string{repository}})
+	if err != nil {
+		return "", err
+	}
+	url := buildurl.New(
+		buildurl.WithBasePath(c.base.DorasURL),
+		buildurl.WithPathElement(apicommon.ApiBasePathV1),
+		buildurl.WithPathElement(apicommon.TokenApiPath),
+	)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.base.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		var errBody apicommon.APIError
+		if err := json.NewDecoder(resp.Body).Decode(&errBody); err != nil {
+			return "", fmt.Errorf("unexpected StatusCode: %q for request to %q", resp.Status, url)
+		}
+		return "", errBody
+	}
+	var res apicommon.TokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.tokens[repository] = deviceToken{token: res.Token, expiresAt: time.Now().Add(time.Duration(res.ExpiresIn) * time.Second)}
+	return res.Token, nil
+}
+
+// invalidateDeviceToken removes the cached token of the repository, e.g. if it has been rejected.
+func (c *deltaApiClient) invalidateDeviceToken(repository string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.tokens, repository)
+}
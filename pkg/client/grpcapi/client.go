@@ -0,0 +1,241 @@
+// Package grpcapi provides a client of the gRPC API of Doras servers (api/doras/v1/doras.proto).
+// The generated client is in the package github.com/unbasical/doras/pkg/api/doras/v1.
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/auth"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	dorasv1 "github.com/unbasical/doras/pkg/api/doras/v1"
+	backoff2 "github.com/unbasical/doras/pkg/backoff"
+	"github.com/unbasical/doras/pkg/client/edgeapi"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	auth2 "oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// maxRetryAfter limits how long the client waits if the server asks it to retry later.
+const maxRetryAfter = 10 * time.Minute
+
+// errorDomain is the domain of the error details of the errors of the server.
+const errorDomain = "doras"
+
+// DeltaClient requests deltas via the gRPC API, it behaves like the delta requests of edgeapi.DeltaApiClient.
+// Errors of the server are returned as apicommon.APIError whose code is the gRPC status code,
+// so they can be compared with errors.Is, e.g. to apicommon.ErrImagesIdentical.
+type DeltaClient interface {
+	// RequestDelta requests a delta without waiting for it to be created.
+	// If the delta is being created the response is nil and retryAfter is the duration
+	// after which the server expects the delta to be created (0 if it has no estimate).
+	RequestDelta(from, to string, acceptedAlgorithms []string) (res *apicommon.ReadDeltaResponse, retryAfter time.Duration, err error)
+	// WaitForDelta watches the delta until it has been created.
+	// Streams that the server ends without the delta and waits that the server asks for count as retries,
+	// the client gives up with backoff.ErrMaxRetries after backoff.DefaultMaxRetries retries.
+	WaitForDelta(from, to string, acceptedAlgorithms []string) (*apicommon.ReadDeltaResponse, error)
+	// Capabilities describes the server.
+	Capabilities() (*apicommon.CapabilitiesResponse, error)
+}
+
+type deltaClient struct {
+	service        dorasv1.DeltaServiceClient
+	credentialFunc auth2.CredentialFunc
+	backoff        backoff2.Strategy
+	// sleep waits before requests are retried.
+	sleep func(time.Duration)
+}
+
+// NewDeltaClient returns a client that requests deltas via the connection, e.g. one returned by grpc.NewClient.
+// The connection configures the transport, e.g. TLS with client certificates.
+// Requests are authenticated with the credentials of the registry of the requested images, the credential function may be nil.
+func NewDeltaClient(conn grpc.ClientConnInterface, credentialFunc auth2.CredentialFunc) DeltaClient {
+	return &deltaClient{
+		service:        dorasv1.NewDeltaServiceClient(conn),
+		credentialFunc: credentialFunc,
+		backoff:        backoff2.DefaultBackoff(),
+		sleep:          time.Sleep,
+	}
+}
+
+func (c *deltaClient) RequestDelta(from, to string, acceptedAlgorithms []string) (res *apicommon.ReadDeltaResponse, retryAfter time.Duration, err error) {
+	ctx, err := c.authorize(context.Background(), from)
+	if err != nil {
+		return nil, 0, err
+	}
+	response, err := c.service.ReadDelta(ctx, &dorasv1.ReadDeltaRequest{From: from, To: to, AcceptedAlgorithms: acceptedAlgorithms})
+	if err != nil {
+		return nil, 0, fromStatus(err)
+	}
+	return fromResponse(response)
+}
+
+func (c *deltaClient) WaitForDelta(from, to string, acceptedAlgorithms []string) (*apicommon.ReadDeltaResponse, error) {
+	wait := apicommon.MaxWait
+	if capabilities, err := c.Capabilities(); err == nil && capabilities.MaxWait > 0 {
+		wait = time.Duration(capabilities.MaxWait) * time.Second
+	}
+	retries := backoff2.NewRetries(backoff2.DefaultMaxRetries)
+	for {
+		sent := time.Now()
+		res, err := c.watchDelta(from, to, acceptedAlgorithms)
+		var retryErr *edgeapi.RetryAfterError
+		if errors.As(err, &retryErr) && retryErr.RetryAfter > 0 {
+			log.Debugf("server asked to retry after %v", retryErr.RetryAfter)
+			if err := retries.Next(); err != nil {
+				return nil, fmt.Errorf("%w: the server keeps asking to retry later", err)
+			}
+			c.sleep(retryErr.RetryAfter)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if res != nil {
+			return res, nil
+		}
+		// The server stopped waiting early, e.g. because it shuts down.
+		if time.Since(sent) < wait {
+			if err := c.backoff.Wait(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := retries.Next(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// watchDelta watches the delta until the server ends the stream, the response is nil if the delta has not been created by then.
+func (c *deltaClient) watchDelta(from, to string, acceptedAlgorithms []string) (*apicommon.ReadDeltaResponse, error) {
+	ctx, err := c.authorize(context.Background(), from)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.service.WatchDelta(ctx, &dorasv1.ReadDeltaRequest{From: from, To: to, AcceptedAlgorithms: acceptedAlgorithms})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	for {
+		response, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fromStatus(err)
+		}
+		res, _, err := fromResponse(response)
+		if err != nil || res != nil {
+			return res, err
+		}
+		log.Debug("delta is being created")
+	}
+}
+
+func (c *deltaClient) Capabilities() (*apicommon.CapabilitiesResponse, error) {
+	response, err := c.service.Capabilities(context.Background(), &dorasv1.CapabilitiesRequest{})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return &apicommon.CapabilitiesResponse{
+		Version:           response.GetVersion(),
+		Differs:           response.GetDiffers(),
+		Compressors:       response.GetCompressors(),
+		DefaultAlgorithms: response.GetDefaultAlgorithms(),
+		MaxArtifactSize:   response.GetMaxArtifactSize(),
+		MaxWait:           response.GetMaxWait(),
+		Auth: apicommon.AuthRequirements{
+			Required:           response.GetAuthRequired(),
+			Schemes:            response.GetAuthSchemes(),
+			ClientCertificates: response.GetClientCertificates(),
+			TokenService:       response.GetTokenService(),
+		},
+	}, nil
+}
+
+// authorize adds the credentials of the registry of the image to the metadata of the call.
+func (c *deltaClient) authorize(ctx context.Context, image string) (context.Context, error) {
+	if c.credentialFunc == nil {
+		log.Warn("no credential provided, using no authentication")
+		return ctx, nil
+	}
+	ociUrl, err := ociutils.ParseOciUrl(image)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := c.credentialFunc(ctx, ociUrl.Host)
+	if err != nil {
+		log.WithError(err).Debug("could not load auth token, using no authentication")
+		return ctx, nil
+	}
+	if creds.AccessToken != "" {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+creds.AccessToken), nil
+	}
+	if creds.Username != "" && creds.Password != "" {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", auth.GenerateBasicAuth(creds.Username, creds.Password)), nil
+	}
+	return ctx, nil
+}
+
+// fromResponse converts the response of the server, the response is nil if the delta is being created.
+func fromResponse(response *dorasv1.ReadDeltaResponse) (res *apicommon.ReadDeltaResponse, retryAfter time.Duration, err error) {
+	switch response.GetStatus() {
+	case dorasv1.DeltaStatus_DELTA_STATUS_READY:
+		return &apicommon.ReadDeltaResponse{TargetImage: response.GetTargetImage(), DeltaImage: response.GetDeltaImage()}, 0, nil
+	case dorasv1.DeltaStatus_DELTA_STATUS_PENDING:
+		return nil, parseEstimatedCompletion(response.GetEstimatedCompletion(), time.Now()), nil
+	case dorasv1.DeltaStatus_DELTA_STATUS_IDENTICAL:
+		return nil, 0, apicommon.ErrImagesIdentical
+	default:
+		return nil, 0, errors.New("unknown delta status in response")
+	}
+}
+
+// parseEstimatedCompletion returns the duration until the estimated completion (RFC 3339).
+// The duration is capped at maxRetryAfter, 0 is returned for missing or invalid estimates.
+func parseEstimatedCompletion(estimate string, now time.Time) time.Duration {
+	t, err := time.Parse(time.RFC3339, estimate)
+	if err != nil {
+		return 0
+	}
+	return min(max(t.Sub(now), 0), maxRetryAfter)
+}
+
+// fromStatus converts the status errors of the server to apicommon.APIError.
+// If the server asks the client to retry later, an edgeapi.RetryAfterError is returned.
+func fromStatus(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	var apiErr error = err
+	var retryAfter time.Duration
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			if d.GetDomain() == errorDomain {
+				apiErr = apicommon.APIError{InnerError: apicommon.APIErrorInner{
+					Code:         int(st.Code()),
+					Message:      d.GetMetadata()["message"],
+					ErrorContext: d.GetMetadata()["context"],
+				}}
+			}
+		case *errdetails.RetryInfo:
+			retryAfter = min(max(d.GetRetryDelay().AsDuration(), 0), maxRetryAfter)
+		}
+	}
+	if retryAfter > 0 {
+		return &edgeapi.RetryAfterError{Err: apiErr, RetryAfter: retryAfter}
+	}
+	return apiErr
+}
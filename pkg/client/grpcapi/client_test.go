@@ -0,0 +1,254 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	dorasv1 "github.com/unbasical/doras/pkg/api/doras/v1"
+	backoff2 "github.com/unbasical/doras/pkg/backoff"
+	"github.com/unbasical/doras/pkg/client/edgeapi"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+	auth2 "oras.land/oras-go/v2/registry/remote/auth"
+)
+
+const testFrom = "registry.example/app@sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+// fakeServer responds with the scripted responses, each call consumes one script.
+type fakeServer struct {
+	dorasv1.UnimplementedDeltaServiceServer
+	scripts       []script
+	calls         int
+	authorization string
+}
+
+type script struct {
+	responses []*dorasv1.ReadDeltaResponse
+	err       error
+}
+
+func (f *fakeServer) next(ctx context.Context) script {
+	f.authorization = ""
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		f.authorization = values[0]
+	}
+	s := f.scripts[min(f.calls, len(f.scripts)-1)]
+	f.calls++
+	return s
+}
+
+func (f *fakeServer) ReadDelta(ctx context.Context, _ *dorasv1.ReadDeltaRequest) (*dorasv1.ReadDeltaResponse, error) {
+	s := f.next(ctx)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.responses[0], nil
+}
+
+func (f *fakeServer) WatchDelta(_ *dorasv1.ReadDeltaRequest, stream grpc.ServerStreamingServer[dorasv1.ReadDeltaResponse]) error {
+	s := f.next(stream.Context())
+	for _, res := range s.responses {
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+	return s.err
+}
+
+func (f *fakeServer) Capabilities(context.Context, *dorasv1.CapabilitiesRequest) (*dorasv1.CapabilitiesResponse, error) {
+	return &dorasv1.CapabilitiesResponse{Version: "test", MaxWait: 120, AuthSchemes: []string{"Bearer"}, TokenService: true}, nil
+}
+
+func newTestClient(t *testing.T, server *fakeServer, credentialFunc auth2.CredentialFunc) (*deltaClient, *[]time.Duration) {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	dorasv1.RegisterDeltaServiceServer(srv, server)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	c := NewDeltaClient(conn, credentialFunc).(*deltaClient)
+	var slept []time.Duration
+	c.sleep = func(d time.Duration) { slept = append(slept, d) }
+	return c, &slept
+}
+
+func ready() *dorasv1.ReadDeltaResponse {
+	return &dorasv1.ReadDeltaResponse{Status: dorasv1.DeltaStatus_DELTA_STATUS_READY, TargetImage: "registry.example/app:v2", DeltaImage: "registry.example/app:delta"}
+}
+
+func pending(in time.Duration) *dorasv1.ReadDeltaResponse {
+	return &dorasv1.ReadDeltaResponse{Status: dorasv1.DeltaStatus_DELTA_STATUS_PENDING, EstimatedCompletion: time.Now().Add(in).UTC().Format(time.RFC3339)}
+}
+
+func statusError(code codes.Code, message, context string, details ...*errdetails.RetryInfo) error {
+	st, err := status.New(code, message).WithDetails(&errdetails.ErrorInfo{
+		Reason:   code.String(),
+		Domain:   errorDomain,
+		Metadata: map[string]string{"message": message, "context": context},
+	})
+	if err != nil {
+		panic(err)
+	}
+	for _, d := range details {
+		if st, err = st.WithDetails(d); err != nil {
+			panic(err)
+		}
+	}
+	return st.Err()
+}
+
+func TestDeltaClient_RequestDelta(t *testing.T) {
+	tests := []struct {
+		name           string
+		script         script
+		wantDelta      bool
+		wantRetryAfter bool
+		wantErr        error
+		wantCode       codes.Code
+	}{
+		{name: "ready", script: script{responses: []*dorasv1.ReadDeltaResponse{ready()}}, wantDelta: true},
+		{name: "pending", script: script{responses: []*dorasv1.ReadDeltaResponse{pending(time.Minute)}}, wantRetryAfter: true},
+		{name: "identical", script: script{responses: []*dorasv1.ReadDeltaResponse{{Status: dorasv1.DeltaStatus_DELTA_STATUS_IDENTICAL}}}, wantErr: apicommon.ErrImagesIdentical},
+		{
+			name:     "incompatible",
+			script:   script{err: statusError(codes.FailedPrecondition, apicommon.ErrImagesIncompatible.InnerError.Message, apicommon.ErrImagesIncompatible.InnerError.ErrorContext)},
+			wantErr:  apicommon.ErrImagesIncompatible,
+			wantCode: codes.FailedPrecondition,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestClient(t, &fakeServer{scripts: []script{tt.script}}, nil)
+			res, retryAfter, err := c.RequestDelta(testFrom, "registry.example/app:v2", nil)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				var apiErr apicommon.APIError
+				if tt.wantCode != codes.OK && (!errors.As(err, &apiErr) || apiErr.InnerError.Code != int(tt.wantCode)) {
+					t.Errorf("expected code %v, got %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (res != nil) != tt.wantDelta {
+				t.Errorf("unexpected response %v", res)
+			}
+			if (retryAfter > 0) != tt.wantRetryAfter {
+				t.Errorf("unexpected retry after %v", retryAfter)
+			}
+		})
+	}
+}
+
+func TestDeltaClient_RequestDelta_authorization(t *testing.T) {
+	server := &fakeServer{scripts: []script{{responses: []*dorasv1.ReadDeltaResponse{ready()}}}}
+	c, _ := newTestClient(t, server, func(context.Context, string) (auth2.Credential, error) {
+		return auth2.Credential{AccessToken: "token"}, nil
+	})
+	if _, _, err := c.RequestDelta(testFrom, "registry.example/app:v2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if server.authorization != "Bearer token" {
+		t.Errorf("unexpected authorization %q", server.authorization)
+	}
+}
+
+func TestDeltaClient_WaitForDelta(t *testing.T) {
+	tooManyRequests := statusError(codes.ResourceExhausted, apicommon.ErrTooManyRequests.InnerError.Message, apicommon.ErrTooManyRequests.InnerError.ErrorContext,
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(3 * time.Second)})
+	tests := []struct {
+		name      string
+		scripts   []script
+		wantCalls int
+		wantSlept []time.Duration
+		wantErr   error
+	}{
+		{
+			name:      "ready after pending",
+			scripts:   []script{{responses: []*dorasv1.ReadDeltaResponse{pending(time.Minute), pending(time.Minute), ready()}}},
+			wantCalls: 1,
+		},
+		{
+			name:      "rate limited",
+			scripts:   []script{{err: tooManyRequests}, {responses: []*dorasv1.ReadDeltaResponse{ready()}}},
+			wantCalls: 2,
+			wantSlept: []time.Duration{3 * time.Second},
+		},
+		{
+			name:      "always rate limited",
+			scripts:   []script{{err: tooManyRequests}},
+			wantCalls: backoff2.DefaultMaxRetries + 1,
+			wantSlept: slices.Repeat([]time.Duration{3 * time.Second}, backoff2.DefaultMaxRetries),
+			wantErr:   backoff2.ErrMaxRetries,
+		},
+		{
+			name:      "identical",
+			scripts:   []script{{responses: []*dorasv1.ReadDeltaResponse{{Status: dorasv1.DeltaStatus_DELTA_STATUS_IDENTICAL}}}},
+			wantCalls: 1,
+			wantErr:   apicommon.ErrImagesIdentical,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &fakeServer{scripts: tt.scripts}
+			c, slept := newTestClient(t, server, nil)
+			res, err := c.WaitForDelta(testFrom, "registry.example/app:v2", nil)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+			} else if err != nil || res.DeltaImage != "registry.example/app:delta" {
+				t.Fatalf("unexpected response %v (%v)", res, err)
+			}
+			if server.calls != tt.wantCalls {
+				t.Errorf("expected %d calls, got %d", tt.wantCalls, server.calls)
+			}
+			if len(*slept) != len(tt.wantSlept) || (len(tt.wantSlept) > 0 && (*slept)[0] != tt.wantSlept[0]) {
+				t.Errorf("expected to sleep %v, slept %v", tt.wantSlept, *slept)
+			}
+		})
+	}
+}
+
+func TestDeltaClient_fromStatus_retryAfter(t *testing.T) {
+	err := fromStatus(statusError(codes.ResourceExhausted, "too many requests", "rate limit exceeded", &errdetails.RetryInfo{RetryDelay: durationpb.New(time.Second)}))
+	var retryErr *edgeapi.RetryAfterError
+	if !errors.As(err, &retryErr) || retryErr.RetryAfter != time.Second || !errors.Is(err, apicommon.ErrTooManyRequests) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestDeltaClient_Capabilities(t *testing.T) {
+	c, _ := newTestClient(t, &fakeServer{}, nil)
+	capabilities, err := c.Capabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capabilities.Version != "test" || capabilities.MaxWait != 120 || len(capabilities.Auth.Schemes) != 1 || !capabilities.Auth.TokenService {
+		t.Errorf("unexpected capabilities %v", capabilities)
+	}
+}
@@ -0,0 +1,156 @@
+// Package mqttwatch lets devices wait for deltas on the MQTT connection they already hold instead of polling the server.
+// The server announces created deltas on an MQTT topic if it has been configured with a broker (--mqtt-broker).
+package mqttwatch
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/mqtt"
+	"github.com/unbasical/doras/pkg/client/edgeapi"
+)
+
+// DefaultTopic is the topic on which the server announces created deltas unless another topic is configured.
+const DefaultTopic = "doras/deltas"
+
+// DefaultPollInterval is the interval in which the target is pulled while the server has no estimate when the delta is created.
+const DefaultPollInterval = 5 * time.Minute
+
+// Delays between attempts to reconnect to the broker.
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// Puller pulls images without blocking until the delta has been created, it is implemented by *updater.Client.
+// If the delta has not been created yet retryAfter is the duration after which the server expects it to be created (0 if it has no estimate).
+type Puller interface {
+	PullAsyncWithRetry(target string) (exists bool, retryAfter time.Duration, err error)
+}
+
+type options struct {
+	mqttOpts     []mqtt.Option
+	pollInterval time.Duration
+}
+
+// Option configures the watch, e.g. the connection to the broker.
+type Option func(*options)
+
+// WithClientID sets the MQTT client identifier, a random identifier is used by default.
+func WithClientID(clientID string) Option {
+	return func(o *options) {
+		o.mqttOpts = append(o.mqttOpts, mqtt.WithClientID(clientID))
+	}
+}
+
+// WithCredentials authenticates the device at the broker with the user name and password.
+func WithCredentials(username, password string) Option {
+	return func(o *options) {
+		o.mqttOpts = append(o.mqttOpts, mqtt.WithCredentials(username, password))
+	}
+}
+
+// WithTLSConfig configures TLS for brokers with TLS (mqtts://, ssl:// or tls://), e.g. client certificates.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *options) {
+		o.mqttOpts = append(o.mqttOpts, mqtt.WithTLSConfig(config))
+	}
+}
+
+// WithPollInterval sets the interval in which the target is pulled while the server has no estimate when the delta is created.
+func WithPollInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.pollInterval = interval
+	}
+}
+
+// Watch pulls the target with the puller and waits for the announcement of the delta on the topic of the broker
+// (e.g. tcp://broker.example:1883) instead of polling the server. It returns once the target has been pulled.
+// The target is pulled whenever the server announces a delta to the target and after each (re)connection to the broker,
+// so deltas that were announced while the device was disconnected are not missed.
+// Announcements are best effort (e.g. the delta creation fails or the server fails to publish), so the target is also pulled
+// once the server expects the delta to be created or after the poll interval if the server has no estimate (see WithPollInterval).
+// Errors of the puller are returned, unless the server asked the device to retry later.
+func Watch(ctx context.Context, broker, topic, target string, puller Puller, opts ...Option) error {
+	o := options{pollInterval: DefaultPollInterval}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	delay := minReconnectDelay
+	for {
+		done, err := watch(ctx, broker, topic, target, puller, o)
+		if done || ctx.Err() != nil {
+			return err
+		}
+		log.WithError(err).Warnf("lost connection to mqtt broker, reconnecting in %v", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+}
+
+// watch pulls the target on the connection to the broker until it has been pulled (done) or the connection is lost.
+func watch(ctx context.Context, broker, topic, target string, puller Puller, o options) (done bool, err error) {
+	client, err := mqtt.Dial(ctx, broker, o.mqttOpts...)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = client.Close() }()
+	// The handler must not block, announcements that arrive during a pull are coalesced into one pull.
+	announced := make(chan struct{}, 1)
+	err = client.Subscribe(ctx, topic, func(m mqtt.Message) {
+		var notification apicommon.DeltaReadyNotification
+		if err := json.Unmarshal(m.Payload, &notification); err != nil {
+			log.WithError(err).Debug("ignoring invalid delta notification")
+			return
+		}
+		if notification.To != target && notification.TargetImage != target {
+			return
+		}
+		select {
+		case announced <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+	// Pull right away, the delta might have been created before the subscription.
+	announced <- struct{}{}
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-announced:
+		case <-retry:
+		case <-client.Done():
+			return false, client.Err()
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+		retry = nil
+		exists, retryAfter, err := puller.PullAsyncWithRetry(target)
+		var retryErr *edgeapi.RetryAfterError
+		if errors.As(err, &retryErr) && retryErr.RetryAfter > 0 {
+			log.Debugf("server asked to retry after %v", retryErr.RetryAfter)
+			retry = time.After(retryErr.RetryAfter)
+			continue
+		}
+		if err != nil || exists {
+			return true, err
+		}
+		// The announcement might never arrive, the target is pulled again once the server expects the delta.
+		if retryAfter <= 0 {
+			retryAfter = o.pollInterval
+		}
+		retry = time.After(retryAfter)
+		log.Debugf("waiting for the announcement of the delta to %s, pulling again in %v", target, retryAfter)
+	}
+}
@@ -0,0 +1,164 @@
+package mqttwatch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/mqtt"
+	"github.com/unbasical/doras/internal/pkg/notify"
+	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+	"github.com/unbasical/doras/pkg/client/edgeapi"
+	"github.com/unbasical/doras/pkg/client/updater"
+)
+
+const testTarget = "registry.example/app:v2"
+
+var _ Puller = (*updater.Client)(nil)
+
+type pullResult struct {
+	exists     bool
+	retryAfter time.Duration
+	err        error
+}
+
+// scriptedPuller returns the scripted results, the last one is repeated.
+// Each call is reported on the calls channel.
+type scriptedPuller struct {
+	results []pullResult
+	calls   chan string
+	n       int
+}
+
+func (p *scriptedPuller) PullAsyncWithRetry(target string) (bool, time.Duration, error) {
+	r := p.results[min(p.n, len(p.results)-1)]
+	p.n++
+	p.calls <- target
+	return r.exists, r.retryAfter, r.err
+}
+
+func newScriptedPuller(results ...pullResult) *scriptedPuller {
+	return &scriptedPuller{results: results, calls: make(chan string, 10)}
+}
+
+func (p *scriptedPuller) awaitCall(t *testing.T) {
+	t.Helper()
+	select {
+	case target := <-p.calls:
+		if target != testTarget {
+			t.Errorf("expected pull of %s, got %s", testTarget, target)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("target has not been pulled")
+	}
+}
+
+func watchAsync(ctx context.Context, broker string, puller Puller, opts ...Option) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- Watch(ctx, broker, DefaultTopic, testTarget, puller, opts...)
+	}()
+	return result
+}
+
+func awaitResult(t *testing.T, result <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not return")
+		return nil
+	}
+}
+
+func TestWatch_announcement(t *testing.T) {
+	broker := testutils.LaunchMQTTBroker(t, "device", "secret")
+	puller := newScriptedPuller(pullResult{}, pullResult{exists: true})
+	result := watchAsync(context.Background(), broker, puller, WithCredentials("device", "secret"), WithClientID("device"))
+	// The target is pulled once the watch is connected, the delta has not been created yet.
+	puller.awaitCall(t)
+	n := notify.NewMQTTNotifier(broker, DefaultTopic, mqtt.WithCredentials("device", "secret"))
+	defer n.Close()
+	ctx := context.Background()
+	if err := n.DeltaReady(ctx, apicommon.DeltaReadyNotification{To: "registry.example/other:v2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.DeltaReady(ctx, apicommon.DeltaReadyNotification{To: testTarget}); err != nil {
+		t.Fatal(err)
+	}
+	puller.awaitCall(t)
+	if err := awaitResult(t, result); err != nil {
+		t.Fatal(err)
+	}
+	if puller.n != 2 {
+		t.Errorf("expected 2 pulls, got %d", puller.n)
+	}
+}
+
+func TestWatch_pullResults(t *testing.T) {
+	errPull := errors.New("pull failed")
+	tests := []struct {
+		name      string
+		results   []pullResult
+		opts      []Option
+		wantPulls int
+		wantErr   error
+	}{
+		{name: "exists", results: []pullResult{{exists: true}}, wantPulls: 1},
+		{name: "failed", results: []pullResult{{err: errPull}}, wantPulls: 1, wantErr: errPull},
+		{
+			name:      "retry after",
+			results:   []pullResult{{err: &edgeapi.RetryAfterError{Err: apicommon.ErrTooManyRequests, RetryAfter: 10 * time.Millisecond}}, {exists: true}},
+			wantPulls: 2,
+		},
+		// The broker never announces the delta, e.g. because the delta creation failed.
+		{
+			name:      "estimated creation without announcement",
+			results:   []pullResult{{retryAfter: 10 * time.Millisecond}, {exists: true}},
+			wantPulls: 2,
+		},
+		{
+			name:      "poll without announcement",
+			results:   []pullResult{{}, {}, {exists: true}},
+			opts:      []Option{WithPollInterval(10 * time.Millisecond)},
+			wantPulls: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := testutils.LaunchMQTTBroker(t, "", "")
+			puller := newScriptedPuller(tt.results...)
+			err := awaitResult(t, watchAsync(context.Background(), broker, puller, tt.opts...))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+			if puller.n != tt.wantPulls {
+				t.Errorf("expected %d pulls, got %d", tt.wantPulls, puller.n)
+			}
+		})
+	}
+}
+
+func TestWatch_cancel(t *testing.T) {
+	tests := []struct {
+		name   string
+		broker func(t *testing.T) string
+	}{
+		{name: "connected", broker: func(t *testing.T) string { return testutils.LaunchMQTTBroker(t, "", "") }},
+		{name: "unreachable", broker: func(*testing.T) string { return "tcp://127.0.0.1:1" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			result := watchAsync(ctx, tt.broker(t), newScriptedPuller(pullResult{}))
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+			if err := awaitResult(t, result); !errors.Is(err, context.Canceled) {
+				t.Errorf("expected %v, got %v", context.Canceled, err)
+			}
+		})
+	}
+}
@@ -2,22 +2,28 @@ package updater
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 
 	"github.com/samber/lo"
 	log "github.com/sirupsen/logrus"
 	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/internal/pkg/utils/tlsutils"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
 	"github.com/unbasical/doras/pkg/backoff"
 	"github.com/unbasical/doras/pkg/client/updater/fetcher"
 	"github.com/unbasical/doras/pkg/client/updater/inspector"
+	"github.com/unbasical/doras/pkg/client/updater/resolver"
 	"github.com/unbasical/doras/pkg/client/updater/statemanager"
 	"github.com/unbasical/doras/pkg/client/updater/updaterstate"
 	"github.com/unbasical/doras/pkg/client/updater/validator"
+	"github.com/unbasical/doras/pkg/signature"
 	"oras.land/oras-go/v2/registry/remote/auth"
 	"oras.land/oras-go/v2/registry/remote/credentials"
 
@@ -36,6 +42,13 @@ type clientOpts struct {
 	KeepOldDir           bool
 	Validators           []validator.ManifestValidator
 	Inspectors           []inspector.ArtifactInspector
+	SignatureValidator   *validator.SignatureValidator
+	ReferrersFallback    bool
+	ServerlessFallback   bool
+	ClientCertPath       string
+	ClientKeyPath        string
+	EdgeOptions          []edgeapi.Option
+	DeviceID             string
 }
 
 // NewClient creates a new Doras update client with the provided options.
@@ -75,11 +88,35 @@ func NewClient(options ...func(*Client)) (*Client, error) {
 
 	// construct cred func that unifies all credential funcs
 	credFunc := ociutils.NewCredentialsAggregate(credFuncOpts...)
-	c, err := edgeapi.NewEdgeClient(client.opts.RemoteURL, client.opts.InsecureAllowHTTP, credFunc)
+	edgeOpts := slices.Clone(client.opts.EdgeOptions)
+	if client.opts.ClientCertPath != "" {
+		// The certificate is reloaded if it is renewed on disk.
+		reloader, err := tlsutils.NewCertificateReloader(client.opts.ClientCertPath, client.opts.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		edgeOpts = append(edgeOpts, edgeapi.WithTLSConfig(&tls.Config{
+			MinVersion:           tls.VersionTLS12,
+			GetClientCertificate: reloader.GetClientCertificate,
+		}))
+	}
+	c, err := edgeapi.NewEdgeClient(client.opts.RemoteURL, client.opts.InsecureAllowHTTP, credFunc, edgeOpts...)
 	if err != nil {
 		return nil, err
 	}
 	client.edgeClient = c
+	if client.opts.RemoteURL != "" {
+		// Negotiate at startup to detect misconfigurations early, the result is cached by the edge client.
+		negotiated, err := c.Negotiate(client.opts.AcceptedAlgorithms)
+		if errors.Is(err, edgeapi.ErrNoCommonAlgorithm) || errors.Is(err, registry.ErrUnknownAlgorithm) {
+			return nil, err
+		}
+		if err != nil {
+			log.WithError(err).Warn("failed to negotiate algorithms with the server, trying again with the first request")
+		} else {
+			log.Debugf("using algorithms %v", negotiated)
+		}
+	}
 	initialState := updaterstate.State{
 		Version:        "2",
 		ArtifactStates: make(map[string]updaterstate.ArtifactState),
@@ -141,8 +178,20 @@ func NewClient(options ...func(*Client)) (*Client, error) {
 		return nil, err
 	}
 
+	validators := client.opts.Validators
+	if client.opts.SignatureValidator != nil {
+		validators = append(slices.Clone(validators), *client.opts.SignatureValidator)
+	}
 	storageSource := fetcher.NewRepoStorageSource(false, credFunc)
-	client.reg = fetcher.NewArtifactLoader(fetcherDir, storageSource, client.opts.Validators, client.opts.Inspectors)
+	client.fetcherDir = fetcherDir
+	client.validators = validators
+	client.reg = fetcher.NewArtifactLoader(fetcherDir, storageSource, validators, client.opts.Inspectors)
+	if client.opts.ReferrersFallback {
+		client.resolver = resolver.NewReferrersResolver(storageSource)
+	}
+	if client.opts.ServerlessFallback {
+		client.tagResolver = resolver.NewTagResolver(storageSource)
+	}
 	return client, nil
 }
 
@@ -268,3 +317,70 @@ func WithArtifactInspectors(inspectors []inspector.ArtifactInspector) func(clien
 		c.opts.Inspectors = inspectors
 	}
 }
+
+// WithSignatureVerification makes the client reject artifacts that are not signed by a trusted party.
+// Artifacts have to be signed with a key that is trusted by one of the artifactVerifiers.
+// Delta manifests have to be signed by the Doras server (deltaVerifiers) and have to lead to a trusted artifact.
+func WithSignatureVerification(artifactVerifiers, deltaVerifiers []signature.Verifier) func(client *Client) {
+	return func(c *Client) {
+		c.opts.SignatureValidator = &validator.SignatureValidator{
+			ArtifactVerifiers: artifactVerifiers,
+			DeltaVerifiers:    deltaVerifiers,
+		}
+	}
+}
+
+// WithReferrersFallback makes the client look up deltas among the referrers of the target image
+// if the Doras server cannot be reached.
+// This requires the server to store deltas as referrers.
+func WithReferrersFallback(referrersFallback bool) func(client *Client) {
+	return func(c *Client) {
+		c.opts.ReferrersFallback = referrersFallback
+	}
+}
+
+// WithServerlessFallback makes the client look for an existing delta in the registry before requesting it from the Doras server.
+// The server is only contacted if the delta does not exist yet, so updates to images for which deltas were already created
+// do not depend on the server being available.
+// This requires the server to store deltas at tags.
+func WithServerlessFallback(serverlessFallback bool) func(client *Client) {
+	return func(c *Client) {
+		c.opts.ServerlessFallback = serverlessFallback
+	}
+}
+
+// WithClientCertificate makes the client authenticate to the Doras server with the PEM encoded certificate and key (mTLS).
+// The server maps the identity of the certificate to registry credentials, so the client does not have to send registry
+// credentials with its delta requests.
+// The files are reloaded when they change, which allows renewing the certificate without restarting the client.
+func WithClientCertificate(certPath, keyPath string) func(*Client) {
+	return func(c *Client) {
+		c.opts.ClientCertPath = certPath
+		c.opts.ClientKeyPath = keyPath
+	}
+}
+
+// WithDeviceKey makes the client request short-lived tokens from the token service of the Doras server,
+// they are used for delta requests instead of registry credentials. The device authenticates with its ID and key.
+func WithDeviceKey(deviceID, key string) func(*Client) {
+	return func(c *Client) {
+		c.opts.DeviceID = deviceID
+		c.opts.EdgeOptions = append(c.opts.EdgeOptions, edgeapi.WithDeviceKey(deviceID, key))
+	}
+}
+
+// WithDeviceJWT is like WithDeviceKey, but the device authenticates with a JWT that is trusted by the Doras server.
+// The function is called whenever a token is requested, so it can return renewed JWTs.
+func WithDeviceJWT(jwt func() (string, error)) func(*Client) {
+	return func(c *Client) {
+		c.opts.EdgeOptions = append(c.opts.EdgeOptions, edgeapi.WithDeviceJWT(jwt))
+	}
+}
+
+// WithDeviceID identifies the device when it asks the Doras server for its target (see Client.Target).
+// Devices that authenticate with WithDeviceKey are identified by their ID, devices that use WithDeviceJWT are identified by the JWT.
+func WithDeviceID(deviceID string) func(*Client) {
+	return func(c *Client) {
+		c.opts.DeviceID = deviceID
+	}
+}
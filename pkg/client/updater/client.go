@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path"
-	"strings"
+	"time"
 
 	"golang.org/x/mod/sumdb/dirhash"
 
@@ -14,29 +14,37 @@ import (
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	log "github.com/sirupsen/logrus"
 	"github.com/unbasical/doras/internal/pkg/api/apicommon"
-	"github.com/unbasical/doras/internal/pkg/utils/compressionutils"
 	"github.com/unbasical/doras/internal/pkg/utils/fileutils"
 	"github.com/unbasical/doras/internal/pkg/utils/tarutils"
 	"github.com/unbasical/doras/pkg/backoff"
+	"github.com/unbasical/doras/pkg/client/bundle"
 	"github.com/unbasical/doras/pkg/client/updater/fetcher"
+	"github.com/unbasical/doras/pkg/client/updater/resolver"
 	"github.com/unbasical/doras/pkg/client/updater/statemanager"
 	"github.com/unbasical/doras/pkg/client/updater/updaterstate"
+	"github.com/unbasical/doras/pkg/client/updater/validator"
 	"github.com/unbasical/doras/pkg/constants"
 
 	"github.com/unbasical/doras/internal/pkg/algorithmchoice"
 	"github.com/unbasical/doras/internal/pkg/compression/gzip"
-	"github.com/unbasical/doras/internal/pkg/compression/zstd"
-	"github.com/unbasical/doras/internal/pkg/delta/bsdiff"
-	"github.com/unbasical/doras/internal/pkg/delta/tardiff"
 	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/pkg/algorithm/delta"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
 	"github.com/unbasical/doras/pkg/client/edgeapi"
 )
 
+// ErrBundleNotApplicable is returned if an offline update bundle does not update the artifact in the output directory.
+var ErrBundleNotApplicable = errors.New("bundle is not applicable")
+
 // Client is used to run delta updates in Doras.
 type Client struct {
 	opts          clientOpts
 	edgeClient    edgeapi.DeltaApiClient
 	reg           fetcher.ArtifactLoader
+	fetcherDir    string
+	validators    []validator.ManifestValidator
+	resolver      resolver.DeltaResolver
+	tagResolver   resolver.DeltaResolver
 	state         *statemanager.Manager[updaterstate.State]
 	ctx           context.Context
 	backoff       backoff.Strategy
@@ -45,16 +53,33 @@ type Client struct {
 
 // Pull an image from the registry.
 // This is just a wrapper around PullAsync that blocks until it succeeds or errors.
+// If the server asks the client to retry later (e.g. because of rate limiting or because it estimated when the delta is created),
+// it waits as long as requested, at most backoff.DefaultMaxRetries times.
 func (c *Client) Pull(image string) error {
-	//TODO: add backoff mechanism from API client
+	retries := backoff.NewRetries(backoff.DefaultMaxRetries)
 	for {
-		exists, err := c.PullAsync(image)
+		exists, retryAfter, err := c.pullAsync(image)
+		var retryErr *edgeapi.RetryAfterError
+		if errors.As(err, &retryErr) && retryErr.RetryAfter > 0 {
+			log.Debugf("server asked to retry after %v", retryErr.RetryAfter)
+			if err := waitRetryAfter(retries, retryErr.RetryAfter); err != nil {
+				return err
+			}
+			continue
+		}
 		if err != nil {
 			return err
 		}
 		if exists {
 			return nil
 		}
+		if retryAfter > 0 {
+			log.Debugf("server expects the delta to be created after %v", retryAfter)
+			if err := waitRetryAfter(retries, retryAfter); err != nil {
+				return err
+			}
+			continue
+		}
 		err = c.backoff.Wait()
 		if err != nil {
 			return err
@@ -62,112 +87,270 @@ func (c *Client) Pull(image string) error {
 	}
 }
 
+// waitRetryAfter waits as long as the server asked, the wait counts against the retries of the request.
+func waitRetryAfter(retries *backoff.Retries, retryAfter time.Duration) error {
+	if err := retries.Next(); err != nil {
+		return fmt.Errorf("%w: the server keeps asking to retry later", err)
+	}
+	time.Sleep(retryAfter)
+	return nil
+}
+
 // getPatcherChoice extracts the algorithms that were used to create the delta from the provided v1.Descriptor.
 func (c *Client) getPatcherChoice(d *v1.Descriptor, patcherTmpDir string) (algorithmchoice.PatcherChoice, error) {
-	choice := algorithmchoice.PatcherChoice{
-		// initialize with default
-		Decompressor: compressionutils.NewNopDecompressor(),
-	}
-	trimmed := strings.TrimPrefix(d.MediaType, "application/")
-	split := strings.Split(trimmed, "+")
-	if len(split) == 2 {
-		switch split[1] {
-		case "gzip":
-			choice.Decompressor = gzip.NewDecompressor()
-		case "zstd":
-			choice.Decompressor = zstd.NewDecompressor()
-		default:
-			panic("not supported")
-		}
-	}
-	switch split[0] {
-	case "bsdiff":
-		choice.Patcher = bsdiff.NewPatcherWithTempDir(patcherTmpDir)
-	case "tardiff":
-		choice.Patcher = tardiff.NewPatcherWithTempDir(patcherTmpDir, c.opts.KeepOldDir, c.opts.OutputDirPermissions)
-	default:
-		return algorithmchoice.PatcherChoice{}, fmt.Errorf("unsupported patcher: %s", split[0])
-	}
-	return choice, nil
+	return algorithmchoice.NewPatcherChoice(d.MediaType, registry.PatcherOptions{
+		TempDir:              patcherTmpDir,
+		KeepOldDir:           c.opts.KeepOldDir,
+		OutputDirPermissions: c.opts.OutputDirPermissions,
+	})
 }
 
 // PullAsync Pull delta, but do not block if the delta has not been created yet.
 // The result of the pull is according to the client configuration.
 func (c *Client) PullAsync(target string) (exists bool, err error) {
+	exists, _, err = c.pullAsync(target)
+	return exists, err
+}
+
+// PullAsyncWithRetry behaves like PullAsync, if the delta has not been created yet retryAfter is the duration
+// after which the server expects it to be created (0 if it has no estimate).
+func (c *Client) PullAsyncWithRetry(target string) (exists bool, retryAfter time.Duration, err error) {
+	return c.pullAsync(target)
+}
+
+// Target asks the Doras server which image the device should run according to its rollouts (see WithDeviceID).
+// The repository is optional if the device is only targeted by rollouts of a single repository.
+// The returned image is identified by its digest, an error that matches apicommon.ErrNoTarget is returned if no rollout targets the device.
+func (c *Client) Target(repository string) (string, error) {
+	res, err := c.edgeClient.Target(c.opts.DeviceID, repository)
+	if err != nil {
+		return "", err
+	}
+	return res.Image, nil
+}
+
+// PullTarget asks the Doras server for the target of the device and pulls it, see Target and Pull.
+// If no rollout targets the device the output directory is left as it is.
+// Rate limited requests are retried like the requests of Pull.
+func (c *Client) PullTarget(repository string) error {
+	retries := backoff.NewRetries(backoff.DefaultMaxRetries)
+	for {
+		target, err := c.Target(repository)
+		var retryErr *edgeapi.RetryAfterError
+		if errors.As(err, &retryErr) && retryErr.RetryAfter > 0 {
+			log.Debugf("server asked to retry after %v", retryErr.RetryAfter)
+			if err := waitRetryAfter(retries, retryErr.RetryAfter); err != nil {
+				return err
+			}
+			continue
+		}
+		if errors.Is(err, apicommon.ErrNoTarget) {
+			log.Info("no rollout targets the device, keeping the current image")
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to determine target: %w", err)
+		}
+		log.Infof("pulling target %s", target)
+		return c.Pull(target)
+	}
+}
+
+// pullAsync behaves like PullAsync, if the delta has not been created yet retryAfter is the duration
+// after which the server expects it to be created (0 if it has no estimate).
+func (c *Client) pullAsync(target string) (exists bool, retryAfter time.Duration, err error) {
 	s, err := c.state.Load()
 	if err != nil {
-		return false, err
+		return false, 0, err
 	}
 	repoName, _, _, err := ociutils.ParseOciImageString(target)
 	if err != nil {
-		return false, err
+		return false, 0, err
 	}
 	// find out what the current version is, if there is none load a full image
 	d, err := s.GetArtifactState(c.opts.OutputDirectory, repoName)
 	if err != nil {
 		log.WithError(err).Debugf("got err:%q while loading state, attempting to load full image", err)
-		return c.pullFullImage(target)
+		exists, err = c.pullFullImage(target)
+		return exists, 0, err
 	}
 	outputDirectoryHash, err := dirhash.HashDir(c.opts.OutputDirectory, "", dirhash.Hash1)
 	if err != nil {
-		return false, err
+		return false, 0, err
 	}
 	if d.DirectoryDigest != digest.Digest(outputDirectoryHash) {
 		log.WithError(err).Warn("detected modifications to output directory, doing a clean pull")
-		return c.pullFullImage(target)
+		exists, err = c.pullFullImage(target)
+		return exists, 0, err
 	}
 	// if we have an initial state we want to use a delta update
 	return c.pullDeltaImageAsync(target, repoName, &d.ImageDigest)
 }
 
-func (c *Client) pullDeltaImageAsync(target string, repoName string, currentVersion *digest.Digest) (bool, error) {
+// isDeltaUnavailable checks whether the server refused to create a delta for the images, a full update is required.
+func isDeltaUnavailable(err error) bool {
+	return errors.Is(err, apicommon.ErrImagesIncompatible) || errors.Is(err, apicommon.ErrArtifactTooLarge) || errors.Is(err, apicommon.ErrQuotaExceeded)
+}
+
+func (c *Client) pullDeltaImageAsync(target string, repoName string, currentVersion *digest.Digest) (bool, time.Duration, error) {
 	currentImage := fmt.Sprintf("%s@%s", repoName, currentVersion.String())
-	// request delta from server asynchronously
-	res, exists, err := c.edgeClient.ReadDeltaAsync(currentImage, target, c.opts.AcceptedAlgorithms)
+	res, exists, err := c.lookupDelta(currentImage, target)
+	var retryAfter time.Duration
+	if !exists && err == nil {
+		// request delta from server asynchronously
+		res, retryAfter, err = c.edgeClient.RequestDelta(currentImage, target, c.opts.AcceptedAlgorithms)
+		exists = res != nil
+	}
+	if err != nil && !errors.Is(err, apicommon.ErrImagesIdentical) && !isDeltaUnavailable(err) && c.resolver != nil {
+		log.WithError(err).Warn("failed to request delta from server, looking up delta in the registry")
+		res, err = c.resolveDelta(currentImage, target, err)
+		exists = err == nil
+	}
 	if err != nil {
 		if errors.Is(err, apicommon.ErrImagesIdentical) {
 			log.Info("already up-to-date")
-			return true, nil
+			return true, 0, nil
 		}
-		if errors.Is(err, apicommon.ErrImagesIncompatible) {
-			return c.pullFullImage(target)
+		if isDeltaUnavailable(err) {
+			exists, err = c.pullFullImage(target)
+			return exists, 0, err
 		}
-		return false, err
+		return false, 0, err
 	}
 	if !exists {
-		return false, nil
+		return false, retryAfter, nil
 	}
 	log.Info("attempting delta update")
+	err = c.applyDelta(c.reg, res.DeltaImage, res.TargetImage)
+	if errors.Is(err, delta.ErrDigestMismatch) {
+		log.WithError(err).Warn("patched artifact failed verification, falling back to loading the full artifact")
+		exists, err = c.pullFullImage(target)
+		return exists, 0, err
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	return true, 0, nil
+}
+
+// applyDelta loads the delta with the loader, patches the output directory in place and records the target image in the state.
+func (c *Client) applyDelta(loader fetcher.ArtifactLoader, deltaImage, targetImage string) error {
 	deltaDir, err := os.MkdirTemp(c.opts.InternalDirectory, "deltas-*")
 	if err != nil {
-		return false, err
+		return err
 	}
 	defer func() {
 		_ = os.RemoveAll(deltaDir)
 	}()
-	_, _, deltas, err := c.reg.ResolveAndLoadToPath(res.DeltaImage, deltaDir)
+	_, mfDelta, deltas, err := loader.ResolveAndLoadToPath(deltaImage, deltaDir)
 	if err != nil {
-		return false, err
+		return err
+	}
+	// The signature validator verified the image the delta leads to, make sure it is the one we asked for.
+	if c.opts.SignatureValidator != nil && mfDelta.Annotations[constants.DorasAnnotationTo] != targetImage {
+		return fmt.Errorf("delta leads to %q instead of %q", mfDelta.Annotations[constants.DorasAnnotationTo], targetImage)
 	}
 	// patch output directory in place
 	for _, d := range deltas {
 		err := c.patchArtifact(d)
 		if err != nil {
-			return false, err
+			return err
 		}
 	}
 	dirHash, err := dirhash.HashDir(c.opts.OutputDirectory, "", dirhash.Hash1)
 	if err != nil {
-		return false, err
+		return err
 	}
 	dirHashDigest := digest.Digest(dirHash)
-	err = c.state.ModifyState(func(u *updaterstate.State) error {
-		return u.SetArtifactState(c.opts.OutputDirectory, res.TargetImage, dirHashDigest)
+	return c.state.ModifyState(func(u *updaterstate.State) error {
+		return u.SetArtifactState(c.opts.OutputDirectory, targetImage, dirHashDigest)
 	})
+}
+
+// ApplyBundle applies the delta of an offline update bundle (see bundle.Create) to the output directory.
+// The output directory has to contain the image the delta was created from, the server is never contacted.
+// If signature verification is enabled the signatures are verified with the content of the bundle.
+func (c *Client) ApplyBundle(path string) error {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	b, err := bundle.Open(ctx, path)
 	if err != nil {
-		return false, err
+		return err
 	}
-	return true, nil
+	s, err := c.state.Load()
+	if err != nil {
+		return err
+	}
+	repoName, _, _, err := ociutils.ParseOciImageString(b.To)
+	if err != nil {
+		return err
+	}
+	d, err := s.GetArtifactState(c.opts.OutputDirectory, repoName)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBundleNotApplicable, err)
+	}
+	currentImage := fmt.Sprintf("%s@%s", repoName, d.ImageDigest.String())
+	if currentImage == b.To {
+		log.Info("already up-to-date")
+		return nil
+	}
+	if currentImage != b.From {
+		return fmt.Errorf("%w: the bundle updates %s but the output directory contains %s", ErrBundleNotApplicable, b.From, currentImage)
+	}
+	outputDirectoryHash, err := dirhash.HashDir(c.opts.OutputDirectory, "", dirhash.Hash1)
+	if err != nil {
+		return err
+	}
+	if d.DirectoryDigest != digest.Digest(outputDirectoryHash) {
+		return fmt.Errorf("%w: detected modifications to the output directory", ErrBundleNotApplicable)
+	}
+	log.Infof("applying bundle %s", path)
+	loader := fetcher.NewArtifactLoader(c.fetcherDir, b, c.validators, c.opts.Inspectors)
+	return c.applyDelta(loader, fmt.Sprintf("%s@%s", repoName, b.Delta.Digest.String()), b.To)
+}
+
+// lookupDelta checks whether the delta was already created and stored in the registry before asking the server for it.
+// Returns false if the delta has to be requested from the server.
+func (c *Client) lookupDelta(currentImage, target string) (*apicommon.ReadDeltaResponse, bool, error) {
+	if c.tagResolver == nil {
+		return nil, false, nil
+	}
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	res, err := c.tagResolver.ResolveDelta(ctx, currentImage, target, c.opts.AcceptedAlgorithms)
+	if errors.Is(err, apicommon.ErrImagesIdentical) {
+		return nil, false, err
+	}
+	if errors.Is(err, resolver.ErrNoDelta) {
+		log.Debug("no finished delta in the registry, requesting delta from server")
+		return nil, false, nil
+	}
+	if err != nil {
+		log.WithError(err).Warn("failed to look up delta in the registry, requesting delta from server")
+		return nil, false, nil
+	}
+	return res, true, nil
+}
+
+// resolveDelta looks up an existing delta without involving the server.
+// The error of the failed server request is returned if there is no such delta.
+func (c *Client) resolveDelta(currentImage, target string, serverErr error) (*apicommon.ReadDeltaResponse, error) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	res, err := c.resolver.ResolveDelta(ctx, currentImage, target, c.opts.AcceptedAlgorithms)
+	if errors.Is(err, resolver.ErrNoDelta) {
+		return nil, serverErr
+	}
+	if err != nil {
+		return nil, errors.Join(serverErr, err)
+	}
+	return res, nil
 }
 
 func (c *Client) patchArtifact(d fetcher.LoadResult) error {
@@ -175,25 +358,50 @@ func (c *Client) patchArtifact(d fetcher.LoadResult) error {
 	if err != nil {
 		return err
 	}
+	expected, err := getExpectedDigest(&d.D, algorithmchoice.IsArchiveAlgorithm(p.Patcher))
+	if err != nil {
+		return err
+	}
 	fp, err := os.Open(d.Path)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = fp.Close()
+	}()
 	decompressedPatch, err := p.Decompress(fp)
 	if err != nil {
 		return err
 	}
-	// digest is not provided, however we already verified a digest while fetching the deltas
-	// PatchFilesystem() takes care of robust file swapping
-	err = p.PatchFilesystem(c.opts.OutputDirectory, decompressedPatch, nil)
+	// PatchFilesystem() takes care of robust file swapping and verifies the output if the expected digest is known
+	err = p.PatchFilesystem(c.opts.OutputDirectory, decompressedPatch, expected)
 	if err != nil {
 		return err
 	}
-	_ = fp.Close()
 	_ = os.Remove(d.Path)
 	return nil
 }
 
+// getExpectedDigest extracts the digest of the patched artifact from the annotations of the delta layer.
+// Returns nil if the delta does not contain the digest, e.g. because it was created by an older server.
+func getExpectedDigest(d *v1.Descriptor, isArchive bool) (*digest.Digest, error) {
+	// Archive algorithms (tardiff) output the uncompressed archive, hence the digest of the (compressed) target layer cannot be used.
+	key := constants.DorasAnnotationTargetDigest
+	if isArchive {
+		key = constants.DorasAnnotationTargetTarDigest
+	}
+	val, ok := d.Annotations[key]
+	if !ok {
+		log.Debugf("delta %s does not contain the digest of the patched artifact, skipping verification", d.Digest)
+		return nil, nil
+	}
+	expected, err := digest.Parse(val)
+	if err != nil {
+		return nil, fmt.Errorf("delta contains invalid digest of the patched artifact: %w", err)
+	}
+	return &expected, nil
+}
+
 //nolint:revive
 func (c *Client) pullFullImage(targetImage string) (bool, error) {
 	log.Info("attempting to load full artifact")
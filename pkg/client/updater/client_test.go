@@ -8,6 +8,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -21,14 +22,18 @@ import (
 	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
 	"github.com/unbasical/doras/internal/pkg/utils/tarutils"
 	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+	"github.com/unbasical/doras/pkg/backoff"
+	"github.com/unbasical/doras/pkg/client/bundle"
 	"github.com/unbasical/doras/pkg/client/edgeapi"
 	"github.com/unbasical/doras/pkg/client/updater/fetcher"
 	"github.com/unbasical/doras/pkg/client/updater/inspector"
 	"github.com/unbasical/doras/pkg/client/updater/statemanager"
 	"github.com/unbasical/doras/pkg/client/updater/updaterstate"
 	"github.com/unbasical/doras/pkg/client/updater/validator"
+	"github.com/unbasical/doras/pkg/constants"
 	"golang.org/x/mod/sumdb/dirhash"
 	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/oci"
 )
 
 func TestClient_PullAsyncTardiff(t *testing.T) {
@@ -202,6 +207,31 @@ func TestClient_PullAsyncTardiff(t *testing.T) {
 				version: &currentDescriptor,
 			},
 		},
+		{
+			name: "success (initialized, but artifact too large for a delta)",
+			fields: fields{
+				opts: func() clientOpts {
+					return clientOpts{
+						OutputDirectory:      outDir,
+						InternalDirectory:    internalDir,
+						OutputDirPermissions: 0755,
+					}
+				}(),
+				edgeClient: &mockApiClient{f: func() (res *apicommon.ReadDeltaResponse, exists bool, err error) {
+					return nil, false, apicommon.ErrArtifactTooLarge
+				}},
+				reg: fetcher.NewArtifactLoader(t.TempDir(), &mockStorageSource{s: s}, nil, nil)},
+			args: args{
+				target: targetImage,
+			},
+			wantExists:     true,
+			wantErr:        false,
+			expectedDir:    expectedDir,
+			expectedDigest: &targetDescriptor.Digest,
+			initialState: initialState{
+				version: &currentDescriptor,
+			},
+		},
 		{
 			name: "success (images are identical)",
 			fields: fields{
@@ -736,6 +766,12 @@ func TestClient_PullAsyncBsdiff(t *testing.T) {
 		{Name: "artifact", Data: []byte(from), Tag: "v1"},
 		{Name: "artifact", Data: []byte(to), Tag: "v2"},
 		{Name: "delta.patch.bsdiff", Data: diffBytes, Tag: "delta", NeedsUnpack: false, MediaType: "application/bsdiff"},
+		{Name: "delta.patch.bsdiff", Data: diffBytes, Tag: "delta-verified", NeedsUnpack: false, MediaType: "application/bsdiff", Annotations: map[string]string{
+			constants.DorasAnnotationTargetDigest: digest.FromString(to).String(),
+		}},
+		{Name: "delta.patch.bsdiff", Data: diffBytes, Tag: "delta-mismatch", NeedsUnpack: false, MediaType: "application/bsdiff", Annotations: map[string]string{
+			constants.DorasAnnotationTargetDigest: digest.FromString("corrupted").String(),
+		}},
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -768,6 +804,20 @@ func TestClient_PullAsyncBsdiff(t *testing.T) {
 	}
 	targetImage := fmt.Sprintf("%s@%s", repoName, targetDescriptor.Digest.String())
 	deltaImage := fmt.Sprintf("%s@%s", repoName, deltaDescriptor.Digest.String())
+	deltaImageVerified := func() string {
+		d, err := s.Resolve(ctx, "delta-verified")
+		if err != nil {
+			t.Fatal()
+		}
+		return fmt.Sprintf("%s@%s", repoName, d.Digest.String())
+	}()
+	deltaImageMismatch := func() string {
+		d, err := s.Resolve(ctx, "delta-mismatch")
+		if err != nil {
+			t.Fatal()
+		}
+		return fmt.Sprintf("%s@%s", repoName, d.Digest.String())
+	}()
 	type initialState struct {
 		version *ocispec.Descriptor
 	}
@@ -818,6 +868,64 @@ func TestClient_PullAsyncBsdiff(t *testing.T) {
 				version: &currentDescriptor,
 			},
 		},
+		{
+			name: "success (initialized, verified output)",
+			fields: fields{
+				opts: func() clientOpts {
+					return clientOpts{
+						OutputDirectory:      outDir,
+						InternalDirectory:    internalDir,
+						OutputDirPermissions: 0755,
+					}
+				}(),
+				edgeClient: &mockApiClient{f: func() (res *apicommon.ReadDeltaResponse, exists bool, err error) {
+					retval := apicommon.ReadDeltaResponse{
+						TargetImage: targetImage,
+						DeltaImage:  deltaImageVerified,
+					}
+					return &retval, true, nil
+				}},
+				reg: fetcher.NewArtifactLoader(t.TempDir(), &mockStorageSource{s: s}, nil, nil)},
+			args: args{
+				target: targetImage,
+			},
+			wantExists:     true,
+			wantErr:        false,
+			expectedDir:    expectedDir,
+			expectedDigest: &targetDescriptor.Digest,
+			initialState: initialState{
+				version: &currentDescriptor,
+			},
+		},
+		{
+			name: "success (initialized, output mismatch falls back to full image)",
+			fields: fields{
+				opts: func() clientOpts {
+					return clientOpts{
+						OutputDirectory:      outDir,
+						InternalDirectory:    internalDir,
+						OutputDirPermissions: 0755,
+					}
+				}(),
+				edgeClient: &mockApiClient{f: func() (res *apicommon.ReadDeltaResponse, exists bool, err error) {
+					retval := apicommon.ReadDeltaResponse{
+						TargetImage: targetImage,
+						DeltaImage:  deltaImageMismatch,
+					}
+					return &retval, true, nil
+				}},
+				reg: fetcher.NewArtifactLoader(t.TempDir(), &mockStorageSource{s: s}, nil, nil)},
+			args: args{
+				target: targetImage,
+			},
+			wantExists:     true,
+			wantErr:        false,
+			expectedDir:    expectedDir,
+			expectedDigest: &targetDescriptor.Digest,
+			initialState: initialState{
+				version: &currentDescriptor,
+			},
+		},
 		{
 			name: "success (uninitialized)",
 			fields: fields{
@@ -1146,17 +1254,220 @@ func (m *mockStorageSource) GetTarget(_ string) (oras.ReadOnlyTarget, error) {
 }
 
 type mockApiClient struct {
-	f func() (res *apicommon.ReadDeltaResponse, exists bool, err error)
+	f      func() (res *apicommon.ReadDeltaResponse, exists bool, err error)
+	target func(device, repository string) (*apicommon.TargetResponse, error)
 }
 
 func (m *mockApiClient) ReadDeltaAsync(_, _ string, _ []string) (res *apicommon.ReadDeltaResponse, exists bool, err error) {
 	return m.f()
 }
 
+func (m *mockApiClient) RequestDelta(_, _ string, _ []string) (res *apicommon.ReadDeltaResponse, retryAfter time.Duration, err error) {
+	res, exists, err := m.f()
+	if !exists {
+		res = nil
+	}
+	return res, 0, err
+}
+
 func (m *mockApiClient) ReadDelta(from, to string, acceptedAlgorithms []string) (*apicommon.ReadDeltaResponse, error) {
 	panic("not implemented")
 }
 
+func (m *mockApiClient) WaitForDelta(from, to string, acceptedAlgorithms []string) (*apicommon.ReadDeltaResponse, error) {
+	panic("not implemented")
+}
+
 func (m *mockApiClient) ReadDeltaAsStream(from, to string, acceptedAlgorithms []string) (*ocispec.Descriptor, string, io.ReadCloser, error) {
 	panic("not implemented")
 }
+
+func (m *mockApiClient) Capabilities() (*apicommon.CapabilitiesResponse, error) {
+	panic("not implemented")
+}
+
+func (m *mockApiClient) Negotiate(acceptedAlgorithms []string) ([]string, error) {
+	return acceptedAlgorithms, nil
+}
+
+func (m *mockApiClient) Target(device, repository string) (*apicommon.TargetResponse, error) {
+	if m.target == nil {
+		panic("not implemented")
+	}
+	return m.target(device, repository)
+}
+
+func TestClient_ApplyBundle(t *testing.T) {
+	ctx := context.Background()
+	from := "hello"
+	to := "hello world"
+	diff, err := bsdiff2.NewDiffer().Diff(strings.NewReader(from), strings.NewReader(to))
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffBytes, err := io.ReadAll(diff)
+	_ = diff.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := oci.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := func(data string, mediaType string, annotations map[string]string) ocispec.Descriptor {
+		d := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromString(data), Size: int64(len(data)), Annotations: annotations}
+		if err := src.Push(ctx, d, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	pack := func(layer ocispec.Descriptor, annotations map[string]string) ocispec.Descriptor {
+		d, err := oras.PackManifest(ctx, src, oras.PackManifestVersion1_1, "application/vnd.test.artifact", oras.PackManifestOptions{
+			Layers:              []ocispec.Descriptor{layer},
+			ManifestAnnotations: annotations,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	repoName := "registry.example.org/foo"
+	fromDescriptor := pack(push(from, "application/vnd.test.file", map[string]string{constants.OciImageTitle: "artifact"}), nil)
+	toDescriptor := pack(push(to, "application/vnd.test.file", map[string]string{constants.OciImageTitle: "artifact"}), nil)
+	otherDescriptor := pack(push("other", "application/vnd.test.file", map[string]string{constants.OciImageTitle: "artifact"}), nil)
+	deltaDescriptor := pack(push(string(diffBytes), "application/bsdiff", map[string]string{
+		constants.OciImageTitle:               "delta.patch.bsdiff",
+		constants.DorasAnnotationTargetDigest: digest.FromString(to).String(),
+	}), map[string]string{
+		constants.DorasAnnotationFrom: fmt.Sprintf("%s@%s", repoName, fromDescriptor.Digest),
+		constants.DorasAnnotationTo:   fmt.Sprintf("%s@%s", repoName, toDescriptor.Digest),
+	})
+	bundlePath := path.Join(t.TempDir(), "bundle.tar")
+	if err := bundle.Create(ctx, src, deltaDescriptor, src, bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	descriptorsToData := map[digest.Digest]string{
+		fromDescriptor.Digest:  from,
+		toDescriptor.Digest:    to,
+		otherDescriptor.Digest: "other",
+	}
+	tests := []struct {
+		name         string
+		version      *ocispec.Descriptor
+		expectedData string
+		wantErr      error
+	}{
+		{name: "success", version: &fromDescriptor, expectedData: to},
+		{name: "already up-to-date", version: &toDescriptor, expectedData: to},
+		{name: "different version", version: &otherDescriptor, expectedData: "other", wantErr: ErrBundleNotApplicable},
+		{name: "uninitialized", version: nil, wantErr: ErrBundleNotApplicable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outDir := t.TempDir()
+			internalDir := t.TempDir()
+			states := map[string]updaterstate.ArtifactState{}
+			if tt.version != nil {
+				err := os.WriteFile(path.Join(outDir, "artifact"), []byte(descriptorsToData[tt.version.Digest]), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dirHash, err := dirhash.HashDir(outDir, "", dirhash.Hash1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				states[fmt.Sprintf("(%s,%s)", outDir, repoName)] = updaterstate.ArtifactState{
+					ImageDigest:     tt.version.Digest,
+					DirectoryDigest: digest.Digest(dirHash),
+				}
+			}
+			s, err := statemanager.New(updaterstate.State{Version: "2", ArtifactStates: states}, path.Join(internalDir, "state.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &Client{
+				opts: clientOpts{
+					OutputDirectory:      outDir,
+					InternalDirectory:    internalDir,
+					OutputDirPermissions: 0755,
+				},
+				state:      s,
+				fetcherDir: t.TempDir(),
+			}
+			err = c.ApplyBundle(bundlePath)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ApplyBundle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.version == nil {
+				return
+			}
+			data, err := os.ReadFile(path.Join(outDir, "artifact"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.expectedData {
+				t.Errorf("expected %q, got %q", tt.expectedData, data)
+			}
+			st, err := s.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			state, err := st.GetArtifactState(outDir, repoName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr == nil && state.ImageDigest != toDescriptor.Digest {
+				t.Errorf("expected state %s, got %s", toDescriptor.Digest, state.ImageDigest)
+			}
+		})
+	}
+}
+
+func TestClient_Target(t *testing.T) {
+	const image = "registry.example.org/app@sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	var devices []string
+	c := &Client{
+		opts: clientOpts{DeviceID: "device-1"},
+		edgeClient: &mockApiClient{target: func(device, repository string) (*apicommon.TargetResponse, error) {
+			devices = append(devices, device)
+			if repository != "registry.example.org/app" {
+				return nil, apicommon.ErrNoTarget
+			}
+			return &apicommon.TargetResponse{Image: image, Rollout: "canary"}, nil
+		}},
+	}
+	got, err := c.Target("registry.example.org/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != image {
+		t.Errorf("expected %s, got %s", image, got)
+	}
+	if _, err := c.Target("registry.example.org/other"); !errors.Is(err, apicommon.ErrNoTarget) {
+		t.Errorf("expected %v, got %v", apicommon.ErrNoTarget, err)
+	}
+	// Devices that are not targeted keep their image.
+	if err := c.PullTarget("registry.example.org/other"); err != nil {
+		t.Errorf("expected no error if no rollout targets the device, got %v", err)
+	}
+	if !slices.Equal(devices, []string{"device-1", "device-1", "device-1"}) {
+		t.Errorf("expected the device to identify itself, got %v", devices)
+	}
+}
+
+func TestClient_PullTarget_rateLimited(t *testing.T) {
+	calls := 0
+	c := &Client{
+		opts: clientOpts{DeviceID: "device-1"},
+		edgeClient: &mockApiClient{target: func(string, string) (*apicommon.TargetResponse, error) {
+			calls++
+			return nil, &edgeapi.RetryAfterError{Err: apicommon.ErrTooManyRequests, RetryAfter: time.Millisecond}
+		}},
+	}
+	if err := c.PullTarget("registry.example.org/app"); !errors.Is(err, backoff.ErrMaxRetries) {
+		t.Fatalf("expected the client to give up, got %v", err)
+	}
+	if calls != backoff.DefaultMaxRetries+1 {
+		t.Errorf("expected %d requests, got %d", backoff.DefaultMaxRetries+1, calls)
+	}
+}
@@ -119,7 +119,12 @@ func (r *registryImpl) resolveAndLoad(image string) (v1.Descriptor, ociutils.Man
 	if err != nil {
 		return v1.Descriptor{}, ociutils.Manifest{}, nil, fmt.Errorf("at least one inspector failed: %w", err)
 	}
-	err = errors.Join(lo.Map(r.mfValidators, func(v validator.ManifestValidator, _ int) error { return v.Validate(&mfD, mf) })...)
+	err = errors.Join(lo.Map(r.mfValidators, func(v validator.ManifestValidator, _ int) error {
+		if sv, ok := v.(validator.SourceValidator); ok {
+			return sv.ValidateWithSource(ctx, src, &mfD, mf)
+		}
+		return v.Validate(&mfD, mf)
+	})...)
 	if err != nil {
 		return v1.Descriptor{}, ociutils.Manifest{}, nil, fmt.Errorf("at least one validator failed: %w", err)
 	}
@@ -0,0 +1,102 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
+	"github.com/unbasical/doras/pkg/client/updater/fetcher"
+	"github.com/unbasical/doras/pkg/constants"
+	"oras.land/oras-go/v2"
+)
+
+// ErrNoDelta is returned if there is no delta that can be used to update to the requested image.
+var ErrNoDelta = errors.New("no suitable delta found")
+
+// DeltaResolver locates deltas in the registry without requesting them from a Doras server.
+type DeltaResolver interface {
+	// ResolveDelta returns the location of an existing delta from the image `from` to the image `to`
+	// which was created with the accepted algorithms.
+	// Returns ErrNoDelta if no such delta exists.
+	ResolveDelta(ctx context.Context, from, to string, acceptedAlgorithms []string) (*apicommon.ReadDeltaResponse, error)
+}
+
+type referrersResolver struct {
+	source fetcher.StorageSource
+}
+
+// NewReferrersResolver returns a DeltaResolver that looks up deltas among the referrers of the target image.
+// This only finds deltas that were stored by a Doras server which stores deltas as referrers.
+func NewReferrersResolver(source fetcher.StorageSource) DeltaResolver {
+	return &referrersResolver{source: source}
+}
+
+func (r *referrersResolver) ResolveDelta(ctx context.Context, from, to string, acceptedAlgorithms []string) (*apicommon.ReadDeltaResponse, error) {
+	_, fromDigest, isDigest, err := ociutils.ParseOciImageString(from)
+	if err != nil {
+		return nil, err
+	}
+	if !isDigest {
+		return nil, fmt.Errorf("expected image with digest, got %q", from)
+	}
+	fromDigest = strings.TrimPrefix(fromDigest, "@")
+	repoName, tag, _, err := ociutils.ParseOciImageString(to)
+	if err != nil {
+		return nil, err
+	}
+	src, err := r.source.GetTarget(repoName)
+	if err != nil {
+		return nil, err
+	}
+	graphSrc, ok := src.(oras.ReadOnlyGraphTarget)
+	if !ok {
+		return nil, errors.New("artifact source does not support listing referrers")
+	}
+	subject, err := graphSrc.Resolve(ctx, strings.TrimPrefix(tag, "@"))
+	if err != nil {
+		return nil, err
+	}
+	if subject.Digest.String() == fromDigest {
+		return nil, apicommon.ErrImagesIdentical
+	}
+	referrers, err := ociutils.Referrers(ctx, graphSrc, subject, constants.DorasDeltaArtifactType)
+	if err != nil {
+		return nil, err
+	}
+	if len(acceptedAlgorithms) == 0 {
+		acceptedAlgorithms = registry.DefaultAlgorithms()
+	}
+	idx := slices.IndexFunc(referrers, func(d v1.Descriptor) bool {
+		return d.Annotations[constants.DorasAnnotationFromDigest] == fromDigest &&
+			d.Annotations[constants.DorasAnnotationIsDummy] != "true" &&
+			isAccepted(d.Annotations[constants.DorasAnnotationAlgorithm], acceptedAlgorithms)
+	})
+	if idx < 0 {
+		return nil, ErrNoDelta
+	}
+	log.Debugf("found delta %s for %s among the referrers of %s", referrers[idx].Digest, from, to)
+	return &apicommon.ReadDeltaResponse{
+		TargetImage: fmt.Sprintf("%s@%s", repoName, subject.Digest.String()),
+		DeltaImage:  fmt.Sprintf("%s@%s", repoName, referrers[idx].Digest.String()),
+	}, nil
+}
+
+// isAccepted checks if all algorithms of an algorithm string (e.g. `bsdiff+zstd`) are accepted.
+func isAccepted(algorithm string, acceptedAlgorithms []string) bool {
+	if algorithm == "" {
+		return false
+	}
+	for _, a := range strings.Split(algorithm, "+") {
+		if !slices.Contains(acceptedAlgorithms, a) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/unbasical/doras/internal/pkg/algorithmchoice"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/compression/zstd"
+	registrydelegate "github.com/unbasical/doras/internal/pkg/delegates/registry"
+	"github.com/unbasical/doras/internal/pkg/delta/bsdiff"
+	"github.com/unbasical/doras/internal/pkg/utils/compressionutils"
+	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+	"github.com/unbasical/doras/pkg/client/updater/fetcher"
+	"github.com/unbasical/doras/pkg/deltalocation"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func pushImage(t *testing.T, repo *remote.Repository, data, tag string) v1.Descriptor {
+	t.Helper()
+	ctx := context.Background()
+	d := v1.Descriptor{
+		MediaType: "application/vnd.test.file",
+		Digest:    digest.FromString(data),
+		Size:      int64(len(data)),
+	}
+	err := repo.Push(ctx, d, bytes.NewReader([]byte(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfDescriptor, err := oras.PackManifest(ctx, repo, oras.PackManifestVersion1_1, "application/vnd.test.artifact", oras.PackManifestOptions{
+		Layers: []v1.Descriptor{d},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Tag(ctx, mfDescriptor, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfDescriptor
+}
+
+func TestReferrersResolver_ResolveDelta(t *testing.T) {
+	ctx := context.Background()
+	repoName := testutils.LaunchInProcessRegistry(t) + "/foo"
+	repo, err := remote.NewRepository(repoName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.PlainHTTP = true
+	v1Descriptor := pushImage(t, repo, "v1", "v1")
+	v2Descriptor := pushImage(t, repo, "v2", "v2")
+	v3Descriptor := pushImage(t, repo, "v3", "v3")
+	imageV1 := fmt.Sprintf("%s@%s", repoName, v1Descriptor.Digest)
+	imageV2 := fmt.Sprintf("%s@%s", repoName, v2Descriptor.Digest)
+	imageV3 := fmt.Sprintf("%s@%s", repoName, v3Descriptor.Digest)
+
+	// Deltas are pushed the same way the Doras server does it.
+	delegate := registrydelegate.NewRegistryDelegate(nil, true, nil, registrydelegate.DeltaStorageReferrers)
+	bsdiffChoice := algorithmchoice.DifferChoice{
+		Differ:     bsdiff.NewDiffer(),
+		Compressor: compressionutils.NewNopCompressor(),
+	}
+	err = delegate.PushDelta(ctx, repoName+":_delta-1", registrydelegate.DeltaManifestOptions{
+		From:         imageV1,
+		To:           imageV2,
+		DifferChoice: bsdiffChoice,
+	}, io.NopCloser(strings.NewReader("delta")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = delegate.PushDummy(repoName+":_delta-2", registrydelegate.DeltaManifestOptions{
+		From:         imageV1,
+		To:           imageV3,
+		DifferChoice: bsdiffChoice,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReferrersResolver(fetcher.NewRepoStorageSource(true, nil))
+	tests := []struct {
+		name               string
+		from               string
+		to                 string
+		acceptedAlgorithms []string
+		wantErr            error
+	}{
+		{name: "delta exists", from: imageV1, to: repoName + ":v2", wantErr: nil},
+		{name: "delta exists (digest)", from: imageV1, to: imageV2, wantErr: nil},
+		{name: "algorithm not accepted", from: imageV1, to: imageV2, acceptedAlgorithms: []string{"tardiff"}, wantErr: ErrNoDelta},
+		{name: "different from image", from: imageV3, to: imageV2, wantErr: ErrNoDelta},
+		{name: "dummy only", from: imageV1, to: imageV3, wantErr: ErrNoDelta},
+		{name: "identical images", from: imageV2, to: imageV2, wantErr: apicommon.ErrImagesIdentical},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := r.ResolveDelta(ctx, tt.from, tt.to, tt.acceptedAlgorithms)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ResolveDelta() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if res.TargetImage != imageV2 {
+				t.Errorf("expected target %s, got %s", imageV2, res.TargetImage)
+			}
+			if !strings.HasPrefix(res.DeltaImage, repoName+"@sha256:") {
+				t.Errorf("expected delta image with digest, got %s", res.DeltaImage)
+			}
+		})
+	}
+}
+
+func TestTagResolver_ResolveDelta(t *testing.T) {
+	ctx := context.Background()
+	repoName := testutils.LaunchInProcessRegistry(t) + "/foo"
+	repo, err := remote.NewRepository(repoName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.PlainHTTP = true
+	v1Descriptor := pushImage(t, repo, "v1", "v1")
+	v2Descriptor := pushImage(t, repo, "v2", "v2")
+	v3Descriptor := pushImage(t, repo, "v3", "v3")
+	imageV1 := fmt.Sprintf("%s@%s", repoName, v1Descriptor.Digest)
+	imageV2 := fmt.Sprintf("%s@%s", repoName, v2Descriptor.Digest)
+	imageV3 := fmt.Sprintf("%s@%s", repoName, v3Descriptor.Digest)
+
+	// Deltas are pushed the same way the Doras server does it, using the default algorithms.
+	delegate := registrydelegate.NewRegistryDelegate(nil, true, nil, registrydelegate.DeltaStorageTag)
+	choice := algorithmchoice.DifferChoice{
+		Differ:     bsdiff.NewDiffer(),
+		Compressor: zstd.NewCompressor(),
+	}
+	deltaLocation, err := deltalocation.GetDeltaLocation(imageV1, imageV2, choice.GetTagSuffix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = delegate.PushDelta(ctx, deltaLocation, registrydelegate.DeltaManifestOptions{
+		From:         imageV1,
+		To:           imageV2,
+		DifferChoice: choice,
+	}, io.NopCloser(strings.NewReader("delta")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dummyLocation, err := deltalocation.GetDeltaLocation(imageV1, imageV3, choice.GetTagSuffix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = delegate.PushDummy(dummyLocation, registrydelegate.DeltaManifestOptions{
+		From:         imageV1,
+		To:           imageV3,
+		DifferChoice: choice,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewTagResolver(fetcher.NewRepoStorageSource(true, nil))
+	tests := []struct {
+		name               string
+		from               string
+		to                 string
+		acceptedAlgorithms []string
+		wantErr            error
+	}{
+		{name: "delta exists", from: imageV1, to: repoName + ":v2", wantErr: nil},
+		{name: "delta exists (digest)", from: imageV1, to: imageV2, wantErr: nil},
+		{name: "delta exists (explicit algorithms)", from: imageV1, to: imageV2, acceptedAlgorithms: []string{"bsdiff", "zstd"}, wantErr: nil},
+		{name: "different algorithms", from: imageV1, to: imageV2, acceptedAlgorithms: []string{"bsdiff"}, wantErr: ErrNoDelta},
+		{name: "different from image", from: imageV3, to: imageV2, wantErr: ErrNoDelta},
+		{name: "dummy only", from: imageV1, to: imageV3, wantErr: ErrNoDelta},
+		{name: "identical images", from: imageV2, to: imageV2, wantErr: apicommon.ErrImagesIdentical},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := r.ResolveDelta(ctx, tt.from, tt.to, tt.acceptedAlgorithms)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ResolveDelta() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if res.TargetImage != imageV2 {
+				t.Errorf("expected target %s, got %s", imageV2, res.TargetImage)
+			}
+			if !strings.HasPrefix(res.DeltaImage, repoName+"@sha256:") {
+				t.Errorf("expected delta image with digest, got %s", res.DeltaImage)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/algorithmchoice"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
+	"github.com/unbasical/doras/pkg/client/updater/fetcher"
+	"github.com/unbasical/doras/pkg/constants"
+	"github.com/unbasical/doras/pkg/deltalocation"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/errdef"
+)
+
+type tagResolver struct {
+	source fetcher.StorageSource
+}
+
+// NewTagResolver returns a DeltaResolver that looks up deltas at the tags where the Doras server stores them.
+// The location is derived the same way the server does it, so the algorithms are chosen like the server would choose them.
+// Dummy deltas, i.e. deltas that are still being created, are not considered.
+func NewTagResolver(source fetcher.StorageSource) DeltaResolver {
+	return &tagResolver{source: source}
+}
+
+func (r *tagResolver) ResolveDelta(ctx context.Context, from, to string, acceptedAlgorithms []string) (*apicommon.ReadDeltaResponse, error) {
+	_, fromDigest, isDigest, err := ociutils.ParseOciImageString(from)
+	if err != nil {
+		return nil, err
+	}
+	if !isDigest {
+		return nil, fmt.Errorf("expected image with digest, got %q", from)
+	}
+	fromDigest = strings.TrimPrefix(fromDigest, "@")
+	repoName, tag, _, err := ociutils.ParseOciImageString(to)
+	if err != nil {
+		return nil, err
+	}
+	src, err := r.source.GetTarget(repoName)
+	if err != nil {
+		return nil, err
+	}
+	mfToDescriptor, err := src.Resolve(ctx, strings.TrimPrefix(tag, "@"))
+	if err != nil {
+		return nil, err
+	}
+	if mfToDescriptor.Digest.String() == fromDigest {
+		return nil, apicommon.ErrImagesIdentical
+	}
+	mfFromDescriptor, err := src.Resolve(ctx, fromDigest)
+	if err != nil {
+		return nil, err
+	}
+	mfFrom, err := fetchManifest(ctx, src, mfFromDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	mfTo, err := fetchManifest(ctx, src, mfToDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	if len(mfFrom.Layers) == 0 && len(mfFrom.Blobs) == 0 {
+		return nil, ErrNoDelta
+	}
+	if len(acceptedAlgorithms) == 0 {
+		acceptedAlgorithms = registry.DefaultAlgorithms()
+	}
+	choice := algorithmchoice.ChooseAlgorithms(acceptedAlgorithms, mfFrom, mfTo)
+	targetImage := fmt.Sprintf("%s@%s", repoName, mfToDescriptor.Digest.String())
+	deltaLocation, err := deltalocation.GetDeltaLocation(from, targetImage, choice.GetTagSuffix())
+	if err != nil {
+		return nil, err
+	}
+	_, deltaTag, _, err := ociutils.ParseOciImageString(deltaLocation)
+	if err != nil {
+		return nil, err
+	}
+	deltaDescriptor, err := src.Resolve(ctx, deltaTag)
+	if errors.Is(err, errdef.ErrNotFound) {
+		return nil, ErrNoDelta
+	}
+	if err != nil {
+		return nil, err
+	}
+	mfDelta, err := fetchManifest(ctx, src, deltaDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	if mfDelta.Annotations[constants.DorasAnnotationIsDummy] == "true" {
+		log.Debugf("delta at %s is still being created", deltaLocation)
+		return nil, ErrNoDelta
+	}
+	log.Debugf("found delta %s for %s at %s", deltaDescriptor.Digest, from, deltaLocation)
+	return &apicommon.ReadDeltaResponse{
+		TargetImage: targetImage,
+		DeltaImage:  fmt.Sprintf("%s@%s", repoName, deltaDescriptor.Digest.String()),
+	}, nil
+}
+
+func fetchManifest(ctx context.Context, src oras.ReadOnlyTarget, d v1.Descriptor) (*ociutils.Manifest, error) {
+	rc, err := src.Fetch(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rc.Close()
+	}()
+	return ociutils.ParseManifestJSON(rc)
+}
@@ -0,0 +1,68 @@
+package validator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/pkg/constants"
+	"github.com/unbasical/doras/pkg/signature"
+	"oras.land/oras-go/v2"
+)
+
+// SourceValidator is a ManifestValidator that needs access to the source the manifest was loaded from,
+// e.g. to look up artifacts that refer to the manifest.
+// Artifact loaders call ValidateWithSource instead of Validate for implementations of this interface.
+type SourceValidator interface {
+	ManifestValidator
+	ValidateWithSource(ctx context.Context, src oras.ReadOnlyTarget, desc *v1.Descriptor, mf *ociutils.Manifest) error
+}
+
+// SignatureValidator ensures that artifacts are signed by trusted parties before they are fetched.
+// Regular artifacts have to carry a signature that is trusted by one of the ArtifactVerifiers.
+// Delta manifests have to be signed by the Doras server (DeltaVerifiers)
+// and the image they lead to (constants.DorasAnnotationTo) has to be signed by one of the ArtifactVerifiers.
+type SignatureValidator struct {
+	ArtifactVerifiers []signature.Verifier
+	DeltaVerifiers    []signature.Verifier
+}
+
+// Validate always fails because signatures can only be verified with access to the source registry.
+func (s SignatureValidator) Validate(_ *v1.Descriptor, _ *ociutils.Manifest) error {
+	return errors.New("signature validation requires access to the artifact source")
+}
+
+// ValidateWithSource verifies the signatures of the manifest and, for deltas, the signature of the target image.
+func (s SignatureValidator) ValidateWithSource(ctx context.Context, src oras.ReadOnlyTarget, desc *v1.Descriptor, mf *ociutils.Manifest) error {
+	graphSrc, ok := src.(oras.ReadOnlyGraphTarget)
+	if !ok {
+		return errors.New("artifact source does not support listing referrers")
+	}
+	toImage, isDelta := mf.Annotations[constants.DorasAnnotationTo]
+	if !isDelta {
+		return signature.VerifyAny(ctx, s.ArtifactVerifiers, graphSrc, *desc)
+	}
+	err := signature.VerifyAny(ctx, s.DeltaVerifiers, graphSrc, *desc)
+	if err != nil {
+		return fmt.Errorf("delta manifest is not signed by a trusted server: %w", err)
+	}
+	_, dgst, isDigest, err := ociutils.ParseOciImageString(toImage)
+	if err != nil {
+		return err
+	}
+	if !isDigest {
+		return fmt.Errorf("delta target %q is not identified by a digest", toImage)
+	}
+	targetDescriptor, err := graphSrc.Resolve(ctx, strings.TrimPrefix(dgst, "@"))
+	if err != nil {
+		return fmt.Errorf("failed to resolve delta target %q: %w", toImage, err)
+	}
+	err = signature.VerifyAny(ctx, s.ArtifactVerifiers, graphSrc, targetDescriptor)
+	if err != nil {
+		return fmt.Errorf("delta target is not signed by a trusted party: %w", err)
+	}
+	return nil
+}
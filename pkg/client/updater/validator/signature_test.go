@@ -0,0 +1,105 @@
+package validator
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+	"github.com/unbasical/doras/pkg/constants"
+	"github.com/unbasical/doras/pkg/signature"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func pushManifest(t *testing.T, target oras.Target, data string, annotations map[string]string) (v1.Descriptor, *ociutils.Manifest) {
+	t.Helper()
+	ctx := context.Background()
+	d := v1.Descriptor{
+		MediaType: "application/vnd.test.file",
+		Digest:    digest.FromString(data),
+		Size:      int64(len(data)),
+	}
+	err := target.Push(ctx, d, bytes.NewReader([]byte(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfDescriptor, err := oras.PackManifest(ctx, target, oras.PackManifestVersion1_1, "application/vnd.test.artifact", oras.PackManifestOptions{
+		Layers:              []v1.Descriptor{d},
+		ManifestAnnotations: annotations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfDescriptor, &ociutils.Manifest{Layers: []v1.Descriptor{d}, Annotations: annotations}
+}
+
+func TestSignatureValidator_ValidateWithSource(t *testing.T) {
+	ctx := context.Background()
+	host := testutils.LaunchInProcessRegistry(t)
+	repoName := host + "/foo"
+	repo, err := remote.NewRepository(repoName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.PlainHTTP = true
+
+	vendorKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	vendorSigner, _ := signature.NewCosignSigner(vendorKey)
+	serverSigner, _ := signature.NewCosignSigner(serverKey)
+	vendorVerifier, _ := signature.NewCosignVerifier(vendorKey.Public())
+	serverVerifier, _ := signature.NewCosignVerifier(serverKey.Public())
+
+	signedTarget, signedTargetMf := pushManifest(t, repo, "signed target", nil)
+	unsignedTarget, unsignedTargetMf := pushManifest(t, repo, "unsigned target", nil)
+	if err := vendorSigner.Sign(ctx, repo, signedTarget, repoName); err != nil {
+		t.Fatal(err)
+	}
+	delta, deltaMf := pushManifest(t, repo, "delta", map[string]string{
+		constants.DorasAnnotationTo: repoName + "@" + signedTarget.Digest.String(),
+	})
+	if err := serverSigner.Sign(ctx, repo, delta, repoName); err != nil {
+		t.Fatal(err)
+	}
+	deltaUnsignedTarget, deltaUnsignedTargetMf := pushManifest(t, repo, "delta to unsigned", map[string]string{
+		constants.DorasAnnotationTo: repoName + "@" + unsignedTarget.Digest.String(),
+	})
+	if err := serverSigner.Sign(ctx, repo, deltaUnsignedTarget, repoName); err != nil {
+		t.Fatal(err)
+	}
+	deltaUnsigned, deltaUnsignedMf := pushManifest(t, repo, "unsigned delta", map[string]string{
+		constants.DorasAnnotationTo: repoName + "@" + signedTarget.Digest.String(),
+	})
+
+	v := SignatureValidator{
+		ArtifactVerifiers: []signature.Verifier{vendorVerifier},
+		DeltaVerifiers:    []signature.Verifier{serverVerifier},
+	}
+	tests := []struct {
+		name    string
+		desc    v1.Descriptor
+		mf      *ociutils.Manifest
+		wantErr bool
+	}{
+		{name: "signed artifact", desc: signedTarget, mf: signedTargetMf, wantErr: false},
+		{name: "unsigned artifact", desc: unsignedTarget, mf: unsignedTargetMf, wantErr: true},
+		{name: "signed delta", desc: delta, mf: deltaMf, wantErr: false},
+		{name: "unsigned delta", desc: deltaUnsigned, mf: deltaUnsignedMf, wantErr: true},
+		{name: "signed delta with unsigned target", desc: deltaUnsignedTarget, mf: deltaUnsignedTargetMf, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.ValidateWithSource(ctx, repo, &tt.desc, tt.mf)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateWithSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
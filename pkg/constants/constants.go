@@ -1,5 +1,7 @@
 package constants
 
+import "github.com/unbasical/doras/pkg/algorithm/registry"
+
 // DorasAnnotationFrom is the constant to extract the from-image from the delta image's manifest.
 const DorasAnnotationFrom = "com.unbasical.doras.delta.from"
 
@@ -9,6 +11,48 @@ const DorasAnnotationTo = "com.unbasical.doras.delta.to"
 // DorasAnnotationIsDummy is the constant to extract the information of whether the artifact is a dummy from the image's manifest.
 const DorasAnnotationIsDummy = "com.unbasical.doras.delta.dummy"
 
+// DorasAnnotationHeartbeat is the constant to extract the last heartbeat (RFC 3339) from a dummy's manifest.
+// The instance that creates the delta renews the dummy periodically, dummies expire relative to their last heartbeat.
+const DorasAnnotationHeartbeat = "com.unbasical.doras.delta.heartbeat"
+
+// DorasAnnotationOwner is the constant to extract the ID of the instance that creates the delta from a dummy's manifest.
+const DorasAnnotationOwner = "com.unbasical.doras.delta.owner"
+
+// DorasAnnotationFromDigest is the constant to extract the digest of the from-image from the delta image's manifest.
+const DorasAnnotationFromDigest = "com.unbasical.doras.delta.from.digest"
+
+// DorasAnnotationAlgorithm is the constant to extract the algorithms that were used to create the delta from the delta image's manifest.
+// The value has the format `<differ>` or `<differ>+<compressor>`, e.g. `bsdiff+zstd`.
+const DorasAnnotationAlgorithm = "com.unbasical.doras.delta.algorithm"
+
+// DorasDeltaArtifactType is the artifact type of delta (and dummy) manifests.
+// It is used to look up deltas that are stored as referrers of the target image.
+const DorasDeltaArtifactType = "application/vnd.unbasical.doras.delta"
+
+// DorasLockArtifactType is the artifact type of lock manifests which coordinate delta creations across replicas.
+const DorasLockArtifactType = "application/vnd.unbasical.doras.lock"
+
+// DorasLockTagPrefix is the prefix of the tags of lock manifests, the garbage collection deletes expired locks.
+const DorasLockTagPrefix = "doras-lock-"
+
+// DorasAnnotationLockKey is the constant to extract the key of the lock from a lock manifest.
+const DorasAnnotationLockKey = "com.unbasical.doras.lock.key"
+
+// DorasAnnotationLockToken is the constant to extract the token of the lease that holds the lock from a lock manifest.
+const DorasAnnotationLockToken = "com.unbasical.doras.lock.token"
+
+// DorasAnnotationLockExpires is the constant to extract the expiration (RFC 3339) of the lock from a lock manifest.
+// Released locks expire immediately.
+const DorasAnnotationLockExpires = "com.unbasical.doras.lock.expires"
+
+// DorasAnnotationTargetDigest is the constant to extract the digest of the target layer from a delta layer's annotations.
+// Clients use it to verify the artifact that results from applying the delta.
+const DorasAnnotationTargetDigest = "com.unbasical.doras.delta.target.digest"
+
+// DorasAnnotationTargetTarDigest is the constant to extract the digest of the uncompressed target archive from a delta layer's annotations.
+// It is only set for algorithms that reconstruct the uncompressed archive (tardiff).
+const DorasAnnotationTargetTarDigest = "com.unbasical.doras.delta.target.tar-digest"
+
 // QueryKeyFromDigest is used to extract the from_digest parameter from the request.
 const QueryKeyFromDigest = "from_digest"
 
@@ -21,14 +65,21 @@ const QueryKeyToDigest = "to_digest"
 // QueryKeyAcceptedAlgorithm is used to extract the (repeatable) accepted algorithms parameter from the request.
 const QueryKeyAcceptedAlgorithm = "accepted_algorithm"
 
+// QueryKeyWait is used to extract the wait parameter (a duration, e.g. 60s) from the request.
+// The server holds the request until the delta has been created or the duration has passed.
+const QueryKeyWait = "wait"
+
+// QueryKeyDevice is used to extract the device parameter (the ID of the device) from requests for targets.
+const QueryKeyDevice = "device"
+
+// QueryKeyRepository is used to extract the optional repository parameter from requests for targets.
+const QueryKeyRepository = "repository"
+
 // DefaultAlgorithms returns the Doras default algorithms.
-// Uses a function to ensure immutability of the default algorithms.
+//
+// Deprecated: use registry.DefaultAlgorithms, which includes algorithms that were added to the registry.
 func DefaultAlgorithms() []string {
-	return []string{
-		"bsdiff",
-		"tardiff",
-		"zstd",
-	}
+	return registry.DefaultAlgorithms()
 }
 
 // OrasContentUnpack is used to extract metadata from an OCI manifest.
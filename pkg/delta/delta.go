@@ -0,0 +1,296 @@
+// Package delta creates Doras deltas without a Doras server, e.g. to build deltas ahead of time in a CI pipeline.
+// Deltas are pushed to the location at which the server and its clients look them up (see docs/delta-storage.md).
+package delta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/unbasical/doras/internal/pkg/algorithmchoice"
+	"github.com/unbasical/doras/internal/pkg/api/apicommon"
+	deltadelegate "github.com/unbasical/doras/internal/pkg/delegates/delta"
+	registrydelegate "github.com/unbasical/doras/internal/pkg/delegates/registry"
+	"github.com/unbasical/doras/internal/pkg/storage"
+	"github.com/unbasical/doras/internal/pkg/utils/funcutils"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
+	"github.com/unbasical/doras/pkg/constants"
+	"github.com/unbasical/doras/pkg/deltalocation"
+	"github.com/unbasical/doras/pkg/signature"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+var (
+	// ErrImagesIdentical is returned if a delta between an image and itself is requested.
+	ErrImagesIdentical error = apicommon.ErrImagesIdentical
+	// ErrImagesIncompatible is returned if no delta can be created between the images,
+	// e.g. because they do not consist of a single artifact or only one of them is an archive.
+	ErrImagesIncompatible error = apicommon.ErrImagesIncompatible
+	// ErrArtifactMismatch is returned if a local file does not contain the artifact of its image.
+	ErrArtifactMismatch = errors.New("file does not match the artifact of the image")
+)
+
+// Creator creates deltas and pushes them to the registry.
+type Creator struct {
+	credentials        auth.CredentialFunc
+	insecureAllowHTTP  bool
+	acceptedAlgorithms []string
+	differ             string
+	compressor         string
+	signer             signature.Signer
+	targets            deltalocation.Targets
+	layoutRoot         string
+}
+
+// Result describes a created (or already existing) delta.
+type Result struct {
+	// Image is the location of the delta, see deltalocation.GetDeltaLocation.
+	Image string
+	// Descriptor is the descriptor of the delta manifest.
+	Descriptor v1.Descriptor
+	// Algorithm identifies the algorithms that were used to create the delta, e.g. `bsdiff+zstd`.
+	Algorithm string
+}
+
+// NewCreator creates a new Creator with the provided options.
+// By default, the algorithms are chosen from registry.DefaultAlgorithms the same way the Doras server chooses them.
+func NewCreator(options ...func(*Creator)) *Creator {
+	c := &Creator{}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// WithCredentials sets the credentials that are used to access the registries.
+func WithCredentials(credentials auth.CredentialFunc) func(*Creator) {
+	return func(c *Creator) {
+		c.credentials = credentials
+	}
+}
+
+// WithInsecureAllowHTTP allows plain HTTP connections to registries.
+func WithInsecureAllowHTTP(insecureAllowHTTP bool) func(*Creator) {
+	return func(c *Creator) {
+		c.insecureAllowHTTP = insecureAllowHTTP
+	}
+}
+
+// WithAcceptedAlgorithms restricts the set of algorithms the creator chooses from (see registry.Differs and registry.Compressors).
+func WithAcceptedAlgorithms(acceptedAlgorithms []string) func(*Creator) {
+	return func(c *Creator) {
+		c.acceptedAlgorithms = acceptedAlgorithms
+	}
+}
+
+// WithAlgorithms makes the creator use the given algorithms instead of choosing them.
+// An empty compressor (or `none`) disables compression.
+func WithAlgorithms(differ, compressor string) func(*Creator) {
+	return func(c *Creator) {
+		c.differ = differ
+		c.compressor = compressor
+	}
+}
+
+// WithSigner signs the manifests of created deltas, clients can verify them with the matching signature.Verifier.
+func WithSigner(signer signature.Signer) func(*Creator) {
+	return func(c *Creator) {
+		c.signer = signer
+	}
+}
+
+// WithTargets stores the deltas of source repositories in separate repositories,
+// it has to match the configuration of the Doras server.
+func WithTargets(targets deltalocation.Targets) func(*Creator) {
+	return func(c *Creator) {
+		c.targets = targets
+	}
+}
+
+// WithOCILayout stores deltas in OCI image layouts in the root directory instead of pushing them to the registry.
+// Each repository is stored in its own layout at `<root>/<repository path>`.
+func WithOCILayout(root string) func(*Creator) {
+	return func(c *Creator) {
+		c.layoutRoot = root
+	}
+}
+
+// Create creates the delta from the image `from` (which has to be identified by its digest) to the image `to`.
+// If the delta already exists it is not created again.
+func (c *Creator) Create(ctx context.Context, from, to string) (Result, error) {
+	return c.create(ctx, from, "", to, "")
+}
+
+// CreateFromFiles is like Create, but the artifacts of the images are read from the local files fromPath and toPath.
+// This avoids downloading artifacts that are already available locally, e.g. after they have been pushed by a CI pipeline.
+// The files have to match the artifacts of the images, otherwise an error that wraps ErrArtifactMismatch is returned.
+func (c *Creator) CreateFromFiles(ctx context.Context, from, fromPath, to, toPath string) (Result, error) {
+	return c.create(ctx, from, fromPath, to, toPath)
+}
+
+// create creates the delta, the artifacts are loaded from the registry unless a path is provided.
+//
+//nolint:revive // The steps mirror the delta creation of the Doras server.
+func (c *Creator) create(ctx context.Context, from, fromPath, to, toPath string) (Result, error) {
+	src := registrydelegate.NewRegistryDelegate(c.credentials, c.insecureAllowHTTP, nil, registrydelegate.DeltaStorageTag)
+	srcFrom, fromImage, fromDescriptor, err := src.Resolve(from, true, c.credentials)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to resolve %s: %w", from, err)
+	}
+	srcTo, toImage, toDescriptor, err := src.Resolve(to, false, c.credentials)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to resolve %s: %w", to, err)
+	}
+	if fromDescriptor.Digest == toDescriptor.Digest {
+		return Result{}, ErrImagesIdentical
+	}
+	mfFrom, err := src.LoadManifest(fromDescriptor, srcFrom)
+	if err != nil {
+		return Result{}, err
+	}
+	mfTo, err := src.LoadManifest(toDescriptor, srcTo)
+	if err != nil {
+		return Result{}, err
+	}
+	artifactFrom, err := singleArtifact(&mfFrom)
+	if err != nil {
+		return Result{}, err
+	}
+	artifactTo, err := singleArtifact(&mfTo)
+	if err != nil {
+		return Result{}, err
+	}
+	isArchive := artifactFrom.Annotations[constants.OrasContentUnpack] == "true"
+	if isArchive != (artifactTo.Annotations[constants.OrasContentUnpack] == "true") {
+		return Result{}, ErrImagesIncompatible
+	}
+	choice, err := c.chooseAlgorithms(&mfFrom, &mfTo)
+	if err != nil {
+		return Result{}, err
+	}
+	if algorithmchoice.IsArchiveAlgorithm(choice.Differ) && !isArchive {
+		return Result{}, fmt.Errorf("%w: %s requires archives", ErrImagesIncompatible, choice.Differ.Name())
+	}
+	manifOpts := registrydelegate.DeltaManifestOptions{
+		From:         fromImage,
+		To:           toImage,
+		DifferChoice: choice,
+		TargetDigest: artifactTo.Digest,
+	}
+
+	dst := src
+	if c.layoutRoot != "" {
+		dst = registrydelegate.NewRegistryDelegateWithStorage(storage.NewLayoutProvider(c.layoutRoot), c.credentials, c.signer, registrydelegate.DeltaStorageTag)
+	} else if c.signer != nil {
+		dst = registrydelegate.NewRegistryDelegate(c.credentials, c.insecureAllowHTTP, c.signer, registrydelegate.DeltaStorageTag)
+	}
+	delegate := deltadelegate.NewDeltaDelegate(0, c.targets)
+	deltaImage, err := delegate.GetDeltaLocation(manifOpts)
+	if err != nil {
+		return Result{}, err
+	}
+	if res, ok := c.lookupDelta(dst, deltaImage, manifOpts); ok {
+		log.Infof("delta from %s to %s already exists at %s", fromImage, toImage, deltaImage)
+		return res, nil
+	}
+
+	rcFrom, err := loadArtifact(src, srcFrom, mfFrom, artifactFrom, fromPath)
+	if err != nil {
+		return Result{}, err
+	}
+	defer funcutils.PanicOrLogOnErr(rcFrom.Close, false, "failed to close reader")
+	rcTo, err := loadArtifact(src, srcTo, mfTo, artifactTo, toPath)
+	if err != nil {
+		return Result{}, err
+	}
+	defer funcutils.PanicOrLogOnErr(rcTo.Close, false, "failed to close reader")
+	log.Infof("creating delta from %s to %s", fromImage, toImage)
+	err = delegate.CreateDelta(ctx, rcFrom, rcTo, manifOpts, dst)
+	if err != nil {
+		return Result{}, err
+	}
+	res, ok := c.lookupDelta(dst, deltaImage, manifOpts)
+	if !ok {
+		return Result{}, fmt.Errorf("failed to resolve created delta at %s", deltaImage)
+	}
+	return res, nil
+}
+
+// lookupDelta returns the delta at the image if it exists, dummies are ignored.
+func (c *Creator) lookupDelta(dst registrydelegate.RegistryDelegate, image string, manifOpts registrydelegate.DeltaManifestOptions) (Result, bool) {
+	target, _, d, err := dst.ResolveDelta(image, manifOpts, c.credentials)
+	if err != nil {
+		return Result{}, false
+	}
+	mf, err := dst.LoadManifest(d, target)
+	if err != nil || mf.Annotations[constants.DorasAnnotationIsDummy] == "true" {
+		return Result{}, false
+	}
+	return Result{
+		Image:      image,
+		Descriptor: d,
+		Algorithm:  manifOpts.GetAlgorithm(),
+	}, true
+}
+
+// chooseAlgorithms returns the configured algorithms or chooses them like the Doras server.
+func (c *Creator) chooseAlgorithms(mfFrom, mfTo *ociutils.Manifest) (algorithmchoice.DifferChoice, error) {
+	if c.differ != "" {
+		return algorithmchoice.NewDifferChoice(c.differ, c.compressor)
+	}
+	acceptedAlgorithms := c.acceptedAlgorithms
+	if len(acceptedAlgorithms) == 0 {
+		acceptedAlgorithms = registry.DefaultAlgorithms()
+	}
+	for _, name := range acceptedAlgorithms {
+		if !registry.IsSupported(name) {
+			return algorithmchoice.DifferChoice{}, fmt.Errorf("%w: %q", registry.ErrUnknownAlgorithm, name)
+		}
+	}
+	return algorithmchoice.ChooseAlgorithms(acceptedAlgorithms, mfFrom, mfTo), nil
+}
+
+// singleArtifact returns the artifact of images that consist of a single layer (or blob), deltas are created for these artifacts.
+func singleArtifact(mf *ociutils.Manifest) (v1.Descriptor, error) {
+	if len(mf.Layers) == 1 {
+		return mf.Layers[0], nil
+	}
+	if len(mf.Layers) == 0 && len(mf.Blobs) == 1 {
+		return mf.Blobs[0], nil
+	}
+	return v1.Descriptor{}, ErrImagesIncompatible
+}
+
+// loadArtifact loads the artifact from the registry or, if a path is provided, from the local file.
+func loadArtifact(src registrydelegate.RegistryDelegate, target oras.ReadOnlyTarget, mf ociutils.Manifest, artifact v1.Descriptor, path string) (io.ReadCloser, error) {
+	if path == "" {
+		return src.LoadArtifact(mf, target)
+	}
+	return openVerified(path, artifact)
+}
+
+// openVerified opens the file at path after verifying that it contains the artifact.
+func openVerified(path string, artifact v1.Descriptor) (io.ReadCloser, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	verifier := artifact.Digest.Verifier()
+	n, err := io.Copy(verifier, fp)
+	if err != nil {
+		return nil, errors.Join(err, fp.Close())
+	}
+	if n != artifact.Size || !verifier.Verified() {
+		return nil, errors.Join(fmt.Errorf("%w: %s is not %s", ErrArtifactMismatch, path, artifact.Digest), fp.Close())
+	}
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Join(err, fp.Close())
+	}
+	return fp, nil
+}
@@ -0,0 +1,245 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/unbasical/doras/internal/pkg/delta/bsdiff"
+	"github.com/unbasical/doras/internal/pkg/storage"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+	"github.com/unbasical/doras/pkg/algorithm/registry"
+	"github.com/unbasical/doras/pkg/constants"
+	"github.com/unbasical/doras/pkg/deltalocation"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func pushImage(t *testing.T, repo *remote.Repository, data string) string {
+	t.Helper()
+	ctx := context.Background()
+	d := v1.Descriptor{
+		MediaType: "application/vnd.test.file",
+		Digest:    digest.FromString(data),
+		Size:      int64(len(data)),
+	}
+	if err := repo.Push(ctx, d, bytes.NewReader([]byte(data))); err != nil {
+		t.Fatal(err)
+	}
+	mfDescriptor, err := oras.PackManifest(ctx, repo, oras.PackManifestVersion1_1, "application/vnd.test.artifact", oras.PackManifestOptions{
+		Layers: []v1.Descriptor{d},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s@%s", repo.Reference.String(), mfDescriptor.Digest)
+}
+
+func newRepository(t *testing.T, name string) *remote.Repository {
+	t.Helper()
+	repo, err := remote.NewRepository(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.PlainHTTP = true
+	return repo
+}
+
+// fetchDelta loads the manifest and the patch of the delta.
+func fetchDelta(t *testing.T, res Result) (ociutils.Manifest, []byte) {
+	t.Helper()
+	ctx := context.Background()
+	repoName, _, _, err := ociutils.ParseOciImageString(res.Image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := newRepository(t, repoName)
+	data, err := content.FetchAll(ctx, repo, res.Descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf, err := ociutils.ParseManifestJSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := content.FetchAll(ctx, repo, mf.Layers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *mf, patch
+}
+
+func TestCreator_Create(t *testing.T) {
+	ctx := context.Background()
+	registryHost := testutils.LaunchInProcessRegistry(t)
+	repo := newRepository(t, registryHost+"/foo")
+	from := pushImage(t, repo, "hello world")
+	to := pushImage(t, repo, "hello world!")
+
+	tests := []struct {
+		name     string
+		options  []func(*Creator)
+		wantRepo string
+		wantAlgo string
+	}{
+		{name: "default algorithms", wantRepo: registryHost + "/foo", wantAlgo: "bsdiff+zstd"},
+		{name: "accepted algorithms", options: []func(*Creator){WithAcceptedAlgorithms([]string{"bsdiff", "gzip"})}, wantRepo: registryHost + "/foo", wantAlgo: "bsdiff+gzip"},
+		{name: "explicit algorithms", options: []func(*Creator){WithAlgorithms("bsdiff", "none")}, wantRepo: registryHost + "/foo", wantAlgo: "bsdiff"},
+		{
+			name: "separate repository",
+			options: []func(*Creator){
+				WithAlgorithms("bsdiff", "none"),
+				WithTargets(deltalocation.Targets{{Source: registryHost + "/foo", Repository: registryHost + "/deltas"}}),
+			},
+			wantRepo: registryHost + "/deltas",
+			wantAlgo: "bsdiff",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creator := NewCreator(append([]func(*Creator){WithInsecureAllowHTTP(true)}, tt.options...)...)
+			res, err := creator.Create(ctx, from, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Algorithm != tt.wantAlgo {
+				t.Errorf("expected algorithm %s, got %s", tt.wantAlgo, res.Algorithm)
+			}
+			differ, compressor, _ := strings.Cut(res.Algorithm, "+")
+			wantImage, err := deltalocation.GetDeltaLocationInRepository(tt.wantRepo, from, to, deltalocation.TagSuffix(differ, compressor))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Image != wantImage {
+				t.Errorf("expected delta at %s, got %s", wantImage, res.Image)
+			}
+			mf, patch := fetchDelta(t, res)
+			if mf.Annotations[constants.DorasAnnotationFrom] != from || mf.Annotations[constants.DorasAnnotationTo] != to {
+				t.Errorf("unexpected annotations %v", mf.Annotations)
+			}
+			if mf.Layers[0].MediaType != "application/"+tt.wantAlgo {
+				t.Errorf("unexpected media type %s", mf.Layers[0].MediaType)
+			}
+			if tt.wantAlgo == "bsdiff" {
+				patched, err := bsdiff.NewPatcher().Patch(bytes.NewReader([]byte("hello world")), bytes.NewReader(patch))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(patched)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != "hello world!" {
+					t.Errorf("patched artifact does not match, got %q", got)
+				}
+			}
+
+			// existing deltas are not created again
+			again, err := creator.Create(ctx, from, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.Descriptor.Digest != res.Descriptor.Digest {
+				t.Errorf("expected existing delta %s, got %s", res.Descriptor.Digest, again.Descriptor.Digest)
+			}
+		})
+	}
+}
+
+func TestCreator_CreateFromFiles(t *testing.T) {
+	ctx := context.Background()
+	repo := newRepository(t, testutils.LaunchInProcessRegistry(t)+"/foo")
+	from := pushImage(t, repo, "hello world")
+	to := pushImage(t, repo, "hello world!")
+	dir := t.TempDir()
+	writeFile := func(name, data string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	fromPath := writeFile("from", "hello world")
+	toPath := writeFile("to", "hello world!")
+	otherPath := writeFile("other", "hello world?")
+
+	creator := NewCreator(WithInsecureAllowHTTP(true), WithAlgorithms("bsdiff", "none"))
+	if _, err := creator.CreateFromFiles(ctx, from, fromPath, to, otherPath); !errors.Is(err, ErrArtifactMismatch) {
+		t.Fatalf("expected ErrArtifactMismatch, got %v", err)
+	}
+	res, err := creator.CreateFromFiles(ctx, from, fromPath, to, toPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf, _ := fetchDelta(t, res)
+	if mf.Layers[0].Annotations[constants.DorasAnnotationTargetDigest] != digest.FromString("hello world!").String() {
+		t.Errorf("unexpected layer annotations %v", mf.Layers[0].Annotations)
+	}
+}
+
+func TestCreator_Create_Errors(t *testing.T) {
+	ctx := context.Background()
+	repo := newRepository(t, testutils.LaunchInProcessRegistry(t)+"/foo")
+	from := pushImage(t, repo, "hello world")
+	to := pushImage(t, repo, "hello world!")
+	tests := []struct {
+		name    string
+		options []func(*Creator)
+		from    string
+		to      string
+		wantErr error
+	}{
+		{name: "identical images", from: from, to: from, wantErr: ErrImagesIdentical},
+		{name: "unknown differ", options: []func(*Creator){WithAlgorithms("foo", "")}, from: from, to: to, wantErr: registry.ErrUnknownAlgorithm},
+		{name: "unknown accepted algorithm", options: []func(*Creator){WithAcceptedAlgorithms([]string{"bsdiff", "foo"})}, from: from, to: to, wantErr: registry.ErrUnknownAlgorithm},
+		{name: "tardiff without archives", options: []func(*Creator){WithAlgorithms("tardiff", "")}, from: from, to: to, wantErr: ErrImagesIncompatible},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creator := NewCreator(append([]func(*Creator){WithInsecureAllowHTTP(true)}, tt.options...)...)
+			if _, err := creator.Create(ctx, tt.from, tt.to); !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCreator_Create_OCILayout(t *testing.T) {
+	ctx := context.Background()
+	repo := newRepository(t, testutils.LaunchInProcessRegistry(t)+"/foo")
+	from := pushImage(t, repo, "hello world")
+	to := pushImage(t, repo, "hello world!")
+	root := t.TempDir()
+	res, err := NewCreator(WithInsecureAllowHTTP(true), WithOCILayout(root)).Create(ctx, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoName, tag, _, err := ociutils.ParseOciImageString(res.Image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, err := storage.NewLayoutProvider(root).ExistingRepository(repoName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := layout.Resolve(ctx, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Digest != res.Descriptor.Digest {
+		t.Errorf("expected delta %s in layout, got %s", res.Descriptor.Digest, d.Digest)
+	}
+	if _, err := repo.Resolve(ctx, tag); err == nil {
+		t.Error("expected delta to not be pushed to the registry")
+	}
+}
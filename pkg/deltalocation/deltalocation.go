@@ -0,0 +1,96 @@
+// Package deltalocation implements the naming scheme Doras uses to store deltas at tags.
+// It is shared by the server, which pushes deltas to these locations, and clients that look deltas up without the server.
+package deltalocation
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/unbasical/doras/internal/pkg/utils/ociutils"
+)
+
+// TagPrefix is the prefix of all tags at which deltas are stored.
+const TagPrefix = "_delta-"
+
+// TagSuffix returns the string that identifies the algorithms that were used to create a delta, e.g. `bsdiff_zstd`.
+// The compressor name is empty if the delta is not compressed.
+func TagSuffix(differ, compressor string) string {
+	if compressor != "" {
+		return differ + "_" + compressor
+	}
+	return differ
+}
+
+// GetDeltaLocation returns the image at which the delta from the image `from` to the image `to` is stored.
+// Both images have to be identified by their digest, tagSuffix identifies the used algorithms (see TagSuffix).
+// The image is located in the repository of the `from` image.
+func GetDeltaLocation(from, to, tagSuffix string) (string, error) {
+	repoName, _, _, err := ociutils.ParseOciImageString(from)
+	if err != nil {
+		return "", err
+	}
+	return GetDeltaLocationInRepository(repoName, from, to, tagSuffix)
+}
+
+// GetDeltaLocationInRepository is like GetDeltaLocation but locates the delta in the given repository.
+func GetDeltaLocationInRepository(repoName, from, to, tagSuffix string) (string, error) {
+	digestFrom, err := extractDigest(from)
+	if err != nil {
+		return "", err
+	}
+	digestTo, err := extractDigest(to)
+	if err != nil {
+		return "", err
+	}
+	dgstIdentifier := digest.FromBytes([]byte(digestFrom.Encoded() + digestTo.Encoded() + tagSuffix))
+	tag := TagPrefix + dgstIdentifier.Encoded()
+	image := fmt.Sprintf("%s:%s", repoName, tag)
+	return image, nil
+}
+
+// Target configures the repository in which the deltas of source repositories are stored.
+type Target struct {
+	// Source is a repository (e.g. `registry.example.org/apps/foo`) or a namespace (e.g. `registry.example.org/apps`).
+	Source string
+	// Repository replaces the matched Source to determine the repository of the deltas,
+	// e.g. `cache.example.org/deltas/apps` stores the deltas of `registry.example.org/apps/foo` in `cache.example.org/deltas/apps/foo`.
+	Repository string
+}
+
+// Targets is a list of storage targets, the most specific matching Target is used.
+type Targets []Target
+
+// Repository returns the repository in which deltas of the source repository are stored.
+// Deltas are stored in the source repository itself if no Target matches.
+func (t Targets) Repository(sourceRepo string) string {
+	match := -1
+	for i, target := range t {
+		source := strings.TrimSuffix(target.Source, "/")
+		if sourceRepo != source && !strings.HasPrefix(sourceRepo, source+"/") {
+			continue
+		}
+		if match < 0 || len(source) > len(strings.TrimSuffix(t[match].Source, "/")) {
+			match = i
+		}
+	}
+	if match < 0 {
+		return sourceRepo
+	}
+	source := strings.TrimSuffix(t[match].Source, "/")
+	return strings.TrimSuffix(t[match].Repository, "/") + strings.TrimPrefix(sourceRepo, source)
+}
+
+func extractDigest(image string) (*digest.Digest, error) {
+	_, tag, isDigest, err := ociutils.ParseOciImageString(image)
+	if err != nil {
+		return nil, err
+	}
+	if !isDigest {
+		return nil, errors.New("expected image with digest")
+	}
+	dgst := strings.TrimPrefix(tag, "@sha256:")
+	val := digest.NewDigestFromEncoded("sha256", dgst)
+	return &val, nil
+}
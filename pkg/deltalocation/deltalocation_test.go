@@ -0,0 +1,75 @@
+package deltalocation
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestGetDeltaLocation(t *testing.T) {
+	dgstFrom := digest.FromString("from")
+	dgstTo := digest.FromString("to")
+	from := "registry.example.org/foobar@" + dgstFrom.String()
+	to := "registry.example.org/foobar@" + dgstTo.String()
+	want := "registry.example.org/foobar:_delta-" + digest.FromString(dgstFrom.Encoded()+dgstTo.Encoded()+"bsdiff_zstd").Encoded()
+	tests := []struct {
+		name    string
+		from    string
+		to      string
+		want    string
+		wantErr bool
+	}{
+		{name: "digests", from: from, to: to, want: want},
+		{name: "from tag", from: "registry.example.org/foobar:v1", to: to, wantErr: true},
+		{name: "to tag", from: from, to: "registry.example.org/foobar:v2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetDeltaLocation(tt.from, tt.to, TagSuffix("bsdiff", "zstd"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetDeltaLocation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("GetDeltaLocation() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagSuffix(t *testing.T) {
+	if got := TagSuffix("bsdiff", "zstd"); got != "bsdiff_zstd" {
+		t.Errorf("TagSuffix() got = %v", got)
+	}
+	if got := TagSuffix("tardiff", ""); got != "tardiff" {
+		t.Errorf("TagSuffix() got = %v", got)
+	}
+}
+
+func TestTargets_Repository(t *testing.T) {
+	targets := Targets{
+		{Source: "registry.example.org/apps", Repository: "cache.example.org/deltas/apps"},
+		{Source: "registry.example.org/apps/special/", Repository: "registry.example.org/deltas/special/"},
+		{Source: "registry.example.org/single", Repository: "registry.example.org/single-deltas"},
+	}
+	tests := []struct {
+		name       string
+		sourceRepo string
+		want       string
+	}{
+		{name: "namespace", sourceRepo: "registry.example.org/apps/foo", want: "cache.example.org/deltas/apps/foo"},
+		{name: "most specific", sourceRepo: "registry.example.org/apps/special/foo", want: "registry.example.org/deltas/special/foo"},
+		{name: "repository", sourceRepo: "registry.example.org/single", want: "registry.example.org/single-deltas"},
+		{name: "partial path segment", sourceRepo: "registry.example.org/applications", want: "registry.example.org/applications"},
+		{name: "no match", sourceRepo: "other.example.org/apps/foo", want: "other.example.org/apps/foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := targets.Repository(tt.sourceRepo); got != tt.want {
+				t.Errorf("Repository() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if got := Targets(nil).Repository("registry.example.org/foo"); got != "registry.example.org/foo" {
+		t.Errorf("Repository() without targets got = %v", got)
+	}
+}
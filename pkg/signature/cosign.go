@@ -0,0 +1,223 @@
+package signature
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry"
+)
+
+// CosignArtifactType is the artifact type of cosign signature manifests that are attached via the referrers API.
+const CosignArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+
+// CosignSimpleSigningMediaType is the media type of cosign simple signing payloads.
+const CosignSimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+// CosignSignatureAnnotation is the layer annotation that stores the base64 encoded signature of the payload.
+const CosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+const cosignSignatureType = "cosign container image signature"
+
+// simpleSigningPayload is the payload format that is signed by cosign.
+type simpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]any `json:"optional"`
+}
+
+type cosignSigner struct {
+	key crypto.Signer
+}
+
+// NewCosignSigner returns a Signer that creates cosign compatible simple signing signatures with the provided key.
+func NewCosignSigner(key crypto.Signer) (Signer, error) {
+	if err := checkKeyType(key.Public()); err != nil {
+		return nil, err
+	}
+	return &cosignSigner{key: key}, nil
+}
+
+func (s *cosignSigner) Sign(ctx context.Context, target oras.Target, subject v1.Descriptor, reference string) error {
+	payload := simpleSigningPayload{}
+	payload.Critical.Identity.DockerReference = reference
+	payload.Critical.Image.DockerManifestDigest = subject.Digest.String()
+	payload.Critical.Type = cosignSignatureType
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	sig, err := signPayload(s.key, payloadBytes)
+	if err != nil {
+		return err
+	}
+	payloadDescriptor := v1.Descriptor{
+		MediaType: CosignSimpleSigningMediaType,
+		Digest:    digest.FromBytes(payloadBytes),
+		Size:      int64(len(payloadBytes)),
+		Annotations: map[string]string{
+			CosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig),
+		},
+	}
+	err = target.Push(ctx, payloadDescriptor, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return fmt.Errorf("failed to push signature payload: %w", err)
+	}
+	opts := oras.PackManifestOptions{
+		Subject: &subject,
+		Layers:  []v1.Descriptor{payloadDescriptor},
+	}
+	mfDescriptor, err := oras.PackManifest(ctx, target, oras.PackManifestVersion1_1, CosignArtifactType, opts)
+	if err != nil {
+		return fmt.Errorf("failed to push signature manifest: %w", err)
+	}
+	log.Debugf("attached signature %s to %s", mfDescriptor.Digest, subject.Digest)
+	return nil
+}
+
+func signPayload(key crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		return key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	h := sha256.Sum256(payload)
+	return key.Sign(rand.Reader, h[:], crypto.SHA256)
+}
+
+type cosignVerifier struct {
+	keys []crypto.PublicKey
+}
+
+// NewCosignVerifier returns a Verifier that accepts cosign simple signing signatures created by any of the keys.
+// Signatures are discovered via the referrers API and the legacy `sha256-<digest>.sig` tag schema.
+func NewCosignVerifier(keys ...crypto.PublicKey) (Verifier, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one public key is required")
+	}
+	for _, k := range keys {
+		if err := checkKeyType(k); err != nil {
+			return nil, err
+		}
+	}
+	return &cosignVerifier{keys: keys}, nil
+}
+
+func (v *cosignVerifier) Verify(ctx context.Context, src oras.ReadOnlyGraphTarget, subject v1.Descriptor) error {
+	manifests, err := registry.Referrers(ctx, src, subject, CosignArtifactType)
+	if err != nil {
+		log.WithError(err).Debug("failed to list referrers, only checking legacy signature tag")
+		manifests = nil
+	}
+	legacyTag := fmt.Sprintf("%s-%s.sig", subject.Digest.Algorithm(), subject.Digest.Encoded())
+	if d, err := src.Resolve(ctx, legacyTag); err == nil {
+		manifests = append(manifests, d)
+	}
+	var errs []error
+	for _, mfDescriptor := range manifests {
+		err := v.verifyManifest(ctx, src, mfDescriptor, subject)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("%w (cosign): %w", ErrNoValidSignature, errors.Join(errs...))
+}
+
+func (v *cosignVerifier) verifyManifest(ctx context.Context, src content.ReadOnlyStorage, mfDescriptor, subject v1.Descriptor) error {
+	if mfDescriptor.Size > maxSignatureBlobSize {
+		return fmt.Errorf("signature manifest %s exceeds size limit", mfDescriptor.Digest)
+	}
+	mfBytes, err := content.FetchAll(ctx, src, mfDescriptor)
+	if err != nil {
+		return err
+	}
+	var mf v1.Manifest
+	if err := json.Unmarshal(mfBytes, &mf); err != nil {
+		return err
+	}
+	var errs []error
+	for _, layer := range mf.Layers {
+		if layer.MediaType != CosignSimpleSigningMediaType {
+			continue
+		}
+		err := v.verifyLayer(ctx, src, layer, subject)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("signature manifest %s contains no simple signing payload", mfDescriptor.Digest)
+	}
+	return errors.Join(errs...)
+}
+
+func (v *cosignVerifier) verifyLayer(ctx context.Context, src content.ReadOnlyStorage, layer, subject v1.Descriptor) error {
+	sig, err := base64.StdEncoding.DecodeString(layer.Annotations[CosignSignatureAnnotation])
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if layer.Size > maxSignatureBlobSize {
+		return fmt.Errorf("signature payload %s exceeds size limit", layer.Digest)
+	}
+	payloadBytes, err := content.FetchAll(ctx, src, layer)
+	if err != nil {
+		return err
+	}
+	if !v.isTrusted(payloadBytes, sig) {
+		return errors.New("signature was not created by a trusted key")
+	}
+	// Only trust the claims of the payload after the signature has been verified.
+	var payload simpleSigningPayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		return err
+	}
+	if payload.Critical.Type != cosignSignatureType {
+		return fmt.Errorf("unexpected signature type %q", payload.Critical.Type)
+	}
+	if payload.Critical.Image.DockerManifestDigest != subject.Digest.String() {
+		return fmt.Errorf("signature is for %s, expected %s", payload.Critical.Image.DockerManifestDigest, subject.Digest)
+	}
+	return nil
+}
+
+func (v *cosignVerifier) isTrusted(payload, sig []byte) bool {
+	h := sha256.Sum256(payload)
+	for _, k := range v.keys {
+		switch key := k.(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(key, h[:], sig) {
+				return true
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig) == nil {
+				return true
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(key, payload, sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package signature
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry"
+)
+
+// NotationArtifactType is the artifact type of Notary Project (notation) signature manifests.
+const NotationArtifactType = "application/vnd.cncf.notary.signature"
+
+// NotationJWSMediaType is the media type of notation signature envelopes in the JWS format.
+const NotationJWSMediaType = "application/jose+json"
+
+// NotationCOSEMediaType is the media type of notation signature envelopes in the COSE format.
+// COSE envelopes are not supported and are skipped during verification.
+const NotationCOSEMediaType = "application/cose"
+
+// NotationPayloadContentType is the content type of the notation signature payload.
+const NotationPayloadContentType = "application/vnd.cncf.notary.payload.v1+json"
+
+// jwsEnvelope is the JWS JSON serialization used by notation.
+type jwsEnvelope struct {
+	Payload   string `json:"payload"`
+	Protected string `json:"protected"`
+	Header    struct {
+		CertChain [][]byte `json:"x5c"`
+	} `json:"header"`
+	Signature string `json:"signature"`
+}
+
+type jwsProtectedHeader struct {
+	Algorithm   string `json:"alg"`
+	ContentType string `json:"cty"`
+}
+
+type notationPayload struct {
+	TargetArtifact v1.Descriptor `json:"targetArtifact"`
+}
+
+type notationVerifier struct {
+	roots *x509.CertPool
+}
+
+// NewNotationVerifier returns a Verifier that accepts notation JWS signatures whose certificate chain leads to
+// one of the trusted certificates.
+func NewNotationVerifier(trusted ...*x509.Certificate) (Verifier, error) {
+	if len(trusted) == 0 {
+		return nil, errors.New("at least one trusted certificate is required")
+	}
+	roots := x509.NewCertPool()
+	for _, c := range trusted {
+		roots.AddCert(c)
+	}
+	return &notationVerifier{roots: roots}, nil
+}
+
+func (v *notationVerifier) Verify(ctx context.Context, src oras.ReadOnlyGraphTarget, subject v1.Descriptor) error {
+	manifests, err := registry.Referrers(ctx, src, subject, NotationArtifactType)
+	if err != nil {
+		return fmt.Errorf("failed to list referrers: %w", err)
+	}
+	var errs []error
+	for _, mfDescriptor := range manifests {
+		err := v.verifyManifest(ctx, src, mfDescriptor, subject)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("%w (notation): %w", ErrNoValidSignature, errors.Join(errs...))
+}
+
+func (v *notationVerifier) verifyManifest(ctx context.Context, src content.ReadOnlyStorage, mfDescriptor, subject v1.Descriptor) error {
+	if mfDescriptor.Size > maxSignatureBlobSize {
+		return fmt.Errorf("signature manifest %s exceeds size limit", mfDescriptor.Digest)
+	}
+	mfBytes, err := content.FetchAll(ctx, src, mfDescriptor)
+	if err != nil {
+		return err
+	}
+	var mf v1.Manifest
+	if err := json.Unmarshal(mfBytes, &mf); err != nil {
+		return err
+	}
+	if len(mf.Layers) != 1 {
+		return fmt.Errorf("expected a single signature envelope, got %d", len(mf.Layers))
+	}
+	envelopeDescriptor := mf.Layers[0]
+	if envelopeDescriptor.MediaType != NotationJWSMediaType {
+		log.Debugf("skipping signature envelope with unsupported media type %q", envelopeDescriptor.MediaType)
+		return fmt.Errorf("unsupported signature envelope %q", envelopeDescriptor.MediaType)
+	}
+	if envelopeDescriptor.Size > maxSignatureBlobSize {
+		return fmt.Errorf("signature envelope %s exceeds size limit", envelopeDescriptor.Digest)
+	}
+	envelopeBytes, err := content.FetchAll(ctx, src, envelopeDescriptor)
+	if err != nil {
+		return err
+	}
+	payload, err := v.verifyJWS(envelopeBytes)
+	if err != nil {
+		return err
+	}
+	if payload.TargetArtifact.Digest != subject.Digest {
+		return fmt.Errorf("signature is for %s, expected %s", payload.TargetArtifact.Digest, subject.Digest)
+	}
+	return nil
+}
+
+// verifyJWS checks the certificate chain and the signature of the envelope and returns the signed payload.
+func (v *notationVerifier) verifyJWS(envelopeBytes []byte) (*notationPayload, error) {
+	var envelope jwsEnvelope
+	if err := json.Unmarshal(envelopeBytes, &envelope); err != nil {
+		return nil, err
+	}
+	if len(envelope.Header.CertChain) == 0 {
+		return nil, errors.New("signature envelope contains no certificate chain")
+	}
+	certs := make([]*x509.Certificate, 0, len(envelope.Header.CertChain))
+	for _, raw := range envelope.Header.CertChain {
+		c, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	leaf := certs[0]
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("untrusted certificate chain: %w", err)
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(envelope.Protected)
+	if err != nil {
+		return nil, err
+	}
+	var header jwsProtectedHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, err
+	}
+	if header.ContentType != NotationPayloadContentType {
+		return nil, fmt.Errorf("unexpected payload content type %q", header.ContentType)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return nil, err
+	}
+	signingInput := []byte(envelope.Protected + "." + envelope.Payload)
+	if err := verifyJWSSignature(header.Algorithm, leaf.PublicKey, signingInput, sig); err != nil {
+		return nil, err
+	}
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, err
+	}
+	var payload notationPayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
+
+// verifyJWSSignature verifies a JWS signature for the algorithms that are allowed by the notation specification.
+func verifyJWSSignature(alg string, key crypto.PublicKey, signingInput, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "PS256", "ES256":
+		hash = crypto.SHA256
+	case "PS384", "ES384":
+		hash = crypto.SHA384
+	case "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signingInput)
+	hashed := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'P' {
+			return fmt.Errorf("algorithm %q does not match RSA key", alg)
+		}
+		return rsa.VerifyPSS(k, hash, hashed, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case *ecdsa.PublicKey:
+		if alg[0] != 'E' {
+			return fmt.Errorf("algorithm %q does not match ECDSA key", alg)
+		}
+		// JWS encodes ECDSA signatures as the concatenation of r and s.
+		if len(sig)%2 != 0 {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:len(sig)/2])
+		s := new(big.Int).SetBytes(sig[len(sig)/2:])
+		if !ecdsa.Verify(k, hashed, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+}
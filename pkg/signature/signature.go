@@ -0,0 +1,149 @@
+package signature
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+)
+
+// maxSignatureBlobSize limits the size of signature blobs that are loaded into memory.
+const maxSignatureBlobSize = 4 * 1024 * 1024
+
+// ErrNoValidSignature is returned when no signature could be verified with the configured keys or certificates.
+var ErrNoValidSignature = errors.New("no valid signature found")
+
+// Signer signs manifests and attaches the signatures to them.
+type Signer interface {
+	// Sign creates a signature for the subject manifest and pushes it to the target as a referrer of the subject.
+	// The reference is the repository name of the subject and is used as the signed identity.
+	Sign(ctx context.Context, target oras.Target, subject v1.Descriptor, reference string) error
+}
+
+// Verifier verifies signatures that are attached to manifests.
+type Verifier interface {
+	// Verify returns nil if at least one signature that is attached to the subject manifest is trusted.
+	// Otherwise, an error that wraps ErrNoValidSignature is returned.
+	Verify(ctx context.Context, src oras.ReadOnlyGraphTarget, subject v1.Descriptor) error
+}
+
+// VerifyAny returns nil if at least one of the verifiers trusts a signature of the subject.
+func VerifyAny(ctx context.Context, verifiers []Verifier, src oras.ReadOnlyGraphTarget, subject v1.Descriptor) error {
+	if len(verifiers) == 0 {
+		return errors.New("no signature verifiers configured")
+	}
+	var errs []error
+	for _, v := range verifiers {
+		err := v.Verify(ctx, src, subject)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("failed to verify signature of %s: %w", subject.Digest, errors.Join(errs...))
+}
+
+// LoadPrivateKey loads an unencrypted PEM encoded private key (PKCS#8, PKCS#1 or SEC 1) from the file at path.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q (only unencrypted keys are supported)", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// LoadPublicKeys loads all PEM encoded public keys from the file at path.
+// Public keys are extracted from certificates if the file contains certificates.
+func LoadPublicKeys(path string) ([]crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []crypto.PublicKey
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, cert.PublicKey)
+		default:
+			return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found in %s", path)
+	}
+	return keys, nil
+}
+
+// LoadCertificates loads all PEM encoded certificates from the file at path.
+func LoadCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return certs, nil
+}
+
+// checkKeyType makes sure only key types that are supported by the signature formats are used.
+func checkKeyType(key crypto.PublicKey) error {
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+}
@@ -0,0 +1,264 @@
+package signature
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/unbasical/doras/internal/pkg/utils/testutils"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func setupRepository(t *testing.T) *remote.Repository {
+	t.Helper()
+	host := testutils.LaunchInProcessRegistry(t)
+	repo, err := remote.NewRepository(host + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.PlainHTTP = true
+	return repo
+}
+
+func pushArtifact(t *testing.T, target oras.Target, data string) v1.Descriptor {
+	t.Helper()
+	ctx := context.Background()
+	d := v1.Descriptor{
+		MediaType: "application/vnd.test.file",
+		Digest:    digest.FromString(data),
+		Size:      int64(len(data)),
+	}
+	err := target.Push(ctx, d, bytes.NewReader([]byte(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfDescriptor, err := oras.PackManifest(ctx, target, oras.PackManifestVersion1_1, "application/vnd.test.artifact", oras.PackManifestOptions{
+		Layers: []v1.Descriptor{d},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfDescriptor
+}
+
+func TestCosign_SignAndVerify(t *testing.T) {
+	ctx := context.Background()
+	repo := setupRepository(t)
+	signed := pushArtifact(t, repo, "signed")
+	unsigned := pushArtifact(t, repo, "unsigned")
+
+	ecdsaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name    string
+		signKey crypto.Signer
+		trusted crypto.PublicKey
+		subject v1.Descriptor
+		wantErr bool
+	}{
+		{name: "ecdsa", signKey: ecdsaKey, trusted: ecdsaKey.Public(), subject: signed, wantErr: false},
+		{name: "rsa", signKey: rsaKey, trusted: rsaKey.Public(), subject: signed, wantErr: false},
+		{name: "ed25519", signKey: ed25519Key, trusted: ed25519Key.Public(), subject: signed, wantErr: false},
+		{name: "untrusted key", signKey: ecdsaKey, trusted: otherKey.Public(), subject: signed, wantErr: true},
+		{name: "unsigned artifact", signKey: ecdsaKey, trusted: ecdsaKey.Public(), subject: unsigned, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := NewCosignSigner(tt.signKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = signer.Sign(ctx, repo, signed, repo.Reference.Registry+"/"+repo.Reference.Repository)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifier, err := NewCosignVerifier(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = verifier.Verify(ctx, repo, tt.subject)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrNoValidSignature) {
+				t.Fatalf("expected ErrNoValidSignature, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCosign_VerifyLegacyTag(t *testing.T) {
+	ctx := context.Background()
+	repo := setupRepository(t)
+	subject := pushArtifact(t, repo, "legacy")
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Older cosign versions store signatures at a tag that is derived from the subject digest instead of using referrers.
+	payload := fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"foo"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, subject.Digest)
+	h := sha256.Sum256([]byte(payload))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := v1.Descriptor{
+		MediaType:   CosignSimpleSigningMediaType,
+		Digest:      digest.FromString(payload),
+		Size:        int64(len(payload)),
+		Annotations: map[string]string{CosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	}
+	err = repo.Push(ctx, layer, bytes.NewReader([]byte(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfDescriptor, err := oras.PackManifest(ctx, repo, oras.PackManifestVersion1_1, CosignArtifactType, oras.PackManifestOptions{
+		Layers: []v1.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Tag(ctx, mfDescriptor, fmt.Sprintf("sha256-%s.sig", subject.Digest.Encoded()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewCosignVerifier(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(ctx, repo, subject); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newCertificate(t *testing.T, template, parent *x509.Certificate, pub crypto.PublicKey, parentKey crypto.Signer) *x509.Certificate {
+	t.Helper()
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// attachNotationSignature creates a JWS envelope the same way notation does and attaches it to the subject.
+func attachNotationSignature(t *testing.T, target oras.Target, subject v1.Descriptor, leaf *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+	ctx := context.Background()
+	protected, _ := json.Marshal(map[string]any{
+		"alg":                          "ES256",
+		"cty":                          NotationPayloadContentType,
+		"crit":                         []string{"io.cncf.notary.signingScheme"},
+		"io.cncf.notary.signingScheme": "notary.x509",
+	})
+	payload, _ := json.Marshal(notationPayload{TargetArtifact: subject})
+	encodedProtected := base64.RawURLEncoding.EncodeToString(protected)
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	h := sha256.Sum256([]byte(encodedProtected + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	envelope := jwsEnvelope{
+		Payload:   encodedPayload,
+		Protected: encodedProtected,
+		Signature: base64.RawURLEncoding.EncodeToString(sig),
+	}
+	envelope.Header.CertChain = [][]byte{leaf.Raw}
+	envelopeBytes, _ := json.Marshal(envelope)
+	layer := v1.Descriptor{
+		MediaType: NotationJWSMediaType,
+		Digest:    digest.FromBytes(envelopeBytes),
+		Size:      int64(len(envelopeBytes)),
+	}
+	err = target.Push(ctx, layer, bytes.NewReader(envelopeBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = oras.PackManifest(ctx, target, oras.PackManifestVersion1_1, NotationArtifactType, oras.PackManifestOptions{
+		Subject: &subject,
+		Layers:  []v1.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotation_Verify(t *testing.T) {
+	ctx := context.Background()
+	repo := setupRepository(t)
+	signed := pushArtifact(t, repo, "signed")
+	unsigned := pushArtifact(t, repo, "unsigned")
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "doras test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca := newCertificate(t, caTemplate, caTemplate, caKey.Public(), caKey)
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := newCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "doras test signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}, ca, leafKey.Public(), caKey)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherCA := newCertificate(t, caTemplate, caTemplate, otherKey.Public(), otherKey)
+
+	attachNotationSignature(t, repo, signed, leaf, leafKey)
+
+	tests := []struct {
+		name    string
+		trusted *x509.Certificate
+		subject v1.Descriptor
+		wantErr bool
+	}{
+		{name: "trusted ca", trusted: ca, subject: signed, wantErr: false},
+		{name: "untrusted ca", trusted: otherCA, subject: signed, wantErr: true},
+		{name: "unsigned artifact", trusted: ca, subject: unsigned, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier, err := NewNotationVerifier(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = verifier.Verify(ctx, repo, tt.subject)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}